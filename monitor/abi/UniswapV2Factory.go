@@ -0,0 +1,429 @@
+// Code generated - DO NOT EDIT.
+// This file is a generated binding and any manual changes will be lost.
+
+package abi
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var (
+	_ = errors.New
+	_ = big.NewInt
+	_ = strings.NewReader
+	_ = ethereum.NotFound
+	_ = bind.Bind
+	_ = common.Big1
+	_ = types.BloomLookup
+	_ = event.NewSubscription
+	_ = abi.ConvertType
+)
+
+// UniswapV2FactoryMetaData contains all meta data concerning the UniswapV2Factory contract.
+var UniswapV2FactoryMetaData = &bind.MetaData{
+	ABI: "[{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"address\",\"name\":\"token0\",\"type\":\"address\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"token1\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"address\",\"name\":\"pair\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"name\":\"PairCreated\",\"type\":\"event\"},{\"constant\":true,\"inputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"name\":\"allPairs\",\"outputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"payable\":false,\"stateMutability\":\"view\",\"type\":\"function\"},{\"constant\":true,\"inputs\":[],\"name\":\"allPairsLength\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"payable\":false,\"stateMutability\":\"view\",\"type\":\"function\"},{\"constant\":true,\"inputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"name\":\"getPair\",\"outputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"payable\":false,\"stateMutability\":\"view\",\"type\":\"function\"}]",
+}
+
+// UniswapV2FactoryABI is the input ABI used to generate the binding from.
+// Deprecated: Use UniswapV2FactoryMetaData.ABI instead.
+var UniswapV2FactoryABI = UniswapV2FactoryMetaData.ABI
+
+// UniswapV2Factory is an auto generated Go binding around an Ethereum contract.
+type UniswapV2Factory struct {
+	UniswapV2FactoryCaller     // Read-only binding to the contract
+	UniswapV2FactoryTransactor // Write-only binding to the contract
+	UniswapV2FactoryFilterer   // Log filterer for contract events
+}
+
+// UniswapV2FactoryCaller is an auto generated read-only Go binding around an Ethereum contract.
+type UniswapV2FactoryCaller struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// UniswapV2FactoryTransactor is an auto generated write-only Go binding around an Ethereum contract.
+type UniswapV2FactoryTransactor struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// UniswapV2FactoryFilterer is an auto generated log filtering Go binding around an Ethereum contract events.
+type UniswapV2FactoryFilterer struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// UniswapV2FactorySession is an auto generated Go binding around an Ethereum contract,
+// with pre-set call and transact options.
+type UniswapV2FactorySession struct {
+	Contract     *UniswapV2Factory // Generic contract binding to set the session for
+	CallOpts     bind.CallOpts     // Call options to use throughout this session
+	TransactOpts bind.TransactOpts // Transaction auth options to use throughout this session
+}
+
+// UniswapV2FactoryCallerSession is an auto generated read-only Go binding around an Ethereum contract,
+// with pre-set call options.
+type UniswapV2FactoryCallerSession struct {
+	Contract *UniswapV2FactoryCaller // Generic contract caller binding to set the session for
+	CallOpts bind.CallOpts           // Call options to use throughout this session
+}
+
+// UniswapV2FactoryTransactorSession is an auto generated write-only Go binding around an Ethereum contract,
+// with pre-set transact options.
+type UniswapV2FactoryTransactorSession struct {
+	Contract     *UniswapV2FactoryTransactor // Generic contract transactor binding to set the session for
+	TransactOpts bind.TransactOpts           // Transaction auth options to use throughout this session
+}
+
+// UniswapV2FactoryRaw is an auto generated low-level Go binding around an Ethereum contract.
+type UniswapV2FactoryRaw struct {
+	Contract *UniswapV2Factory // Generic contract binding to access the raw methods on
+}
+
+// UniswapV2FactoryCallerRaw is an auto generated low-level read-only Go binding around an Ethereum contract.
+type UniswapV2FactoryCallerRaw struct {
+	Contract *UniswapV2FactoryCaller // Generic read-only contract binding to access the raw methods on
+}
+
+// UniswapV2FactoryTransactorRaw is an auto generated low-level write-only Go binding around an Ethereum contract.
+type UniswapV2FactoryTransactorRaw struct {
+	Contract *UniswapV2FactoryTransactor // Generic write-only contract binding to access the raw methods on
+}
+
+// NewUniswapV2Factory creates a new instance of UniswapV2Factory, bound to a specific deployed contract.
+func NewUniswapV2Factory(address common.Address, backend bind.ContractBackend) (*UniswapV2Factory, error) {
+	contract, err := bindUniswapV2Factory(address, backend, backend, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &UniswapV2Factory{UniswapV2FactoryCaller: UniswapV2FactoryCaller{contract: contract}, UniswapV2FactoryTransactor: UniswapV2FactoryTransactor{contract: contract}, UniswapV2FactoryFilterer: UniswapV2FactoryFilterer{contract: contract}}, nil
+}
+
+// NewUniswapV2FactoryCaller creates a new read-only instance of UniswapV2Factory, bound to a specific deployed contract.
+func NewUniswapV2FactoryCaller(address common.Address, caller bind.ContractCaller) (*UniswapV2FactoryCaller, error) {
+	contract, err := bindUniswapV2Factory(address, caller, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &UniswapV2FactoryCaller{contract: contract}, nil
+}
+
+// NewUniswapV2FactoryTransactor creates a new write-only instance of UniswapV2Factory, bound to a specific deployed contract.
+func NewUniswapV2FactoryTransactor(address common.Address, transactor bind.ContractTransactor) (*UniswapV2FactoryTransactor, error) {
+	contract, err := bindUniswapV2Factory(address, nil, transactor, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &UniswapV2FactoryTransactor{contract: contract}, nil
+}
+
+// NewUniswapV2FactoryFilterer creates a new log filterer instance of UniswapV2Factory, bound to a specific deployed contract.
+func NewUniswapV2FactoryFilterer(address common.Address, filterer bind.ContractFilterer) (*UniswapV2FactoryFilterer, error) {
+	contract, err := bindUniswapV2Factory(address, nil, nil, filterer)
+	if err != nil {
+		return nil, err
+	}
+	return &UniswapV2FactoryFilterer{contract: contract}, nil
+}
+
+// bindUniswapV2Factory binds a generic wrapper to an already deployed contract.
+func bindUniswapV2Factory(address common.Address, caller bind.ContractCaller, transactor bind.ContractTransactor, filterer bind.ContractFilterer) (*bind.BoundContract, error) {
+	parsed, err := UniswapV2FactoryMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	return bind.NewBoundContract(address, *parsed, caller, transactor, filterer), nil
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_UniswapV2Factory *UniswapV2FactoryRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _UniswapV2Factory.Contract.UniswapV2FactoryCaller.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_UniswapV2Factory *UniswapV2FactoryRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _UniswapV2Factory.Contract.UniswapV2FactoryTransactor.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_UniswapV2Factory *UniswapV2FactoryRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _UniswapV2Factory.Contract.UniswapV2FactoryTransactor.contract.Transact(opts, method, params...)
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_UniswapV2Factory *UniswapV2FactoryCallerRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _UniswapV2Factory.Contract.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_UniswapV2Factory *UniswapV2FactoryTransactorRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _UniswapV2Factory.Contract.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_UniswapV2Factory *UniswapV2FactoryTransactorRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _UniswapV2Factory.Contract.contract.Transact(opts, method, params...)
+}
+
+// AllPairs is a free data retrieval call binding the contract method 0x1e3dd18b.
+//
+// Solidity: function allPairs(uint256 ) view returns(address)
+func (_UniswapV2Factory *UniswapV2FactoryCaller) AllPairs(opts *bind.CallOpts, arg0 *big.Int) (common.Address, error) {
+	var out []interface{}
+	err := _UniswapV2Factory.contract.Call(opts, &out, "allPairs", arg0)
+
+	if err != nil {
+		return *new(common.Address), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(common.Address)).(*common.Address)
+
+	return out0, err
+
+}
+
+// AllPairs is a free data retrieval call binding the contract method 0x1e3dd18b.
+//
+// Solidity: function allPairs(uint256 ) view returns(address)
+func (_UniswapV2Factory *UniswapV2FactorySession) AllPairs(arg0 *big.Int) (common.Address, error) {
+	return _UniswapV2Factory.Contract.AllPairs(&_UniswapV2Factory.CallOpts, arg0)
+}
+
+// AllPairs is a free data retrieval call binding the contract method 0x1e3dd18b.
+//
+// Solidity: function allPairs(uint256 ) view returns(address)
+func (_UniswapV2Factory *UniswapV2FactoryCallerSession) AllPairs(arg0 *big.Int) (common.Address, error) {
+	return _UniswapV2Factory.Contract.AllPairs(&_UniswapV2Factory.CallOpts, arg0)
+}
+
+// AllPairsLength is a free data retrieval call binding the contract method 0x574f2ba3.
+//
+// Solidity: function allPairsLength() view returns(uint256)
+func (_UniswapV2Factory *UniswapV2FactoryCaller) AllPairsLength(opts *bind.CallOpts) (*big.Int, error) {
+	var out []interface{}
+	err := _UniswapV2Factory.contract.Call(opts, &out, "allPairsLength")
+
+	if err != nil {
+		return *new(*big.Int), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(*big.Int)).(**big.Int)
+
+	return out0, err
+
+}
+
+// AllPairsLength is a free data retrieval call binding the contract method 0x574f2ba3.
+//
+// Solidity: function allPairsLength() view returns(uint256)
+func (_UniswapV2Factory *UniswapV2FactorySession) AllPairsLength() (*big.Int, error) {
+	return _UniswapV2Factory.Contract.AllPairsLength(&_UniswapV2Factory.CallOpts)
+}
+
+// AllPairsLength is a free data retrieval call binding the contract method 0x574f2ba3.
+//
+// Solidity: function allPairsLength() view returns(uint256)
+func (_UniswapV2Factory *UniswapV2FactoryCallerSession) AllPairsLength() (*big.Int, error) {
+	return _UniswapV2Factory.Contract.AllPairsLength(&_UniswapV2Factory.CallOpts)
+}
+
+// GetPair is a free data retrieval call binding the contract method 0xe6a43905.
+//
+// Solidity: function getPair(address , address ) view returns(address)
+func (_UniswapV2Factory *UniswapV2FactoryCaller) GetPair(opts *bind.CallOpts, arg0 common.Address, arg1 common.Address) (common.Address, error) {
+	var out []interface{}
+	err := _UniswapV2Factory.contract.Call(opts, &out, "getPair", arg0, arg1)
+
+	if err != nil {
+		return *new(common.Address), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(common.Address)).(*common.Address)
+
+	return out0, err
+
+}
+
+// GetPair is a free data retrieval call binding the contract method 0xe6a43905.
+//
+// Solidity: function getPair(address , address ) view returns(address)
+func (_UniswapV2Factory *UniswapV2FactorySession) GetPair(arg0 common.Address, arg1 common.Address) (common.Address, error) {
+	return _UniswapV2Factory.Contract.GetPair(&_UniswapV2Factory.CallOpts, arg0, arg1)
+}
+
+// GetPair is a free data retrieval call binding the contract method 0xe6a43905.
+//
+// Solidity: function getPair(address , address ) view returns(address)
+func (_UniswapV2Factory *UniswapV2FactoryCallerSession) GetPair(arg0 common.Address, arg1 common.Address) (common.Address, error) {
+	return _UniswapV2Factory.Contract.GetPair(&_UniswapV2Factory.CallOpts, arg0, arg1)
+}
+
+// UniswapV2FactoryPairCreatedIterator is returned from FilterPairCreated and is used to iterate over the raw logs and unpacked data for PairCreated events raised by the UniswapV2Factory contract.
+type UniswapV2FactoryPairCreatedIterator struct {
+	Event *UniswapV2FactoryPairCreated // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *UniswapV2FactoryPairCreatedIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(UniswapV2FactoryPairCreated)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(UniswapV2FactoryPairCreated)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *UniswapV2FactoryPairCreatedIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *UniswapV2FactoryPairCreatedIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// UniswapV2FactoryPairCreated represents a PairCreated event raised by the UniswapV2Factory contract.
+type UniswapV2FactoryPairCreated struct {
+	Token0 common.Address
+	Token1 common.Address
+	Pair   common.Address
+	Arg3   *big.Int
+	Raw    types.Log // Blockchain specific contextual infos
+}
+
+// FilterPairCreated is a free log retrieval operation binding the contract event 0x0d3648bd0f6ba80134a33ba9275ac585d9d315f0ad8355cddefde31afa28d0e9.
+//
+// Solidity: event PairCreated(address indexed token0, address indexed token1, address pair, uint256 arg3)
+func (_UniswapV2Factory *UniswapV2FactoryFilterer) FilterPairCreated(opts *bind.FilterOpts, token0 []common.Address, token1 []common.Address) (*UniswapV2FactoryPairCreatedIterator, error) {
+
+	var token0Rule []interface{}
+	for _, token0Item := range token0 {
+		token0Rule = append(token0Rule, token0Item)
+	}
+	var token1Rule []interface{}
+	for _, token1Item := range token1 {
+		token1Rule = append(token1Rule, token1Item)
+	}
+
+	logs, sub, err := _UniswapV2Factory.contract.FilterLogs(opts, "PairCreated", token0Rule, token1Rule)
+	if err != nil {
+		return nil, err
+	}
+	return &UniswapV2FactoryPairCreatedIterator{contract: _UniswapV2Factory.contract, event: "PairCreated", logs: logs, sub: sub}, nil
+}
+
+// WatchPairCreated is a free log subscription operation binding the contract event 0x0d3648bd0f6ba80134a33ba9275ac585d9d315f0ad8355cddefde31afa28d0e9.
+//
+// Solidity: event PairCreated(address indexed token0, address indexed token1, address pair, uint256 arg3)
+func (_UniswapV2Factory *UniswapV2FactoryFilterer) WatchPairCreated(opts *bind.WatchOpts, sink chan<- *UniswapV2FactoryPairCreated, token0 []common.Address, token1 []common.Address) (event.Subscription, error) {
+
+	var token0Rule []interface{}
+	for _, token0Item := range token0 {
+		token0Rule = append(token0Rule, token0Item)
+	}
+	var token1Rule []interface{}
+	for _, token1Item := range token1 {
+		token1Rule = append(token1Rule, token1Item)
+	}
+
+	logs, sub, err := _UniswapV2Factory.contract.WatchLogs(opts, "PairCreated", token0Rule, token1Rule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(UniswapV2FactoryPairCreated)
+				if err := _UniswapV2Factory.contract.UnpackLog(event, "PairCreated", log); err != nil {
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParsePairCreated is a log parse operation binding the contract event 0x0d3648bd0f6ba80134a33ba9275ac585d9d315f0ad8355cddefde31afa28d0e9.
+//
+// Solidity: event PairCreated(address indexed token0, address indexed token1, address pair, uint256 arg3)
+func (_UniswapV2Factory *UniswapV2FactoryFilterer) ParsePairCreated(log types.Log) (*UniswapV2FactoryPairCreated, error) {
+	event := new(UniswapV2FactoryPairCreated)
+	if err := _UniswapV2Factory.contract.UnpackLog(event, "PairCreated", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
@@ -3,8 +3,10 @@ package abi
 import "github.com/ethereum/go-ethereum/accounts/abi"
 
 var (
-	Multicall2ABIInstance    *abi.ABI
-	UniswapV2PairABIInstance *abi.ABI
+	Multicall2ABIInstance       *abi.ABI
+	UniswapV2PairABIInstance    *abi.ABI
+	UniswapV2FactoryABIInstance *abi.ABI
+	ERC20ABIInstance            *abi.ABI
 )
 
 func init() {
@@ -17,4 +19,12 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	UniswapV2FactoryABIInstance, err = UniswapV2FactoryMetaData.GetAbi()
+	if err != nil {
+		panic(err)
+	}
+	ERC20ABIInstance, err = ERC20MetaData.GetAbi()
+	if err != nil {
+		panic(err)
+	}
 }
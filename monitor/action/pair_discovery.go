@@ -0,0 +1,285 @@
+package action
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"monitor/client"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/storage"
+	"monitor/utils"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	defaultDiscoveryPageSize        = uint64(200)
+	defaultDiscoveryRefreshInterval = time.Hour
+	discoveryRetryInterval          = time.Minute
+	discoveryCursorPrefix           = "factory-"
+)
+
+var _ Action = &PairDiscovery{}
+
+// CursorKeeper persists named cursors across restarts
+type CursorKeeper interface {
+	SaveCursor(name string, blockNumber uint64) error
+	LoadCursor(name string) (uint64, bool, error)
+}
+
+// PairDiscovery indexes the pairs of the configured factories, PairCreated logs are
+// handled as they come and allPairs is backfilled from a persisted index cursor,
+// the reserves of every discovered pair are seeded by multicall
+type PairDiscovery struct {
+	config    *config.Config
+	cursors   CursorKeeper
+	factories map[common.Address]bool
+}
+
+func NewPairDiscovery(ctx context.Context, conf *config.Config, cursors CursorKeeper) *PairDiscovery {
+	factories := map[common.Address]bool{}
+	for _, factory := range conf.Factories {
+		factories[factory.Address] = true
+	}
+	return &PairDiscovery{
+		config:    conf,
+		cursors:   cursors,
+		factories: factories,
+	}
+}
+
+func (p *PairDiscovery) Init(ctx context.Context) error {
+	if len(p.factories) == 0 {
+		return nil
+	}
+	utils.Go(client.WithPriority(ctx, client.PriorityBackground), "discovery.backfill", func(ctx context.Context) error {
+		for _, factory := range p.config.Factories {
+			for {
+				err := p.backfill(ctx, factory)
+				if err == nil {
+					break
+				}
+				utils.Warnf("backfill factory %s fail %s", factory.Name, err)
+				if !utils.Sleep(ctx, discoveryRetryInterval) {
+					return nil
+				}
+			}
+		}
+		return p.loopRefresh(ctx)
+	})
+	return nil
+}
+
+func (p *PairDiscovery) OnNewBlockHandler(ctx context.Context, params ...interface{}) error {
+	return nil
+}
+
+func (p *PairDiscovery) OnNewLogHandler(ctx context.Context, params ...interface{}) error {
+	logs := params[0].([]*types.Log)
+	pairs, err := protocol.FilterUniswapV2PairCreatedFromLog(ctx, logs, p.factories)
+	if err != nil {
+		return fmt.Errorf("filter uniswapv2 pair created fail %s", err)
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	blockNumber := uint64(0)
+	for _, pair := range pairs {
+		if pair.BlockNumber > blockNumber {
+			blockNumber = pair.BlockNumber
+		}
+		utils.Infof("discover pair %s factory %s token0 %s token1 %s", pair.Address, pair.Factory, pair.Token0, pair.Token1)
+	}
+	cli, err := client.GetETHClient(ctx, p.config.Node, p.config.MulticallAddress)
+	if err != nil {
+		return fmt.Errorf("get eth client fail %s", err)
+	}
+	return p.seedPairs(ctx, cli, blockNumber, pairs)
+}
+
+// backfill reads allPairs of the factory from the cursor to the current length page by page
+func (p *PairDiscovery) backfill(ctx context.Context, factory *config.Factory) error {
+	cli, err := client.GetETHClient(ctx, p.config.Node, p.config.MulticallAddress)
+	if err != nil {
+		return fmt.Errorf("get eth client fail %s", err)
+	}
+	cursor := discoveryCursorPrefix + factory.Address.Hex()
+	index, _, err := p.cursors.LoadCursor(cursor)
+	if err != nil {
+		return fmt.Errorf("load cursor fail %s", err)
+	}
+	callResult, err := cli.MultiViewCall(ctx, nil, protocol.NewUniswapV2FactoryLengthCalls(factory.Address))
+	if err != nil {
+		return fmt.Errorf("multi view call fail %s", err)
+	}
+	length, _, ok := protocol.UniswapV2FactoryCallResult(factory.Address, callResult)
+	if !ok {
+		return fmt.Errorf("read allPairsLength of factory %s fail", factory.Name)
+	}
+	utils.Infof("backfill factory %s pairs from %d to %d", factory.Name, index, length)
+	for index < length {
+		end := index + p.pageSize()
+		if end > length {
+			end = length
+		}
+		blockNumber, err := cli.BlockNumber(ctx)
+		if err != nil {
+			return fmt.Errorf("get block number fail %s", err)
+		}
+		callResult, err := cli.MultiViewCallAt(ctx, new(big.Int).SetUint64(blockNumber), protocol.NewUniswapV2FactoryPairsCalls(factory.Address, index, end))
+		if err != nil {
+			return fmt.Errorf("multi view call fail %s", err)
+		}
+		_, addrs, _ := protocol.UniswapV2FactoryCallResult(factory.Address, callResult)
+		if uint64(len(addrs)) != end-index {
+			return fmt.Errorf("read pairs from %d to %d got %d", index, end, len(addrs))
+		}
+		pairs := make(map[common.Address]*protocol.UniswapV2Pair, len(addrs))
+		for _, addr := range addrs {
+			pairs[addr] = newSeedPair(addr, factory.Address)
+		}
+		err = p.seedPairs(ctx, cli, blockNumber, pairs)
+		if err != nil {
+			return err
+		}
+		index = end
+		err = p.cursors.SaveCursor(cursor, index)
+		if err != nil {
+			return fmt.Errorf("save cursor fail %s", err)
+		}
+	}
+	return nil
+}
+
+func (p *PairDiscovery) loopRefresh(ctx context.Context) error {
+	interval := p.config.DiscoveryRefreshInterval
+	if interval <= 0 {
+		interval = defaultDiscoveryRefreshInterval
+	}
+	for utils.Sleep(ctx, interval) {
+		err := p.refresh(ctx)
+		if err != nil {
+			utils.Warnf("refresh discovered pairs fail %s", err)
+		}
+	}
+	return nil
+}
+
+// refresh reseeds the discovered pairs quiet for half the ttl, so they are not swept
+func (p *PairDiscovery) refresh(ctx context.Context) error {
+	head := storage.Head()
+	if head == 0 {
+		return nil
+	}
+	ttl := p.config.StorageTTLBlocks
+	if ttl == 0 {
+		ttl = storage.DefaultTTLBlocks
+	}
+	stale := []common.Address{}
+	protocol.UniswapV2Pairs.Range(func(addr common.Address, pair *protocol.UniswapV2Pair) bool {
+		if p.factories[pair.Factory] && pair.UpdatedBlock()+ttl/2 < head {
+			stale = append(stale, addr)
+		}
+		return true
+	})
+	if len(stale) == 0 {
+		return nil
+	}
+	utils.Infof("refresh discovered pairs %d", len(stale))
+	return p.RefreshPairs(ctx, stale)
+}
+
+// RefreshPairs reads the reserves of the pairs at the latest block and stores them
+func (p *PairDiscovery) RefreshPairs(ctx context.Context, addrs []common.Address) error {
+	cli, err := client.GetETHClient(ctx, p.config.Node, p.config.MulticallAddress)
+	if err != nil {
+		return fmt.Errorf("get eth client fail %s", err)
+	}
+	for from := uint64(0); from < uint64(len(addrs)); from += p.pageSize() {
+		to := from + p.pageSize()
+		if to > uint64(len(addrs)) {
+			to = uint64(len(addrs))
+		}
+		blockNumber, err := cli.BlockNumber(ctx)
+		if err != nil {
+			return fmt.Errorf("get block number fail %s", err)
+		}
+		pairs := map[common.Address]*protocol.UniswapV2Pair{}
+		for _, addr := range addrs[from:to] {
+			pairs[addr] = newSeedPair(addr, common.Address{})
+		}
+		err = p.seedPairs(ctx, cli, blockNumber, pairs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedPairs reads the reserves, and the tokens when unknown, at blockNumber and stores the pairs
+func (p *PairDiscovery) seedPairs(ctx context.Context, cli *client.ETHClient, blockNumber uint64, pairs map[common.Address]*protocol.UniswapV2Pair) error {
+	viewcalls := []*client.ViewCall{}
+	for _, pair := range pairs {
+		if pair.Token0 == (common.Address{}) || pair.Token1 == (common.Address{}) {
+			viewcalls = append(viewcalls, protocol.NewUniswapV2PairInfoCalls(pair)...)
+		}
+		viewcalls = append(viewcalls, protocol.NewUniswapV2PairStateCalls(pair)...)
+	}
+	callResult, err := cli.MultiViewCallAt(ctx, new(big.Int).SetUint64(blockNumber), viewcalls)
+	if err != nil {
+		return fmt.Errorf("multi view call fail %s", err)
+	}
+	protocol.UniswapV2PairCallResult(pairs, callResult)
+	var (
+		storeKeys  = make([]common.Address, 0, len(pairs))
+		storeDatas = make([]*protocol.UniswapV2Pair, 0, len(pairs))
+		timestamp  = time.Now().Unix()
+	)
+	for addr, pair := range pairs {
+		if pair.Reserve0 == nil || pair.Reserve1 == nil {
+			pair.Error = true
+			pair.Reserve0, pair.Reserve1 = big.NewInt(0), big.NewInt(0)
+		}
+		// the reserves are read at the end of the block, so every log of the block is older
+		pair.StateFromLogUpdate = &protocol.StateFromLogUpdate{
+			BlockNumber: blockNumber,
+			TxIndex:     math.MaxUint32,
+			LogIndex:    math.MaxUint32,
+			Timestamp:   timestamp,
+		}
+		factoryFee(p.config, pair)
+		storeKeys = append(storeKeys, addr)
+		storeDatas = append(storeDatas, pair)
+	}
+	protocol.UniswapV2Pairs.Store(storeKeys, storeDatas)
+	return nil
+}
+
+func (p *PairDiscovery) pageSize() uint64 {
+	if p.config.DiscoveryPageSize > 0 {
+		return p.config.DiscoveryPageSize
+	}
+	return defaultDiscoveryPageSize
+}
+
+// newSeedPair keeps the known tokens and fee of the stored pair so only reserves are read
+func newSeedPair(addr common.Address, factory common.Address) *protocol.UniswapV2Pair {
+	pair := &protocol.UniswapV2Pair{
+		Address: addr,
+		Factory: factory,
+		Fee:     30,
+	}
+	if prePair, ok := protocol.UniswapV2Pairs.Load(addr); ok {
+		pair.Token0 = prePair.Token0
+		pair.Token1 = prePair.Token1
+		pair.Fee = prePair.Fee
+		if pair.Factory == (common.Address{}) {
+			pair.Factory = prePair.Factory
+		}
+	}
+	return pair
+}
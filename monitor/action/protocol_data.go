@@ -6,9 +6,9 @@ import (
 	"monitor/client"
 	"monitor/config"
 	"monitor/protocol"
-	"monitor/storage"
 	"monitor/utils"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 )
 
@@ -61,17 +61,17 @@ func (p *ProtocolData) doNewLogHandlerUniswapV2(ctx context.Context, logs []*typ
 	if err != nil {
 		return fmt.Errorf("filter uniswapv2 pair fail %s", err)
 	}
-	pairStore := storage.GetStorage(storage.StoreKeyUniswapv2Pairs)
+	pairStore := protocol.UniswapV2Pairs
 	viewcalls := []*client.ViewCall{}
 	for _, pair := range pairs {
-		if data := pairStore.Load(pair.Address); data == nil {
+		if prePair, ok := pairStore.Load(pair.Address); !ok {
 			viewcalls = append(viewcalls, protocol.NewUniswapV2PairInfoCalls(pair)...)
 		} else {
-			prePair := data.(*protocol.UniswapV2Pair)
 			pair.Token0 = prePair.Token0
 			pair.Token1 = prePair.Token1
 			pair.Fee = prePair.Fee
 			pair.Error = prePair.Error
+			pair.Factory = prePair.Factory
 		}
 	}
 	if len(viewcalls) > 0 {
@@ -89,15 +89,22 @@ func (p *ProtocolData) doNewLogHandlerUniswapV2(ctx context.Context, logs []*typ
 	if err != nil {
 		return fmt.Errorf("filter uniswapv2 fee fail %s", err)
 	}
+	fixed := map[common.Address]bool{}
+	for addr, pair := range pairs {
+		fixed[addr] = factoryFee(p.config, pair)
+	}
 	for addr, fee := range fees {
+		if fixed[addr] {
+			continue
+		}
 		utils.Infof("caculated pair swap fee %s %d", addr, fee)
 		if pair, ok := pairs[addr]; ok {
 			pair.Fee = fee
 		}
 	}
 	var (
-		storeKeys  = []interface{}{}
-		storeDatas = []interface{}{}
+		storeKeys  = []common.Address{}
+		storeDatas = []*protocol.UniswapV2Pair{}
 	)
 	for key, pair := range pairs {
 		storeKeys = append(storeKeys, key)
@@ -106,3 +113,16 @@ func (p *ProtocolData) doNewLogHandlerUniswapV2(ctx context.Context, logs []*typ
 	pairStore.Store(storeKeys, storeDatas)
 	return nil
 }
+
+// factoryFee sets the configured fee of the pair factory, it reports whether the fee is fixed
+func factoryFee(conf *config.Config, pair *protocol.UniswapV2Pair) bool {
+	if pair.Factory == (common.Address{}) {
+		return false
+	}
+	factory := conf.Factory(pair.Factory)
+	if factory == nil || factory.Fee <= 0 {
+		return false
+	}
+	pair.Fee = factory.Fee
+	return true
+}
@@ -0,0 +1,119 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/utils"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// defaultPairHistory is the number of states kept per pair
+	defaultPairHistory = 16
+	// defaultPairHistoryPairs is the number of pairs states are kept of
+	defaultPairHistoryPairs = 4096
+)
+
+var _ utils.Keeper = &Admin{}
+
+// PairRefresher reads the reserves of pairs from the node and stores them, the pair discovery
+type PairRefresher interface {
+	RefreshPairs(ctx context.Context, addrs []common.Address) error
+}
+
+// Admin serves the pairs in storage with their recent states and guards every admin
+// handler with the bearer token of the config
+type Admin struct {
+	config    *config.Config
+	refresher PairRefresher
+	history   *pairHistory
+}
+
+func NewAdmin(ctx context.Context, conf *config.Config, refresher PairRefresher) *Admin {
+	size := conf.AdminPairHistory
+	if size <= 0 {
+		size = defaultPairHistory
+	}
+	pairs := conf.AdminPairHistoryPairs
+	if pairs <= 0 {
+		pairs = defaultPairHistoryPairs
+	}
+	return &Admin{
+		config:    conf,
+		refresher: refresher,
+		history:   newPairHistory(size, pairs),
+	}
+}
+
+func (a *Admin) Init(ctx context.Context) error {
+	protocol.UniswapV2Pairs.Subscribe(func(_ []common.Address, pairs []*protocol.UniswapV2Pair) {
+		a.history.add(pairs)
+	})
+	protocol.UniswapV2Pairs.OnEvict(func(keys []common.Address, _ []*protocol.UniswapV2Pair) {
+		a.history.remove(keys)
+	})
+	return nil
+}
+
+func (*Admin) ShutDown(context.Context) {
+
+}
+
+// Auth passes the requests carrying the admin token as "Authorization: Bearer <token>",
+// every request is refused when no token is configured
+func (a *Admin) Auth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(a.config.AdminToken) == 0 {
+			http.Error(w, "admin token not configured", http.StatusForbidden)
+			return
+		}
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(a.config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Handler serves the pairs behind Auth:
+//
+//	GET  /admin/pairs?token=&factory=&offset=&limit=  the stored pairs ordered by address
+//	GET  /admin/pairs/<address>                       a pair with its recent states, newest first
+//	POST /admin/pairs/<address>/refresh               reads the reserves of a pair again
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/pairs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.handleListPairs(w, r)
+	})
+	mux.HandleFunc("/admin/pairs/", func(w http.ResponseWriter, r *http.Request) {
+		value := strings.TrimPrefix(r.URL.Path, "/admin/pairs/")
+		refresh := strings.HasSuffix(value, "/refresh")
+		value = strings.TrimSuffix(value, "/refresh")
+		if !common.IsHexAddress(value) {
+			http.Error(w, "invalid address "+value, http.StatusBadRequest)
+			return
+		}
+		addr := common.HexToAddress(value)
+		switch {
+		case refresh && r.Method == http.MethodPost:
+			a.handleRefreshPair(w, r, addr)
+		case !refresh && r.Method == http.MethodGet:
+			a.handleGetPair(w, r, addr)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return a.Auth(mux)
+}
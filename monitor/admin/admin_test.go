@@ -0,0 +1,177 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"monitor/config"
+	"monitor/protocol"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type testRefresher struct {
+	refreshed []common.Address
+	err       error
+}
+
+func (r *testRefresher) RefreshPairs(ctx context.Context, addrs []common.Address) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.refreshed = append(r.refreshed, addrs...)
+	for _, addr := range addrs {
+		pair, _ := protocol.UniswapV2Pairs.Load(addr)
+		storeTestPair(addr, pair.Token0, pair.Token1, pair.BlockNumber+1, 7)
+	}
+	return nil
+}
+
+func storeTestPair(addr, token0, token1 common.Address, blockNumber uint64, reserve int64) {
+	pair := &protocol.UniswapV2Pair{
+		Address:            addr,
+		Token0:             token0,
+		Token1:             token1,
+		Reserve0:           big.NewInt(reserve),
+		Reserve1:           big.NewInt(reserve * 2),
+		Fee:                30,
+		StateFromLogUpdate: &protocol.StateFromLogUpdate{BlockNumber: blockNumber},
+	}
+	protocol.UniswapV2Pairs.Store([]common.Address{addr}, []*protocol.UniswapV2Pair{pair})
+}
+
+func get(t *testing.T, server *httptest.Server, method, path, token string, value interface{}) int {
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && value != nil {
+		if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+			t.Fatalf("%s %s", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAuth(t *testing.T) {
+	conf := &config.Config{}
+	a := NewAdmin(context.Background(), conf, nil)
+	server := httptest.NewServer(a.Handler())
+	defer server.Close()
+
+	if code := get(t, server, http.MethodGet, "/admin/pairs", "secret", nil); code != http.StatusForbidden {
+		t.Fatalf("no token configured %d", code)
+	}
+	conf.AdminToken = "secret"
+	for token, want := range map[string]int{
+		"":       http.StatusUnauthorized,
+		"wrong":  http.StatusUnauthorized,
+		"secret": http.StatusOK,
+	} {
+		if code := get(t, server, http.MethodGet, "/admin/pairs", token, nil); code != want {
+			t.Fatalf("token %q %d want %d", token, code, want)
+		}
+	}
+}
+
+func TestPairs(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		conf      = &config.Config{AdminToken: "secret", AdminPairHistory: 2}
+		refresher = &testRefresher{}
+		a         = NewAdmin(ctx, conf, refresher)
+		weth      = common.Address{0x61}
+		token     = common.Address{0x62}
+		pairs     = []common.Address{{0x71}, {0x72}, {0x73}}
+	)
+	if err := a.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(a.Handler())
+	defer server.Close()
+	storeTestPair(pairs[0], weth, token, 10, 1)
+	storeTestPair(pairs[1], token, common.Address{0x63}, 10, 1)
+	storeTestPair(pairs[2], weth, common.Address{0x64}, 10, 1)
+
+	list := &pairsJSON{}
+	if code := get(t, server, http.MethodGet, "/admin/pairs?token="+token.Hex(), "secret", list); code != http.StatusOK || list.Total != 2 || list.Pairs[0].Address != pairs[0] || list.Pairs[1].Address != pairs[1] {
+		t.Fatalf("search %d %+v", code, list)
+	}
+	if get(t, server, http.MethodGet, "/admin/pairs?token="+weth.Hex()+"&offset=1&limit=1", "secret", list); list.Total != 2 || len(list.Pairs) != 1 || list.Pairs[0].Address != pairs[2] {
+		t.Fatalf("page %+v", list)
+	}
+	if code := get(t, server, http.MethodGet, "/admin/pairs?limit=0", "secret", nil); code != http.StatusBadRequest {
+		t.Fatalf("limit 0 %d", code)
+	}
+
+	// the history keeps the last states, newest first
+	for i := int64(2); i <= 3; i++ {
+		storeTestPair(pairs[0], weth, token, uint64(10+i), i)
+	}
+	state := &pairStateJSON{}
+	if code := get(t, server, http.MethodGet, "/admin/pairs/"+pairs[0].Hex(), "secret", state); code != http.StatusOK || state.Pair.Reserve0 != "3" {
+		t.Fatalf("pair %d %+v", code, state)
+	}
+	if len(state.History) != 2 || state.History[0].BlockNumber != 13 || state.History[1].BlockNumber != 12 {
+		t.Fatalf("history %+v", state.History)
+	}
+	if code := get(t, server, http.MethodGet, "/admin/pairs/"+common.Address{0x79}.Hex(), "secret", nil); code != http.StatusNotFound {
+		t.Fatalf("missing pair %d", code)
+	}
+
+	if code := get(t, server, http.MethodPost, "/admin/pairs/"+pairs[1].Hex()+"/refresh", "secret", state); code != http.StatusOK || state.Pair.Reserve0 != "7" || len(refresher.refreshed) != 1 {
+		t.Fatalf("refresh %d %+v", code, state)
+	}
+	refresher.err = fmt.Errorf("node down")
+	if code := get(t, server, http.MethodPost, "/admin/pairs/"+pairs[1].Hex()+"/refresh", "secret", nil); code != http.StatusBadGateway {
+		t.Fatalf("refresh fail %d", code)
+	}
+	if code := get(t, server, http.MethodGet, "/admin/pairs/"+pairs[1].Hex()+"/refresh", "secret", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("refresh get %d", code)
+	}
+
+	// an evicted pair drops its history
+	protocol.UniswapV2Pairs.Expire(1000, 100)
+	if code := get(t, server, http.MethodGet, "/admin/pairs/"+pairs[0].Hex(), "secret", nil); code != http.StatusNotFound {
+		t.Fatalf("evicted pair %d", code)
+	}
+}
+
+func TestPairHistory(t *testing.T) {
+	h := newPairHistory(2, 2)
+	pair := func(addr common.Address, blockNumber uint64) *protocol.UniswapV2Pair {
+		return &protocol.UniswapV2Pair{
+			Address:            addr,
+			Reserve0:           big.NewInt(1),
+			Reserve1:           big.NewInt(1),
+			StateFromLogUpdate: &protocol.StateFromLogUpdate{BlockNumber: blockNumber},
+		}
+	}
+	a, b, c := common.Address{0x81}, common.Address{0x82}, common.Address{0x83}
+	h.add([]*protocol.UniswapV2Pair{pair(a, 1), pair(b, 1)})
+	h.add([]*protocol.UniswapV2Pair{pair(a, 2), pair(a, 3)})
+	if states := h.get(a); len(states) != 2 || states[0].BlockNumber != 3 {
+		t.Fatalf("states %+v", states)
+	}
+	// the pair stored least recently is dropped past the bound
+	h.add([]*protocol.UniswapV2Pair{pair(c, 4)})
+	if len(h.get(b)) != 0 || len(h.get(a)) != 2 || len(h.get(c)) != 1 || len(h.states) != 2 {
+		t.Fatalf("not bounded %d", len(h.states))
+	}
+	h.remove([]common.Address{a})
+	if len(h.get(a)) != 0 || h.order.Len() != 1 {
+		t.Fatalf("not removed %d", h.order.Len())
+	}
+}
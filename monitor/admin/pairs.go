@@ -0,0 +1,218 @@
+package admin
+
+import (
+	"bytes"
+	"container/list"
+	"monitor/protocol"
+	"monitor/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	defaultPairsLimit = 100
+	maxPairsLimit     = 1000
+)
+
+type pairJSON struct {
+	Address     common.Address `json:"address"`
+	Token0      common.Address `json:"token0"`
+	Token1      common.Address `json:"token1"`
+	Factory     common.Address `json:"factory"`
+	Fee         int64          `json:"fee"`
+	Error       bool           `json:"error"`
+	Reserve0    string         `json:"reserve0"`
+	Reserve1    string         `json:"reserve1"`
+	BlockNumber uint64         `json:"blockNumber"`
+	Timestamp   int64          `json:"timestamp"`
+}
+
+func newPairJSON(pair *protocol.UniswapV2Pair) *pairJSON {
+	ret := &pairJSON{
+		Address:  pair.Address,
+		Token0:   pair.Token0,
+		Token1:   pair.Token1,
+		Factory:  pair.Factory,
+		Fee:      pair.Fee,
+		Error:    pair.Error,
+		Reserve0: "0",
+		Reserve1: "0",
+	}
+	if pair.Reserve0 != nil {
+		ret.Reserve0 = pair.Reserve0.String()
+	}
+	if pair.Reserve1 != nil {
+		ret.Reserve1 = pair.Reserve1.String()
+	}
+	if pair.StateFromLogUpdate != nil {
+		ret.BlockNumber, ret.Timestamp = pair.BlockNumber, pair.Timestamp
+	}
+	return ret
+}
+
+type pairsJSON struct {
+	Total int         `json:"total"`
+	Pairs []*pairJSON `json:"pairs"`
+}
+
+type pairStateJSON struct {
+	Pair    *pairJSON   `json:"pair,omitempty"`
+	History []*pairJSON `json:"history"`
+}
+
+func (a *Admin) handleListPairs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var token, factory *common.Address
+	for key, addr := range map[string]**common.Address{"token": &token, "factory": &factory} {
+		value := query.Get(key)
+		if len(value) == 0 {
+			continue
+		}
+		if !common.IsHexAddress(value) {
+			http.Error(w, "invalid "+key+" "+value, http.StatusBadRequest)
+			return
+		}
+		one := common.HexToAddress(value)
+		*addr = &one
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid offset "+query.Get("offset"), http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), defaultPairsLimit)
+	if err != nil || limit <= 0 || limit > maxPairsLimit {
+		http.Error(w, "invalid limit "+query.Get("limit"), http.StatusBadRequest)
+		return
+	}
+
+	pairs := []*protocol.UniswapV2Pair{}
+	protocol.UniswapV2Pairs.Range(func(_ common.Address, pair *protocol.UniswapV2Pair) bool {
+		if token != nil && pair.Token0 != *token && pair.Token1 != *token {
+			return true
+		}
+		if factory != nil && pair.Factory != *factory {
+			return true
+		}
+		pairs = append(pairs, pair)
+		return true
+	})
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].Address.Bytes(), pairs[j].Address.Bytes()) < 0
+	})
+	ret := &pairsJSON{Total: len(pairs), Pairs: []*pairJSON{}}
+	for i := offset; i < len(pairs) && i < offset+limit; i++ {
+		ret.Pairs = append(ret.Pairs, newPairJSON(pairs[i]))
+	}
+	utils.WriteJSON(w, ret)
+}
+
+func (a *Admin) handleGetPair(w http.ResponseWriter, r *http.Request, addr common.Address) {
+	ret := &pairStateJSON{History: a.history.get(addr)}
+	if pair, ok := protocol.UniswapV2Pairs.Load(addr); ok {
+		ret.Pair = newPairJSON(pair)
+	} else if len(ret.History) == 0 {
+		http.Error(w, "pair not found", http.StatusNotFound)
+		return
+	}
+	utils.WriteJSON(w, ret)
+}
+
+func (a *Admin) handleRefreshPair(w http.ResponseWriter, r *http.Request, addr common.Address) {
+	if a.refresher == nil {
+		http.Error(w, "pair refresh not available", http.StatusServiceUnavailable)
+		return
+	}
+	if err := a.refresher.RefreshPairs(r.Context(), []common.Address{addr}); err != nil {
+		http.Error(w, "refresh pair fail "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	utils.Infof("pair %s refreshed", addr)
+	a.handleGetPair(w, r, addr)
+}
+
+// pairHistory keeps the last states stored of the pairs stored most recently, newest last
+type pairHistory struct {
+	size     int
+	maxPairs int
+	// order lists the *pairStates, the pair stored most recently first
+	order  *list.List
+	states map[common.Address]*list.Element
+	lock   sync.Mutex
+}
+
+type pairStates struct {
+	addr   common.Address
+	states []*pairJSON
+}
+
+func newPairHistory(size, maxPairs int) *pairHistory {
+	return &pairHistory{
+		size:     size,
+		maxPairs: maxPairs,
+		order:    list.New(),
+		states:   map[common.Address]*list.Element{},
+	}
+}
+
+func (h *pairHistory) add(pairs []*protocol.UniswapV2Pair) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, pair := range pairs {
+		elem, ok := h.states[pair.Address]
+		if ok {
+			h.order.MoveToFront(elem)
+		} else {
+			elem = h.order.PushFront(&pairStates{addr: pair.Address})
+			h.states[pair.Address] = elem
+		}
+		entry := elem.Value.(*pairStates)
+		if len(entry.states) >= h.size {
+			entry.states = append(entry.states[:0], entry.states[len(entry.states)-h.size+1:]...)
+		}
+		entry.states = append(entry.states, newPairJSON(pair))
+	}
+	for h.order.Len() > h.maxPairs {
+		oldest := h.order.Back()
+		h.order.Remove(oldest)
+		delete(h.states, oldest.Value.(*pairStates).addr)
+	}
+}
+
+func (h *pairHistory) remove(addrs []common.Address) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, addr := range addrs {
+		if elem, ok := h.states[addr]; ok {
+			h.order.Remove(elem)
+			delete(h.states, addr)
+		}
+	}
+}
+
+// get returns the states of a pair, newest first
+func (h *pairHistory) get(addr common.Address) []*pairJSON {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	elem, ok := h.states[addr]
+	if !ok {
+		return []*pairJSON{}
+	}
+	states := elem.Value.(*pairStates).states
+	ret := make([]*pairJSON, 0, len(states))
+	for i := len(states) - 1; i >= 0; i-- {
+		ret = append(ret, states[i])
+	}
+	return ret
+}
+
+func queryInt(value string, def int) (int, error) {
+	if len(value) == 0 {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
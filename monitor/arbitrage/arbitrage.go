@@ -1,76 +1,208 @@
 package arbitrage
 
 import (
+	"bytes"
 	"context"
 	"math"
 	"math/big"
 	"monitor/config"
+	"monitor/metrics"
 	"monitor/protocol"
+	"monitor/screening"
 	"monitor/storage"
 	"monitor/trader"
 	"monitor/utils"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
-	_         utils.Keeper = &Arbitrage{}
-	duplicate              = cache.New(time.Minute, 12*time.Hour)
+	_ utils.Keeper = &Arbitrage{}
+	_ Executor     = &trader.Trader{}
+
+	logger = utils.NewLogger("arbitrage")
 )
 
+// Executor sends the trades of the cycles found, the trader or a simulated one in backtests
+type Executor interface {
+	// MinProfit is the least profit in wei a cycle of length hops is traded for
+	MinProfit(length int) float64
+	// Available is the WETH in wei the next trade can spend
+	Available() float64
+	SwapV2(ctx context.Context, inputAmount float64, pairPath []*protocol.UniswapV2Pair) error
+	// SwapBatch sends the cycles in one tx, each is skipped alone when no longer profitable
+	SwapBatch(ctx context.Context, swaps []*trader.Swap) error
+}
+
 type Arbitrage struct {
-	config *config.Config
-	trader *trader.Trader
+	config    *config.Config
+	trader    Executor
+	screener  *screening.Screener
+	stats     atomic.Pointer[PruneStats]
+	now       func() time.Time
+	duplicate *cooldown
+
+	thresholds atomic.Pointer[Thresholds]
+	paused     atomic.Bool
+	cycleLog   cycleLog
+	// graph is the pairs of the last graph searched
+	graph atomic.Pointer[[]*protocol.UniswapV2Pair]
+	// trades counts the cycles being tried, ShutDown waits for them
+	trades sync.WaitGroup
+
+	graphPairs     *prometheus.GaugeVec
+	graphTokens    prometheus.Gauge
+	searchDuration prometheus.Histogram
+	cycles         *prometheus.CounterVec
 }
 
-func NewArbitrage(ctx context.Context, conf *config.Config, trader *trader.Trader) *Arbitrage {
+func NewArbitrage(ctx context.Context, conf *config.Config, trader Executor, screener *screening.Screener) *Arbitrage {
 	if conf.MinRecieve <= 0 {
 		conf.MinRecieve = 0.0001
 	}
-	return &Arbitrage{
-		config: conf,
-		trader: trader,
+	if conf.BatchCycles <= 0 || conf.FlashSwap {
+		conf.BatchCycles = 1
+	}
+	a := &Arbitrage{
+		config:   conf,
+		trader:   trader,
+		screener: screener,
+		now:      time.Now,
+		graphPairs: metrics.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "arbitrage",
+			Name:      "graph_pairs",
+			Help:      "Pairs of the last graph by state, kept or the reason they were pruned.",
+		}, "state"),
+		graphTokens: metrics.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "arbitrage",
+			Name:      "graph_tokens",
+			Help:      "Tokens of the last graph.",
+		}),
+		searchDuration: metrics.NewHistogram(prometheus.HistogramOpts{
+			Subsystem: "arbitrage",
+			Name:      "search_duration_seconds",
+			Help:      "Time to prune the pairs, build the graph and search it.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+		}),
+		cycles: metrics.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "arbitrage",
+			Name:      "cycles_total",
+			Help:      "Cycles found by result: duplicate, stale, unprofitable, unfunded, paused, traded or failed.",
+		}, "result"),
 	}
+	a.duplicate = newCooldown(func() time.Time {
+		return a.now()
+	})
+	// the min recieve floor is opt in at runtime, the strategy min profit alone decides
+	// the trades as it always did
+	a.thresholds.Store(&Thresholds{
+		GraphMinLiquidity:   conf.GraphMinLiquidity,
+		GraphMinTradeSize:   conf.GraphMinTradeSize,
+		GraphTargetSlippage: conf.GraphTargetSlippage,
+	})
+	return a
+}
+
+// SetClock replaces the wall clock, backtests move it with the blocks replayed
+func (a *Arbitrage) SetClock(now func() time.Time) {
+	a.now = now
 }
 
 func (a *Arbitrage) Init(ctx context.Context) error {
-	go a.loopWatcher(ctx)
+	utils.Go(ctx, "arbitrage.watcher", a.loopWatcher)
 	return nil
 }
 
-func (*Arbitrage) ShutDown(context.Context) {
-
+// ShutDown waits for the cycles being tried, the watcher is stopped by the context of Init
+func (a *Arbitrage) ShutDown(ctx context.Context) {
+	if !utils.Wait(ctx, &a.trades) {
+		logger.Errorf("trades still in flight at shutdown")
+	}
 }
 
-func (a *Arbitrage) loopWatcher(ctx context.Context) {
-	for {
-		<-time.After(time.Millisecond * 100)
-
+func (a *Arbitrage) loopWatcher(ctx context.Context) error {
+	for utils.Sleep(ctx, time.Millisecond*100) {
 		err := a.findArbitrage(ctx)
 		if err != nil {
-			utils.Warnf("find arbitrage fail %s", err)
+			logger.Warnf("find arbitrage fail %s", err)
 		}
 	}
+	return nil
 }
 
 func (a *Arbitrage) findArbitrage(ctx context.Context) error {
-	// startTime := time.Now()
-	store := storage.GetStorage(storage.StoreKeyUniswapv2Pairs)
-	pairs := store.LoadAll()
-	// utils.Infof("load data finish in %s", time.Since(startTime))
-	g := NewSwapGraph()
-	for _, p := range pairs {
-		pair := p.(*protocol.UniswapV2Pair)
-		if pair.Error || pair.Fee < 0 {
-			continue
-		}
+	paths, pairs := a.search()
+	if len(paths) > 0 {
+		a.trades.Add(1)
+		utils.SafeGo(ctx, "arbitrage.trade", func(ctx context.Context) {
+			defer a.trades.Done()
+			a.tryTrade(ctx, paths, pairs)
+		})
+	}
+	return nil
+}
+
+// Step searches the graph once and tries the cycles found before returning, backtests
+// call it after every block replayed
+func (a *Arbitrage) Step(ctx context.Context) {
+	paths, pairs := a.search()
+	if len(paths) > 0 {
+		a.tryTrade(ctx, paths, pairs)
+	}
+}
+
+// search builds the graph of the stored pairs and returns the pairs of the cycles through WETH
+// found, up to BatchCycles of them without a pair in common
+func (a *Arbitrage) search() ([][]common.Address, *storage.Snapshot[common.Address, *protocol.UniswapV2Pair]) {
+	startTime := time.Now()
+	pairs := protocol.UniswapV2Pairs.Snapshot()
+	kept, stats := a.prunePairs(pairs)
+	a.graph.Store(&kept)
+	for _, pair := range kept {
 		r0, _ := big.NewFloat(0).SetInt(pair.Reserve0).Float64()
 		r1, _ := big.NewFloat(0).SetInt(pair.Reserve1).Float64()
 		pair.Weight0 = -math.Log10(r1 / r0 * (protocol.FeeBase - float64(pair.Fee)) / protocol.FeeBase)
 		pair.Weight1 = -math.Log10(r0 / r1 * (protocol.FeeBase - float64(pair.Fee)) / protocol.FeeBase)
+	}
+	var (
+		paths [][]common.Address
+		used  = map[common.Address]bool{}
+	)
+	for len(paths) < a.config.BatchCycles {
+		g := a.buildGraph(kept, used)
+		if len(paths) == 0 {
+			stats.Tokens = len(g.distances)
+		}
+		path := g.FindCircle(a.config.WETHAddress)
+		if len(path) == 0 {
+			break
+		}
+		paths = append(paths, path)
+		for _, pair := range path {
+			used[pair] = true
+		}
+	}
+	stats.Duration = float64(time.Since(startTime).Microseconds()) / 1000
+	a.storeStats(stats)
+	a.searchDuration.Observe(stats.Duration / 1000)
+	return paths, pairs
+}
 
+// buildGraph is the graph of the pairs weighted, the used ones left out
+func (a *Arbitrage) buildGraph(kept []*protocol.UniswapV2Pair, used map[common.Address]bool) *SwapGraph {
+	g := NewSwapGraph()
+	if a.config.ReproducibleSearch {
+		g = NewReproducibleSwapGraph()
+	}
+	for _, pair := range kept {
+		if used[pair.Address] {
+			continue
+		}
 		g.AddVertices(pair.Token0, pair.Token1)
 		g.AddEdges(
 			&SwapEdge{
@@ -89,12 +221,74 @@ func (a *Arbitrage) findArbitrage(ctx context.Context) error {
 			},
 		)
 	}
-	path := g.FindCircle(a.config.WETHAddress)
-	if len(path) > 0 {
-		go a.tryTrade(ctx, path, pairs)
+	return g
+}
+
+// prunePairs returns the pairs entering the graph, the reasons the others are left out are counted
+func (a *Arbitrage) prunePairs(pairs *storage.Snapshot[common.Address, *protocol.UniswapV2Pair]) ([]*protocol.UniswapV2Pair, *PruneStats) {
+	var (
+		tokens  = protocol.Tokens.Snapshot()
+		allowed = a.screener.PairFilter()
+		stats   = &PruneStats{UpdatedAt: a.now()}
+		valid   = make([]*protocol.UniswapV2Pair, 0, pairs.Len())
+	)
+	pairs.Range(func(_ common.Address, pair *protocol.UniswapV2Pair) bool {
+		stats.Pairs++
+		if pair.Error || pair.Fee < 0 || pair.Reserve0 == nil || pair.Reserve1 == nil || pair.Reserve0.Sign() <= 0 || pair.Reserve1.Sign() <= 0 {
+			stats.Invalid++
+			return true
+		}
+		if token, ok := tokens.Load(pair.Token0); ok && token.Excluded() {
+			stats.Excluded++
+			return true
+		}
+		if token, ok := tokens.Load(pair.Token1); ok && token.Excluded() {
+			stats.Excluded++
+			return true
+		}
+		if !allowed(pair) {
+			stats.Screened++
+			return true
+		}
+		valid = append(valid, pair)
+		return true
+	})
+	if a.config.ReproducibleSearch {
+		// the snapshot ranges in random order, sorted pairs keep the graph search reproducible
+		sort.Slice(valid, func(i, j int) bool {
+			return bytes.Compare(valid[i].Address.Bytes(), valid[j].Address.Bytes()) < 0
+		})
 	}
-	// utils.Infof("find arbitrage finish in %s", time.Since(startTime))
-	return nil
+	kept := a.liquidityFilter(valid, stats)
+	stats.Kept = len(kept)
+	return kept, stats
+}
+
+// storeStats keeps the stats of the last graph and logs them every minute
+func (a *Arbitrage) storeStats(stats *PruneStats) {
+	for state, count := range map[string]int{
+		"kept":          stats.Kept,
+		"invalid":       stats.Invalid,
+		"excluded":      stats.Excluded,
+		"screened":      stats.Screened,
+		"unpriced":      stats.Unpriced,
+		"low_liquidity": stats.LowLiquidity,
+		"low_depth":     stats.LowDepth,
+	} {
+		a.graphPairs.WithLabelValues(state).Set(float64(count))
+	}
+	a.graphTokens.Set(float64(stats.Tokens))
+	last := a.stats.Swap(stats)
+	if last != nil && last.UpdatedAt.Truncate(time.Minute).Equal(stats.UpdatedAt.Truncate(time.Minute)) {
+		return
+	}
+	logger.Infof("graph pairs %d kept %d tokens %d invalid %d excluded %d screened %d unpriced %d low liquidity %d low depth %d in %.1fms",
+		stats.Pairs, stats.Kept, stats.Tokens, stats.Invalid, stats.Excluded, stats.Screened, stats.Unpriced, stats.LowLiquidity, stats.LowDepth, stats.Duration)
+}
+
+// PruneStats returns the pruning stats of the last graph, nil before the first one
+func (a *Arbitrage) PruneStats() *PruneStats {
+	return a.stats.Load()
 }
 
 type AddressList []common.Address
@@ -110,34 +304,114 @@ func (l AddressList) String() string {
 	return ret
 }
 
-func (a *Arbitrage) tryTrade(ctx context.Context, path []common.Address, pairs map[interface{}]interface{}) {
-	if len(path) == 0 {
+// sized is a cycle found worth trading, amounts in wei
+type sized struct {
+	key        string
+	cycle      *Cycle
+	pairPath   []*protocol.UniswapV2Pair
+	amountIn   float64
+	amountOut  float64
+	minRecieve float64
+}
+
+// tryTrade sizes the cycles of paths and sends the profitable ones, together in one batch
+// when there are several
+func (a *Arbitrage) tryTrade(ctx context.Context, paths [][]common.Address, pairs *storage.Snapshot[common.Address, *protocol.UniswapV2Pair]) {
+	var (
+		trades    = make([]*sized, 0, len(paths))
+		available = a.trader.Available()
+	)
+	for _, path := range paths {
+		trade := a.sizeCycle(path, pairs, available)
+		if trade == nil {
+			continue
+		}
+		// the cycles of a batch are paid from the same inventory
+		available -= trade.amountIn
+		trades = append(trades, trade)
+	}
+	if len(trades) == 0 {
 		return
 	}
-	key := AddressList(path).String()
-	dupCount, ok := duplicate.Get(key)
-	if ok {
+	ctx = utils.WithCorrelationID(ctx, "trade")
+	log := logger.Ctx(ctx)
+	weth := a.config.WETHAddress
+	for _, trade := range trades {
+		trade.cycle.Trade = utils.CorrelationID(ctx, "trade")
+		trade.cycle.AmountIn, trade.cycle.AmountOut = trade.amountIn/math.Pow10(18), trade.amountOut/math.Pow10(18)
+		log.Warnf("tryTrade ok %s %s profit %s minRecieve %s path %s", protocol.FormatAmount(weth, trade.amountIn), protocol.FormatAmount(weth, trade.amountOut), protocol.FormatAmount(weth, trade.amountOut-trade.amountIn), protocol.FormatAmount(weth, trade.minRecieve), protocol.FormatPath(weth, trade.pairPath))
+		for _, pair := range trade.pairPath {
+			r0, _ := pair.Reserve0.Float64()
+			r1, _ := pair.Reserve1.Float64()
+			log.Warnf("--------pair %s %s %s fee %d", pair.Address, protocol.FormatAmount(pair.Token0, r0), protocol.FormatAmount(pair.Token1, r1), pair.Fee)
+		}
+	}
+	if a.Paused() {
+		log.Warnf("trading paused, trade not sent")
+		for _, trade := range trades {
+			a.endCycle(trade.cycle, "paused")
+		}
 		return
 	}
-	duplicate.SetDefault(key, int(0))
+	var err error
+	if len(trades) == 1 {
+		err = a.trader.SwapV2(ctx, trades[0].amountIn, trades[0].pairPath)
+		if err != nil {
+			log.Errorf("SwapV2 fail %s", err)
+		}
+	} else {
+		swaps := make([]*trader.Swap, 0, len(trades))
+		for _, trade := range trades {
+			swaps = append(swaps, &trader.Swap{AmountIn: trade.amountIn, Path: trade.pairPath})
+		}
+		err = a.trader.SwapBatch(ctx, swaps)
+		if err != nil {
+			log.Errorf("SwapBatch fail %s", err)
+		}
+	}
+	for _, trade := range trades {
+		if err != nil {
+			a.duplicate.Fail(trade.key)
+			trade.cycle.Error = err.Error()
+			a.endCycle(trade.cycle, "failed")
+			continue
+		}
+		a.endCycle(trade.cycle, "traded")
+	}
+}
 
-	pairPath := make([]*protocol.UniswapV2Pair, 0, len(path))
+// sizeCycle returns the cycle of path sized to the inventory available and its min profit,
+// nil when it is not traded
+func (a *Arbitrage) sizeCycle(path []common.Address, pairs *storage.Snapshot[common.Address, *protocol.UniswapV2Pair], available float64) *sized {
+	if len(path) == 0 {
+		return nil
+	}
+	key := AddressList(path).String()
+	if !a.duplicate.Try(key) {
+		a.cycles.WithLabelValues("duplicate").Inc()
+		return nil
+	}
+	var (
+		pairPath = make([]*protocol.UniswapV2Pair, 0, len(path))
+		cycle    = &Cycle{Time: a.now(), Pairs: make([]common.Address, 0, len(path))}
+	)
 	for i := len(path) - 1; i >= 0; i-- {
-		pair, ok := pairs[path[i]].(*protocol.UniswapV2Pair)
+		cycle.Pairs = append(cycle.Pairs, path[i])
+	}
+	for _, addr := range cycle.Pairs {
+		pair, ok := pairs.Load(addr)
 		if !ok {
-			return
+			a.endCycle(cycle, "stale")
+			return nil
 		}
 		pairPath = append(pairPath, pair)
 	}
 	var (
-		amtIn, amtOut float64
-		canTrade      bool
-		minRecieve    = a.trader.EstimateFee(len(pairPath)) * 1.5
+		amtIn      float64
+		minRecieve = math.Max(a.trader.MinProfit(len(pairPath)), a.Thresholds().MinRecieve*math.Pow10(18))
 	)
-	pair0 := pairs[path[len(path)-1]].(*protocol.UniswapV2Pair)
-	if pair0 == nil {
-		return
-	}
+	cycle.MinRecieve = minRecieve / math.Pow10(18)
+	pair0 := pairPath[0]
 	if pair0.Token0 == a.config.WETHAddress {
 		amtIn, _ = pair0.Reserve0.Float64()
 		amtIn *= 0.1
@@ -145,37 +419,26 @@ func (a *Arbitrage) tryTrade(ctx context.Context, path []common.Address, pairs m
 		amtIn, _ = pair0.Reserve1.Float64()
 		amtIn *= 0.1
 	} else {
-		return
+		a.endCycle(cycle, "stale")
+		return nil
 	}
-	for {
-		pAmtOut := protocol.GetAmountsOut(a.config.WETHAddress, amtIn, pairPath)
-		if pAmtOut <= amtIn+minRecieve {
-			if amtIn < minRecieve {
-				// utils.Warnf("------ %f %f %f %f %+v", amtIn, pAmtIn, (pAmtIn-amtIn)/math.Pow10(18), minRecieve/math.Pow10(18), path)
-				return
-			}
-			amtIn *= 0.9
-		} else {
-			canTrade = true
-			amtOut = pAmtOut
-			break
+	// the trade is sized down to the inventory, the swap contract caps it silently otherwise
+	if amtIn > available {
+		if available <= minRecieve {
+			a.endCycle(cycle, "unfunded")
+			return nil
 		}
+		amtIn = available
 	}
-	if canTrade {
-		utils.Warnf("tryTrade ok %f %f %f %f", amtIn, amtOut, (amtOut-amtIn)/math.Pow10(18), minRecieve/math.Pow10(18))
-		for i := len(path) - 1; i >= 0; i-- {
-			pair := pairs[path[i]].(*protocol.UniswapV2Pair)
-			utils.Warnf("--------pair %s %s %s %s %s %d", pair.Address, pair.Token0, pair.Token1, pair.Reserve0, pair.Reserve1, pair.Fee)
+	for {
+		pAmtOut := protocol.GetAmountsOut(a.config.WETHAddress, amtIn, pairPath)
+		if pAmtOut > amtIn+minRecieve {
+			return &sized{key: key, cycle: cycle, pairPath: pairPath, amountIn: amtIn, amountOut: pAmtOut, minRecieve: minRecieve}
 		}
-		err := a.trader.SwapV2(ctx, amtIn, pairPath)
-		if err != nil {
-			failCount := 0
-			if dupCount != nil {
-				failCount = dupCount.(int)
-			}
-			failCount++
-			duplicate.Set(key, failCount, time.Minute*time.Duration(10*failCount))
-			utils.Errorf("SwapV2 fail %s", err)
+		if amtIn <= minRecieve {
+			a.endCycle(cycle, "unprofitable")
+			return nil
 		}
+		amtIn *= 0.9
 	}
 }
@@ -0,0 +1,190 @@
+package arbitrage
+
+import (
+	"bytes"
+	"fmt"
+	"monitor/protocol"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// recentCycles is the number of cycles kept for inspection
+const recentCycles = 100
+
+// Thresholds are the limits of the arbitrage changed at runtime, amounts in ether.
+// MinRecieve is a floor on the min profit of the strategy, 0 until set
+type Thresholds struct {
+	MinRecieve          float64 `json:"minRecieve"`
+	GraphMinLiquidity   float64 `json:"graphMinLiquidity"`
+	GraphMinTradeSize   float64 `json:"graphMinTradeSize"`
+	GraphTargetSlippage float64 `json:"graphTargetSlippage"`
+}
+
+func (t *Thresholds) validate() error {
+	if t.MinRecieve < 0 || t.GraphMinLiquidity < 0 || t.GraphMinTradeSize < 0 {
+		return fmt.Errorf("negative threshold %+v", *t)
+	}
+	if t.GraphTargetSlippage < 0 || t.GraphTargetSlippage >= 1 {
+		return fmt.Errorf("target slippage out of range %f", t.GraphTargetSlippage)
+	}
+	return nil
+}
+
+// Thresholds returns the thresholds in use, they start from the config
+func (a *Arbitrage) Thresholds() Thresholds {
+	return *a.thresholds.Load()
+}
+
+func (a *Arbitrage) SetThresholds(t Thresholds) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	a.thresholds.Store(&t)
+	logger.Warnf("thresholds set %+v", t)
+	return nil
+}
+
+// Pause stops sending trades, the cycles found are still searched and recorded
+func (a *Arbitrage) Pause() {
+	a.paused.Store(true)
+	logger.Warnf("trading paused")
+}
+
+func (a *Arbitrage) Resume() {
+	a.paused.Store(false)
+	logger.Warnf("trading resumed")
+}
+
+func (a *Arbitrage) Paused() bool {
+	return a.paused.Load()
+}
+
+// Cycle is a cycle found and what became of it, amounts in ether
+type Cycle struct {
+	Time       time.Time        `json:"time"`
+	Trade      string           `json:"trade,omitempty"`
+	Pairs      []common.Address `json:"pairs"`
+	AmountIn   float64          `json:"amountIn,omitempty"`
+	AmountOut  float64          `json:"amountOut,omitempty"`
+	MinRecieve float64          `json:"minRecieve"`
+	Result     string           `json:"result"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// cycleLog keeps the last cycles, newest last
+type cycleLog struct {
+	cycles []*Cycle
+	lock   sync.Mutex
+}
+
+func (l *cycleLog) add(cycle *Cycle) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.cycles) >= recentCycles {
+		l.cycles = append(l.cycles[:0], l.cycles[1:]...)
+	}
+	l.cycles = append(l.cycles, cycle)
+}
+
+// recent returns up to limit cycles, newest first
+func (l *cycleLog) recent(limit int) []*Cycle {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if limit <= 0 || limit > len(l.cycles) {
+		limit = len(l.cycles)
+	}
+	ret := make([]*Cycle, 0, limit)
+	for i := len(l.cycles) - 1; i >= 0 && len(ret) < limit; i-- {
+		ret = append(ret, l.cycles[i])
+	}
+	return ret
+}
+
+// RecentCycles returns the last cycles tried, newest first, duplicates are left out
+func (a *Arbitrage) RecentCycles(limit int) []*Cycle {
+	return a.cycleLog.recent(limit)
+}
+
+func (a *Arbitrage) endCycle(cycle *Cycle, result string) {
+	cycle.Result = result
+	a.cycles.WithLabelValues(result).Inc()
+	a.cycleLog.add(cycle)
+}
+
+// Neighborhood is the part of the last graph within depth pairs of a token
+type Neighborhood struct {
+	Token  common.Address      `json:"token"`
+	Depth  int                 `json:"depth"`
+	Tokens []common.Address    `json:"tokens"`
+	Pairs  []*NeighborhoodPair `json:"pairs"`
+}
+
+type NeighborhoodPair struct {
+	Address  common.Address `json:"address"`
+	Token0   common.Address `json:"token0"`
+	Token1   common.Address `json:"token1"`
+	Reserve0 string         `json:"reserve0"`
+	Reserve1 string         `json:"reserve1"`
+	Fee      int64          `json:"fee"`
+	Weight0  float64        `json:"weight0"`
+	Weight1  float64        `json:"weight1"`
+}
+
+// Neighborhood walks the pairs of the last graph from token, nil before the first graph
+func (a *Arbitrage) Neighborhood(token common.Address, depth int) *Neighborhood {
+	graph := a.graph.Load()
+	if graph == nil {
+		return nil
+	}
+	byToken := map[common.Address][]*protocol.UniswapV2Pair{}
+	for _, pair := range *graph {
+		byToken[pair.Token0] = append(byToken[pair.Token0], pair)
+		byToken[pair.Token1] = append(byToken[pair.Token1], pair)
+	}
+	var (
+		ret     = &Neighborhood{Token: token, Depth: depth, Tokens: []common.Address{}, Pairs: []*NeighborhoodPair{}}
+		seen    = map[common.Address]bool{token: true}
+		visited = map[common.Address]bool{}
+		level   = []common.Address{token}
+	)
+	for d := 0; d < depth && len(level) > 0; d++ {
+		next := []common.Address{}
+		for _, one := range level {
+			for _, pair := range byToken[one] {
+				if visited[pair.Address] {
+					continue
+				}
+				visited[pair.Address] = true
+				ret.Pairs = append(ret.Pairs, &NeighborhoodPair{
+					Address:  pair.Address,
+					Token0:   pair.Token0,
+					Token1:   pair.Token1,
+					Reserve0: pair.Reserve0.String(),
+					Reserve1: pair.Reserve1.String(),
+					Fee:      pair.Fee,
+					Weight0:  pair.Weight0,
+					Weight1:  pair.Weight1,
+				})
+				for _, other := range []common.Address{pair.Token0, pair.Token1} {
+					if !seen[other] {
+						seen[other] = true
+						next = append(next, other)
+					}
+				}
+			}
+		}
+		level = next
+	}
+	if len(ret.Pairs) > 0 {
+		for addr := range seen {
+			ret.Tokens = append(ret.Tokens, addr)
+		}
+		sort.Slice(ret.Tokens, func(i, j int) bool {
+			return bytes.Compare(ret.Tokens[i].Bytes(), ret.Tokens[j].Bytes()) < 0
+		})
+	}
+	return ret
+}
@@ -0,0 +1,80 @@
+package arbitrage
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// tryCooldown holds a cycle after it is tried
+	tryCooldown = time.Minute
+	// failCooldown is multiplied by the failures of a cycle in a row
+	failCooldown     = 10 * time.Minute
+	cooldownCleanup  = time.Hour
+	cooldownFailKeep = 12 * time.Hour
+)
+
+type cooldownEntry struct {
+	until time.Time
+	fails int
+}
+
+// cooldown holds the cycles tried recently on the arbitrage clock so they are not
+// tried again at once, the failures of a cycle hold it longer
+type cooldown struct {
+	now       func() time.Time
+	entries   map[string]*cooldownEntry
+	lastClean time.Time
+	lock      sync.Mutex
+}
+
+func newCooldown(now func() time.Time) *cooldown {
+	return &cooldown{
+		now:     now,
+		entries: map[string]*cooldownEntry{},
+	}
+}
+
+// Try reports whether the key may be tried and holds it for the try cooldown
+func (c *cooldown) Try(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	c.clean(now)
+	entry, ok := c.entries[key]
+	if ok && now.Before(entry.until) {
+		return false
+	}
+	if !ok {
+		entry = &cooldownEntry{}
+		c.entries[key] = entry
+	}
+	entry.until = now.Add(tryCooldown)
+	return true
+}
+
+// Fail holds the key for the fail cooldown times its failures
+func (c *cooldown) Fail(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &cooldownEntry{}
+		c.entries[key] = entry
+	}
+	entry.fails++
+	entry.until = c.now().Add(failCooldown * time.Duration(entry.fails))
+}
+
+// clean drops the entries released for a while, their failures are forgotten
+func (c *cooldown) clean(now time.Time) {
+	if now.Sub(c.lastClean) < cooldownCleanup {
+		return
+	}
+	c.lastClean = now
+	for key, entry := range c.entries {
+		if now.Sub(entry.until) > cooldownFailKeep {
+			delete(c.entries, key)
+		}
+	}
+}
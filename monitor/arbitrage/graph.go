@@ -9,6 +9,9 @@ type SwapGraph struct {
 	// predecessors map[common.Address]common.Address
 	preedges map[common.Address]string
 	edges    map[string]*SwapEdge
+	// order keeps the edges in the order they were added when the search is reproducible
+	order        []*SwapEdge
+	reproducible bool
 }
 
 type SwapEdge struct {
@@ -28,6 +31,13 @@ func NewSwapGraph() *SwapGraph {
 	}
 }
 
+// NewReproducibleSwapGraph searches its edges in the order they were added
+func NewReproducibleSwapGraph() *SwapGraph {
+	g := NewSwapGraph()
+	g.reproducible = true
+	return g
+}
+
 func (g *SwapGraph) AddVertices(vertices ...common.Address) {
 	for _, v := range vertices {
 		g.distances[v] = 1000000000000000000
@@ -36,22 +46,52 @@ func (g *SwapGraph) AddVertices(vertices ...common.Address) {
 
 func (g *SwapGraph) AddEdges(edges ...*SwapEdge) {
 	for _, e := range edges {
+		if g.reproducible {
+			g.addOrder(e)
+		}
 		g.edges[e.Key] = e
 	}
 }
 
+// addOrder appends a new edge to the order or replaces the edge of the same key
+func (g *SwapGraph) addOrder(e *SwapEdge) {
+	if _, ok := g.edges[e.Key]; !ok {
+		g.order = append(g.order, e)
+		return
+	}
+	for i, one := range g.order {
+		if one.Key == e.Key {
+			g.order[i] = e
+		}
+	}
+}
+
+// rangeEdges calls f with the edges in the order they were added when the search is
+// reproducible, else in the map order
+func (g *SwapGraph) rangeEdges(f func(e *SwapEdge)) {
+	if g.reproducible {
+		for _, e := range g.order {
+			f(e)
+		}
+		return
+	}
+	for _, e := range g.edges {
+		f(e)
+	}
+}
+
 func (g *SwapGraph) BellmanFord(source common.Address) {
 	g.distances[source] = 0
 	for i := 0; i < 5; i++ {
 		var change bool
-		for _, e := range g.edges {
+		g.rangeEdges(func(e *SwapEdge) {
 			fromDist, ok := g.distances[e.From]
 			if !ok {
-				continue
+				return
 			}
 			toDist, ok := g.distances[e.To]
 			if !ok {
-				continue
+				return
 			}
 			if newDist := fromDist + e.Distance; newDist < toDist {
 				change = true
@@ -59,7 +99,7 @@ func (g *SwapGraph) BellmanFord(source common.Address) {
 				// g.predecessors[e.To] = e.From
 				g.preedges[e.To] = e.Key
 			}
-		}
+		})
 		if !change {
 			break
 		}
@@ -72,17 +112,17 @@ func (g *SwapGraph) FindCircle(source common.Address) []common.Address {
 		minEdge     *SwapEdge
 		minDistance float64
 	)
-	for _, e := range g.edges {
+	g.rangeEdges(func(e *SwapEdge) {
 		if e.To != source {
-			continue
+			return
 		}
 		fromDist, ok := g.distances[e.From]
 		if !ok {
-			continue
+			return
 		}
 		toDist, ok := g.distances[e.To]
 		if !ok {
-			continue
+			return
 		}
 		if newDist := fromDist + e.Distance; newDist < toDist {
 			if minEdge == nil || newDist < minDistance {
@@ -90,6 +130,11 @@ func (g *SwapGraph) FindCircle(source common.Address) []common.Address {
 				minDistance = newDist
 			}
 		}
+	})
+	// in the fixed order a pass can relax the whole cycle and leave no edge to relax, the
+	// source reached below zero is then the proof of the cycle
+	if g.reproducible && minEdge == nil && g.distances[source] < 0 {
+		minEdge = g.edges[g.preedges[source]]
 	}
 	ret := []common.Address{}
 	if minEdge != nil {
@@ -0,0 +1,140 @@
+package arbitrage
+
+import (
+	"encoding/json"
+	"monitor/utils"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	defaultNeighborhoodDepth = 1
+	maxNeighborhoodDepth     = 3
+)
+
+type tradingJSON struct {
+	Paused bool `json:"paused"`
+}
+
+// Handler serves the state of the arbitrage and its controls:
+//
+//	GET  /arbitrage/pruning            the pruning stats of the last graph
+//	GET  /arbitrage/cycles?limit=      the last cycles tried, newest first
+//	GET  /arbitrage/graph/<token>      the pairs of the last graph around a token, ?depth= up to 3
+//	GET  /arbitrage/trading            whether trading is paused
+//	POST /arbitrage/trading/pause      stops sending trades
+//	POST /arbitrage/trading/resume     sends trades again
+//	GET  /arbitrage/thresholds         the thresholds in use
+//	POST /arbitrage/thresholds         replaces them, {"minRecieve","graphMinLiquidity",...}
+func (a *Arbitrage) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/arbitrage/pruning", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stats := a.PruneStats()
+		if stats == nil {
+			http.Error(w, "no graph built yet", http.StatusServiceUnavailable)
+			return
+		}
+		utils.WriteJSON(w, stats)
+	})
+	mux.HandleFunc("/arbitrage/cycles", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit, err := queryInt(r, "limit", recentCycles)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		utils.WriteJSON(w, a.RecentCycles(limit))
+	})
+	mux.HandleFunc("/arbitrage/graph/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.handleGetGraph(w, r)
+	})
+	mux.HandleFunc("/arbitrage/trading", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		utils.WriteJSON(w, &tradingJSON{Paused: a.Paused()})
+	})
+	mux.HandleFunc("/arbitrage/trading/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/arbitrage/trading/") {
+		case "pause":
+			a.Pause()
+		case "resume":
+			a.Resume()
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		utils.WriteJSON(w, &tradingJSON{Paused: a.Paused()})
+	})
+	mux.HandleFunc("/arbitrage/thresholds", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			utils.WriteJSON(w, a.Thresholds())
+		case http.MethodPost:
+			a.handlePostThresholds(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+func (a *Arbitrage) handleGetGraph(w http.ResponseWriter, r *http.Request) {
+	value := strings.TrimPrefix(r.URL.Path, "/arbitrage/graph/")
+	if !common.IsHexAddress(value) {
+		http.Error(w, "invalid address "+value, http.StatusBadRequest)
+		return
+	}
+	depth, err := queryInt(r, "depth", defaultNeighborhoodDepth)
+	if err != nil || depth < 1 || depth > maxNeighborhoodDepth {
+		http.Error(w, "invalid depth "+r.URL.Query().Get("depth"), http.StatusBadRequest)
+		return
+	}
+	neighborhood := a.Neighborhood(common.HexToAddress(value), depth)
+	if neighborhood == nil {
+		http.Error(w, "no graph built yet", http.StatusServiceUnavailable)
+		return
+	}
+	utils.WriteJSON(w, neighborhood)
+}
+
+// handlePostThresholds changes the thresholds given, the others are kept
+func (a *Arbitrage) handlePostThresholds(w http.ResponseWriter, r *http.Request) {
+	thresholds := a.Thresholds()
+	if err := json.NewDecoder(r.Body).Decode(&thresholds); err != nil {
+		http.Error(w, "decode body fail "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.SetThresholds(thresholds); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	utils.WriteJSON(w, a.Thresholds())
+}
+
+func queryInt(r *http.Request, key string, value int) (int, error) {
+	s := r.URL.Query().Get(key)
+	if len(s) == 0 {
+		return value, nil
+	}
+	return strconv.Atoi(s)
+}
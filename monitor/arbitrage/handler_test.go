@@ -0,0 +1,231 @@
+package arbitrage
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/storage"
+	"monitor/trader"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type testExecutor struct {
+	swaps    int
+	amountIn float64
+	// batches are the swaps sent by SwapBatch
+	batches [][]*trader.Swap
+	// available limits the trades when set
+	available *float64
+}
+
+func (*testExecutor) MinProfit(length int) float64 {
+	return 0
+}
+
+func (e *testExecutor) Available() float64 {
+	if e.available != nil {
+		return *e.available
+	}
+	return math.Inf(1)
+}
+
+func (e *testExecutor) SwapV2(ctx context.Context, inputAmount float64, pairPath []*protocol.UniswapV2Pair) error {
+	e.swaps++
+	e.amountIn = inputAmount
+	return nil
+}
+
+func (e *testExecutor) SwapBatch(ctx context.Context, swaps []*trader.Swap) error {
+	e.batches = append(e.batches, swaps)
+	return nil
+}
+
+func request(t *testing.T, h http.Handler, method, path, body string, value interface{}) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if w.Code == http.StatusOK && value != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), value); err != nil {
+			t.Fatalf("%s %s %s", path, err, w.Body)
+		}
+	}
+	return w.Code
+}
+
+func TestHandler(t *testing.T) {
+	var (
+		weth  = common.Address{0x41}
+		a     = common.Address{0x42}
+		b     = common.Address{0x43}
+		ether = math.Pow10(18)
+		pairs = []*protocol.UniswapV2Pair{
+			newTestPair(common.Address{0x51}, weth, a, 100*ether, 100*ether),
+			newTestPair(common.Address{0x52}, a, b, 100*ether, 200*ether),
+			newTestPair(common.Address{0x53}, b, weth, 100*ether, 100*ether),
+		}
+		keys     = []common.Address{pairs[0].Address, pairs[1].Address, pairs[2].Address}
+		executor = &testExecutor{}
+		now      = time.Unix(1700000000, 0)
+		store    = storage.NewStore[common.Address, *protocol.UniswapV2Pair]()
+	)
+	store.Store(keys, pairs)
+	arb := NewArbitrage(context.Background(), &config.Config{WETHAddress: weth}, executor, nil)
+	arb.SetClock(func() time.Time {
+		return now
+	})
+	h := arb.Handler()
+
+	if code := request(t, h, http.MethodGet, "/arbitrage/graph/"+a.Hex(), "", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("graph before search %d", code)
+	}
+	kept, _ := arb.prunePairs(store.Snapshot())
+	arb.graph.Store(&kept)
+	neighborhood := &Neighborhood{}
+	if code := request(t, h, http.MethodGet, "/arbitrage/graph/"+a.Hex(), "", neighborhood); code != http.StatusOK || len(neighborhood.Pairs) != 2 || len(neighborhood.Tokens) != 3 {
+		t.Fatalf("graph depth 1 %d %+v", code, neighborhood)
+	}
+	if request(t, h, http.MethodGet, "/arbitrage/graph/"+a.Hex()+"?depth=2", "", neighborhood); len(neighborhood.Pairs) != 3 {
+		t.Fatalf("graph depth 2 %+v", neighborhood)
+	}
+	if code := request(t, h, http.MethodGet, "/arbitrage/graph/"+a.Hex()+"?depth=9", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("graph depth 9 %d", code)
+	}
+
+	// the path is given from the last pair, as the graph search returns it
+	path := []common.Address{keys[2], keys[1], keys[0]}
+	trading := &tradingJSON{}
+	if code := request(t, h, http.MethodPost, "/arbitrage/trading/pause", "", trading); code != http.StatusOK || !trading.Paused {
+		t.Fatalf("pause %d", code)
+	}
+	arb.tryTrade(context.Background(), [][]common.Address{path}, store.Snapshot())
+	now = now.Add(tryCooldown)
+	request(t, h, http.MethodPost, "/arbitrage/trading/resume", "", trading)
+	if trading.Paused {
+		t.Fatalf("not resumed")
+	}
+	arb.tryTrade(context.Background(), [][]common.Address{path}, store.Snapshot())
+	arb.tryTrade(context.Background(), [][]common.Address{path}, store.Snapshot())
+	if executor.swaps != 1 {
+		t.Fatalf("swaps %d", executor.swaps)
+	}
+	cycles := []*Cycle{}
+	if request(t, h, http.MethodGet, "/arbitrage/cycles", "", &cycles); len(cycles) != 2 || cycles[0].Result != "traded" || cycles[1].Result != "paused" {
+		t.Fatalf("cycles %+v", cycles)
+	}
+	if cycles[0].Pairs[0] != keys[0] || len(cycles[0].Trade) == 0 || cycles[0].AmountOut <= cycles[0].AmountIn {
+		t.Fatalf("cycle %+v", cycles[0])
+	}
+
+	// a minimum above the profit leaves the cycle untraded
+	thresholds := &Thresholds{}
+	if code := request(t, h, http.MethodPost, "/arbitrage/thresholds", `{"minRecieve":1000}`, thresholds); code != http.StatusOK || thresholds.MinRecieve != 1000 {
+		t.Fatalf("thresholds %d %+v", code, thresholds)
+	}
+	if code := request(t, h, http.MethodPost, "/arbitrage/thresholds", `{"graphTargetSlippage":1}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("invalid thresholds %d", code)
+	}
+	now = now.Add(tryCooldown)
+	arb.tryTrade(context.Background(), [][]common.Address{path}, store.Snapshot())
+	if request(t, h, http.MethodGet, "/arbitrage/cycles?limit=1", "", &cycles); len(cycles) != 1 || cycles[0].Result != "unprofitable" || executor.swaps != 1 {
+		t.Fatalf("cycles %+v", cycles)
+	}
+}
+
+func TestInventorySizing(t *testing.T) {
+	var (
+		weth      = common.Address{0x41}
+		a         = common.Address{0x42}
+		b         = common.Address{0x43}
+		ether     = math.Pow10(18)
+		available = 0.5 * ether
+		pairs     = []*protocol.UniswapV2Pair{
+			newTestPair(common.Address{0x51}, weth, a, 100*ether, 100*ether),
+			newTestPair(common.Address{0x52}, a, b, 100*ether, 200*ether),
+			newTestPair(common.Address{0x53}, b, weth, 100*ether, 100*ether),
+		}
+		keys     = []common.Address{pairs[0].Address, pairs[1].Address, pairs[2].Address}
+		path     = []common.Address{keys[2], keys[1], keys[0]}
+		executor = &testExecutor{available: &available}
+		now      = time.Unix(1700000000, 0)
+		store    = storage.NewStore[common.Address, *protocol.UniswapV2Pair]()
+	)
+	store.Store(keys, pairs)
+	arb := NewArbitrage(context.Background(), &config.Config{WETHAddress: weth}, executor, nil)
+	arb.SetClock(func() time.Time {
+		return now
+	})
+	arb.tryTrade(context.Background(), [][]common.Address{path}, store.Snapshot())
+	if executor.swaps != 1 || executor.amountIn > available {
+		t.Fatalf("swaps %d amountIn %f", executor.swaps, executor.amountIn/ether)
+	}
+	// the min recieve of the config is no floor until set at runtime
+	if cycles := arb.RecentCycles(1); cycles[0].MinRecieve != 0 {
+		t.Fatalf("min recieve %f", cycles[0].MinRecieve)
+	}
+
+	// an empty wallet does not trade
+	available = 0
+	now = now.Add(tryCooldown)
+	arb.tryTrade(context.Background(), [][]common.Address{path}, store.Snapshot())
+	if cycles := arb.RecentCycles(1); executor.swaps != 1 || cycles[0].Result != "unfunded" {
+		t.Fatalf("swaps %d cycles %+v", executor.swaps, cycles[0])
+	}
+}
+
+func TestBatch(t *testing.T) {
+	var (
+		weth  = common.Address{0x41}
+		ether = math.Pow10(18)
+		pairs = []*protocol.UniswapV2Pair{
+			newTestPair(common.Address{0x61}, weth, common.Address{0x42}, 100*ether, 100*ether),
+			newTestPair(common.Address{0x62}, common.Address{0x42}, common.Address{0x43}, 100*ether, 200*ether),
+			newTestPair(common.Address{0x63}, common.Address{0x43}, weth, 100*ether, 100*ether),
+			newTestPair(common.Address{0x64}, weth, common.Address{0x44}, 100*ether, 100*ether),
+			newTestPair(common.Address{0x65}, common.Address{0x44}, common.Address{0x45}, 100*ether, 300*ether),
+			newTestPair(common.Address{0x66}, common.Address{0x45}, weth, 100*ether, 100*ether),
+		}
+		keys     = make([]common.Address, 0, len(pairs))
+		executor = &testExecutor{}
+	)
+	for _, pair := range pairs {
+		keys = append(keys, pair.Address)
+	}
+	protocol.UniswapV2Pairs.Store(keys, pairs)
+	arb := NewArbitrage(context.Background(), &config.Config{WETHAddress: weth, BatchCycles: 2, ReproducibleSearch: true}, executor, nil)
+
+	// the second cycle is searched without the pairs of the first one
+	paths, snapshot := arb.search()
+	if len(paths) != 2 {
+		t.Fatalf("paths %v", paths)
+	}
+	used := map[common.Address]bool{}
+	for _, path := range paths {
+		for _, pair := range path {
+			if used[pair] {
+				t.Fatalf("pair %s in both cycles %v", pair, paths)
+			}
+			used[pair] = true
+		}
+	}
+	arb.tryTrade(context.Background(), paths, snapshot)
+	if executor.swaps != 0 || len(executor.batches) != 1 || len(executor.batches[0]) != 2 {
+		t.Fatalf("swaps %d batches %v", executor.swaps, executor.batches)
+	}
+	cycles := arb.RecentCycles(2)
+	if cycles[0].Result != "traded" || cycles[1].Result != "traded" || cycles[0].Trade != cycles[1].Trade {
+		t.Fatalf("cycles %+v %+v", cycles[0], cycles[1])
+	}
+
+	// flash swaps are sent one cycle per tx
+	flash := NewArbitrage(context.Background(), &config.Config{WETHAddress: weth, BatchCycles: 2, FlashSwap: true}, executor, nil)
+	if flash.config.BatchCycles != 1 {
+		t.Fatalf("flash swap batch cycles %d", flash.config.BatchCycles)
+	}
+}
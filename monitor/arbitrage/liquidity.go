@@ -0,0 +1,147 @@
+package arbitrage
+
+import (
+	"math"
+	"monitor/protocol"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// DefaultTargetSlippage is the slippage the minimum trade size is measured at, 1%
+	DefaultTargetSlippage = 0.01
+
+	// priceHops bounds the path from a token to WETH
+	priceHops = 3
+)
+
+// tokenPrice values a token through its widest path to WETH
+type tokenPrice struct {
+	// price is the WETH wei of one token unit
+	price float64
+	// depth is the WETH wei of the thinnest reserve on the path
+	depth float64
+}
+
+// PriceIndex is the WETH value of the tokens reachable from WETH
+type PriceIndex map[common.Address]tokenPrice
+
+// NewPriceIndex prices every token through the path to WETH whose thinnest reserve is
+// the deepest, so a dust pair never sets the price of a token also traded in a deep pair
+func NewPriceIndex(weth common.Address, pairs []*protocol.UniswapV2Pair) PriceIndex {
+	index := PriceIndex{weth: {price: 1, depth: math.Inf(1)}}
+	relax := func(from, to common.Address, reserveFrom, reserveTo float64) bool {
+		known, ok := index[from]
+		if !ok {
+			return false
+		}
+		depth := math.Min(known.depth, reserveFrom*known.price)
+		if old, ok := index[to]; ok && old.depth >= depth {
+			return false
+		}
+		index[to] = tokenPrice{
+			price: known.price * reserveFrom / reserveTo,
+			depth: depth,
+		}
+		return true
+	}
+	for i := 0; i < priceHops; i++ {
+		changed := false
+		for _, pair := range pairs {
+			r0, _ := pair.Reserve0.Float64()
+			r1, _ := pair.Reserve1.Float64()
+			if r0 <= 0 || r1 <= 0 {
+				continue
+			}
+			changed = relax(pair.Token0, pair.Token1, r0, r1) || changed
+			changed = relax(pair.Token1, pair.Token0, r1, r0) || changed
+		}
+		if !changed {
+			break
+		}
+	}
+	return index
+}
+
+// Value returns the WETH wei of amount units of token
+func (p PriceIndex) Value(token common.Address, amount float64) (float64, bool) {
+	known, ok := p[token]
+	if !ok {
+		return 0, false
+	}
+	return amount * known.price, true
+}
+
+// PruneStats counts the pairs left out of the last graph by reason
+type PruneStats struct {
+	Pairs int `json:"pairs"`
+	// Invalid pairs have an error, an unknown fee or an empty reserve
+	Invalid int `json:"invalid"`
+	// Excluded pairs hold a fee on transfer or rebasing token
+	Excluded int `json:"excluded"`
+	// Screened pairs are denied or risky
+	Screened int `json:"screened"`
+	// Unpriced pairs have a token without a path to WETH
+	Unpriced int `json:"unpriced"`
+	// LowLiquidity pairs have a side under the minimum WETH reserve
+	LowLiquidity int `json:"lowLiquidity"`
+	// LowDepth pairs can not take the minimum trade at the target slippage
+	LowDepth  int       `json:"lowDepth"`
+	Kept      int       `json:"kept"`
+	Tokens    int       `json:"tokens"`
+	Duration  float64   `json:"durationMs"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// liquidityFilter prices the pairs and checks the liquidity thresholds, the
+// pairs are kept as they are when no threshold is set
+func (a *Arbitrage) liquidityFilter(pairs []*protocol.UniswapV2Pair, stats *PruneStats) []*protocol.UniswapV2Pair {
+	var (
+		thresholds   = a.Thresholds()
+		minLiquidity = thresholds.GraphMinLiquidity * math.Pow10(18)
+		minTrade     = thresholds.GraphMinTradeSize * math.Pow10(18)
+		slippage     = thresholds.GraphTargetSlippage
+	)
+	if minLiquidity <= 0 && minTrade <= 0 {
+		return pairs
+	}
+	if slippage <= 0 {
+		slippage = DefaultTargetSlippage
+	}
+	var (
+		index = NewPriceIndex(a.config.WETHAddress, pairs)
+		kept  = make([]*protocol.UniswapV2Pair, 0, len(pairs))
+	)
+	for _, pair := range pairs {
+		r0, _ := pair.Reserve0.Float64()
+		r1, _ := pair.Reserve1.Float64()
+		v0, ok0 := index.Value(pair.Token0, r0)
+		v1, ok1 := index.Value(pair.Token1, r1)
+		if !ok0 || !ok1 {
+			stats.Unpriced++
+			continue
+		}
+		side := math.Min(v0, v1)
+		if side < minLiquidity {
+			stats.LowLiquidity++
+			continue
+		}
+		if minTrade > 0 && maxTradeAtSlippage(side, pair.Fee, slippage) < minTrade {
+			stats.LowDepth++
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	return kept
+}
+
+// maxTradeAtSlippage is the largest amount sold into reserve getting at most slippage
+// below the spot price, fee included: x = R(s-f)/((1-s)(1-f))
+func maxTradeAtSlippage(reserve float64, fee int64, slippage float64) float64 {
+	f := float64(fee) / protocol.FeeBase
+	if slippage <= f || slippage >= 1 {
+		return 0
+	}
+	return reserve * (slippage - f) / ((1 - slippage) * (1 - f))
+}
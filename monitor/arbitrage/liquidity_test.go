@@ -0,0 +1,120 @@
+package arbitrage
+
+import (
+	"context"
+	"math"
+	"math/big"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/storage"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func newTestPair(addr, token0, token1 common.Address, reserve0, reserve1 float64) *protocol.UniswapV2Pair {
+	r0, _ := big.NewFloat(reserve0).Int(nil)
+	r1, _ := big.NewFloat(reserve1).Int(nil)
+	return &protocol.UniswapV2Pair{
+		Address:  addr,
+		Token0:   token0,
+		Token1:   token1,
+		Reserve0: r0,
+		Reserve1: r1,
+		Fee:      30,
+	}
+}
+
+func TestPriceIndex(t *testing.T) {
+	var (
+		weth  = common.Address{0x01}
+		usd   = common.Address{0x02}
+		other = common.Address{0x03}
+		dust  = common.Address{0x04}
+		ether = math.Pow10(18)
+	)
+	pairs := []*protocol.UniswapV2Pair{
+		// 1 usd unit is 1/2000 weth wei
+		newTestPair(common.Address{0x11}, weth, usd, 100*ether, 200000*ether),
+		// a dust pair quoting usd at 1 weth
+		newTestPair(common.Address{0x12}, usd, weth, 1e6, 1e6),
+		// other is priced through usd only
+		newTestPair(common.Address{0x13}, other, usd, 1000*ether, 2000*ether),
+		newTestPair(common.Address{0x14}, dust, usd, 1e3, 1e3),
+	}
+	index := NewPriceIndex(weth, pairs)
+	if value, _ := index.Value(usd, 2000*ether); math.Abs(value-ether) > 1e6 {
+		t.Fatalf("usd value %f", value)
+	}
+	if value, _ := index.Value(other, ether); math.Abs(value-ether/1000) > 1e6 {
+		t.Fatalf("other value %f", value)
+	}
+	if depth := index[other].depth; math.Abs(depth-ether) > 1e6 {
+		t.Fatalf("other depth %f", depth)
+	}
+	if _, ok := index.Value(common.Address{0x05}, 1); ok {
+		t.Fatalf("unreachable token priced")
+	}
+}
+
+func TestMaxTradeAtSlippage(t *testing.T) {
+	reserve := 1000.0
+	amount := maxTradeAtSlippage(reserve, 30, 0.01)
+	// selling amount gets exactly 1% under the spot price
+	out := amount * 0.997 * reserve / (reserve + amount*0.997)
+	if math.Abs(out/amount-0.99) > 1e-9 {
+		t.Fatalf("slippage %f", 1-out/amount)
+	}
+	if maxTradeAtSlippage(reserve, 30, 0.002) != 0 {
+		t.Fatalf("slippage under the fee")
+	}
+}
+
+func TestPrunePairs(t *testing.T) {
+	var (
+		weth    = common.Address{0x21}
+		deep    = common.Address{0x22}
+		shallow = common.Address{0x23}
+		orphan  = common.Address{0x24}
+		ether   = math.Pow10(18)
+		pairs   = []*protocol.UniswapV2Pair{
+			newTestPair(common.Address{0x31}, weth, deep, 10*ether, 10*ether),
+			newTestPair(common.Address{0x32}, weth, shallow, 0.05*ether, 10*ether),
+			newTestPair(common.Address{0x33}, orphan, common.Address{0x25}, ether, ether),
+			newTestPair(common.Address{0x34}, weth, orphan, 0, ether),
+		}
+		keys = []common.Address{}
+	)
+	for _, pair := range pairs {
+		keys = append(keys, pair.Address)
+	}
+	store := storage.NewStore[common.Address, *protocol.UniswapV2Pair]()
+	store.Store(keys, pairs)
+	a := NewArbitrage(context.Background(), &config.Config{
+		WETHAddress:       weth,
+		GraphMinLiquidity: 0.1,
+	}, nil, nil)
+	kept, stats := a.prunePairs(store.Snapshot())
+	if len(kept) != 1 || kept[0].Address != pairs[0].Address {
+		t.Fatalf("kept %d", len(kept))
+	}
+	if stats.Pairs != 4 || stats.Invalid != 1 || stats.Unpriced != 1 || stats.LowLiquidity != 1 || stats.Kept != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	// 10 ether sides take about 0.07 ether at 1% slippage
+	a.SetThresholds(Thresholds{GraphMinTradeSize: 0.05})
+	if kept, stats = a.prunePairs(store.Snapshot()); len(kept) != 1 || stats.LowDepth != 1 {
+		t.Fatalf("kept %d stats %+v", len(kept), stats)
+	}
+	a.SetThresholds(Thresholds{GraphMinTradeSize: 0.1})
+	if kept, stats = a.prunePairs(store.Snapshot()); len(kept) != 0 || stats.LowDepth != 2 {
+		t.Fatalf("kept %d stats %+v", len(kept), stats)
+	}
+
+	// no threshold keeps every valid pair
+	a.SetThresholds(Thresholds{})
+	if kept, _ = a.prunePairs(store.Snapshot()); len(kept) != 3 {
+		t.Fatalf("kept %d", len(kept))
+	}
+}
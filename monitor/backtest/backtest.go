@@ -0,0 +1,106 @@
+package backtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"monitor/action"
+	"monitor/arbitrage"
+	"monitor/config"
+	"monitor/onchainmonitor"
+	"monitor/utils"
+	"time"
+)
+
+// DefaultBlockTime moves the simulated clock per block
+const DefaultBlockTime = 2 * time.Second
+
+// Backtest replays the logs of a source through the monitor actions and the arbitrage in
+// order, the arbitrage runs once after every batch on a clock moved by the batches and
+// its trades are recorded by the simulated executor
+type Backtest struct {
+	config    *config.Config
+	source    Source
+	monitor   *onchainmonitor.EVMMonitor
+	arbitrage *arbitrage.Arbitrage
+	executor  *Executor
+	blockTime time.Duration
+	clock     time.Time
+}
+
+func NewBacktest(ctx context.Context, conf *config.Config, source Source, executor *Executor, blockTime time.Duration) *Backtest {
+	if blockTime <= 0 {
+		blockTime = DefaultBlockTime
+	}
+	// a backtest takes the same decisions every run
+	conf.ReproducibleSearch = true
+	b := &Backtest{
+		config:    conf,
+		source:    source,
+		monitor:   onchainmonitor.NewEVMMonitor(ctx, conf, []action.Action{action.NewProtocolData(ctx, conf)}),
+		arbitrage: arbitrage.NewArbitrage(ctx, conf, executor, nil),
+		executor:  executor,
+		blockTime: blockTime,
+	}
+	b.arbitrage.SetClock(func() time.Time {
+		return b.clock
+	})
+	return b
+}
+
+// Run replays the source to its end, the report covers the blocks replayed when it fails
+func (b *Backtest) Run(ctx context.Context) (*Report, error) {
+	var (
+		startTime = time.Now()
+		report    = &Report{}
+		lastBlock uint64
+	)
+	defer func() {
+		report.addOpportunities(b.executor.Opportunities())
+		report.Duration = time.Since(startTime)
+	}()
+	for {
+		batch, err := b.source.Next(ctx)
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, fmt.Errorf("read logs fail %s", err)
+		}
+		if len(batch.Logs) == 0 {
+			continue
+		}
+		blockNumber := batch.Logs[len(batch.Logs)-1].BlockNumber
+		if report.FromBlock == 0 || batch.Logs[0].BlockNumber < report.FromBlock {
+			report.FromBlock = batch.Logs[0].BlockNumber
+		}
+		if blockNumber != lastBlock {
+			report.Blocks++
+			lastBlock = blockNumber
+		}
+		report.ToBlock = blockNumber
+		report.Batches++
+		report.Logs += len(batch.Logs)
+
+		b.clock = batch.Time
+		if b.clock.IsZero() {
+			b.clock = time.Unix(0, 0).Add(time.Duration(blockNumber) * b.blockTime)
+		}
+		if batch.GasPrice > 0 {
+			b.executor.SetGasPrice(batch.GasPrice, batch.ETHGasPrice)
+		}
+		if err := b.monitor.HandleLogs(ctx, batch.Logs); err != nil {
+			report.LogErrors++
+			utils.Warnf("handle logs of block %d fail %s", blockNumber, err)
+			continue
+		}
+		b.executor.setBlock(blockNumber, b.clock)
+		b.arbitrage.Step(ctx)
+	}
+}
+
+func floatToInt(value float64) *big.Int {
+	ret, _ := big.NewFloat(value).Int(nil)
+	return ret
+}
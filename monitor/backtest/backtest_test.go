@@ -0,0 +1,125 @@
+package backtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/big"
+	"monitor/config"
+	"monitor/protocol"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func newSyncLog(pair common.Address, blockNumber uint64, index uint, reserve0, reserve1 *big.Int) *types.Log {
+	return &types.Log{
+		Address:     pair,
+		Topics:      []common.Hash{protocol.UniswapV2PairEventSyncSign},
+		Data:        append(common.LeftPadBytes(reserve0.Bytes(), 32), common.LeftPadBytes(reserve1.Bytes(), 32)...),
+		BlockNumber: blockNumber,
+		Index:       index,
+	}
+}
+
+func encodeLogs(t *testing.T, logs []*types.Log) []byte {
+	body := []byte{}
+	for _, log := range logs {
+		line, err := json.Marshal(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = append(append(body, line...), '\n')
+	}
+	return body
+}
+
+func TestFileSource(t *testing.T) {
+	pair := common.Address{0x01}
+	logs := []*types.Log{
+		newSyncLog(pair, 12, 0, big.NewInt(1), big.NewInt(1)),
+		newSyncLog(pair, 10, 3, big.NewInt(1), big.NewInt(1)),
+		newSyncLog(pair, 10, 1, big.NewInt(1), big.NewInt(1)),
+		newSyncLog(pair, 30, 0, big.NewInt(1), big.NewInt(1)),
+		newSyncLog(pair, 5, 0, big.NewInt(1), big.NewInt(1)),
+	}
+	source, err := readFileSource(bytes.NewReader(encodeLogs(t, logs)), 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	batch, err := source.Next(ctx)
+	if err != nil || len(batch.Logs) != 2 || batch.Logs[0].BlockNumber != 10 || batch.Logs[0].Index != 1 || batch.Logs[1].Index != 3 {
+		t.Fatalf("first block %+v %v", batch, err)
+	}
+	batch, err = source.Next(ctx)
+	if err != nil || len(batch.Logs) != 1 || batch.Logs[0].BlockNumber != 12 {
+		t.Fatalf("second block %+v %v", batch, err)
+	}
+	if _, err = source.Next(ctx); err != io.EOF {
+		t.Fatalf("end %v", err)
+	}
+	if _, err := readFileSource(bytes.NewReader([]byte("{")), 0, 0); err == nil {
+		t.Fatalf("broken line read")
+	}
+}
+
+func TestBacktestRun(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		weth  = common.Address{0xee}
+		a     = common.Address{0xaa}
+		b     = common.Address{0xbb}
+		ether = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+		units = func(n int64) *big.Int {
+			return new(big.Int).Mul(big.NewInt(n), ether)
+		}
+		pairs = []*protocol.UniswapV2Pair{
+			{Address: common.Address{0x01}, Token0: weth, Token1: a},
+			{Address: common.Address{0x02}, Token0: a, Token1: b},
+			{Address: common.Address{0x03}, Token0: b, Token1: weth},
+		}
+		keys = []common.Address{}
+	)
+	for _, pair := range pairs {
+		pair.Fee = 30
+		pair.StateFromLogUpdate = &protocol.StateFromLogUpdate{}
+		keys = append(keys, pair.Address)
+	}
+	protocol.UniswapV2Pairs.Store(keys, pairs)
+
+	logs := []*types.Log{
+		// balanced prices, no cycle
+		newSyncLog(pairs[0].Address, 100, 0, units(100), units(100)),
+		newSyncLog(pairs[1].Address, 100, 1, units(100), units(100)),
+		newSyncLog(pairs[2].Address, 100, 2, units(100), units(100)),
+		// b is cheap in the a/b pair
+		newSyncLog(pairs[1].Address, 101, 0, units(100), units(200)),
+	}
+	source, err := readFileSource(bytes.NewReader(encodeLogs(t, logs)), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Config{WETHAddress: weth}
+	executor := NewExecutor(ctx, conf)
+	report, err := NewBacktest(ctx, conf, source, executor, time.Second).Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Blocks != 2 || report.Batches != 2 || report.Logs != 4 || report.FromBlock != 100 || report.ToBlock != 101 {
+		t.Fatalf("report %+v", report)
+	}
+	if len(report.Opportunities) != 1 || report.Profitable != 1 {
+		t.Fatalf("opportunities %d", len(report.Opportunities))
+	}
+	one := report.Opportunities[0]
+	if one.BlockNumber != 101 || one.Profit <= 0 || len(one.Pairs) != 3 || !one.Time.Equal(time.Unix(101, 0)) {
+		t.Fatalf("opportunity %+v", one)
+	}
+	if report.Summary() == "" {
+		t.Fatalf("empty summary")
+	}
+}
@@ -0,0 +1,115 @@
+package backtest
+
+import (
+	"context"
+	"math"
+	"monitor/arbitrage"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/trader"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var _ arbitrage.Executor = &Executor{}
+
+// Opportunity is a trade the arbitrage would have sent, amounts are in WETH wei
+type Opportunity struct {
+	BlockNumber uint64           `json:"blockNumber"`
+	Time        time.Time        `json:"time"`
+	AmountIn    float64          `json:"amountIn"`
+	AmountOut   float64          `json:"amountOut"`
+	Fee         float64          `json:"fee"`
+	Profit      float64          `json:"profit"`
+	Pairs       []common.Address `json:"pairs"`
+	Path        string           `json:"path"`
+}
+
+// Executor records the trades instead of sending them, the fee is estimated by the
+// trader fee model at the gas prices set, the reserves are left to the next logs
+type Executor struct {
+	config *config.Config
+	fees   *trader.Trader
+
+	blockNumber   uint64
+	blockTime     time.Time
+	opportunities []*Opportunity
+	lock          sync.Mutex
+}
+
+func NewExecutor(ctx context.Context, conf *config.Config) *Executor {
+	return &Executor{
+		config: conf,
+		fees:   trader.NewTrader(ctx, conf),
+	}
+}
+
+// SetGasPrice sets the gas prices of the fee model in wei
+func (e *Executor) SetGasPrice(gasPrice, ethGasPrice float64) {
+	e.fees.SetGasPrice(floatToInt(gasPrice), floatToInt(ethGasPrice))
+}
+
+func (e *Executor) EstimateFee(length int) float64 {
+	return e.fees.EstimateFee(length)
+}
+
+// MinProfit is the min profit of the trader strategy at the gas prices set
+func (e *Executor) MinProfit(length int) float64 {
+	return e.fees.MinProfit(length)
+}
+
+// Available does not limit the trades replayed
+func (e *Executor) Available() float64 {
+	return math.Inf(1)
+}
+
+func (e *Executor) SwapV2(ctx context.Context, inputAmount float64, pairPath []*protocol.UniswapV2Pair) error {
+	var (
+		weth      = e.config.WETHAddress
+		amountOut = protocol.GetAmountsOut(weth, inputAmount, pairPath)
+		fee       = e.EstimateFee(len(pairPath))
+		pairs     = make([]common.Address, 0, len(pairPath))
+	)
+	for _, pair := range pairPath {
+		pairs = append(pairs, pair.Address)
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.opportunities = append(e.opportunities, &Opportunity{
+		BlockNumber: e.blockNumber,
+		Time:        e.blockTime,
+		AmountIn:    inputAmount,
+		AmountOut:   amountOut,
+		Fee:         fee,
+		Profit:      amountOut - inputAmount - fee,
+		Pairs:       pairs,
+		Path:        protocol.FormatPath(weth, pairPath),
+	})
+	return nil
+}
+
+// SwapBatch records every cycle of the batch as an opportunity of its own
+func (e *Executor) SwapBatch(ctx context.Context, swaps []*trader.Swap) error {
+	for _, swap := range swaps {
+		if err := e.SwapV2(ctx, swap.AmountIn, swap.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Executor) setBlock(blockNumber uint64, blockTime time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.blockNumber = blockNumber
+	e.blockTime = blockTime
+}
+
+// Opportunities returns the trades recorded so far
+func (e *Executor) Opportunities() []*Opportunity {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]*Opportunity{}, e.opportunities...)
+}
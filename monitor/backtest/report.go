@@ -0,0 +1,91 @@
+package backtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportTop is the number of opportunities and paths listed by the summary
+const reportTop = 10
+
+// Report sums up a backtest run, amounts are in WETH wei
+type Report struct {
+	FromBlock     uint64         `json:"fromBlock"`
+	ToBlock       uint64         `json:"toBlock"`
+	Blocks        int            `json:"blocks"`
+	Batches       int            `json:"batches"`
+	Logs          int            `json:"logs"`
+	LogErrors     int            `json:"logErrors"`
+	Opportunities []*Opportunity `json:"opportunities"`
+	Profitable    int            `json:"profitable"`
+	Profit        float64        `json:"profit"`
+	Duration      time.Duration  `json:"duration"`
+}
+
+func (r *Report) addOpportunities(opportunities []*Opportunity) {
+	r.Opportunities = opportunities
+	r.Profitable = 0
+	r.Profit = 0
+	for _, one := range opportunities {
+		if one.Profit > 0 {
+			r.Profitable++
+		}
+		r.Profit += one.Profit
+	}
+}
+
+// Summary lists the totals, the best opportunities and the paths taken the most
+func (r *Report) Summary() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "blocks %d to %d replayed %d batches %d logs %d failed %d in %s\n", r.FromBlock, r.ToBlock, r.Blocks, r.Batches, r.Logs, r.LogErrors, r.Duration)
+	fmt.Fprintf(b, "opportunities %d profitable %d profit %f ether\n", len(r.Opportunities), r.Profitable, r.Profit/math.Pow10(18))
+
+	best := append([]*Opportunity{}, r.Opportunities...)
+	sort.SliceStable(best, func(i, j int) bool {
+		return best[i].Profit > best[j].Profit
+	})
+	if len(best) > reportTop {
+		best = best[:reportTop]
+	}
+	for _, one := range best {
+		fmt.Fprintf(b, "  block %d in %f out %f fee %f profit %f path %s\n", one.BlockNumber,
+			one.AmountIn/math.Pow10(18), one.AmountOut/math.Pow10(18), one.Fee/math.Pow10(18), one.Profit/math.Pow10(18), one.Path)
+	}
+
+	var (
+		counts = map[string]int{}
+		paths  = []string{}
+	)
+	for _, one := range r.Opportunities {
+		if counts[one.Path] == 0 {
+			paths = append(paths, one.Path)
+		}
+		counts[one.Path]++
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return counts[paths[i]] > counts[paths[j]]
+	})
+	if len(paths) > reportTop {
+		paths = paths[:reportTop]
+	}
+	for _, path := range paths {
+		fmt.Fprintf(b, "  path %s taken %d\n", path, counts[path])
+	}
+	return b.String()
+}
+
+func (r *Report) WriteFile(filePath string) error {
+	body, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal report fail %s", err)
+	}
+	if err := os.WriteFile(filePath, body, 0644); err != nil {
+		return fmt.Errorf("write report fail %s", err)
+	}
+	return nil
+}
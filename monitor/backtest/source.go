@@ -0,0 +1,182 @@
+package backtest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"monitor/client"
+	"monitor/config"
+	"monitor/protocol"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// DefaultPageBlocks is the block range of one eth_getLogs call
+const DefaultPageBlocks = uint64(500)
+
+// Batch is the logs handled at once, a block of logs or a recorded batch
+type Batch struct {
+	Logs []*types.Log
+	// Time and the gas prices are set by recordings, the clock is moved by the blocks
+	// and the gas prices are left as they are otherwise
+	Time        time.Time
+	GasPrice    float64
+	ETHGasPrice float64
+}
+
+// Source yields the batches of logs in order, io.EOF is returned after the last one
+type Source interface {
+	Next(ctx context.Context) (*Batch, error)
+}
+
+// sortLogs orders the logs as they were emitted
+func sortLogs(logs []*types.Log) {
+	sort.SliceStable(logs, func(i, j int) bool {
+		if logs[i].BlockNumber != logs[j].BlockNumber {
+			return logs[i].BlockNumber < logs[j].BlockNumber
+		}
+		return logs[i].Index < logs[j].Index
+	})
+}
+
+// nextBlock cuts the logs of the first block off sorted logs
+func nextBlock(logs []*types.Log) ([]*types.Log, []*types.Log) {
+	if len(logs) == 0 {
+		return nil, nil
+	}
+	end := 1
+	for end < len(logs) && logs[end].BlockNumber == logs[0].BlockNumber {
+		end++
+	}
+	return logs[:end], logs[end:]
+}
+
+// FileSource reads recorded logs, one json encoded log per line, the logs out of
+// the block range are skipped, a zero to block reads to the end
+type FileSource struct {
+	logs []*types.Log
+}
+
+func NewFileSource(filePath string, from, to uint64) (*FileSource, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("open file fail %s", err)
+	}
+	defer file.Close()
+	return readFileSource(file, from, to)
+}
+
+func readFileSource(r io.Reader, from, to uint64) (*FileSource, error) {
+	var (
+		logs    = []*types.Log{}
+		scanner = bufio.NewScanner(r)
+		line    = 0
+	)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		log := &types.Log{}
+		if err := json.Unmarshal(scanner.Bytes(), log); err != nil {
+			return nil, fmt.Errorf("decode log at line %d fail %s", line, err)
+		}
+		if log.Removed || log.BlockNumber < from || (to > 0 && log.BlockNumber > to) {
+			continue
+		}
+		logs = append(logs, log)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read file fail %s", err)
+	}
+	sortLogs(logs)
+	return &FileSource{logs: logs}, nil
+}
+
+func (f *FileSource) Next(ctx context.Context) (*Batch, error) {
+	if len(f.logs) == 0 {
+		return nil, io.EOF
+	}
+	var block []*types.Log
+	block, f.logs = nextBlock(f.logs)
+	return &Batch{Logs: block}, nil
+}
+
+// NodeSource fetches the logs the monitor subscribes to from a node by pages of blocks,
+// an archive node or a local stand-in serves old ranges
+type NodeSource struct {
+	config     *config.Config
+	next       uint64
+	to         uint64
+	pageBlocks uint64
+	logs       []*types.Log
+}
+
+func NewNodeSource(conf *config.Config, from, to, pageBlocks uint64) *NodeSource {
+	if pageBlocks == 0 {
+		pageBlocks = DefaultPageBlocks
+	}
+	return &NodeSource{
+		config:     conf,
+		next:       from,
+		to:         to,
+		pageBlocks: pageBlocks,
+	}
+}
+
+func (n *NodeSource) Next(ctx context.Context) (*Batch, error) {
+	for len(n.logs) == 0 {
+		if n.next > n.to {
+			return nil, io.EOF
+		}
+		if err := n.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var block []*types.Log
+	block, n.logs = nextBlock(n.logs)
+	return &Batch{Logs: block}, nil
+}
+
+func (n *NodeSource) fetch(ctx context.Context) error {
+	cli, err := client.GetETHClient(ctx, n.config.Node, n.config.MulticallAddress)
+	if err != nil {
+		return fmt.Errorf("get eth client fail %s", err)
+	}
+	to := n.next + n.pageBlocks - 1
+	if to > n.to {
+		to = n.to
+	}
+	logs, err := cli.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(n.next),
+		ToBlock:   new(big.Int).SetUint64(to),
+		Topics: [][]common.Hash{
+			{
+				protocol.UniswapV2PairEventSyncSign,
+				protocol.UniswapV2PairEventSwapSign,
+				protocol.UniswapV2FactoryEventPairCreatedSign,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("filter logs from %d to %d fail %s", n.next, to, err)
+	}
+	n.logs = make([]*types.Log, 0, len(logs))
+	for i := range logs {
+		if !logs[i].Removed {
+			n.logs = append(n.logs, &logs[i])
+		}
+	}
+	sortLogs(n.logs)
+	n.next = to + 1
+	return nil
+}
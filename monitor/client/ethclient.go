@@ -3,22 +3,67 @@ package client
 import (
 	"context"
 	"fmt"
+	"math/big"
 	"monitor/abi"
+	"monitor/metrics"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethclient/gethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type ETHClient struct {
 	*ethclient.Client
 
 	multicallAddress common.Address
+	limiter          *RateLimiter
+	// endpoint labels the metrics of the node
+	endpoint string
 }
 
-var ETHClientMap = map[string]*ETHClient{}
+var (
+	ETHClientMap = map[string]*ETHClient{}
+
+	// multicallHook is set by SetMulticallHook while the multicalls read it
+	multicallHook atomic.Pointer[MulticallHook]
+
+	multicallDuration = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "client",
+		Name:      "multicall_duration_seconds",
+		Help:      "Latency of the multicalls by endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, "endpoint")
+	multicallTotal = metrics.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "client",
+		Name:      "multicalls_total",
+		Help:      "Multicalls by endpoint and result, ok or error.",
+	}, "endpoint", "result")
+)
+
+// MulticallHook sees the multicall results read from the node, replays serve them
+// from a recording instead of the node
+type MulticallHook interface {
+	// Replay returns the results of the calls, ok false reads them from the node
+	Replay(blockNumber *big.Int, calls []*ViewCall) (results map[string]*abi.Multicall2Result, ok bool, err error)
+	Record(blockNumber *big.Int, calls []*ViewCall, results map[string]*abi.Multicall2Result)
+}
+
+// SetMulticallHook installs the hook of every client, nil removes it
+func SetMulticallHook(hook MulticallHook) {
+	if hook == nil {
+		multicallHook.Store(nil)
+		return
+	}
+	multicallHook.Store(&hook)
+}
 
 func GetETHClient(ctx context.Context, node string, multicallAddress common.Address) (*ETHClient, error) {
 	if ETHClientMap[node] != nil {
@@ -28,7 +73,7 @@ func GetETHClient(ctx context.Context, node string, multicallAddress common.Addr
 	if err != nil {
 		return nil, fmt.Errorf("eth client dial fail %s", err)
 	}
-	ETHClientMap[node] = &ETHClient{cli, multicallAddress}
+	ETHClientMap[node] = &ETHClient{cli, multicallAddress, getRateLimiter(node), metrics.Endpoint(node)}
 	return ETHClientMap[node], nil
 }
 
@@ -39,20 +84,42 @@ type ViewCall struct {
 }
 
 func (e *ETHClient) MultiViewCall(ctx context.Context, opt *bind.TransactOpts, calls []*ViewCall) (map[string]*abi.Multicall2Result, error) {
+	return e.MultiViewCallAt(ctx, nil, calls)
+}
+
+// MultiViewCallAt reads the calls at blockNumber, the latest block when it is nil
+func (e *ETHClient) MultiViewCallAt(ctx context.Context, blockNumber *big.Int, calls []*ViewCall) (map[string]*abi.Multicall2Result, error) {
 	if len(calls) == 0 {
 		return map[string]*abi.Multicall2Result{}, nil
 	}
+	var hook MulticallHook
+	if stored := multicallHook.Load(); stored != nil {
+		hook = *stored
+	}
+	if hook != nil {
+		results, ok, err := hook.Replay(blockNumber, calls)
+		if err != nil {
+			return nil, fmt.Errorf("replay multicall fail %s", err)
+		}
+		if ok {
+			return results, nil
+		}
+	}
 	input, err := abi.Multicall2ABIInstance.Methods["tryAggregate"].Inputs.Pack(false, NewViewMulticall2Calls(calls))
 	if err != nil {
 		return nil, fmt.Errorf("pack input fail %s", err)
 	}
-	resBody, err := e.Client.CallContract(ctx, ethereum.CallMsg{
+	startTime := time.Now()
+	resBody, err := e.CallContract(ctx, ethereum.CallMsg{
 		To:   &e.multicallAddress,
 		Data: append(abi.Multicall2ABIInstance.Methods["tryAggregate"].ID, input...),
-	}, nil)
+	}, blockNumber)
+	multicallDuration.WithLabelValues(e.endpoint).Observe(time.Since(startTime).Seconds())
 	if err != nil {
+		multicallTotal.WithLabelValues(e.endpoint, "error").Inc()
 		return nil, fmt.Errorf("call contract fail %s", err)
 	}
+	multicallTotal.WithLabelValues(e.endpoint, "ok").Inc()
 	res, err := abi.Multicall2ABIInstance.Methods["tryAggregate"].Outputs.Unpack(resBody)
 	if err != nil {
 		return nil, fmt.Errorf("unpack result fail %s", err)
@@ -77,6 +144,9 @@ func (e *ETHClient) MultiViewCall(ctx context.Context, opt *bind.TransactOpts, c
 			ReturnData: one.ReturnData,
 		}
 	}
+	if hook != nil {
+		hook.Record(blockNumber, calls, ret)
+	}
 	return ret, nil
 }
 
@@ -94,13 +164,30 @@ func NewViewMulticall2Calls(calls []*ViewCall) []abi.Multicall2Call {
 
 func (e *ETHClient) EstimateGasLast(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
 	var hex hexutil.Uint64
-	err := e.Client.Client().CallContext(ctx, &hex, "eth_estimateGas", toCallArg(msg), "latest")
+	err := e.limiter.Wait(ctx, "eth_estimateGas")
+	if err != nil {
+		return 0, err
+	}
+	err = e.Client.Client().CallContext(ctx, &hex, "eth_estimateGas", toCallArg(msg), "latest")
 	if err != nil {
 		return 0, err
 	}
 	return uint64(hex), nil
 }
 
+// CallContractWithCode runs the call with the code of the accounts replaced, the chain is not changed
+func (e *ETHClient) CallContractWithCode(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int, codes map[common.Address][]byte) ([]byte, error) {
+	err := e.limiter.Wait(ctx, "eth_call")
+	if err != nil {
+		return nil, err
+	}
+	overrides := make(map[common.Address]gethclient.OverrideAccount, len(codes))
+	for addr, code := range codes {
+		overrides[addr] = gethclient.OverrideAccount{Code: code}
+	}
+	return gethclient.New(e.Client.Client()).CallContract(ctx, msg, blockNumber, &overrides)
+}
+
 func toCallArg(msg ethereum.CallMsg) interface{} {
 	arg := map[string]interface{}{
 		"from": msg.From,
@@ -120,3 +207,118 @@ func toCallArg(msg ethereum.CallMsg) interface{} {
 	}
 	return arg
 }
+
+func (e *ETHClient) ChainID(ctx context.Context) (*big.Int, error) {
+	if err := e.limiter.Wait(ctx, "eth_chainId"); err != nil {
+		return nil, err
+	}
+	return e.Client.ChainID(ctx)
+}
+
+func (e *ETHClient) BlockNumber(ctx context.Context) (uint64, error) {
+	if err := e.limiter.Wait(ctx, "eth_blockNumber"); err != nil {
+		return 0, err
+	}
+	return e.Client.BlockNumber(ctx)
+}
+
+func (e *ETHClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	if err := e.limiter.Wait(ctx, "eth_gasPrice"); err != nil {
+		return nil, err
+	}
+	return e.Client.SuggestGasPrice(ctx)
+}
+
+func (e *ETHClient) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if err := e.limiter.Wait(ctx, "eth_call"); err != nil {
+		return nil, err
+	}
+	return e.Client.CallContract(ctx, msg, blockNumber)
+}
+
+func (e *ETHClient) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
+	if err := e.limiter.Wait(ctx, "eth_getCode"); err != nil {
+		return nil, err
+	}
+	return e.Client.CodeAt(ctx, account, blockNumber)
+}
+
+func (e *ETHClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if err := e.limiter.Wait(ctx, "eth_getBlockByNumber"); err != nil {
+		return nil, err
+	}
+	return e.Client.HeaderByNumber(ctx, number)
+}
+
+func (e *ETHClient) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	if err := e.limiter.Wait(ctx, "eth_getTransactionReceipt"); err != nil {
+		return nil, err
+	}
+	return e.Client.TransactionReceipt(ctx, txHash)
+}
+
+func (e *ETHClient) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	if err := e.limiter.Wait(ctx, "eth_getTransactionByHash"); err != nil {
+		return nil, false, err
+	}
+	return e.Client.TransactionByHash(ctx, hash)
+}
+
+// BatchCallContext sends b in one rpc request, every call of it waits for the rate limiter
+func (e *ETHClient) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	for _, elem := range b {
+		if err := e.limiter.Wait(ctx, elem.Method); err != nil {
+			return err
+		}
+	}
+	return e.Client.Client().BatchCallContext(ctx, b)
+}
+
+func (e *ETHClient) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	if err := e.limiter.Wait(ctx, "eth_estimateGas"); err != nil {
+		return 0, err
+	}
+	return e.Client.EstimateGas(ctx, msg)
+}
+
+func (e *ETHClient) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	if err := e.limiter.Wait(ctx, "eth_getTransactionCount"); err != nil {
+		return 0, err
+	}
+	return e.Client.NonceAt(ctx, account, blockNumber)
+}
+
+func (e *ETHClient) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	if err := e.limiter.Wait(ctx, "eth_getTransactionCount"); err != nil {
+		return 0, err
+	}
+	return e.Client.PendingNonceAt(ctx, account)
+}
+
+func (e *ETHClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if err := e.limiter.Wait(ctx, "eth_sendRawTransaction"); err != nil {
+		return err
+	}
+	return e.Client.SendTransaction(ctx, tx)
+}
+
+func (e *ETHClient) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	if err := e.limiter.Wait(ctx, "eth_getLogs"); err != nil {
+		return nil, err
+	}
+	return e.Client.FilterLogs(ctx, q)
+}
+
+func (e *ETHClient) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	if err := e.limiter.Wait(ctx, "eth_subscribe"); err != nil {
+		return nil, err
+	}
+	return e.Client.SubscribeFilterLogs(ctx, q, ch)
+}
+
+func (e *ETHClient) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	if err := e.limiter.Wait(ctx, "eth_subscribe"); err != nil {
+		return nil, err
+	}
+	return e.Client.SubscribeNewHead(ctx, ch)
+}
@@ -0,0 +1,329 @@
+package client
+
+import (
+	"context"
+	"math"
+	"monitor/config"
+	"monitor/metrics"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Priority int
+
+const (
+	PriorityBackground Priority = iota
+	PriorityNormal
+	PriorityTrade
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBackground:
+		return "background"
+	case PriorityNormal:
+		return "normal"
+	case PriorityTrade:
+		return "trade"
+	default:
+		return "unknown"
+	}
+}
+
+type priorityKey struct{}
+
+// WithPriority marks every rpc call made with ctx, calls without a mark are PriorityNormal
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func PriorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+var (
+	rateLimitConfigs = map[string]*config.RateLimit{}
+	rateLimiters     = map[string]*RateLimiter{}
+	rateLimitLock    sync.Mutex
+
+	rateLimitCalls = metrics.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "client",
+		Name:      "ratelimit_calls_total",
+		Help:      "Rpc calls let through the rate limiter by endpoint and priority.",
+	}, "endpoint", "priority")
+	rateLimitThrottled = metrics.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "client",
+		Name:      "ratelimit_throttled_total",
+		Help:      "Rpc calls that waited for the rate limiter by endpoint and priority.",
+	}, "endpoint", "priority")
+	rateLimitWait = metrics.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "client",
+		Name:      "ratelimit_wait_seconds_total",
+		Help:      "Time the throttled rpc calls waited by endpoint and priority.",
+	}, "endpoint", "priority")
+	rateLimitCanceled = metrics.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "client",
+		Name:      "ratelimit_canceled_total",
+		Help:      "Rpc calls canceled while throttled by endpoint and priority.",
+	}, "endpoint", "priority")
+	rateLimitUnits = metrics.Register(&rateLimitCollector{
+		units: prometheus.NewDesc(
+			prometheus.BuildFQName(metrics.Namespace, "client", "ratelimit_compute_units_total"),
+			"Compute units spent by the rpc calls let through the rate limiter by endpoint.",
+			[]string{"endpoint"}, nil,
+		),
+	})
+)
+
+// rateLimitCollector reads the compute units of RateLimitStats at scrape
+type rateLimitCollector struct {
+	units *prometheus.Desc
+}
+
+func (c *rateLimitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.units
+}
+
+func (c *rateLimitCollector) Collect(ch chan<- prometheus.Metric) {
+	// nodes on the same host share a label
+	units := map[string]float64{}
+	for node, stats := range RateLimitStats() {
+		units[metrics.Endpoint(node)] += stats.ComputeUnits
+	}
+	for endpoint, value := range units {
+		ch <- prometheus.MustNewConstMetric(c.units, prometheus.CounterValue, value, endpoint)
+	}
+}
+
+// ConfigureRateLimits must run before the first GetETHClient of an endpoint
+func ConfigureRateLimits(confs map[string]*config.RateLimit) {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	for node, conf := range confs {
+		rateLimitConfigs[node] = conf
+	}
+}
+
+func getRateLimiter(node string) *RateLimiter {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	if l, ok := rateLimiters[node]; ok {
+		return l
+	}
+	conf, ok := rateLimitConfigs[node]
+	if !ok {
+		return nil
+	}
+	l := NewRateLimiter(conf)
+	l.endpoint = metrics.Endpoint(node)
+	rateLimiters[node] = l
+	return l
+}
+
+// RateLimitStats returns the throttling counters of every configured endpoint
+func RateLimitStats() map[string]RateLimiterStats {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	ret := make(map[string]RateLimiterStats, len(rateLimiters))
+	for node, l := range rateLimiters {
+		ret[node] = l.Stats()
+	}
+	return ret
+}
+
+type RateLimiterStats struct {
+	Calls         map[Priority]uint64
+	Throttled     map[Priority]uint64
+	ThrottledTime map[Priority]time.Duration
+	Canceled      map[Priority]uint64
+	ComputeUnits  float64
+}
+
+// RateLimiter is a request and compute unit token bucket,
+// lower priority callers wait while a higher priority caller is waiting
+// and background callers can not spend the trade reserve
+type RateLimiter struct {
+	requests *tokenBucket
+	units    *tokenBucket
+	weights  map[string]float64
+	reserve  float64
+
+	waiting [PriorityTrade + 1]int
+	stats   RateLimiterStats
+	lock    sync.Mutex
+	// endpoint labels the metrics of the limiter
+	endpoint string
+}
+
+func NewRateLimiter(conf *config.RateLimit) *RateLimiter {
+	l := &RateLimiter{
+		weights: map[string]float64{},
+		reserve: conf.TradeReserve,
+		stats: RateLimiterStats{
+			Calls:         map[Priority]uint64{},
+			Throttled:     map[Priority]uint64{},
+			ThrottledTime: map[Priority]time.Duration{},
+			Canceled:      map[Priority]uint64{},
+		},
+	}
+	if conf.RequestsPerSecond > 0 {
+		l.requests = newTokenBucket(conf.RequestsPerSecond)
+	}
+	if conf.ComputeUnitsPerSecond > 0 {
+		l.units = newTokenBucket(conf.ComputeUnitsPerSecond)
+	}
+	for method, weight := range conf.MethodComputeUnits {
+		l.weights[method] = weight
+	}
+	if l.reserve < 0 || l.reserve >= 1 {
+		l.reserve = 0
+	}
+	return l
+}
+
+func (l *RateLimiter) Weight(method string) float64 {
+	if weight, ok := l.weights[method]; ok {
+		return weight
+	}
+	return 1
+}
+
+func (l *RateLimiter) Wait(ctx context.Context, method string) error {
+	if l == nil {
+		return nil
+	}
+	var (
+		p         = PriorityFromContext(ctx)
+		cost      = l.Weight(method)
+		startTime = time.Now()
+		throttled bool
+	)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.waiting[p]++
+	defer func() {
+		l.waiting[p]--
+	}()
+	for {
+		now := time.Now()
+		delay := l.delay(p, cost, now)
+		if delay <= 0 {
+			l.requests.take(1)
+			l.units.take(cost)
+			l.stats.Calls[p]++
+			l.stats.ComputeUnits += cost
+			rateLimitCalls.WithLabelValues(l.endpoint, p.String()).Inc()
+			if throttled {
+				l.stats.Throttled[p]++
+				l.stats.ThrottledTime[p] += now.Sub(startTime)
+				rateLimitThrottled.WithLabelValues(l.endpoint, p.String()).Inc()
+				rateLimitWait.WithLabelValues(l.endpoint, p.String()).Add(now.Sub(startTime).Seconds())
+			}
+			return nil
+		}
+		throttled = true
+		l.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			l.lock.Lock()
+			l.stats.Canceled[p]++
+			rateLimitCanceled.WithLabelValues(l.endpoint, p.String()).Inc()
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		l.lock.Lock()
+	}
+}
+
+func (l *RateLimiter) delay(p Priority, cost float64, now time.Time) time.Duration {
+	for q := p + 1; q <= PriorityTrade; q++ {
+		if l.waiting[q] > 0 {
+			return time.Millisecond * 5
+		}
+	}
+	var reserve float64
+	if p == PriorityBackground {
+		reserve = l.reserve
+	}
+	return maxDuration(
+		l.requests.delay(1, reserve, now),
+		l.units.delay(cost, reserve, now),
+	)
+}
+
+func (l *RateLimiter) Stats() RateLimiterStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ret := RateLimiterStats{
+		Calls:         map[Priority]uint64{},
+		Throttled:     map[Priority]uint64{},
+		ThrottledTime: map[Priority]time.Duration{},
+		Canceled:      map[Priority]uint64{},
+		ComputeUnits:  l.stats.ComputeUnits,
+	}
+	for p := PriorityBackground; p <= PriorityTrade; p++ {
+		ret.Calls[p] = l.stats.Calls[p]
+		ret.Throttled[p] = l.stats.Throttled[p]
+		ret.ThrottledTime[p] = l.stats.ThrottledTime[p]
+		ret.Canceled[p] = l.stats.Canceled[p]
+	}
+	return ret
+}
+
+// tokenBucket holds one second of rate as burst
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// delay returns how long until cost tokens can be taken while keeping reserve fraction of the burst
+func (b *tokenBucket) delay(cost, reserve float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	need := cost + b.rate*reserve
+	if need > b.rate {
+		// a call heavier than the burst waits for a full bucket instead of forever
+		need = b.rate
+	}
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(cost float64) {
+	if b == nil {
+		return
+	}
+	b.tokens -= cost
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"monitor/config"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRateLimiterThrottle(t *testing.T) {
+	ctx := context.Background()
+	l := NewRateLimiter(&config.RateLimit{
+		RequestsPerSecond: 100,
+	})
+	l.endpoint = "test.throttle"
+	startTime := time.Now()
+	for i := 0; i < 150; i++ {
+		err := l.Wait(ctx, "eth_call")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if spend := time.Since(startTime); spend < time.Millisecond*400 {
+		t.Fatal(spend)
+	}
+	stats := l.Stats()
+	if stats.Calls[PriorityNormal] != 150 || stats.Throttled[PriorityNormal] == 0 {
+		t.Fatalf("%+v", stats)
+	}
+	if calls := testutil.ToFloat64(rateLimitCalls.WithLabelValues("test.throttle", "normal")); calls != 150 {
+		t.Fatalf("calls metric %f", calls)
+	}
+	throttled := testutil.ToFloat64(rateLimitThrottled.WithLabelValues("test.throttle", "normal"))
+	if throttled != float64(stats.Throttled[PriorityNormal]) || testutil.ToFloat64(rateLimitWait.WithLabelValues("test.throttle", "normal")) <= 0 {
+		t.Fatalf("throttled metric %f", throttled)
+	}
+}
+
+func TestRateLimiterComputeUnits(t *testing.T) {
+	ctx := context.Background()
+	node := "https://test.units/apikey"
+	ConfigureRateLimits(map[string]*config.RateLimit{node: {
+		ComputeUnitsPerSecond: 100,
+		MethodComputeUnits: map[string]float64{
+			"eth_call": 50,
+		},
+	}})
+	l := getRateLimiter(node)
+	startTime := time.Now()
+	for i := 0; i < 4; i++ {
+		err := l.Wait(ctx, "eth_call")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if spend := time.Since(startTime); spend < time.Millisecond*900 {
+		t.Fatal(spend)
+	}
+	if l.Stats().ComputeUnits != 200 {
+		t.Fatal(l.Stats().ComputeUnits)
+	}
+	ch := make(chan prometheus.Metric, 16)
+	rateLimitUnits.Collect(ch)
+	close(ch)
+	units := map[string]float64{}
+	for m := range ch {
+		metric := &dto.Metric{}
+		if err := m.Write(metric); err != nil {
+			t.Fatal(err)
+		}
+		units[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+	}
+	if units["test.units"] != 200 {
+		t.Fatalf("compute units metric %+v", units)
+	}
+}
+
+func TestRateLimiterPriority(t *testing.T) {
+	ctx := context.Background()
+	l := NewRateLimiter(&config.RateLimit{
+		RequestsPerSecond: 20,
+		TradeReserve:      0.5,
+	})
+	l.endpoint = "test.priority"
+	// background calls stop at the reserve, trade calls can spend it
+	bgCtx, cancel := context.WithTimeout(WithPriority(ctx, PriorityBackground), time.Millisecond*20)
+	defer cancel()
+	background := 0
+	for l.Wait(bgCtx, "eth_blockNumber") == nil {
+		background++
+	}
+	if background > 11 {
+		t.Fatal(background)
+	}
+	tradeCtx := WithPriority(ctx, PriorityTrade)
+	startTime := time.Now()
+	for i := 0; i < 8; i++ {
+		err := l.Wait(tradeCtx, "eth_sendRawTransaction")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if spend := time.Since(startTime); spend > time.Millisecond*100 {
+		t.Fatal(spend)
+	}
+
+	// a waiting trade call is served before waiting background calls
+	var (
+		order = []Priority{}
+		lock  sync.Mutex
+		wait  sync.WaitGroup
+	)
+	for i := 0; i < 5; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			_ = l.Wait(WithPriority(ctx, PriorityBackground), "eth_blockNumber")
+			lock.Lock()
+			order = append(order, PriorityBackground)
+			lock.Unlock()
+		}()
+	}
+	time.Sleep(time.Millisecond * 10)
+	err := l.Wait(tradeCtx, "eth_sendRawTransaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	order = append(order, PriorityTrade)
+	lock.Unlock()
+	wait.Wait()
+	if order[0] != PriorityTrade {
+		t.Fatal(order)
+	}
+	if l.Stats().Canceled[PriorityBackground] != 1 {
+		t.Fatalf("%+v", l.Stats())
+	}
+	if canceled := testutil.ToFloat64(rateLimitCanceled.WithLabelValues("test.priority", "background")); canceled != 1 {
+		t.Fatalf("canceled metric %f", canceled)
+	}
+}
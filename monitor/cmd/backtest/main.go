@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"monitor/backtest"
+	"monitor/client"
+	"monitor/config"
+	"monitor/recorder"
+	"monitor/utils"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// backtest replays a block range of logs, read from a logs file or fetched from a node,
+// through the arbitrage with a simulated executor and prints the report:
+//
+//	go run ./cmd/backtest -node http://localhost:8545 -from 100 -to 200 -report report.json
+//
+// -logs replays a logs file instead of fetching the logs, the pair infos are still read
+// from -node:
+//
+//	go run ./cmd/backtest -node http://localhost:8545 -logs logs.jsonl
+//
+// -record replays the files of a monitor RecordDir with the multicall results, the
+// gas prices and the times recorded, no node is needed:
+//
+//	go run ./cmd/backtest -record ./data/record
+func main() {
+	var (
+		node       = flag.String("node", "", "node reading the pair infos and the logs when no file is given")
+		logsFile   = flag.String("logs", "", "logs file, one json encoded log per line")
+		recordDir  = flag.String("record", "", "record dir of a monitor to replay")
+		from       = flag.Uint64("from", 0, "first block replayed")
+		to         = flag.Uint64("to", 0, "last block replayed, required with -node")
+		pageBlocks = flag.Uint64("page", backtest.DefaultPageBlocks, "blocks per eth_getLogs call")
+		multicall  = flag.String("multicall", "0xcA11bde05977b3631167028862bE2a173976CA11", "multicall2 address")
+		weth       = flag.String("weth", "0x4200000000000000000000000000000000000006", "weth address")
+		factories  = flag.String("factories", "", "fixed factory fees, address:fee comma separated")
+		gasPrice   = flag.Float64("gas-price", 0.12, "gas price in gwei")
+		ethGas     = flag.Float64("eth-gas-price", 20, "l1 gas price in gwei")
+		blockTime  = flag.Duration("block-time", backtest.DefaultBlockTime, "simulated time per block")
+		minLiq     = flag.Float64("min-liquidity", 0, "minimum WETH reserve per pair side in ether")
+		minTrade   = flag.Float64("min-trade", 0, "minimum trade in ether at the target slippage")
+		reportFile = flag.String("report", "", "json report file")
+		logLevel   = flag.String("log-level", "warn", "log level, debug info warn or error")
+	)
+	flag.Parse()
+	if err := utils.ConfigureLog(&utils.LogConfig{Level: *logLevel}); err != nil {
+		exit(err)
+	}
+
+	ctx := context.Background()
+	conf := &config.Config{
+		Node:              *node,
+		MulticallAddress:  common.HexToAddress(*multicall),
+		WETHAddress:       common.HexToAddress(*weth),
+		GraphMinLiquidity: *minLiq,
+		GraphMinTradeSize: *minTrade,
+	}
+	var err error
+	conf.Factories, err = parseFactories(*factories)
+	if err != nil {
+		exit(err)
+	}
+
+	var source backtest.Source
+	switch {
+	case len(*recordDir) > 0:
+		files, err := recorder.Files(*recordDir)
+		if err != nil {
+			exit(err)
+		}
+		if len(files) == 0 {
+			exit(fmt.Errorf("no record file in %s", *recordDir))
+		}
+		replay := recorder.NewSource(files)
+		defer replay.Close()
+		source = replay
+		if len(conf.Node) == 0 {
+			conf.Node = recorder.ReplayNode
+		}
+	case len(*logsFile) > 0:
+		if len(*node) == 0 {
+			exit(fmt.Errorf("-logs reads the pair infos from a node, -node is required"))
+		}
+		source, err = backtest.NewFileSource(*logsFile, *from, *to)
+		if err != nil {
+			exit(err)
+		}
+	case len(*node) > 0 && *to >= *from && *to > 0:
+		source = backtest.NewNodeSource(conf, *from, *to, *pageBlocks)
+	default:
+		exit(fmt.Errorf("missing -logs or -node with -to"))
+	}
+	client.ConfigureRateLimits(conf.RateLimits)
+
+	executor := backtest.NewExecutor(ctx, conf)
+	executor.SetGasPrice(*gasPrice*math.Pow10(9), *ethGas*math.Pow10(9))
+	report, err := backtest.NewBacktest(ctx, conf, source, executor, *blockTime).Run(ctx)
+	if err != nil {
+		utils.Errorf("backtest stopped %s", err)
+	}
+	fmt.Print(report.Summary())
+	if len(*reportFile) > 0 {
+		if err := report.WriteFile(*reportFile); err != nil {
+			exit(err)
+		}
+	}
+}
+
+func parseFactories(value string) ([]*config.Factory, error) {
+	factories := []*config.Factory{}
+	for _, one := range strings.Split(value, ",") {
+		if len(one) == 0 {
+			continue
+		}
+		parts := strings.Split(one, ":")
+		if len(parts) != 2 || !common.IsHexAddress(parts[0]) {
+			return nil, fmt.Errorf("factory format error %s", one)
+		}
+		fee, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("factory fee error %s", one)
+		}
+		factories = append(factories, &config.Factory{Address: common.HexToAddress(parts[0]), Fee: fee})
+	}
+	return factories, nil
+}
+
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
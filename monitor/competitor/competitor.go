@@ -0,0 +1,455 @@
+package competitor
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"monitor/action"
+	"monitor/arbitrage"
+	"monitor/client"
+	"monitor/config"
+	"monitor/metrics"
+	"monitor/protocol"
+	"monitor/trader"
+	"monitor/utils"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	_ action.Action = &Analyzer{}
+
+	logger = utils.NewLogger("competitor")
+)
+
+const (
+	// reportSize is the number of arbitrage txs kept for inspection
+	reportSize = 500
+	// matchWindow is how far from the block time a cycle of ours matches an arbitrage tx
+	matchWindow = 30 * time.Second
+	// maxBlockLag drops the swaps of blocks further behind the blocks kept open, the
+	// backfilled and late ones, rather than read them from the node
+	maxBlockLag = 5
+	// maxBatchCalls bounds the rpc calls sent in one request
+	maxBatchCalls = 100
+
+	// MatchOurs is an arbitrage tx we sent
+	MatchOurs = "ours"
+	// MatchSeen is an arbitrage tx of others through a cycle we found too
+	MatchSeen = "seen"
+	// MatchMissed is an arbitrage tx of others through a cycle we did not find
+	MatchMissed = "missed"
+)
+
+// Cycles are the cycles found by the engine, the arbitrage
+type Cycles interface {
+	RecentCycles(limit int) []*arbitrage.Cycle
+}
+
+// Trades are the swaps we sent and the strategy learning from the others, the trader
+type Trades interface {
+	Ledger(limit int) []trader.LedgerEntry
+	ObserveWinners(block uint64, gasPrices []float64)
+}
+
+// Chain reads the header and the txs of the arbitrages in batches of rpc calls, the eth client
+type Chain interface {
+	BatchCallContext(ctx context.Context, b []rpc.BatchElem) error
+}
+
+// Arb is a tx swapping a token through a cycle of pairs back into itself, amounts in wei of
+// Token and gas prices in wei per gas
+type Arb struct {
+	Time        time.Time        `json:"time"`
+	Block       uint64           `json:"block"`
+	Tx          common.Hash      `json:"tx"`
+	TxIndex     uint             `json:"txIndex"`
+	From        common.Address   `json:"from"`
+	To          common.Address   `json:"to"`
+	Token       common.Address   `json:"token"`
+	Pairs       []common.Address `json:"pairs"`
+	AmountIn    *big.Int         `json:"amountIn"`
+	Profit      *big.Int         `json:"profit"`
+	GasUsed     uint64           `json:"gasUsed,omitempty"`
+	GasPrice    float64          `json:"gasPrice,omitempty"`
+	PriorityFee float64          `json:"priorityFee,omitempty"`
+	// Match is ours, seen or missed, Result is what became of our cycle when seen
+	Match  string `json:"match"`
+	Result string `json:"result,omitempty"`
+}
+
+// txRead is the receipt and the tx of an arbitrage read in a batch
+type txRead struct {
+	receipt *types.Receipt
+	tx      *types.Transaction
+	err     error
+}
+
+// hop is a swap of a tx from one token of a pair into the other
+type hop struct {
+	pair      common.Address
+	tokenIn   common.Address
+	tokenOut  common.Address
+	amountIn  *big.Int
+	amountOut *big.Int
+}
+
+// Analyzer finds the arbitrage txs of every recent block in the swap logs once the block is
+// complete, matches them to the cycles of the engine and feeds the gas prices of the ones won
+// by others to the strategy, once per block
+type Analyzer struct {
+	config *config.Config
+	cycles Cycles
+	trades Trades
+	chain  func(ctx context.Context) (Chain, error)
+	// pairTokens gives the tokens of a pair
+	pairTokens func(pair common.Address) (token0, token1 common.Address, ok bool)
+
+	lock sync.Mutex
+	arbs []*Arb
+
+	// handleLock runs the flushes of logs one at a time, the monitor starts them concurrently
+	handleLock sync.Mutex
+	// pending buffers the swaps of the blocks not analyzed yet by block, latest is the last
+	// block swaps came from and analyzed the last block analyzed
+	blocksLock sync.Mutex
+	pending    map[uint64][]*protocol.UniswapV2Swap
+	latest     uint64
+	analyzed   uint64
+
+	found *prometheus.CounterVec
+}
+
+func NewAnalyzer(ctx context.Context, conf *config.Config, cycles Cycles, trades Trades) *Analyzer {
+	if conf.CompetitorBlockLag == 0 {
+		conf.CompetitorBlockLag = 1
+	}
+	return &Analyzer{
+		config:  conf,
+		cycles:  cycles,
+		trades:  trades,
+		pending: map[uint64][]*protocol.UniswapV2Swap{},
+		chain: func(ctx context.Context) (Chain, error) {
+			return client.GetETHClient(ctx, conf.Node, conf.MulticallAddress)
+		},
+		pairTokens: func(pair common.Address) (common.Address, common.Address, bool) {
+			info, ok := protocol.UniswapV2Pairs.Load(pair)
+			if !ok {
+				return common.Address{}, common.Address{}, false
+			}
+			return info.Token0, info.Token1, true
+		},
+		found: metrics.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "competitor",
+			Name:      "arbs_total",
+			Help:      "Arbitrage txs found on chain by match: ours, seen or missed.",
+		}, "match"),
+	}
+}
+
+func (a *Analyzer) Init(context.Context) error {
+	return nil
+}
+
+func (a *Analyzer) OnNewBlockHandler(context.Context, ...interface{}) error {
+	return nil
+}
+
+func (a *Analyzer) OnNewLogHandler(ctx context.Context, params ...interface{}) error {
+	a.handleLock.Lock()
+	defer a.handleLock.Unlock()
+	logs := params[0].([]*types.Log)
+	swaps, err := protocol.FilterUniswapV2SwapFromLog(ctx, logs)
+	if err != nil {
+		return fmt.Errorf("filter uniswapv2 swap fail %s", err)
+	}
+	for _, block := range a.buffer(swaps) {
+		arbs := a.findArbs(block)
+		if len(arbs) == 0 {
+			continue
+		}
+		if err := a.analyzeBlock(ctx, block[0].BlockNumber, arbs); err != nil {
+			return fmt.Errorf("analyze block %d fail %s", block[0].BlockNumber, err)
+		}
+	}
+	return nil
+}
+
+// buffer keeps swaps until their block is complete and returns the swaps of the blocks
+// completed, oldest first. A block is complete once the swaps of CompetitorBlockLag later
+// blocks came, so a tx whose swaps span flushes of logs, or whose logs come late, is
+// analyzed whole
+func (a *Analyzer) buffer(swaps []*protocol.UniswapV2Swap) [][]*protocol.UniswapV2Swap {
+	a.blocksLock.Lock()
+	defer a.blocksLock.Unlock()
+	lag := a.config.CompetitorBlockLag
+	for _, swap := range swaps {
+		if swap.BlockNumber > a.latest {
+			a.latest = swap.BlockNumber
+		}
+	}
+	for _, swap := range swaps {
+		if swap.BlockNumber <= a.analyzed || swap.BlockNumber+lag+maxBlockLag < a.latest {
+			continue
+		}
+		a.pending[swap.BlockNumber] = append(a.pending[swap.BlockNumber], swap)
+	}
+	numbers := []uint64{}
+	for number := range a.pending {
+		if number+lag <= a.latest {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	ready := make([][]*protocol.UniswapV2Swap, 0, len(numbers))
+	for _, number := range numbers {
+		block := a.pending[number]
+		delete(a.pending, number)
+		sort.SliceStable(block, func(i, j int) bool {
+			if block[i].TxIndex != block[j].TxIndex {
+				return block[i].TxIndex < block[j].TxIndex
+			}
+			return block[i].LogIndex < block[j].LogIndex
+		})
+		ready = append(ready, block)
+		a.analyzed = number
+	}
+	return ready
+}
+
+// findArbs chains the swaps of every tx into cycles, a swap whose input is the output of
+// the swap before continues the chain, a chain ending in its first token is an arbitrage
+func (a *Analyzer) findArbs(swaps []*protocol.UniswapV2Swap) []*Arb {
+	arbs := []*Arb{}
+	var (
+		chain []*hop
+		last  *protocol.UniswapV2Swap
+	)
+	for _, swap := range swaps {
+		if last != nil && last.TxHash != swap.TxHash {
+			chain = nil
+		}
+		last = swap
+		one, ok := a.toHop(swap)
+		if !ok {
+			chain = nil
+			continue
+		}
+		if len(chain) > 0 && chain[len(chain)-1].tokenOut != one.tokenIn {
+			chain = nil
+		}
+		chain = append(chain, one)
+		if len(chain) < 2 || one.tokenOut != chain[0].tokenIn {
+			continue
+		}
+		arb := &Arb{
+			Block:    swap.BlockNumber,
+			Tx:       swap.TxHash,
+			TxIndex:  swap.TxIndex,
+			Token:    chain[0].tokenIn,
+			AmountIn: chain[0].amountIn,
+			Profit:   new(big.Int).Sub(one.amountOut, chain[0].amountIn),
+		}
+		for _, one := range chain {
+			arb.Pairs = append(arb.Pairs, one.pair)
+		}
+		arbs = append(arbs, arb)
+		chain = nil
+	}
+	return arbs
+}
+
+// toHop is the direction of swap, false for pairs unknown or swaps both ways
+func (a *Analyzer) toHop(swap *protocol.UniswapV2Swap) (*hop, bool) {
+	token0, token1, ok := a.pairTokens(swap.Address)
+	if !ok {
+		return nil, false
+	}
+	switch {
+	case swap.Amount0In.Sign() > 0 && swap.Amount1In.Sign() == 0 && swap.Amount1Out.Sign() > 0:
+		return &hop{pair: swap.Address, tokenIn: token0, tokenOut: token1, amountIn: swap.Amount0In, amountOut: swap.Amount1Out}, true
+	case swap.Amount1In.Sign() > 0 && swap.Amount0In.Sign() == 0 && swap.Amount0Out.Sign() > 0:
+		return &hop{pair: swap.Address, tokenIn: token1, tokenOut: token0, amountIn: swap.Amount1In, amountOut: swap.Amount0Out}, true
+	}
+	return nil, false
+}
+
+// analyzeBlock reads the gas paid by the arbs of block, matches them and keeps them
+func (a *Analyzer) analyzeBlock(ctx context.Context, number uint64, arbs []*Arb) error {
+	chain, err := a.chain(ctx)
+	if err != nil {
+		return fmt.Errorf("get eth client fail %s", err)
+	}
+	header, reads, err := readBlock(ctx, chain, number, arbs)
+	if err != nil {
+		return err
+	}
+	blockTime := time.Unix(int64(header.Time), 0)
+	ours := map[common.Hash]bool{}
+	for _, entry := range a.trades.Ledger(0) {
+		ours[entry.Tx] = true
+	}
+	cycles := a.cycles.RecentCycles(0)
+	gasPrices := []float64{}
+	for _, arb := range arbs {
+		arb.Time = blockTime
+		if err := readTx(header, arb, reads[arb.Tx]); err != nil {
+			// the arb is kept without its gas
+			logger.Ctx(ctx).Warnf("read arbitrage tx %s fail %s", arb.Tx, err)
+		}
+		a.match(arb, ours, cycles)
+		if arb.Match != MatchOurs && arb.GasPrice > 0 {
+			gasPrices = append(gasPrices, arb.GasPrice)
+		}
+		a.found.WithLabelValues(arb.Match).Inc()
+		a.add(arb)
+		logger.Ctx(ctx).Infof("arbitrage tx %s block %d from %s pairs %d profit %s gas price %.0f %s",
+			arb.Tx, arb.Block, arb.From, len(arb.Pairs), arb.Profit, arb.GasPrice, arb.Match)
+	}
+	a.trades.ObserveWinners(number, gasPrices)
+	return nil
+}
+
+// readBlock reads the header of block number and the receipts and txs of arbs in batches of
+// rpc calls, a tx failed to read is kept with its error
+func readBlock(ctx context.Context, chain Chain, number uint64, arbs []*Arb) (*types.Header, map[common.Hash]*txRead, error) {
+	var (
+		header *types.Header
+		reads  = map[common.Hash]*txRead{}
+		elems  = []rpc.BatchElem{{
+			Method: "eth_getBlockByNumber",
+			Args:   []interface{}{hexutil.EncodeUint64(number), false},
+			Result: &header,
+		}}
+		first = map[common.Hash]int{}
+	)
+	for _, arb := range arbs {
+		if _, ok := reads[arb.Tx]; ok {
+			continue
+		}
+		read := &txRead{}
+		reads[arb.Tx], first[arb.Tx] = read, len(elems)
+		elems = append(elems,
+			rpc.BatchElem{Method: "eth_getTransactionReceipt", Args: []interface{}{arb.Tx}, Result: &read.receipt},
+			rpc.BatchElem{Method: "eth_getTransactionByHash", Args: []interface{}{arb.Tx}, Result: &read.tx},
+		)
+	}
+	for start := 0; start < len(elems); start += maxBatchCalls {
+		end := start + maxBatchCalls
+		if end > len(elems) {
+			end = len(elems)
+		}
+		if err := chain.BatchCallContext(ctx, elems[start:end]); err != nil {
+			return nil, nil, fmt.Errorf("batch call fail %s", err)
+		}
+	}
+	if elems[0].Error != nil {
+		return nil, nil, fmt.Errorf("get header fail %s", elems[0].Error)
+	}
+	if header == nil {
+		return nil, nil, fmt.Errorf("header not found")
+	}
+	for hash, read := range reads {
+		i := first[hash]
+		if elems[i].Error != nil {
+			read.err = fmt.Errorf("get receipt fail %s", elems[i].Error)
+		} else if elems[i+1].Error != nil {
+			read.err = fmt.Errorf("get tx fail %s", elems[i+1].Error)
+		}
+	}
+	return header, reads, nil
+}
+
+// readTx sets the sender and the gas of arb
+func readTx(header *types.Header, arb *Arb, read *txRead) error {
+	if read.err != nil {
+		return read.err
+	}
+	if read.receipt == nil {
+		return fmt.Errorf("receipt not found")
+	}
+	arb.GasUsed = read.receipt.GasUsed
+	if read.receipt.EffectiveGasPrice != nil {
+		arb.GasPrice, _ = new(big.Float).SetInt(read.receipt.EffectiveGasPrice).Float64()
+		if header.BaseFee != nil {
+			tip := new(big.Int).Sub(read.receipt.EffectiveGasPrice, header.BaseFee)
+			arb.PriorityFee, _ = new(big.Float).SetInt(tip).Float64()
+		}
+	}
+	if read.tx == nil {
+		return fmt.Errorf("tx not found")
+	}
+	if read.tx.To() != nil {
+		arb.To = *read.tx.To()
+	}
+	from, err := types.Sender(types.LatestSignerForChainID(read.tx.ChainId()), read.tx)
+	if err != nil {
+		return fmt.Errorf("recover sender fail %s", err)
+	}
+	arb.From = from
+	return nil
+}
+
+// match tells whether arb is ours, else whether the engine found its pairs near the block
+func (a *Analyzer) match(arb *Arb, ours map[common.Hash]bool, cycles []*arbitrage.Cycle) {
+	if ours[arb.Tx] || (arb.To == a.config.SwapAddress && arb.To != common.Address{}) {
+		arb.Match = MatchOurs
+		return
+	}
+	arb.Match = MatchMissed
+	key := pairsKey(arb.Pairs)
+	for _, cycle := range cycles {
+		if pairsKey(cycle.Pairs) != key {
+			continue
+		}
+		if d := cycle.Time.Sub(arb.Time); d > matchWindow || d < -matchWindow {
+			continue
+		}
+		// the cycles come newest first
+		arb.Match, arb.Result = MatchSeen, cycle.Result
+		return
+	}
+}
+
+// pairsKey is the set of pairs, cycles match whatever pair they start from
+func pairsKey(pairs []common.Address) string {
+	keys := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		keys = append(keys, pair.Hex())
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func (a *Analyzer) add(arb *Arb) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.arbs) >= reportSize {
+		a.arbs = append(a.arbs[:0], a.arbs[1:]...)
+	}
+	a.arbs = append(a.arbs, arb)
+}
+
+// Arbs returns the last arbitrage txs found of match, all of them when empty, newest first
+func (a *Analyzer) Arbs(limit int, match string) []*Arb {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if limit <= 0 || limit > len(a.arbs) {
+		limit = len(a.arbs)
+	}
+	ret := make([]*Arb, 0, limit)
+	for i := len(a.arbs) - 1; i >= 0 && len(ret) < limit; i-- {
+		if len(match) == 0 || a.arbs[i].Match == match {
+			ret = append(ret, a.arbs[i])
+		}
+	}
+	return ret
+}
@@ -0,0 +1,347 @@
+package competitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"monitor/abi"
+	"monitor/arbitrage"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/trader"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const gwei = 1e9
+
+type testCycles []*arbitrage.Cycle
+
+func (c testCycles) RecentCycles(limit int) []*arbitrage.Cycle {
+	return c
+}
+
+type testTrades struct {
+	ledger   []trader.LedgerEntry
+	winners  map[uint64][]float64
+	observed map[uint64]int
+}
+
+func (t *testTrades) Ledger(limit int) []trader.LedgerEntry {
+	return t.ledger
+}
+
+func (t *testTrades) ObserveWinners(block uint64, gasPrices []float64) {
+	t.winners[block] = append(t.winners[block], gasPrices...)
+	t.observed[block]++
+}
+
+type testChain struct {
+	headers  map[uint64]*types.Header
+	receipts map[common.Hash]*types.Receipt
+	txs      map[common.Hash]*types.Transaction
+	batches  int
+}
+
+// BatchCallContext answers the calls like a node, null for a receipt or tx not found
+func (c *testChain) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	c.batches++
+	for i := range b {
+		elem := &b[i]
+		switch elem.Method {
+		case "eth_getBlockByNumber":
+			number, err := hexutil.DecodeUint64(elem.Args[0].(string))
+			if err != nil {
+				return err
+			}
+			header, ok := c.headers[number]
+			if !ok {
+				elem.Error = fmt.Errorf("no header %d", number)
+				continue
+			}
+			*elem.Result.(**types.Header) = header
+		case "eth_getTransactionReceipt":
+			*elem.Result.(**types.Receipt) = c.receipts[elem.Args[0].(common.Hash)]
+		case "eth_getTransactionByHash":
+			*elem.Result.(**types.Transaction) = c.txs[elem.Args[0].(common.Hash)]
+		default:
+			elem.Error = fmt.Errorf("method %s", elem.Method)
+		}
+	}
+	return nil
+}
+
+// testLogs builds the swap logs of the txs of a block
+type testLogs struct {
+	t     *testing.T
+	block uint64
+	logs  []*types.Log
+}
+
+// swap is a swap log of tx, in the amount of token0 when in0 else of token1
+func (l *testLogs) swap(tx common.Hash, txIndex uint, pair common.Address, in0 bool, in, out int64) {
+	amounts := []*big.Int{big.NewInt(0), big.NewInt(in), big.NewInt(out), big.NewInt(0)}
+	if in0 {
+		amounts = []*big.Int{big.NewInt(in), big.NewInt(0), big.NewInt(0), big.NewInt(out)}
+	}
+	data, err := abi.UniswapV2PairABIInstance.Events["Swap"].Inputs.NonIndexed().Pack(amounts[0], amounts[1], amounts[2], amounts[3])
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	l.logs = append(l.logs, &types.Log{
+		Address:     pair,
+		Topics:      []common.Hash{protocol.UniswapV2PairEventSwapSign, {}, {}},
+		Data:        data,
+		BlockNumber: l.block,
+		TxHash:      tx,
+		TxIndex:     txIndex,
+		Index:       uint(len(l.logs)),
+	})
+}
+
+func TestAnalyzer(t *testing.T) {
+	var (
+		w, x, y               = common.Address{0x01}, common.Address{0x02}, common.Address{0x03}
+		wx, xy, wy, xw        = common.Address{0x11}, common.Address{0x12}, common.Address{0x13}, common.Address{0x14}
+		swapAddress           = common.Address{0x99}
+		chainID               = big.NewInt(8453)
+		blockTime      uint64 = 1700000000
+		tokens                = map[common.Address][2]common.Address{wx: {w, x}, xy: {x, y}, wy: {w, y}, xw: {x, w}}
+		chain                 = &testChain{
+			headers: map[uint64]*types.Header{
+				1: {Number: big.NewInt(1), Time: blockTime, BaseFee: big.NewInt(gwei)},
+				2: {Number: big.NewInt(2), Time: blockTime + 2, BaseFee: big.NewInt(gwei)},
+			},
+			receipts: map[common.Hash]*types.Receipt{},
+			txs:      map[common.Hash]*types.Transaction{},
+		}
+	)
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	searcher := crypto.PubkeyToAddress(key.PublicKey)
+	newTx := func(nonce uint64, to common.Address, gasPrice int64) common.Hash {
+		tx, err := types.SignNewTx(key, types.LatestSignerForChainID(chainID), &types.DynamicFeeTx{
+			ChainID:   chainID,
+			Nonce:     nonce,
+			To:        &to,
+			Gas:       300000,
+			GasFeeCap: big.NewInt(gasPrice),
+			GasTipCap: big.NewInt(gasPrice - gwei),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.txs[tx.Hash()] = tx
+		chain.receipts[tx.Hash()] = &types.Receipt{GasUsed: 150000, EffectiveGasPrice: big.NewInt(gasPrice)}
+		return tx.Hash()
+	}
+	var (
+		seen    = newTx(0, common.Address{0x77}, 3*gwei)
+		single  = newTx(1, common.Address{0x77}, 2*gwei)
+		single2 = newTx(2, common.Address{0x77}, 2*gwei)
+		ours    = newTx(3, swapAddress, 5*gwei)
+		missed  = newTx(4, common.Address{0x77}, 4*gwei)
+		unknown = newTx(5, common.Address{0x77}, 6*gwei)
+		block1  = &testLogs{t: t, block: 1}
+		block2  = &testLogs{t: t, block: 2}
+	)
+	// w -> x -> y -> w for 10 of profit
+	block1.swap(seen, 0, wx, true, 100, 90)
+	block1.swap(seen, 0, xy, true, 90, 80)
+	block1.swap(seen, 0, wy, false, 80, 110)
+	// a swap back into its token in another tx is not a cycle
+	block1.swap(single, 1, wx, true, 100, 90)
+	block1.swap(single2, 2, xw, true, 90, 101)
+	// w -> x -> w of ours for 11
+	block1.swap(ours, 3, wx, true, 100, 90)
+	block1.swap(ours, 3, xw, true, 90, 111)
+	// w -> x -> w losing 5
+	block2.swap(missed, 0, wx, true, 100, 90)
+	block2.swap(missed, 0, xw, true, 90, 95)
+	// the unknown pair breaks the chain
+	block2.swap(unknown, 1, wx, true, 100, 90)
+	block2.swap(unknown, 1, common.Address{0x15}, true, 90, 80)
+	block2.swap(unknown, 1, xw, true, 80, 120)
+
+	trades := &testTrades{
+		ledger:   []trader.LedgerEntry{{Tx: ours}},
+		winners:  map[uint64][]float64{},
+		observed: map[uint64]int{},
+	}
+	cycles := testCycles{
+		{Time: time.Unix(int64(blockTime)-1, 0), Pairs: []common.Address{wy, wx, xy}, Result: "unprofitable"},
+		// too long before the block
+		{Time: time.Unix(int64(blockTime)-60, 0), Pairs: []common.Address{wx, xw}, Result: "traded"},
+	}
+	a := NewAnalyzer(context.Background(), &config.Config{SwapAddress: swapAddress}, cycles, trades)
+	a.chain = func(context.Context) (Chain, error) {
+		return chain, nil
+	}
+	a.pairTokens = func(pair common.Address) (common.Address, common.Address, bool) {
+		pairTokens, ok := tokens[pair]
+		return pairTokens[0], pairTokens[1], ok
+	}
+	// the swaps of a tx span two flushes of logs, a block is analyzed once a later one starts
+	block100 := &testLogs{t: t, block: 100}
+	block100.swap(common.Hash{0x64}, 0, wx, true, 100, 90)
+	for _, logs := range [][]*types.Log{block1.logs[:2], block1.logs[2:], block2.logs, block100.logs} {
+		if err := a.OnNewLogHandler(context.Background(), logs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if chain.batches != 2 {
+		t.Fatalf("batches %d", chain.batches)
+	}
+	// the blocks analyzed and the ones far behind the latest, backfilled, are not read again
+	block50 := &testLogs{t: t, block: 50}
+	block50.swap(common.Hash{0x32}, 0, wx, true, 100, 90)
+	block50.swap(common.Hash{0x32}, 0, xw, true, 90, 120)
+	for _, logs := range [][]*types.Log{block1.logs, block50.logs} {
+		if err := a.OnNewLogHandler(context.Background(), logs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if chain.batches != 2 {
+		t.Fatalf("blocks read again %d", chain.batches)
+	}
+
+	arbs := a.Arbs(0, "")
+	if len(arbs) != 3 {
+		t.Fatalf("arbs %d", len(arbs))
+	}
+	byTx := map[common.Hash]*Arb{}
+	for _, arb := range arbs {
+		byTx[arb.Tx] = arb
+	}
+	arb := byTx[seen]
+	if arb == nil || arb.Match != MatchSeen || arb.Result != "unprofitable" || arb.Token != w ||
+		arb.AmountIn.Int64() != 100 || arb.Profit.Int64() != 10 || len(arb.Pairs) != 3 || arb.Pairs[2] != wy {
+		t.Fatalf("seen %+v", arb)
+	}
+	if arb.From != searcher || arb.GasUsed != 150000 || arb.GasPrice != 3*gwei || arb.PriorityFee != 2*gwei ||
+		!arb.Time.Equal(time.Unix(int64(blockTime), 0)) {
+		t.Fatalf("seen gas %+v", arb)
+	}
+	if arb := byTx[ours]; arb == nil || arb.Match != MatchOurs || arb.Profit.Int64() != 11 || arb.TxIndex != 3 {
+		t.Fatalf("ours %+v", arb)
+	}
+	if arb := byTx[missed]; arb == nil || arb.Match != MatchMissed || arb.Profit.Int64() != -5 {
+		t.Fatalf("missed %+v", arb)
+	}
+	// our txs are not winners to outbid
+	if len(trades.winners) != 2 || len(trades.winners[1]) != 1 || trades.winners[1][0] != 3*gwei ||
+		len(trades.winners[2]) != 1 || trades.winners[2][0] != 4*gwei {
+		t.Fatalf("winners %+v", trades.winners)
+	}
+	if len(trades.observed) != 2 || trades.observed[1] != 1 || trades.observed[2] != 1 {
+		t.Fatalf("observed %+v", trades.observed)
+	}
+	if got := a.Arbs(1, MatchMissed); len(got) != 1 || got[0].Tx != missed {
+		t.Fatalf("missed arbs %+v", got)
+	}
+
+	h := a.Handler()
+	w1 := httptest.NewRecorder()
+	h.ServeHTTP(w1, httptest.NewRequest(http.MethodGet, "/competitor/arbs?match=seen", nil))
+	var got []*Arb
+	if err := json.Unmarshal(w1.Body.Bytes(), &got); err != nil || len(got) != 1 || got[0].Tx != seen {
+		t.Fatalf("%d %s", w1.Code, w1.Body)
+	}
+	w2 := httptest.NewRecorder()
+	h.ServeHTTP(w2, httptest.NewRequest(http.MethodGet, "/competitor/summary", nil))
+	summary := &Summary{}
+	if err := json.Unmarshal(w2.Body.Bytes(), summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Arbs != 3 || summary.Matches[MatchOurs] != 1 || len(summary.Senders) != 1 ||
+		summary.Senders[0].Arbs != 2 || summary.Senders[0].Missed != 1 || summary.Senders[0].MaxGasPrice != 4*gwei {
+		t.Fatalf("summary %s", w2.Body)
+	}
+	for path, code := range map[string]int{
+		"/competitor/arbs?limit=x":     http.StatusBadRequest,
+		"/competitor/arbs?match=other": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code {
+			t.Fatalf("%s %d", path, w.Code)
+		}
+	}
+	w3 := httptest.NewRecorder()
+	h.ServeHTTP(w3, httptest.NewRequest(http.MethodPost, "/competitor/summary", nil))
+	if w3.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("post summary %d", w3.Code)
+	}
+}
+
+func TestAnalyzerLateLogs(t *testing.T) {
+	var (
+		w, x    = common.Address{0x01}, common.Address{0x02}
+		wx, xw  = common.Address{0x11}, common.Address{0x14}
+		tokens  = map[common.Address][2]common.Address{wx: {w, x}, xw: {x, w}}
+		late    = common.Hash{0x0a}
+		block10 = &testLogs{t: t, block: 10}
+		block11 = &testLogs{t: t, block: 11}
+		block12 = &testLogs{t: t, block: 12}
+		chain   = &testChain{
+			headers: map[uint64]*types.Header{
+				10: {Number: big.NewInt(10), Time: 1700000000, BaseFee: big.NewInt(gwei)},
+			},
+			receipts: map[common.Hash]*types.Receipt{},
+			txs:      map[common.Hash]*types.Transaction{},
+		}
+		trades = &testTrades{winners: map[uint64][]float64{}, observed: map[uint64]int{}}
+	)
+	block10.swap(late, 0, wx, true, 100, 90)
+	block10.swap(late, 0, xw, true, 90, 120)
+	block11.swap(common.Hash{0x0b}, 0, wx, true, 100, 90)
+	block12.swap(common.Hash{0x0c}, 0, wx, true, 100, 90)
+
+	a := NewAnalyzer(context.Background(), &config.Config{CompetitorBlockLag: 2}, testCycles{}, trades)
+	a.chain = func(context.Context) (Chain, error) {
+		return chain, nil
+	}
+	a.pairTokens = func(pair common.Address) (common.Address, common.Address, bool) {
+		pairTokens, ok := tokens[pair]
+		return pairTokens[0], pairTokens[1], ok
+	}
+	// the flushes run concurrently, the last swap of block 10 comes after the ones of block 11
+	var wg sync.WaitGroup
+	for _, logs := range [][]*types.Log{block10.logs[:1], block11.logs, block10.logs[1:]} {
+		logs := logs
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := a.OnNewLogHandler(context.Background(), logs); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if chain.batches != 0 {
+		t.Fatalf("block 10 analyzed open %d", chain.batches)
+	}
+	// block 10 is complete two blocks later, with its late swap
+	if err := a.OnNewLogHandler(context.Background(), block12.logs); err != nil {
+		t.Fatal(err)
+	}
+	arbs := a.Arbs(0, "")
+	if chain.batches != 1 || len(arbs) != 1 || arbs[0].Tx != late || len(arbs[0].Pairs) != 2 || arbs[0].Profit.Int64() != 20 {
+		t.Fatalf("batches %d arbs %+v", chain.batches, arbs)
+	}
+	if trades.observed[10] != 1 || trades.observed[11] != 0 {
+		t.Fatalf("observed %+v", trades.observed)
+	}
+}
@@ -0,0 +1,93 @@
+package competitor
+
+import (
+	"monitor/utils"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Summary counts the arbitrage txs kept by match and by sender
+type Summary struct {
+	Arbs    int              `json:"arbs"`
+	Matches map[string]int   `json:"matches"`
+	Senders []*SenderSummary `json:"senders"`
+}
+
+// SenderSummary is the arbitrage txs of a sender, the ones we saw and missed
+type SenderSummary struct {
+	From        common.Address `json:"from"`
+	Arbs        int            `json:"arbs"`
+	Missed      int            `json:"missed"`
+	MaxGasPrice float64        `json:"maxGasPrice"`
+}
+
+// Summarize counts the arbitrage txs kept, the senders with most txs first
+func (a *Analyzer) Summarize() *Summary {
+	arbs := a.Arbs(0, "")
+	summary := &Summary{Arbs: len(arbs), Matches: map[string]int{}, Senders: []*SenderSummary{}}
+	senders := map[common.Address]*SenderSummary{}
+	for _, arb := range arbs {
+		summary.Matches[arb.Match]++
+		if arb.Match == MatchOurs {
+			continue
+		}
+		sender, ok := senders[arb.From]
+		if !ok {
+			sender = &SenderSummary{From: arb.From}
+			senders[arb.From] = sender
+			summary.Senders = append(summary.Senders, sender)
+		}
+		sender.Arbs++
+		if arb.Match == MatchMissed {
+			sender.Missed++
+		}
+		if arb.GasPrice > sender.MaxGasPrice {
+			sender.MaxGasPrice = arb.GasPrice
+		}
+	}
+	sort.SliceStable(summary.Senders, func(i, j int) bool {
+		return summary.Senders[i].Arbs > summary.Senders[j].Arbs
+	})
+	return summary
+}
+
+// Handler serves the arbitrage txs found on chain:
+//
+//	GET /competitor/arbs?limit=&match=   the last arbitrage txs, newest first, match is ours, seen or missed
+//	GET /competitor/summary              the arbitrage txs kept by match and by sender
+func (a *Analyzer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/competitor/arbs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := reportSize
+		if s := r.URL.Query().Get("limit"); len(s) > 0 {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil {
+				http.Error(w, "invalid limit "+s, http.StatusBadRequest)
+				return
+			}
+		}
+		match := r.URL.Query().Get("match")
+		switch match {
+		case "", MatchOurs, MatchSeen, MatchMissed:
+		default:
+			http.Error(w, "invalid match "+match, http.StatusBadRequest)
+			return
+		}
+		utils.WriteJSON(w, a.Arbs(limit, match))
+	})
+	mux.HandleFunc("/competitor/summary", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		utils.WriteJSON(w, a.Summarize())
+	})
+	return mux
+}
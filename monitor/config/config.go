@@ -1,6 +1,11 @@
 package config
 
-import "github.com/ethereum/go-ethereum/common"
+import (
+	"monitor/utils"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
 
 type Config struct {
 	Node             string
@@ -12,4 +17,141 @@ type Config struct {
 	SwapAddress      common.Address
 	MinRecieve       float64
 	ETHNode          string
+	// KeystoreDir holds encrypted json keystores of more signer accounts, each trades a cycle
+	// in parallel with the others
+	KeystoreDir string
+	// KeystorePassphrase decrypts every keystore of KeystoreDir, read from KeystorePassphraseFile
+	// or prompted on the terminal when empty
+	KeystorePassphrase     string
+	KeystorePassphraseFile string
+	// RemoteSigner signs the txs of more accounts out of the process, nil disables it
+	RemoteSigner *RemoteSigner
+	// RateLimits is keyed by node endpoint, endpoints without an entry are not throttled
+	RateLimits map[string]*RateLimit
+	// StorageTTLBlocks drops datas not updated for this many blocks
+	StorageTTLBlocks     uint64
+	StorageSweepInterval time.Duration
+	// DataKeeper is the persistence backend, "file" (default) or "leveldb"
+	DataKeeper string
+	// DataKeeperWarmBlocks limits the leveldb cold start to datas updated in the last blocks, 0 loads all
+	DataKeeperWarmBlocks uint64
+	// Factories are the uniswapv2 style factories whose pairs are discovered and backfilled
+	Factories []*Factory
+	// DiscoveryPageSize is the number of pairs read per multicall, default 200
+	DiscoveryPageSize uint64
+	// DiscoveryRefreshInterval reseeds the reserves of pairs quiet for half the ttl, default 1 hour
+	DiscoveryRefreshInterval time.Duration
+	// ScreenMaxScore excludes the tokens whose risk score reaches it, default 50
+	ScreenMaxScore int64
+	// ScreenMinLiquidity is the minimum reserve in ether of the deepest WETH pair of a token, 0 disables it
+	ScreenMinLiquidity float64
+	// ScreenMinPairAgeBlocks excludes the pairs first seen fewer blocks ago, 0 disables it
+	ScreenMinPairAgeBlocks uint64
+	// ScreenRefreshBlocks screens a token again after this many blocks, default 43200
+	ScreenRefreshBlocks uint64
+	// GraphMinLiquidity is the minimum reserve in ether of either side of a pair valued through
+	// the best path to WETH, 0 disables it
+	GraphMinLiquidity float64
+	// GraphMinTradeSize is the minimum trade in ether a pair takes within GraphTargetSlippage, 0 disables it
+	GraphMinTradeSize float64
+	// GraphTargetSlippage is the slippage below the spot price, fee included, default 0.01
+	GraphTargetSlippage float64
+	// RecordDir records the logs, the gas prices and the multicall results into per day files, empty disables it
+	RecordDir string
+	// ReproducibleSearch searches the graph in pair address order so a replay takes the same
+	// decisions, backtests set it, the live search keeps the map order
+	ReproducibleSearch bool
+	// BatchCycles is the most cycles searched per graph, each without the pairs of the ones
+	// found before, the cycles traded together are sent in one swapBatch tx, default 1 sends
+	// every cycle alone, flash swaps are never batched
+	BatchCycles int
+	// Log configures the format, the levels per package and the sampling of the logs, nil logs
+	// colored text from info
+	Log *utils.LogConfig
+	// AdminToken is the bearer token of the admin api, empty refuses every admin request
+	AdminToken string
+	// AdminPairHistory is the number of states kept per pair for the admin api, default 16
+	AdminPairHistory int
+	// AdminPairHistoryPairs bounds the pairs the admin api keeps states of, the pair stored
+	// least recently is dropped first, default 4096
+	AdminPairHistoryPairs int
+	// CompetitorBlockLag keeps the swaps of a block open for its late logs until this many later
+	// blocks came, then the arbitrage txs of the block are analyzed, default 1
+	CompetitorBlockLag uint64
+	// ShutdownTimeout bounds the shutdown of every keeper, default 30s
+	ShutdownTimeout time.Duration
+	// MinGasBalance is the native balance in ether below which the low gas alert is raised, default 0.005
+	MinGasBalance float64
+	// AutoWrapReserve wraps the native balance above twice this many ether into WETH down to it,
+	// 0 disables it
+	AutoWrapReserve float64
+	// AutoApprove approves the swap contract for all WETH once the allowance falls below the balance
+	AutoApprove bool
+	// FlashSwap funds the cycles by a flash swap of their first pair, the trades are not bounded
+	// by the WETH of the accounts which need neither WETH nor an allowance
+	FlashSwap bool
+	// Strategy decides the min profit and the gas bid of the swaps, nil keeps the default policy
+	Strategy *Strategy
+}
+
+type Factory struct {
+	Name    string
+	Address common.Address
+	// Fee of every pair in fee base units, 0 leaves it calculated from swaps
+	Fee int64
+}
+
+// RemoteSigner is a json rpc signer serving eth_signTransaction, web3signer or a geth node,
+// clef serves account_signTransaction instead
+type RemoteSigner struct {
+	URL string
+	// Accounts signed by the remote signer, empty asks it with eth_accounts
+	Accounts []common.Address
+	// Headers are sent with every request, an authorization token for example
+	Headers map[string]string
+}
+
+// Strategy picks the first policy set of Competitive, FixedMargin and ProfitShare, else the
+// default policy bidding profit/1.2 and sending the cycles paying 1.5 times their fee
+type Strategy struct {
+	// MinGasPriceRatio is the lowest bid as a ratio of the gas price, default 0.05
+	MinGasPriceRatio float64
+	// DangerFee is the fee budget in ether above which the default policy refuses a swap able
+	// to outbid the gas price, unset refuses every such swap
+	DangerFee float64
+	// FixedMargin keeps this many ether of every swap and bids the rest of its profit
+	FixedMargin float64
+	// ProfitShare keeps this share of every swap profit and bids the rest
+	ProfitShare float64
+	// Competitive outbids the arbitrage txs won in the recent blocks, the winners are fed by
+	// the competitor analyzer and it bids the gas price until one is seen
+	Competitive *Competitive
+}
+
+type Competitive struct {
+	// Blocks is the number of recent blocks whose winners are outbid, default 50
+	Blocks uint64
+	// Overbid is the ratio bid above the highest winner, default 0.1
+	Overbid float64
+	// ProfitShare is the least share of the profit kept, default 0.2
+	ProfitShare float64
+}
+
+type RateLimit struct {
+	RequestsPerSecond     float64
+	ComputeUnitsPerSecond float64
+	// MethodComputeUnits is the provider compute unit weight per json rpc method, default 1
+	MethodComputeUnits map[string]float64
+	// TradeReserve is the fraction of the budget background calls must leave for trade calls
+	TradeReserve float64
+}
+
+// Factory returns the configured factory of address, nil when it is not configured
+func (c *Config) Factory(address common.Address) *Factory {
+	for _, factory := range c.Factories {
+		if factory.Address == address {
+			return factory
+		}
+	}
+	return nil
 }
@@ -0,0 +1,36 @@
+package datakeeper
+
+import (
+	"context"
+	"fmt"
+	"monitor/config"
+	"monitor/utils"
+)
+
+const (
+	KeeperTypeFile    = "file"
+	KeeperTypeLevelDB = "leveldb"
+
+	// CursorHead is the latest block whose logs were stored
+	CursorHead = "head"
+)
+
+// DataKeeper persists every registered storage and named block cursors
+type DataKeeper interface {
+	utils.Keeper
+	// Flush persists the datas accepted so far
+	Flush(ctx context.Context) error
+	SaveCursor(name string, blockNumber uint64) error
+	LoadCursor(name string) (uint64, bool, error)
+}
+
+func NewDataKeeper(ctx context.Context, conf *config.Config) (DataKeeper, error) {
+	switch conf.DataKeeper {
+	case "", KeeperTypeFile:
+		return NewFileDataKeeper(ctx, conf), nil
+	case KeeperTypeLevelDB:
+		return NewKVDataKeeper(ctx, conf), nil
+	default:
+		return nil, fmt.Errorf("data keeper type %s not support", conf.DataKeeper)
+	}
+}
@@ -3,27 +3,45 @@ package datakeeper
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"monitor/client"
+	"monitor/config"
 	"monitor/protocol"
 	"monitor/storage"
 	"monitor/utils"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var _ utils.Keeper = &FileDataKeeper{}
+const (
+	filePerm        = 0644
+	dirPerm         = 0755
+	legacySuffix    = ".legacy"
+	cursorsFileName = "Cursors"
+)
+
+var _ DataKeeper = &FileDataKeeper{}
 
 type FileDataKeeper struct {
+	config        *config.Config
 	storeFilePath string
-	wait          sync.WaitGroup
-	closed        bool
+	chainID       uint64
+	wals          map[string]*walFile
+	cursorLock    sync.Mutex
+	// writeLock serializes the snapshot writes with the shut down, closed is set under it
+	// and read by the wal subscriptions without it
+	writeLock sync.Mutex
+	closed    atomic.Bool
 }
 
-func NewFileDataKeeper(ctx context.Context, storeFilePath string) *FileDataKeeper {
+func NewFileDataKeeper(ctx context.Context, conf *config.Config) *FileDataKeeper {
 	return &FileDataKeeper{
-		storeFilePath: storeFilePath,
+		config:        conf,
+		storeFilePath: conf.StoreFilePath,
 	}
 }
 
@@ -32,90 +50,282 @@ func (f *FileDataKeeper) Init(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("make path dir fail %s", err)
 	}
+	cli, err := client.GetETHClient(ctx, f.config.Node, f.config.MulticallAddress)
+	if err != nil {
+		return fmt.Errorf("get eth client fail %s", err)
+	}
+	chainID, err := cli.ChainID(ctx)
+	if err != nil {
+		return fmt.Errorf("get chain id fail %s", err)
+	}
+	f.chainID = chainID.Uint64()
 	err = f.readData(ctx)
 	if err != nil {
 		return fmt.Errorf("read file data fail %s", err)
 	}
-	go func() {
-		f.writtingData(ctx)
-	}()
+	err = f.openWALs(ctx)
+	if err != nil {
+		return fmt.Errorf("open wal fail %s", err)
+	}
+	utils.Go(ctx, "datakeeper.write", f.writtingData)
 	return nil
 }
 
 func (f *FileDataKeeper) ShutDown(ctx context.Context) {
-	f.closed = true
-	err := f.writeData(ctx)
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+	if f.closed.Load() {
+		return
+	}
+	err := f.writeDataLocked(ctx)
 	if err != nil {
 		utils.Errorf("wirte data fail %s", err)
 	}
-	f.wait.Wait()
+	// the changes after the last snapshot are not appended to the closed wals
+	f.closed.Store(true)
+	for key, wal := range f.wals {
+		err = wal.Close()
+		if err != nil {
+			utils.Errorf("close wal %s fail %s", key, err)
+		}
+	}
 }
 
-func (f *FileDataKeeper) writtingData(ctx context.Context) {
-	for {
-		<-time.After(time.Minute)
-		if f.closed {
-			return
+// openWALs appends every accepted change to the wal of its storage,
+// it must run after readData so the replay is not written again
+func (f *FileDataKeeper) openWALs(ctx context.Context) error {
+	f.wals = map[string]*walFile{}
+	for key, store := range storage.AllDatasStorage {
+		wal, err := openWAL(f.storeFilePath, key)
+		if err != nil {
+			return fmt.Errorf("open wal %s fail %s", key, err)
 		}
+		f.wals[key] = wal
+		key := key
+		store.SubscribeDatas(func(_ []interface{}, datas []storage.DataUpdate) {
+			if f.closed.Load() {
+				return
+			}
+			records := make([][]byte, 0, len(datas))
+			for _, data := range datas {
+				records = append(records, data.(protocol.DataConvert).ToBinary())
+			}
+			err := wal.Append(records)
+			if err != nil && !f.closed.Load() {
+				utils.Errorf("append wal %s fail %s", key, err)
+			}
+		})
+	}
+	return nil
+}
+
+func (f *FileDataKeeper) Flush(ctx context.Context) error {
+	return f.writeData(ctx)
+}
+
+func (f *FileDataKeeper) SaveCursor(name string, blockNumber uint64) error {
+	f.cursorLock.Lock()
+	defer f.cursorLock.Unlock()
+	cursors, err := f.readCursors()
+	if err != nil {
+		return err
+	}
+	cursors[name] = blockNumber
+	body, err := json.Marshal(cursors)
+	if err != nil {
+		return fmt.Errorf("marshal cursors fail %s", err)
+	}
+	return writeFileAtomic(filepath.Join(f.storeFilePath, cursorsFileName), body)
+}
+
+func (f *FileDataKeeper) LoadCursor(name string) (uint64, bool, error) {
+	f.cursorLock.Lock()
+	defer f.cursorLock.Unlock()
+	cursors, err := f.readCursors()
+	if err != nil {
+		return 0, false, err
+	}
+	blockNumber, ok := cursors[name]
+	return blockNumber, ok, nil
+}
+
+func (f *FileDataKeeper) readCursors() (map[string]uint64, error) {
+	cursors := map[string]uint64{}
+	body, err := f.fetchFile(context.Background(), cursorsFileName)
+	if err != nil {
+		return nil, fmt.Errorf("fetch cursors fail %s", err)
+	}
+	if len(body) == 0 {
+		return cursors, nil
+	}
+	err = json.Unmarshal(body, &cursors)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal cursors fail %s", err)
+	}
+	return cursors, nil
+}
+
+func (f *FileDataKeeper) writtingData(ctx context.Context) error {
+	for utils.Sleep(ctx, time.Minute) {
 		err := f.writeData(ctx)
 		if err != nil {
 			utils.Warnf("wirte data fail %s", err)
 		}
 	}
+	return nil
 }
 
 func (f *FileDataKeeper) writeData(ctx context.Context) error {
-	f.wait.Add(1)
-	defer f.wait.Done()
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+	if f.closed.Load() {
+		return fmt.Errorf("data keeper closed")
+	}
+	return f.writeDataLocked(ctx)
+}
+
+// writeDataLocked must be called with writeLock held
+func (f *FileDataKeeper) writeDataLocked(ctx context.Context) error {
 	startTime := time.Now()
 	total := 0
 	for key, store := range storage.AllDatasStorage {
-		datas := store.LoadAll()
-		dataBody := []byte{}
-		for _, data := range datas {
-			dataBody = append(dataBody, data.(protocol.DataConvert).ToFileData()...)
-			dataBody = append(dataBody, []byte("\n")...)
+		records, seq, err := f.compactRecords(key, store)
+		if err != nil {
+			return fmt.Errorf("rotate wal %s fail %s", key, err)
 		}
-		total += len(datas)
-		err := f.updateFile(ctx, key, dataBody)
+		total += len(records)
+		body := encodeSnapshot(&SnapshotHeader{
+			ChainID:   f.chainID,
+			LastBlock: storage.Head(),
+		}, records)
+		err = f.updateFile(ctx, key, body)
 		if err != nil {
 			return fmt.Errorf("update file %s fail %s", key, err)
 		}
+		if wal := f.wals[key]; wal != nil {
+			err = wal.dropBefore(seq)
+			if err != nil {
+				return fmt.Errorf("drop wal %s fail %s", key, err)
+			}
+		}
 	}
 	utils.Infof("write file date length %d, spend time %s", total, time.Since(startTime))
 	return nil
 }
 
+// compactRecords reads the storage and starts a new wal segment under the wal lock,
+// every change missing from the records is appended to the new segment
+func (f *FileDataKeeper) compactRecords(key string, store storage.DatasStorage) ([][]byte, uint64, error) {
+	wal := f.wals[key]
+	if wal != nil {
+		wal.lock.Lock()
+		defer wal.lock.Unlock()
+	}
+	records := make([][]byte, 0, store.Len())
+	store.RangeDatas(func(_ interface{}, data storage.DataUpdate) bool {
+		records = append(records, data.(protocol.DataConvert).ToBinary())
+		return true
+	})
+	if wal == nil {
+		return records, 0, nil
+	}
+	seq, err := wal.rotate()
+	return records, seq, err
+}
+
 func (f *FileDataKeeper) readData(ctx context.Context) error {
 	for key, store := range storage.AllDatasStorage {
 		body, err := f.fetchFile(ctx, key)
 		if err != nil {
 			return fmt.Errorf("fetch file %s fail %s", key, err)
 		}
-		lines := bytes.Split(body, []byte("\n"))
 		var (
-			ks = []interface{}{}
-			vs = []interface{}{}
+			ks     = []interface{}{}
+			vs     = []interface{}{}
+			report = &SnapshotReport{}
+			decode = func(record []byte) error {
+				k, v, err := protocol.BinaryToStorage(key, record)
+				if err != nil {
+					return err
+				}
+				ks = append(ks, k)
+				vs = append(vs, v)
+				return nil
+			}
 		)
-		for _, line := range lines {
-			if len(line) == 0 {
-				continue
+		switch {
+		case len(body) == 0:
+			// nothing snapshotted yet, the wal may still hold changes
+		case isSnapshot(body):
+			var header *SnapshotHeader
+			header, report, err = decodeSnapshot(body, decode)
+			if err != nil {
+				return fmt.Errorf("decode snapshot %s fail %s", key, err)
 			}
-			k, v, err := protocol.FileDataToStorage(key, line)
+			if header.ChainID != f.chainID {
+				return fmt.Errorf("snapshot %s chain id %d mismatch %d", key, header.ChainID, f.chainID)
+			}
+			storage.UpdateHead(header.LastBlock)
+		default:
+			// text format before snapshot version 1, keep a copy since the next write replaces it
+			report = readLegacyData(key, body, func(k, v interface{}) {
+				ks = append(ks, k)
+				vs = append(vs, v)
+			})
+			err = f.backupLegacyFile(ctx, key, body)
 			if err != nil {
-				return fmt.Errorf("file data to struct fail %s %s", string(line), err)
+				return fmt.Errorf("backup legacy file %s fail %s", key, err)
 			}
-			ks = append(ks, k)
-			vs = append(vs, v)
+			utils.Infof("migrate legacy text file %s", key)
+		}
+		if report.Skipped > 0 || report.Truncated {
+			utils.Warnf("read file %s skipped %d records truncated %t %s", key, report.Skipped, report.Truncated, report.Errors)
 		}
-		store.Store(ks, vs)
+		walReport, err := replayWAL(f.storeFilePath, key, decode)
+		if err != nil {
+			return fmt.Errorf("replay wal %s fail %s", key, err)
+		}
+		if walReport.Skipped > 0 || walReport.Truncated {
+			utils.Warnf("replay wal %s skipped %d records truncated %t %s", key, walReport.Skipped, walReport.Truncated, walReport.Errors)
+		}
+		err = store.StoreDatas(ks, vs)
+		if err != nil {
+			return fmt.Errorf("store %s fail %s", key, err)
+		}
+		utils.Infof("read file %s loaded %d records, replay wal %d records", key, report.Loaded, walReport.Loaded)
 	}
 	return nil
 }
 
+func readLegacyData(key string, body []byte, store func(k, v interface{})) *SnapshotReport {
+	report := &SnapshotReport{}
+	lines := bytes.Split(body, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		k, v, err := protocol.FileDataToStorage(key, line)
+		if err != nil {
+			report.skip("line %d %s", i+1, err)
+			continue
+		}
+		store(k, v)
+		report.Loaded++
+	}
+	return report
+}
+
+func (f *FileDataKeeper) backupLegacyFile(ctx context.Context, fileName string, body []byte) error {
+	filePath := filepath.Join(f.storeFilePath, fileName+legacySuffix)
+	if _, err := os.Stat(filePath); err == nil {
+		return nil
+	}
+	return writeFileAtomic(filePath, body)
+}
+
 func (f *FileDataKeeper) appendFile(ctx context.Context, fileName string, body []byte) error {
 	filePath := filepath.Join(f.storeFilePath, fileName)
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, filePerm)
 	if err != nil {
 		return fmt.Errorf("open file fail %s", err)
 	}
@@ -129,11 +339,7 @@ func (f *FileDataKeeper) appendFile(ctx context.Context, fileName string, body [
 
 func (f *FileDataKeeper) updateFile(ctx context.Context, fileName string, body []byte) error {
 	filePath := filepath.Join(f.storeFilePath, fileName)
-	err := os.WriteFile(filePath, body, os.ModePerm)
-	if err != nil {
-		return fmt.Errorf("write file fail %s", err)
-	}
-	return nil
+	return writeFileAtomic(filePath, body)
 }
 
 func (f *FileDataKeeper) fetchFile(ctx context.Context, fileName string) ([]byte, error) {
@@ -152,5 +358,5 @@ func (f *FileDataKeeper) mkDir(ctx context.Context) error {
 	if f.storeFilePath == "" {
 		return fmt.Errorf("storage path empty")
 	}
-	return os.MkdirAll(f.storeFilePath, os.ModePerm)
+	return os.MkdirAll(f.storeFilePath, dirPerm)
 }
@@ -0,0 +1,47 @@
+package datakeeper
+
+import (
+	"context"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/storage"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestFileDataKeeperShutDown(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := NewFileDataKeeper(ctx, &config.Config{StoreFilePath: dir})
+	f.chainID = 8453
+	if err := f.openWALs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	walRecords := func() int {
+		report, err := replayWAL(dir, storage.StoreKeyUniswapv2Pairs, func([]byte) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report.Loaded
+	}
+	store := func(i int) {
+		pair := testPair(i)
+		protocol.UniswapV2Pairs.Store([]common.Address{pair.Address}, []*protocol.UniswapV2Pair{pair})
+	}
+	store(500)
+	if n := walRecords(); n != 1 {
+		t.Fatalf("wal records %d", n)
+	}
+
+	f.ShutDown(ctx)
+	if err := f.Flush(ctx); err == nil {
+		t.Fatalf("flushed after shut down")
+	}
+	// the changes after the shut down are not appended to the closed wals
+	store(501)
+	if n := walRecords(); n != 0 {
+		t.Fatalf("wal records after shut down %d", n)
+	}
+	f.ShutDown(ctx)
+}
@@ -0,0 +1,482 @@
+package datakeeper
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"monitor/client"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/storage"
+	"monitor/trader"
+	"monitor/utils"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/leveldb"
+)
+
+/*
+key layout, one bucket per storage key
+
+	d<storeKey>/<key>                  data record
+	t<storeKey>/<token><key>           index by token
+	b<storeKey>/<block uint64><key>    index by last updated block
+	r<time unix nano uint64><tx>       trade of the ledger
+	c<name>                            block cursor
+	mchainid                           chain id
+*/
+const (
+	kvDirName     = "leveldb"
+	kvLoadChunk   = 10000
+	kvCacheMB     = 256
+	kvFileHandles = 512
+)
+
+var (
+	_ DataKeeper = &KVDataKeeper{}
+
+	errKVClosed = errors.New("leveldb closed")
+
+	kvChainIDKey   = []byte("mchainid")
+	kvTradesPrefix = []byte("r")
+	kvCursorPrefix = []byte("c")
+)
+
+// blockIndexed datas are indexed by their last updated block
+type blockIndexed interface {
+	UpdatedBlock() uint64
+}
+
+// tokenIndexed datas are indexed by the tokens they trade
+type tokenIndexed interface {
+	IndexTokens() []common.Address
+}
+
+// KVDataKeeper writes every accepted change to an embedded leveldb,
+// the cold start only loads the datas updated in the last warm blocks
+type KVDataKeeper struct {
+	config *config.Config
+	db     ethdb.KeyValueStore
+	// the writes hold lock to read closed, ShutDown closes the db holding it
+	lock   sync.RWMutex
+	closed bool
+}
+
+func NewKVDataKeeper(ctx context.Context, conf *config.Config) *KVDataKeeper {
+	return &KVDataKeeper{
+		config: conf,
+	}
+}
+
+func (k *KVDataKeeper) Init(ctx context.Context) error {
+	if k.db == nil {
+		if k.config.StoreFilePath == "" {
+			return fmt.Errorf("storage path empty")
+		}
+		db, err := leveldb.New(filepath.Join(k.config.StoreFilePath, kvDirName), kvCacheMB, kvFileHandles, "", false)
+		if err != nil {
+			return fmt.Errorf("open leveldb fail %s", err)
+		}
+		k.db = db
+	}
+	cli, err := client.GetETHClient(ctx, k.config.Node, k.config.MulticallAddress)
+	if err != nil {
+		return fmt.Errorf("get eth client fail %s", err)
+	}
+	chainID, err := cli.ChainID(ctx)
+	if err != nil {
+		return fmt.Errorf("get chain id fail %s", err)
+	}
+	return k.open(ctx, chainID.Uint64())
+}
+
+// open checks the chain, loads the warm datas and starts writing changes
+func (k *KVDataKeeper) open(ctx context.Context, chainID uint64) error {
+	stored, err := k.db.Get(kvChainIDKey)
+	if err == nil {
+		if len(stored) != 8 || binary.BigEndian.Uint64(stored) != chainID {
+			return fmt.Errorf("leveldb chain id %x mismatch %d", stored, chainID)
+		}
+	} else {
+		err = k.db.Put(kvChainIDKey, binary.BigEndian.AppendUint64(nil, chainID))
+		if err != nil {
+			return fmt.Errorf("put chain id fail %s", err)
+		}
+	}
+	head, _, err := k.LoadCursor(CursorHead)
+	if err != nil {
+		return err
+	}
+	storage.UpdateHead(head)
+	var from uint64
+	if k.config.DataKeeperWarmBlocks > 0 && head > k.config.DataKeeperWarmBlocks {
+		from = head - k.config.DataKeeperWarmBlocks
+	}
+	for key, store := range storage.AllDatasStorage {
+		startTime := time.Now()
+		count, err := k.load(key, store, from)
+		if err != nil {
+			return fmt.Errorf("load %s fail %s", key, err)
+		}
+		utils.Infof("load leveldb %s from block %d length %d, spend time %s", key, from, count, time.Since(startTime))
+		key := key
+		store.SubscribeDatas(func(keys []interface{}, datas []storage.DataUpdate) {
+			err := k.write(key, keys, datas)
+			if err != nil && err != errKVClosed {
+				utils.Errorf("write leveldb %s fail %s", key, err)
+			}
+		})
+		store.EvictDatas(func(keys []interface{}, datas []storage.DataUpdate) {
+			err := k.evict(key, keys, datas)
+			if err != nil && err != errKVClosed {
+				utils.Errorf("evict leveldb %s fail %s", key, err)
+			}
+		})
+	}
+	return nil
+}
+
+// ShutDown saves the head and closes the db, the writes after it fail
+func (k *KVDataKeeper) ShutDown(ctx context.Context) {
+	err := k.Flush(ctx)
+	if err != nil && err != errKVClosed {
+		utils.Errorf("flush leveldb fail %s", err)
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.closed || k.db == nil {
+		return
+	}
+	k.closed = true
+	err = k.db.Close()
+	if err != nil {
+		utils.Errorf("close leveldb fail %s", err)
+	}
+}
+
+// Flush saves the head cursor, the datas are written as they change with the head
+func (k *KVDataKeeper) Flush(ctx context.Context) error {
+	head := storage.Head()
+	if head == 0 {
+		return nil
+	}
+	return k.SaveCursor(CursorHead, head)
+}
+
+func (k *KVDataKeeper) SaveCursor(name string, blockNumber uint64) error {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if k.closed {
+		return errKVClosed
+	}
+	err := k.db.Put(kvCursorKey(name), binary.BigEndian.AppendUint64(nil, blockNumber))
+	if err != nil {
+		return fmt.Errorf("put cursor %s fail %s", name, err)
+	}
+	return nil
+}
+
+func (k *KVDataKeeper) LoadCursor(name string) (uint64, bool, error) {
+	key := kvCursorKey(name)
+	ok, err := k.db.Has(key)
+	if err != nil {
+		return 0, false, fmt.Errorf("has cursor %s fail %s", name, err)
+	}
+	if !ok {
+		return 0, false, nil
+	}
+	value, err := k.db.Get(key)
+	if err != nil {
+		return 0, false, fmt.Errorf("get cursor %s fail %s", name, err)
+	}
+	if len(value) != 8 {
+		return 0, false, fmt.Errorf("cursor %s length error %d", name, len(value))
+	}
+	return binary.BigEndian.Uint64(value), true, nil
+}
+
+// RangeByToken calls f with every data of storeKey trading token, including the ones not loaded
+func (k *KVDataKeeper) RangeByToken(storeKey string, token common.Address, f func(key, data interface{}) bool) error {
+	return k.rangeIndex(storeKey, "t", token.Bytes(), nil, common.AddressLength, func(_ []byte, key, data interface{}) bool {
+		return f(key, data)
+	})
+}
+
+// RangeByBlock calls f with every data of storeKey last updated in [from, to] in block order
+func (k *KVDataKeeper) RangeByBlock(storeKey string, from, to uint64, f func(key, data interface{}) bool) error {
+	return k.rangeIndex(storeKey, "b", nil, binary.BigEndian.AppendUint64(nil, from), 8, func(indexed []byte, key, data interface{}) bool {
+		if binary.BigEndian.Uint64(indexed) > to {
+			return false
+		}
+		return f(key, data)
+	})
+}
+
+// rangeIndex iterates the index kind of storeKey, every index key is prefix, indexed value of skip bytes, data key
+func (k *KVDataKeeper) rangeIndex(storeKey, kind string, match, start []byte, skip int, f func(indexed []byte, key, data interface{}) bool) error {
+	prefix := kvIndexPrefix(kind, storeKey)
+	it := k.db.NewIterator(append(prefix, match...), start)
+	defer it.Release()
+	for it.Next() {
+		var (
+			indexed = it.Key()[len(prefix) : len(prefix)+skip]
+			dataKey = it.Key()[len(prefix)+skip:]
+		)
+		record, err := k.db.Get(kvDataKey(storeKey, dataKey))
+		if err != nil {
+			// the data is gone since the iterator started
+			continue
+		}
+		key, data, err := protocol.BinaryToStorage(storeKey, record)
+		if err != nil {
+			return fmt.Errorf("decode %s %x fail %s", storeKey, dataKey, err)
+		}
+		if !f(indexed, key, data) {
+			return nil
+		}
+	}
+	return it.Error()
+}
+
+// load stores the datas updated since from, all of them when from is 0, in chunks
+func (k *KVDataKeeper) load(storeKey string, store storage.DatasStorage, from uint64) (int, error) {
+	var (
+		total   = 0
+		ks      = []interface{}{}
+		vs      = []interface{}{}
+		loadErr error
+		flush   = func() {
+			loadErr = store.StoreDatas(ks, vs)
+			total += len(ks)
+			ks, vs = ks[:0], vs[:0]
+		}
+		add = func(key, data interface{}) bool {
+			ks = append(ks, key)
+			vs = append(vs, data)
+			if len(ks) >= kvLoadChunk {
+				flush()
+			}
+			return loadErr == nil
+		}
+	)
+	if from > 0 && !k.hasIndex(storeKey, "b") {
+		// datas without block index are always loaded
+		from = 0
+	}
+	if from == 0 {
+		it := k.db.NewIterator(kvIndexPrefix("d", storeKey), nil)
+		for it.Next() {
+			key, data, err := protocol.BinaryToStorage(storeKey, it.Value())
+			if err != nil {
+				utils.Warnf("decode leveldb %s %x fail %s", storeKey, it.Key(), err)
+				continue
+			}
+			if !add(key, data) {
+				break
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return total, err
+		}
+	} else {
+		err := k.RangeByBlock(storeKey, from, ^uint64(0), add)
+		if err != nil {
+			return total, err
+		}
+	}
+	if loadErr != nil {
+		return total, loadErr
+	}
+	flush()
+	return total, loadErr
+}
+
+func (k *KVDataKeeper) hasIndex(storeKey, kind string) bool {
+	it := k.db.NewIterator(kvIndexPrefix(kind, storeKey), nil)
+	defer it.Release()
+	return it.Next()
+}
+
+func (k *KVDataKeeper) write(storeKey string, keys []interface{}, datas []storage.DataUpdate) error {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if k.closed {
+		return errKVClosed
+	}
+	batch := k.db.NewBatch()
+	for i, data := range datas {
+		dataKey, err := kvKeyBytes(keys[i])
+		if err != nil {
+			return err
+		}
+		convert, ok := data.(protocol.DataConvert)
+		if !ok {
+			return fmt.Errorf("data type error %T", data)
+		}
+		if block, ok := data.(blockIndexed); ok {
+			err = k.moveBlockIndex(batch, storeKey, dataKey, block.UpdatedBlock())
+			if err != nil {
+				return err
+			}
+		}
+		if tokens, ok := data.(tokenIndexed); ok {
+			for _, token := range tokens.IndexTokens() {
+				err = batch.Put(append(append(kvIndexPrefix("t", storeKey), token.Bytes()...), dataKey...), nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err = batch.Put(kvDataKey(storeKey, dataKey), convert.ToBinary())
+		if err != nil {
+			return err
+		}
+	}
+	// the head moves with the datas so a crash restarts from the datas written
+	if head := storage.Head(); head > 0 {
+		err := batch.Put(kvCursorKey(CursorHead), binary.BigEndian.AppendUint64(nil, head))
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Write()
+}
+
+// evict deletes the datas dropped from the store with their indexes
+func (k *KVDataKeeper) evict(storeKey string, keys []interface{}, datas []storage.DataUpdate) error {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if k.closed {
+		return errKVClosed
+	}
+	batch := k.db.NewBatch()
+	for i, data := range datas {
+		dataKey, err := kvKeyBytes(keys[i])
+		if err != nil {
+			return err
+		}
+		// the block index is the one of the stored record
+		if record, err := k.db.Get(kvDataKey(storeKey, dataKey)); err == nil {
+			if _, old, err := protocol.BinaryToStorage(storeKey, record); err == nil {
+				if block, ok := old.(blockIndexed); ok {
+					err = batch.Delete(kvBlockKey(kvIndexPrefix("b", storeKey), block.UpdatedBlock(), dataKey))
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if tokens, ok := data.(tokenIndexed); ok {
+			for _, token := range tokens.IndexTokens() {
+				err = batch.Delete(append(append(kvIndexPrefix("t", storeKey), token.Bytes()...), dataKey...))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err = batch.Delete(kvDataKey(storeKey, dataKey))
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Write()
+}
+
+// SaveTrade writes entry to the trades bucket, a later save of the same trade replaces it
+func (k *KVDataKeeper) SaveTrade(entry trader.LedgerEntry) error {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if k.db == nil {
+		return fmt.Errorf("leveldb not open")
+	}
+	if k.closed {
+		return errKVClosed
+	}
+	value, err := json.Marshal(&entry)
+	if err != nil {
+		return fmt.Errorf("marshal trade fail %s", err)
+	}
+	err = k.db.Put(kvTradeKey(entry.Time, entry.Tx), value)
+	if err != nil {
+		return fmt.Errorf("put trade %s fail %s", entry.Tx, err)
+	}
+	return nil
+}
+
+// RangeTrades calls f with the trades sent in [from, to] in time order
+func (k *KVDataKeeper) RangeTrades(from, to time.Time, f func(entry *trader.LedgerEntry) bool) error {
+	it := k.db.NewIterator(kvTradesPrefix, binary.BigEndian.AppendUint64(nil, uint64(from.UnixNano())))
+	defer it.Release()
+	for it.Next() {
+		key := it.Key()[len(kvTradesPrefix):]
+		if binary.BigEndian.Uint64(key[:8]) > uint64(to.UnixNano()) {
+			break
+		}
+		entry := &trader.LedgerEntry{}
+		if err := json.Unmarshal(it.Value(), entry); err != nil {
+			return fmt.Errorf("decode trade %x fail %s", key[8:], err)
+		}
+		if !f(entry) {
+			return nil
+		}
+	}
+	return it.Error()
+}
+
+// moveBlockIndex drops the block index of the stored record before adding the new one
+func (k *KVDataKeeper) moveBlockIndex(batch ethdb.Batch, storeKey string, dataKey []byte, blockNumber uint64) error {
+	prefix := kvIndexPrefix("b", storeKey)
+	if record, err := k.db.Get(kvDataKey(storeKey, dataKey)); err == nil {
+		if _, old, err := protocol.BinaryToStorage(storeKey, record); err == nil {
+			if block, ok := old.(blockIndexed); ok && block.UpdatedBlock() != blockNumber {
+				err = batch.Delete(kvBlockKey(prefix, block.UpdatedBlock(), dataKey))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return batch.Put(kvBlockKey(prefix, blockNumber, dataKey), nil)
+}
+
+func kvIndexPrefix(kind string, storeKey string) []byte {
+	return []byte(kind + storeKey + "/")
+}
+
+func kvDataKey(storeKey string, dataKey []byte) []byte {
+	return append(kvIndexPrefix("d", storeKey), dataKey...)
+}
+
+func kvBlockKey(prefix []byte, blockNumber uint64, dataKey []byte) []byte {
+	key := binary.BigEndian.AppendUint64(append([]byte{}, prefix...), blockNumber)
+	return append(key, dataKey...)
+}
+
+func kvCursorKey(name string) []byte {
+	return append(append([]byte{}, kvCursorPrefix...), name...)
+}
+
+func kvTradeKey(at time.Time, tx common.Hash) []byte {
+	key := binary.BigEndian.AppendUint64(append([]byte{}, kvTradesPrefix...), uint64(at.UnixNano()))
+	return append(key, tx.Bytes()...)
+}
+
+func kvKeyBytes(key interface{}) ([]byte, error) {
+	switch v := key.(type) {
+	case common.Address:
+		return v.Bytes(), nil
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return append([]byte{}, v...), nil
+	default:
+		return nil, fmt.Errorf("key type error %T", key)
+	}
+}
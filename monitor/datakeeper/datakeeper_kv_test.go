@@ -0,0 +1,163 @@
+package datakeeper
+
+import (
+	"context"
+	"math/big"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/storage"
+	"monitor/trader"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+func TestKVDataKeeper(t *testing.T) {
+	ctx := context.Background()
+	k := NewKVDataKeeper(ctx, &config.Config{DataKeeperWarmBlocks: 5})
+	k.db = memorydb.New()
+	err := k.open(ctx, 8453)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []common.Address{}
+	pairs := []*protocol.UniswapV2Pair{}
+	for i := 0; i < 10; i++ {
+		pair := testPair(200 + i)
+		pair.BlockNumber = 100 + uint64(i)
+		keys = append(keys, pair.Address)
+		pairs = append(pairs, pair)
+	}
+	protocol.UniswapV2Pairs.Store(keys, pairs)
+
+	// every test pair trades token 1
+	count := 0
+	err = k.RangeByToken(storage.StoreKeyUniswapv2Pairs, common.BigToAddress(common.Big1), func(key, data interface{}) bool {
+		count++
+		return true
+	})
+	if err != nil || count < 10 {
+		t.Fatal(count, err)
+	}
+	count = 0
+	err = k.RangeByToken(storage.StoreKeyUniswapv2Pairs, pairs[3].Token1, func(key, data interface{}) bool {
+		if key.(common.Address) != pairs[3].Address {
+			t.Fatal(key)
+		}
+		count++
+		return true
+	})
+	if err != nil || count != 1 {
+		t.Fatal(count, err)
+	}
+
+	// the head is written with the datas
+	storage.UpdateHead(112)
+	// moving a pair to a newer block moves its block index
+	moved := testPair(200)
+	moved.BlockNumber = 120
+	protocol.UniswapV2Pairs.Store([]common.Address{moved.Address}, []*protocol.UniswapV2Pair{moved})
+	blocks := []uint64{}
+	err = k.RangeByBlock(storage.StoreKeyUniswapv2Pairs, 100, 120, func(key, data interface{}) bool {
+		blocks = append(blocks, data.(*protocol.UniswapV2Pair).BlockNumber)
+		return true
+	})
+	if err != nil || len(blocks) != 10 || blocks[0] != 101 || blocks[9] != 120 {
+		t.Fatal(blocks, err)
+	}
+
+	head, ok, err := k.LoadCursor(CursorHead)
+	if err != nil || !ok || head < 112 {
+		t.Fatal(head, ok, err)
+	}
+	err = k.SaveCursor(CursorHead, 110)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, ok, err = k.LoadCursor(CursorHead)
+	if err != nil || !ok || head != 110 {
+		t.Fatal(head, ok, err)
+	}
+
+	// a cold start only loads the warm datas
+	cold := storage.NewStore[common.Address, *protocol.UniswapV2Pair]()
+	loaded, err := k.load(storage.StoreKeyUniswapv2Pairs, cold, 105)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 6 || cold.Len() != 6 {
+		t.Fatal(loaded, cold.Len())
+	}
+	if _, ok := cold.Load(moved.Address); !ok {
+		t.Fatal("moved pair should be warm")
+	}
+
+	// tokens have no block index, they are always loaded
+	token := &protocol.Token{Address: common.BigToAddress(big.NewInt(77)), Decimals: 6, Symbol: "T", CheckedBlock: 1}
+	protocol.Tokens.Store([]common.Address{token.Address}, []*protocol.Token{token})
+	coldTokens := storage.NewStore[common.Address, *protocol.Token]()
+	loaded, err = k.load(storage.StoreKeyTokens, coldTokens, 105)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, ok := coldTokens.Load(token.Address); loaded != 1 || !ok || *stored != *token {
+		t.Fatal(loaded, stored)
+	}
+
+	// the evicted pairs are deleted with their indexes
+	protocol.UniswapV2Pairs.Expire(115, 10)
+	if ok, _ := k.db.Has(kvDataKey(storage.StoreKeyUniswapv2Pairs, pairs[1].Address.Bytes())); ok {
+		t.Fatal("evicted pair still stored")
+	}
+	count = 0
+	err = k.RangeByToken(storage.StoreKeyUniswapv2Pairs, pairs[1].Token1, func(key, data interface{}) bool {
+		count++
+		return true
+	})
+	if err != nil || count != 0 {
+		t.Fatal(count, err)
+	}
+	blocks = blocks[:0]
+	err = k.RangeByBlock(storage.StoreKeyUniswapv2Pairs, 0, 200, func(key, data interface{}) bool {
+		blocks = append(blocks, data.(*protocol.UniswapV2Pair).BlockNumber)
+		return true
+	})
+	if err != nil || len(blocks) != 6 || blocks[0] != 105 {
+		t.Fatal(blocks, err)
+	}
+
+	// a trade saved again is replaced
+	sent := time.Unix(1700000000, 0)
+	for _, entry := range []trader.LedgerEntry{
+		{Time: sent, Tx: common.Hash{1}, Status: "sent"},
+		{Time: sent.Add(time.Second), Tx: common.Hash{2}, Status: "sent"},
+		{Time: sent, Tx: common.Hash{1}, Status: "mined"},
+	} {
+		if err := k.SaveTrade(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trades := []*trader.LedgerEntry{}
+	err = k.RangeTrades(sent, sent.Add(time.Second), func(entry *trader.LedgerEntry) bool {
+		trades = append(trades, entry)
+		return true
+	})
+	if err != nil || len(trades) != 2 || trades[0].Status != "mined" || trades[1].Tx != (common.Hash{2}) {
+		t.Fatal(trades, err)
+	}
+
+	err = k.open(ctx, 1)
+	if err == nil {
+		t.Fatal("chain id mismatch should fail")
+	}
+
+	// the ledger saves after the shut down fail instead of writing a closed db
+	k.ShutDown(ctx)
+	if err := k.SaveTrade(trader.LedgerEntry{Time: sent, Tx: common.Hash{3}, Status: "mined"}); err != errKVClosed {
+		t.Fatal(err)
+	}
+	k.ShutDown(ctx)
+}
@@ -0,0 +1,177 @@
+package datakeeper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+/*
+snapshot file layout, integers are big endian
+
+	magic      8 bytes "EVMARBSS"
+	version    uint16
+	chainID    uint64
+	lastBlock  uint64
+	count      uint64
+	headerCRC  uint32 crc32 of the fields above
+	records    count times: length uint32, crc32 uint32, payload
+*/
+const (
+	snapshotMagic         = "EVMARBSS"
+	snapshotVersion       = uint16(1)
+	snapshotHeaderLength  = 8 + 2 + 8 + 8 + 8 + 4
+	snapshotRecordHeader  = 4 + 4
+	snapshotMaxRecord     = 1 << 20
+	snapshotReportMaxErrs = 10
+)
+
+type SnapshotHeader struct {
+	Version   uint16
+	ChainID   uint64
+	LastBlock uint64
+	Count     uint64
+}
+
+// SnapshotReport counts the records loaded and skipped by a tolerant read
+type SnapshotReport struct {
+	Loaded    int
+	Skipped   int
+	Truncated bool
+	// Offset is the end of the last complete record
+	Offset int
+	Errors []string
+}
+
+func (r *SnapshotReport) skip(format string, a ...interface{}) {
+	r.Skipped++
+	if len(r.Errors) < snapshotReportMaxErrs {
+		r.Errors = append(r.Errors, fmt.Sprintf(format, a...))
+	}
+}
+
+func isSnapshot(body []byte) bool {
+	return bytes.HasPrefix(body, []byte(snapshotMagic))
+}
+
+func encodeSnapshot(header *SnapshotHeader, records [][]byte) []byte {
+	size := snapshotHeaderLength
+	for _, record := range records {
+		size += snapshotRecordHeader + len(record)
+	}
+	body := make([]byte, 0, size)
+	body = append(body, []byte(snapshotMagic)...)
+	body = binary.BigEndian.AppendUint16(body, snapshotVersion)
+	body = binary.BigEndian.AppendUint64(body, header.ChainID)
+	body = binary.BigEndian.AppendUint64(body, header.LastBlock)
+	body = binary.BigEndian.AppendUint64(body, uint64(len(records)))
+	body = binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+	for _, record := range records {
+		body = appendRecord(body, record)
+	}
+	return body
+}
+
+func appendRecord(body []byte, record []byte) []byte {
+	body = binary.BigEndian.AppendUint32(body, uint32(len(record)))
+	body = binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(record))
+	return append(body, record...)
+}
+
+// decodeSnapshot fails only on a broken header, bad records are skipped and reported,
+// decode is called for every record whose checksum matches
+func decodeSnapshot(body []byte, decode func([]byte) error) (*SnapshotHeader, *SnapshotReport, error) {
+	if len(body) < snapshotHeaderLength || !isSnapshot(body) {
+		return nil, nil, fmt.Errorf("snapshot header error")
+	}
+	if crc32.ChecksumIEEE(body[:snapshotHeaderLength-4]) != binary.BigEndian.Uint32(body[snapshotHeaderLength-4:snapshotHeaderLength]) {
+		return nil, nil, fmt.Errorf("snapshot header checksum error")
+	}
+	header := &SnapshotHeader{
+		Version:   binary.BigEndian.Uint16(body[8:10]),
+		ChainID:   binary.BigEndian.Uint64(body[10:18]),
+		LastBlock: binary.BigEndian.Uint64(body[18:26]),
+		Count:     binary.BigEndian.Uint64(body[26:34]),
+	}
+	if header.Version != snapshotVersion {
+		return nil, nil, fmt.Errorf("snapshot version %d not support", header.Version)
+	}
+	report := readRecords(body[snapshotHeaderLength:], decode)
+	if uint64(report.Loaded+report.Skipped) != header.Count {
+		report.Truncated = true
+	}
+	return header, report, nil
+}
+
+// readRecords stops at the first record whose length runs past the end
+func readRecords(body []byte, decode func([]byte) error) *SnapshotReport {
+	report := &SnapshotReport{}
+	offset := 0
+	for offset < len(body) {
+		if len(body)-offset < snapshotRecordHeader {
+			report.Truncated = true
+			break
+		}
+		length := int(binary.BigEndian.Uint32(body[offset : offset+4]))
+		checksum := binary.BigEndian.Uint32(body[offset+4 : offset+8])
+		if length > snapshotMaxRecord || len(body)-offset-snapshotRecordHeader < length {
+			report.Truncated = true
+			break
+		}
+		start := offset
+		record := body[offset+snapshotRecordHeader : offset+snapshotRecordHeader+length]
+		offset += snapshotRecordHeader + length
+		report.Offset = offset
+		if crc32.ChecksumIEEE(record) != checksum {
+			report.skip("record at %d checksum error", start)
+			continue
+		}
+		if err := decode(record); err != nil {
+			report.skip("record at %d decode fail %s", start, err)
+			continue
+		}
+		report.Loaded++
+	}
+	report.Offset = offset
+	return report
+}
+
+// writeFileAtomic writes a temp file in the same dir, syncs it and renames it over filePath
+func writeFileAtomic(filePath string, body []byte) error {
+	dir := filepath.Dir(filePath)
+	tmp, err := os.CreateTemp(dir, filepath.Base(filePath)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create temp file fail %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(body)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp file fail %s", err)
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file fail %s", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("close temp file fail %s", err)
+	}
+	err = os.Chmod(tmp.Name(), filePerm)
+	if err != nil {
+		return fmt.Errorf("chmod temp file fail %s", err)
+	}
+	err = os.Rename(tmp.Name(), filePath)
+	if err != nil {
+		return fmt.Errorf("rename temp file fail %s", err)
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
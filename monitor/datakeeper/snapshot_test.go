@@ -0,0 +1,136 @@
+package datakeeper
+
+import (
+	"context"
+	"encoding/binary"
+	"math/big"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/storage"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func testPair(i int) *protocol.UniswapV2Pair {
+	return &protocol.UniswapV2Pair{
+		Address:  common.BigToAddress(big.NewInt(int64(1000 + i))),
+		Token0:   common.BigToAddress(big.NewInt(1)),
+		Token1:   common.BigToAddress(big.NewInt(int64(2 + i))),
+		Reserve0: big.NewInt(int64(100 + i)),
+		Reserve1: big.NewInt(int64(200 + i)),
+		Fee:      30,
+		StateFromLogUpdate: &protocol.StateFromLogUpdate{
+			BlockNumber: uint64(10 + i),
+		},
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	records := [][]byte{}
+	for i := 0; i < 5; i++ {
+		records = append(records, testPair(i).ToBinary())
+	}
+	body := encodeSnapshot(&SnapshotHeader{ChainID: 8453, LastBlock: 99}, records)
+
+	decoded := 0
+	header, report, err := decodeSnapshot(body, func(record []byte) error {
+		decoded++
+		return (&protocol.UniswapV2Pair{}).FromBinary(record)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.ChainID != 8453 || header.LastBlock != 99 || header.Count != 5 {
+		t.Fatalf("%+v", header)
+	}
+	if report.Loaded != 5 || report.Skipped != 0 || report.Truncated || decoded != 5 {
+		t.Fatalf("%+v", report)
+	}
+
+	// flip a byte in the second record payload
+	broken := append([]byte{}, body...)
+	second := snapshotHeaderLength + snapshotRecordHeader + len(records[0]) + snapshotRecordHeader
+	broken[second+3] ^= 0xff
+	_, report, err = decodeSnapshot(broken, func(record []byte) error {
+		return (&protocol.UniswapV2Pair{}).FromBinary(record)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Loaded != 4 || report.Skipped != 1 || report.Truncated {
+		t.Fatalf("%+v", report)
+	}
+
+	// cut in the middle of the last record
+	_, report, err = decodeSnapshot(body[:len(body)-3], func(record []byte) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Loaded != 4 || !report.Truncated {
+		t.Fatalf("%+v", report)
+	}
+
+	broken = append([]byte{}, body...)
+	binary.BigEndian.PutUint64(broken[10:18], 1)
+	_, _, err = decodeSnapshot(broken, func(record []byte) error { return nil })
+	if err == nil {
+		t.Fatal("header checksum should fail")
+	}
+}
+
+func TestReadLegacyData(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := NewFileDataKeeper(ctx, &config.Config{StoreFilePath: dir})
+	f.chainID = 8453
+
+	body := []byte{}
+	for i := 0; i < 3; i++ {
+		body = append(body, testPair(i).ToFileData()...)
+		body = append(body, '\n')
+	}
+	body = append(body, []byte("broken line\n")...)
+	err := os.WriteFile(filepath.Join(dir, storage.StoreKeyUniswapv2Pairs), body, filePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.readData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := protocol.UniswapV2Pairs.Load(testPair(i).Address); !ok {
+			t.Fatal(i)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, storage.StoreKeyUniswapv2Pairs+legacySuffix)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.writeData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(filepath.Join(dir, storage.StoreKeyUniswapv2Pairs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSnapshot(written) {
+		t.Fatalf("%x", written[:8])
+	}
+	err = f.readData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.chainID = 1
+	err = f.readData(ctx)
+	if err == nil {
+		t.Fatal("chain id mismatch should fail")
+	}
+}
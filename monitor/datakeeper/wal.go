@@ -0,0 +1,157 @@
+package datakeeper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const walSuffix = ".wal."
+
+// walFile appends snapshot records to numbered segments <key>.wal.<n>,
+// Rotate starts a new segment so the older ones can be dropped once a snapshot covers them
+type walFile struct {
+	dir  string
+	key  string
+	seq  uint64
+	file *os.File
+	lock sync.Mutex
+}
+
+func openWAL(dir string, key string) (*walFile, error) {
+	segments, err := walSegments(dir, key)
+	if err != nil {
+		return nil, err
+	}
+	w := &walFile{
+		dir: dir,
+		key: key,
+	}
+	if len(segments) > 0 {
+		w.seq = segments[len(segments)-1]
+	}
+	w.file, err = os.OpenFile(w.segmentPath(w.seq), os.O_APPEND|os.O_CREATE|os.O_WRONLY, filePerm)
+	if err != nil {
+		return nil, fmt.Errorf("open wal fail %s", err)
+	}
+	return w, nil
+}
+
+func (w *walFile) segmentPath(seq uint64) string {
+	return filepath.Join(w.dir, w.key+walSuffix+strconv.FormatUint(seq, 10))
+}
+
+func (w *walFile) Append(records [][]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+	body := []byte{}
+	for _, record := range records {
+		body = appendRecord(body, record)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return fmt.Errorf("wal closed")
+	}
+	_, err := w.file.Write(body)
+	if err != nil {
+		return fmt.Errorf("write wal fail %s", err)
+	}
+	return w.file.Sync()
+}
+
+// rotate must be called with lock held, it returns the sequence of the new segment
+func (w *walFile) rotate() (uint64, error) {
+	file, err := os.OpenFile(w.segmentPath(w.seq+1), os.O_APPEND|os.O_CREATE|os.O_WRONLY, filePerm)
+	if err != nil {
+		return 0, fmt.Errorf("open wal fail %s", err)
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.seq++
+	w.file = file
+	return w.seq, nil
+}
+
+// dropBefore removes the segments older than seq
+func (w *walFile) dropBefore(seq uint64) error {
+	segments, err := walSegments(w.dir, w.key)
+	if err != nil {
+		return err
+	}
+	for _, one := range segments {
+		if one >= seq {
+			continue
+		}
+		err = os.Remove(w.segmentPath(one))
+		if err != nil {
+			return fmt.Errorf("remove wal fail %s", err)
+		}
+	}
+	return nil
+}
+
+func (w *walFile) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func walSegments(dir string, key string) ([]uint64, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, key+walSuffix+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("list wal fail %s", err)
+	}
+	segments := []uint64{}
+	for _, path := range paths {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(path), key+walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+// replayWAL decodes every segment in order, a torn tail left by a crash is cut off
+// so later appends are readable
+func replayWAL(dir string, key string, decode func([]byte) error) (*SnapshotReport, error) {
+	segments, err := walSegments(dir, key)
+	if err != nil {
+		return nil, err
+	}
+	total := &SnapshotReport{}
+	for _, seq := range segments {
+		path := filepath.Join(dir, key+walSuffix+strconv.FormatUint(seq, 10))
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read wal fail %s", err)
+		}
+		report := readRecords(body, decode)
+		if report.Truncated {
+			err = os.Truncate(path, int64(report.Offset))
+			if err != nil {
+				return nil, fmt.Errorf("truncate wal fail %s", err)
+			}
+		}
+		total.Loaded += report.Loaded
+		total.Skipped += report.Skipped
+		total.Truncated = total.Truncated || report.Truncated
+		total.Errors = append(total.Errors, report.Errors...)
+	}
+	return total, nil
+}
@@ -0,0 +1,150 @@
+package datakeeper
+
+import (
+	"context"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/storage"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestWALRecovery(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := openWAL(dir, storage.StoreKeyUniswapv2Pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ends := []int{}
+	size := 0
+	for i := 0; i < 6; i += 2 {
+		records := [][]byte{testPair(i).ToBinary(), testPair(i + 1).ToBinary()}
+		err = wal.Append(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range records {
+			size += snapshotRecordHeader + len(record)
+			ends = append(ends, size)
+		}
+	}
+	wal.Close()
+	body, err := os.ReadFile(wal.segmentPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != size {
+		t.Fatal(len(body), size)
+	}
+
+	for offset := 0; offset <= len(body); offset++ {
+		cut := t.TempDir()
+		segment := filepath.Join(cut, storage.StoreKeyUniswapv2Pairs+walSuffix+"0")
+		err = os.WriteFile(segment, body[:offset], filePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		for _, end := range ends {
+			if end <= offset {
+				want++
+			}
+		}
+		pairs := []*protocol.UniswapV2Pair{}
+		report, err := replayWAL(cut, storage.StoreKeyUniswapv2Pairs, func(record []byte) error {
+			pair := &protocol.UniswapV2Pair{}
+			err := pair.FromBinary(record)
+			pairs = append(pairs, pair)
+			return err
+		})
+		if err != nil {
+			t.Fatal(offset, err)
+		}
+		if report.Loaded != want || report.Skipped != 0 {
+			t.Fatalf("offset %d want %d %+v", offset, want, report)
+		}
+		for i, pair := range pairs {
+			if pair.Address != testPair(i).Address {
+				t.Fatal(offset, i, pair.Address)
+			}
+		}
+
+		// the torn tail is cut so a later append is replayed
+		again, err := openWAL(cut, storage.StoreKeyUniswapv2Pairs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = again.Append([][]byte{testPair(9).ToBinary()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		again.Close()
+		report, err = replayWAL(cut, storage.StoreKeyUniswapv2Pairs, func(record []byte) error {
+			return nil
+		})
+		if err != nil {
+			t.Fatal(offset, err)
+		}
+		if report.Loaded != want+1 || report.Truncated {
+			t.Fatalf("offset %d want %d %+v", offset, want+1, report)
+		}
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := NewFileDataKeeper(ctx, &config.Config{StoreFilePath: dir})
+	f.chainID = 8453
+	err := f.openWALs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, wal := range f.wals {
+			wal.Close()
+		}
+	}()
+
+	storePairs := func(from, to int) {
+		keys := []common.Address{}
+		pairs := []*protocol.UniswapV2Pair{}
+		for i := from; i < to; i++ {
+			pair := testPair(i)
+			pair.BlockNumber = 1000 + uint64(i)
+			keys = append(keys, pair.Address)
+			pairs = append(pairs, pair)
+		}
+		protocol.UniswapV2Pairs.Store(keys, pairs)
+	}
+	countWAL := func() int {
+		report, err := replayWAL(dir, storage.StoreKeyUniswapv2Pairs, func([]byte) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report.Loaded
+	}
+
+	storePairs(100, 110)
+	if count := countWAL(); count != 10 {
+		t.Fatal(count)
+	}
+	err = f.writeData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := walSegments(dir, storage.StoreKeyUniswapv2Pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0] != 1 || countWAL() != 0 {
+		t.Fatal(segments)
+	}
+	storePairs(110, 115)
+	if count := countWAL(); count != 5 {
+		t.Fatal(count)
+	}
+}
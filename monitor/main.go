@@ -3,10 +3,18 @@ package main
 import (
 	"context"
 	"monitor/action"
+	"monitor/admin"
 	"monitor/arbitrage"
+	"monitor/client"
+	"monitor/competitor"
 	"monitor/config"
 	"monitor/datakeeper"
+	"monitor/metrics"
 	"monitor/onchainmonitor"
+	"monitor/recorder"
+	"monitor/screening"
+	"monitor/storage"
+	"monitor/tokenregistry"
 	"monitor/trader"
 	"monitor/utils"
 	"net/http"
@@ -14,6 +22,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"strconv"
 	"syscall"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -45,35 +54,131 @@ func main() {
 		SwapAddress:   common.HexToAddress("0x229735D12D750B09b751fbD6b75B55902c1A2c0a"),
 		MinRecieve:    0.0001,
 		ETHNode:       "https://eth.llamarpc.com",
+		// more accounts trade in parallel from the keystores of KEYSTORE_DIR, the passphrase is
+		// prompted when neither KEYSTORE_PASSPHRASE nor KEYSTORE_PASSPHRASE_FILE is set
+		KeystoreDir:            os.Getenv("KEYSTORE_DIR"),
+		KeystorePassphrase:     os.Getenv("KEYSTORE_PASSPHRASE"),
+		KeystorePassphraseFile: os.Getenv("KEYSTORE_PASSPHRASE_FILE"),
+		RateLimits: map[string]*config.RateLimit{
+			"wss://distinguished-long-frog.base-mainnet.discover.quiknode.pro/9733b4ce6e9bbd6556771ea11f7a910d7ba0c50a/": {
+				RequestsPerSecond:     25,
+				ComputeUnitsPerSecond: 500,
+				MethodComputeUnits: map[string]float64{
+					"eth_call":               20,
+					"eth_estimateGas":        20,
+					"eth_sendRawTransaction": 20,
+					"eth_subscribe":          20,
+				},
+				TradeReserve: 0.2,
+			},
+			"https://eth.llamarpc.com": {
+				RequestsPerSecond: 1,
+			},
+		},
+		// aerodrome pools emit Sync with uint256 reserves, they are not uniswapv2 compatible
+		Factories: []*config.Factory{
+			{
+				Name:    "uniswapv2",
+				Address: common.HexToAddress("0x8909Dc15e40173Ff4699343b6eB8132c65e18eC6"),
+				Fee:     30,
+			},
+			{
+				Name:    "sushiswapv2",
+				Address: common.HexToAddress("0x71524B4f93c58fcbF659783284E38825f0622859"),
+				Fee:     30,
+			},
+			{
+				Name:    "baseswap",
+				Address: common.HexToAddress("0xFDa619b6d20975be80A10332cD39b9a4b0FAa8BB"),
+				Fee:     25,
+			},
+		},
+		ScreenMinLiquidity:     0.5,
+		ScreenMinPairAgeBlocks: 1800,
+		GraphMinLiquidity:      0.1,
+		GraphMinTradeSize:      0.01,
+		AdminToken:             os.Getenv("ADMIN_TOKEN"),
+		Log: &utils.LogConfig{
+			Format: os.Getenv("LOG_FORMAT"),
+			Level:  os.Getenv("LOG_LEVEL"),
+			// the new logs of every subscription flush are sampled
+			SampleFirst:      10,
+			SampleThereafter: 100,
+		},
 	}
-	if len(conf.FromAddress) == 0 || len(conf.PrivateKey) == 0 {
-		panic("missing env config ADDRESS or PRIVATEKEY")
+	if err := utils.ConfigureLog(conf.Log); err != nil {
+		panic(err)
 	}
+	// FLASH_SWAP funds the trades by flash swaps instead of the WETH of the accounts
+	conf.FlashSwap, _ = strconv.ParseBool(os.Getenv("FLASH_SWAP"))
+	// BATCH_CYCLES sends up to this many cycles found in a graph in one swapBatch tx
+	conf.BatchCycles, _ = strconv.Atoi(os.Getenv("BATCH_CYCLES"))
+	if url := os.Getenv("REMOTE_SIGNER_URL"); len(url) > 0 {
+		conf.RemoteSigner = &config.RemoteSigner{URL: url}
+		if token := os.Getenv("REMOTE_SIGNER_TOKEN"); len(token) > 0 {
+			conf.RemoteSigner.Headers = map[string]string{"Authorization": "Bearer " + token}
+		}
+	}
+	if len(conf.PrivateKey) == 0 && len(conf.KeystoreDir) == 0 && conf.RemoteSigner == nil {
+		panic("missing env config PRIVATEKEY, KEYSTORE_DIR or REMOTE_SIGNER_URL")
+	}
+	client.ConfigureRateLimits(conf.RateLimits)
 	traderKeeper := trader.NewTrader(ctx, conf)
-	keepers := []utils.Keeper{
-		traderKeeper,
-		datakeeper.NewFileDataKeeper(ctx, conf.StoreFilePath),
-		onchainmonitor.NewEVMMonitor(ctx, conf, []action.Action{
-			action.NewProtocolData(ctx, conf),
-		}),
-		arbitrage.NewArbitrage(ctx, conf, traderKeeper),
+	dataKeeper, err := datakeeper.NewDataKeeper(ctx, conf)
+	if err != nil {
+		panic(err)
 	}
-	for _, keeper := range keepers {
-		err := keeper.Init(ctx)
-		if err != nil {
-			panic(err)
-		}
+	if kv, ok := dataKeeper.(*datakeeper.KVDataKeeper); ok {
+		// the trades bucket keeps the ledger past its last entries
+		traderKeeper.SubscribeLedger(func(entry trader.LedgerEntry) {
+			if err := kv.SaveTrade(entry); err != nil {
+				utils.Warnf("save trade %s fail %s", entry.Tx, err)
+			}
+		})
 	}
+	screener := screening.NewScreener(ctx, conf)
+	arbitrageKeeper := arbitrage.NewArbitrage(ctx, conf, traderKeeper, screener)
+	pairDiscovery := action.NewPairDiscovery(ctx, conf, dataKeeper)
+	adminKeeper := admin.NewAdmin(ctx, conf, pairDiscovery)
+	http.Handle("/admin/", adminKeeper.Handler())
+	http.Handle("/screening/", adminKeeper.Auth(screener.Handler()))
+	http.Handle("/arbitrage/", adminKeeper.Auth(arbitrageKeeper.Handler()))
+	http.Handle("/trader/", adminKeeper.Auth(traderKeeper.Handler()))
+	// the arbitrage txs of others found in the swap logs, their gas prices teach the strategy
+	competitorAnalyzer := competitor.NewAnalyzer(ctx, conf, arbitrageKeeper, traderKeeper)
+	http.Handle("/competitor/", adminKeeper.Auth(competitorAnalyzer.Handler()))
+	http.Handle("/metrics", metrics.Handler())
+	actions := []action.Action{
+		action.NewProtocolData(ctx, conf),
+		pairDiscovery,
+		competitorAnalyzer,
+	}
+	supervisor := utils.NewSupervisor(conf.ShutdownTimeout)
+	http.Handle("/health", supervisor.Handler())
+	supervisor.Add("admin", adminKeeper)
+	// the datakeeper shuts down after the trader so the ledger of the swaps in flight is saved
+	supervisor.Add("datakeeper", dataKeeper)
+	supervisor.Add("trader", traderKeeper)
+	if len(conf.RecordDir) > 0 {
+		rec := recorder.NewRecorder(ctx, conf, traderKeeper)
+		actions = append(actions, rec.LogAction())
+		supervisor.Add("recorder", rec)
+	}
+	supervisor.Add("janitor", storage.NewJanitor(ctx, conf))
+	supervisor.Add("tokenregistry", tokenregistry.NewTokenRegistry(ctx, conf))
+	supervisor.Add("screening", screener)
+	supervisor.Add("onchainmonitor", onchainmonitor.NewEVMMonitor(ctx, conf, actions))
+	supervisor.Add("arbitrage", arbitrageKeeper)
 
-	for {
-		select {
-		case <-c:
-			utils.Infof("program shutdown signal")
-			close(c)
-			for _, keeper := range keepers {
-				keeper.ShutDown(ctx)
-			}
-			return
-		}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := supervisor.Start(ctx); err != nil {
+		utils.Errorf("start fail %s", err)
+		supervisor.ShutDown(context.Background())
+		return
 	}
+
+	<-c
+	utils.Infof("program shutdown signal")
+	supervisor.ShutDown(context.Background())
 }
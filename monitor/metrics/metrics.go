@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes every metric of the monitor
+const Namespace = "monitor"
+
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the registry in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// register returns the collector registered before under the same descriptors, so the
+// keepers built twice, in tests or backtests, share their metrics
+func register[C prometheus.Collector](c C) C {
+	err := Registry.Register(c)
+	if err == nil {
+		return c
+	}
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		if existing, ok := registered.ExistingCollector.(C); ok {
+			return existing
+		}
+	}
+	panic(err)
+}
+
+// Register registers a collector that reads its values at scrape, its descriptors carry the
+// Namespace themselves
+func Register[C prometheus.Collector](c C) C {
+	return register(c)
+}
+
+func NewCounterVec(opts prometheus.CounterOpts, labels ...string) *prometheus.CounterVec {
+	opts.Namespace = Namespace
+	return register(prometheus.NewCounterVec(opts, labels))
+}
+
+func NewGaugeVec(opts prometheus.GaugeOpts, labels ...string) *prometheus.GaugeVec {
+	opts.Namespace = Namespace
+	return register(prometheus.NewGaugeVec(opts, labels))
+}
+
+func NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	opts.Namespace = Namespace
+	return register(prometheus.NewGauge(opts))
+}
+
+func NewGaugeFunc(opts prometheus.GaugeOpts, f func() float64) prometheus.GaugeFunc {
+	opts.Namespace = Namespace
+	return register(prometheus.NewGaugeFunc(opts, f))
+}
+
+func NewHistogramVec(opts prometheus.HistogramOpts, labels ...string) *prometheus.HistogramVec {
+	opts.Namespace = Namespace
+	return register(prometheus.NewHistogramVec(opts, labels))
+}
+
+func NewHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	opts.Namespace = Namespace
+	return register(prometheus.NewHistogram(opts))
+}
+
+// Endpoint labels a node by its host, the path and query often carry an api key
+func Endpoint(node string) string {
+	u, err := url.Parse(node)
+	if err != nil || len(u.Host) == 0 {
+		return "unknown"
+	}
+	return u.Host
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegister(t *testing.T) {
+	opts := prometheus.CounterOpts{Subsystem: "test", Name: "registered_total", Help: "test"}
+	first := NewCounterVec(opts, "result")
+	second := NewCounterVec(opts, "result")
+	if first != second {
+		t.Fatalf("second registration not shared")
+	}
+	second.WithLabelValues("ok").Inc()
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `monitor_test_registered_total{result="ok"} 1`) {
+		t.Fatalf("metric not served %s", body)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	for node, want := range map[string]string{
+		"wss://base.example.com/9733b4ce6e9bbd65/": "base.example.com",
+		"http://localhost:8545?key=secret":         "localhost:8545",
+		"":                                         "unknown",
+	} {
+		if got := Endpoint(node); got != want {
+			t.Fatalf("endpoint of %s %s want %s", node, got, want)
+		}
+	}
+}
@@ -7,19 +7,33 @@ import (
 	"monitor/action"
 	"monitor/client"
 	"monitor/config"
+	"monitor/metrics"
 	"monitor/protocol"
+	"monitor/storage"
 	"monitor/utils"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	maxBackfillBlocks = 2000
+
+	// healthLogTimeout marks the monitor unhealthy when no log is received for this long
+	healthLogTimeout = 2 * time.Minute
 )
 
 var (
-	_ Monitor      = &EVMMonitor{}
-	_ utils.Keeper = &EVMMonitor{}
+	_ Monitor       = &EVMMonitor{}
+	_ utils.Keeper  = &EVMMonitor{}
+	_ utils.Checker = &EVMMonitor{}
+
+	logger = utils.NewLogger("onchainmonitor")
 )
 
 type EVMMonitor struct {
@@ -27,12 +41,39 @@ type EVMMonitor struct {
 	actions []action.Action
 
 	latestBlockNumber uint64
+	// lagBlock is the latest block whose ingest lag was observed
+	lagBlock uint64
+	// lastLogAt is the unix nano time of the last logs received, or of Init
+	lastLogAt int64
+	// handlers counts the actions running on logs, ShutDown waits for them
+	handlers sync.WaitGroup
+
+	batchSize prometheus.Histogram
+	ingestLag prometheus.Histogram
+	logsTotal *prometheus.CounterVec
 }
 
 func NewEVMMonitor(ctx context.Context, conf *config.Config, actions []action.Action) *EVMMonitor {
 	return &EVMMonitor{
 		config:  conf,
 		actions: actions,
+		batchSize: metrics.NewHistogram(prometheus.HistogramOpts{
+			Subsystem: "monitor",
+			Name:      "log_batch_size",
+			Help:      "Logs handed to the actions at once.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+		ingestLag: metrics.NewHistogram(prometheus.HistogramOpts{
+			Subsystem: "monitor",
+			Name:      "log_ingest_lag_seconds",
+			Help:      "Time between a block timestamp and the first of its logs received.",
+			Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+		}),
+		logsTotal: metrics.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "monitor",
+			Name:      "logs_total",
+			Help:      "Logs received by source, subscription or backfill.",
+		}, "source"),
 	}
 }
 
@@ -43,22 +84,28 @@ func (e *EVMMonitor) Init(ctx context.Context) error {
 			return fmt.Errorf("init action fail %s", err)
 		}
 	}
+	atomic.StoreInt64(&e.lastLogAt, time.Now().UnixNano())
 	// go e.loopWatcher(ctx)
 	// go e.subscribeWatcher(ctx)
-	go func() {
-		for {
-			<-time.After(time.Second)
-			err := e.subscribeFilter(ctx)
-			if err != nil {
-				utils.Warnf("subscribe filter fail %s", err)
-			}
-		}
-	}()
+	utils.Go(client.WithPriority(ctx, client.PriorityBackground), "onchainmonitor.subscribe", e.subscribeFilter)
 	return nil
 }
 
+// ShutDown waits for the actions running on the logs received, the subscription is
+// stopped by the context of Init
 func (e *EVMMonitor) ShutDown(ctx context.Context) {
+	if !utils.Wait(ctx, &e.handlers) {
+		logger.Errorf("log handlers still running at shutdown")
+	}
+}
 
+// Check fails when no log was received for a while, the subscription is likely stuck
+func (e *EVMMonitor) Check() error {
+	last := time.Unix(0, atomic.LoadInt64(&e.lastLogAt))
+	if since := time.Since(last); since > healthLogTimeout {
+		return fmt.Errorf("no logs received for %s", since.Truncate(time.Second))
+	}
+	return nil
 }
 
 func (e *EVMMonitor) loopWatcher(ctx context.Context) {
@@ -67,16 +114,18 @@ func (e *EVMMonitor) loopWatcher(ctx context.Context) {
 
 		cli, err := client.GetETHClient(ctx, e.config.Node, e.config.MulticallAddress)
 		if err != nil {
-			utils.Errorf("get eth client fail %s", err)
+			logger.Errorf("get eth client fail %s", err)
 			continue
 		}
 		bloNum, err := cli.BlockNumber(ctx)
 		if err != nil {
-			utils.Errorf("get block number fail %s", err)
+			logger.Errorf("get block number fail %s", err)
 			continue
 		}
 		if bloNum > e.latestBlockNumber {
-			go e.onNewBlock(ctx, bloNum)
+			utils.SafeGo(ctx, "onchainmonitor.block", func(ctx context.Context) {
+				e.onNewBlock(ctx, bloNum)
+			})
 		}
 	}
 }
@@ -98,7 +147,9 @@ func (e *EVMMonitor) subscribeWatcher(ctx context.Context) error {
 		case block := <-blocks:
 			bloNum := block.Number.Uint64()
 			if bloNum > e.latestBlockNumber {
-				go e.onNewBlock(ctx, bloNum)
+				utils.SafeGo(ctx, "onchainmonitor.block", func(ctx context.Context) {
+					e.onNewBlock(ctx, bloNum)
+				})
 			}
 		}
 	}
@@ -120,6 +171,7 @@ func (e *EVMMonitor) subscribeFilter(ctx context.Context) error {
 			{
 				protocol.UniswapV2PairEventSyncSign,
 				protocol.UniswapV2PairEventSwapSign,
+				protocol.UniswapV2FactoryEventPairCreatedSign,
 			},
 		},
 	}
@@ -127,28 +179,37 @@ func (e *EVMMonitor) subscribeFilter(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("subscribe filter fail %s", err)
 	}
+	e.backfill(ctx, filter, blockNumber)
 	var (
 		logs     = []*types.Log{}
 		logsLock = sync.Mutex{}
-		subErr   error
 	)
+	done := make(chan struct{})
+	defer func() {
+		sub.Unsubscribe()
+		close(done)
+	}()
 	go func() {
-		for log := range logChan {
-			if subErr != nil {
+		for {
+			select {
+			case <-done:
 				return
+			case log := <-logChan:
+				copy := log
+				logsLock.Lock()
+				logs = append(logs, &copy)
+				logsLock.Unlock()
 			}
-			copy := log
-			logsLock.Lock()
-			logs = append(logs, &copy)
-			logsLock.Unlock()
 		}
 	}()
 	for {
-		<-time.After(time.Millisecond * 10)
+		if !utils.Sleep(ctx, time.Millisecond*10) {
+			return nil
+		}
 		select {
-		case subErr = <-sub.Err():
-			if subErr != nil {
-				return fmt.Errorf("subscribe error %s", subErr)
+		case err := <-sub.Err():
+			if err != nil {
+				return fmt.Errorf("subscribe error %s", err)
 			}
 		default:
 			if len(logs) == 0 {
@@ -158,11 +219,52 @@ func (e *EVMMonitor) subscribeFilter(ctx context.Context) error {
 			tmp := logs
 			logs = []*types.Log{}
 			logsLock.Unlock()
-			go e.onNewLogs(ctx, tmp)
+			e.logsTotal.WithLabelValues("subscription").Add(float64(len(tmp)))
+			atomic.StoreInt64(&e.lastLogAt, time.Now().UnixNano())
+			e.observeLag(ctx, tmp, time.Now())
+			utils.SafeGo(ctx, "onchainmonitor.logs", func(ctx context.Context) {
+				e.onNewLogs(ctx, tmp)
+			})
 		}
 	}
 }
 
+// backfill replays the logs between the persisted head and the subscription start,
+// older states are dropped by the storage so overlapping the subscription is harmless
+func (e *EVMMonitor) backfill(ctx context.Context, filter ethereum.FilterQuery, blockNumber uint64) {
+	head := storage.Head()
+	if head == 0 || head >= blockNumber {
+		return
+	}
+	if blockNumber-head > maxBackfillBlocks {
+		head = blockNumber - maxBackfillBlocks
+	}
+	cli, err := client.GetETHClient(ctx, e.config.Node, e.config.MulticallAddress)
+	if err != nil {
+		logger.Warnf("get eth client fail %s", err)
+		return
+	}
+	filter.FromBlock = big.NewInt(int64(head))
+	filter.ToBlock = big.NewInt(int64(blockNumber))
+	backfillLogs, err := cli.FilterLogs(ctx, filter)
+	if err != nil {
+		logger.Warnf("backfill logs from %d to %d fail %s", head, blockNumber, err)
+		return
+	}
+	if len(backfillLogs) == 0 {
+		return
+	}
+	logs := make([]*types.Log, 0, len(backfillLogs))
+	for i := range backfillLogs {
+		logs = append(logs, &backfillLogs[i])
+	}
+	logger.Infof("backfill logs from %d to %d", head, blockNumber)
+	e.logsTotal.WithLabelValues("backfill").Add(float64(len(logs)))
+	utils.SafeGo(ctx, "onchainmonitor.logs", func(ctx context.Context) {
+		e.onNewLogs(ctx, logs)
+	})
+}
+
 func (e *EVMMonitor) onNewBlock(ctx context.Context, blockNumber uint64) {
 	if blockNumber <= e.latestBlockNumber {
 		return
@@ -176,27 +278,79 @@ func (e *EVMMonitor) onNewBlock(ctx context.Context, blockNumber uint64) {
 		}
 	}
 	e.latestBlockNumber = blockNumber
-	utils.Infof("on new blocks %d", blockNumbers)
+	logger.Infof("on new blocks %d", blockNumbers)
 	for _, act := range e.actions {
 		tmp := act
-		go func() {
+		utils.SafeGo(ctx, "onchainmonitor.block.action", func(ctx context.Context) {
 			err := tmp.OnNewBlockHandler(ctx, blockNumbers)
 			if err != nil {
-				utils.Warnf("handle new block fail %d %s", blockNumbers, err)
+				logger.Warnf("handle new block fail %d %s", blockNumbers, err)
 			}
-		}()
+		})
+	}
+}
+
+// HandleLogs runs the actions on the logs one after another and returns once they are done,
+// replays use it so the actions see the logs in the order they were recorded
+func (e *EVMMonitor) HandleLogs(ctx context.Context, logs []*types.Log) error {
+	for _, log := range logs {
+		storage.UpdateHead(log.BlockNumber)
+	}
+	for _, act := range e.actions {
+		err := act.OnNewLogHandler(ctx, logs)
+		if err != nil {
+			return fmt.Errorf("handle new logs fail %s", err)
+		}
 	}
+	return nil
+}
+
+// observeLag reads the timestamp of the newest block of the logs received first,
+// one header per block
+func (e *EVMMonitor) observeLag(ctx context.Context, logs []*types.Log, received time.Time) {
+	blockNumber := uint64(0)
+	for _, log := range logs {
+		if log.BlockNumber > blockNumber {
+			blockNumber = log.BlockNumber
+		}
+	}
+	last := atomic.LoadUint64(&e.lagBlock)
+	if blockNumber <= last || !atomic.CompareAndSwapUint64(&e.lagBlock, last, blockNumber) {
+		return
+	}
+	utils.SafeGo(ctx, "onchainmonitor.lag", func(ctx context.Context) {
+		cli, err := client.GetETHClient(ctx, e.config.Node, e.config.MulticallAddress)
+		if err != nil {
+			return
+		}
+		header, err := cli.HeaderByNumber(ctx, new(big.Int).SetUint64(blockNumber))
+		if err != nil {
+			logger.Warnf("get header %d fail %s", blockNumber, err)
+			return
+		}
+		lag := received.Sub(time.Unix(int64(header.Time), 0))
+		if lag >= 0 {
+			e.ingestLag.Observe(lag.Seconds())
+		}
+	})
 }
 
 func (e *EVMMonitor) onNewLogs(ctx context.Context, logs []*types.Log) {
-	utils.Infof("on new logs %d", len(logs))
+	ctx = utils.WithCorrelationID(ctx, "batch")
+	logger.Ctx(ctx).Infof("on new logs %d", len(logs))
+	e.batchSize.Observe(float64(len(logs)))
+	for _, log := range logs {
+		storage.UpdateHead(log.BlockNumber)
+	}
 	for _, act := range e.actions {
 		tmp := act
-		go func() {
+		e.handlers.Add(1)
+		utils.SafeGo(ctx, "onchainmonitor.logs.action", func(ctx context.Context) {
+			defer e.handlers.Done()
 			err := tmp.OnNewLogHandler(ctx, logs)
 			if err != nil {
-				utils.Warnf("handle new logs fail %s", err)
+				logger.Ctx(ctx).Warnf("handle new logs fail %s", err)
 			}
-		}()
+		})
 	}
 }
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"monitor/storage"
 	"strconv"
@@ -14,8 +15,11 @@ var (
 
 type DataConvert interface {
 	ToFileData() []byte
+	ToBinary() []byte
 }
 
+const stateFromLogUpdateBinaryLength = 24
+
 type StateFromLogUpdate struct {
 	BlockNumber uint64
 	TxIndex     uint
@@ -36,8 +40,15 @@ func (old *StateFromLogUpdate) NeedUpdate(new interface{}) bool {
 		(newState.BlockNumber == old.BlockNumber && newState.TxIndex == old.TxIndex && newState.LogIndex > old.LogIndex)
 }
 
-func (old *StateFromLogUpdate) Expired(now int64) bool {
-	return now > old.Timestamp+86400
+func (old *StateFromLogUpdate) Expired(head uint64, ttl uint64) bool {
+	return head > old.BlockNumber+ttl
+}
+
+func (s *StateFromLogUpdate) UpdatedBlock() uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.BlockNumber
 }
 
 func (s *StateFromLogUpdate) ToFileData() []byte {
@@ -83,6 +94,70 @@ func (s *StateFromLogUpdate) FromFileData(body []byte) error {
 	return nil
 }
 
+func (s *StateFromLogUpdate) ToBinary() []byte {
+	body := make([]byte, stateFromLogUpdateBinaryLength)
+	if s == nil {
+		return body
+	}
+	binary.BigEndian.PutUint64(body[0:8], s.BlockNumber)
+	binary.BigEndian.PutUint32(body[8:12], uint32(s.TxIndex))
+	binary.BigEndian.PutUint32(body[12:16], uint32(s.LogIndex))
+	binary.BigEndian.PutUint64(body[16:24], uint64(s.Timestamp))
+	return body
+}
+
+func (s *StateFromLogUpdate) FromBinary(body []byte) error {
+	if s == nil {
+		return fmt.Errorf("s is nil")
+	}
+	if len(body) != stateFromLogUpdateBinaryLength {
+		return fmt.Errorf("binary length error %d", len(body))
+	}
+	s.BlockNumber = binary.BigEndian.Uint64(body[0:8])
+	s.TxIndex = uint(binary.BigEndian.Uint32(body[8:12]))
+	s.LogIndex = uint(binary.BigEndian.Uint32(body[12:16]))
+	s.Timestamp = int64(binary.BigEndian.Uint64(body[16:24]))
+	return nil
+}
+
+func BinaryToStorage(key string, body []byte) (interface{}, interface{}, error) {
+	if len(body) == 0 {
+		return nil, nil, fmt.Errorf("body is nil")
+	}
+	switch key {
+	case storage.StoreKeyUniswapv2Pairs:
+		data := &UniswapV2Pair{}
+		err := data.FromBinary(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("from binary fail %s", err)
+		}
+		return data.Address, data, nil
+	case storage.StoreKeyTokens:
+		data := &Token{}
+		err := data.FromBinary(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("from binary fail %s", err)
+		}
+		return data.Address, data, nil
+	case storage.StoreKeyScreens:
+		data := &Screen{}
+		err := data.FromBinary(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("from binary fail %s", err)
+		}
+		return data.Address, data, nil
+	case storage.StoreKeyScreenLists:
+		data := &ListEntry{}
+		err := data.FromBinary(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("from binary fail %s", err)
+		}
+		return data.Address, data, nil
+	default:
+		return nil, nil, fmt.Errorf("key error %s", key)
+	}
+}
+
 func FileDataToStorage(key string, line []byte) (interface{}, interface{}, error) {
 	if len(line) == 0 {
 		return nil, nil, fmt.Errorf("line is nil")
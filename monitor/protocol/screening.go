@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"monitor/storage"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	ScreenKindToken = uint8(1)
+	ScreenKindPair  = uint8(2)
+
+	ListNone  = uint8(0)
+	ListAllow = uint8(1)
+	ListDeny  = uint8(2)
+)
+
+// risks found by the screening
+const (
+	// RiskHoneypot is set when what was bought can not be sold back
+	RiskHoneypot uint32 = 1 << iota
+	RiskSellFee
+	RiskBlacklist
+	RiskPause
+	RiskOwnerFee
+	RiskUpgradeable
+)
+
+var (
+	_ storage.DataUpdate = &Screen{}
+	_ DataConvert        = &Screen{}
+	_ storage.DataUpdate = &ListEntry{}
+	_ DataConvert        = &ListEntry{}
+
+	Screens     = storage.NewStore[common.Address, *Screen]()
+	ScreenLists = storage.NewStore[common.Address, *ListEntry]()
+)
+
+func init() {
+	storage.Register(storage.StoreKeyScreens, Screens)
+	storage.Register(storage.StoreKeyScreenLists, ScreenLists)
+}
+
+// Screen is the result of screening a token or a pair
+type Screen struct {
+	Address common.Address
+	Kind    uint8
+	Risks   uint32
+	// SellFee is the share lost selling back to the pair, in FeeBase units
+	SellFee int64
+	// FirstSeenBlock is the block the address was first screened at
+	FirstSeenBlock uint64
+	CheckedBlock   uint64
+}
+
+func (s *Screen) NeedUpdate(new interface{}) bool {
+	newScreen, ok := new.(*Screen)
+	return ok && newScreen.CheckedBlock >= s.CheckedBlock
+}
+
+func (s *Screen) Expired(head uint64, ttl uint64) bool {
+	return false
+}
+
+func (s *Screen) ToFileData() []byte {
+	if s == nil {
+		return []byte{}
+	}
+	return []byte(fmt.Sprintf("%s,%d,%d,%d,%d,%d", s.Address, s.Kind, s.Risks, s.SellFee, s.FirstSeenBlock, s.CheckedBlock))
+}
+
+// ToBinary layout: address, kind, risks uint32, sell fee int64, first seen block, checked block
+func (s *Screen) ToBinary() []byte {
+	if s == nil {
+		return []byte{}
+	}
+	body := make([]byte, 0, 20+1+4+8+8+8)
+	body = append(body, s.Address.Bytes()...)
+	body = append(body, s.Kind)
+	body = binary.BigEndian.AppendUint32(body, s.Risks)
+	body = binary.BigEndian.AppendUint64(body, uint64(s.SellFee))
+	body = binary.BigEndian.AppendUint64(body, s.FirstSeenBlock)
+	return binary.BigEndian.AppendUint64(body, s.CheckedBlock)
+}
+
+func (s *Screen) FromBinary(body []byte) error {
+	if s == nil {
+		return fmt.Errorf("s is nil")
+	}
+	if len(body) != 20+1+4+8+8+8 {
+		return fmt.Errorf("binary length error %d", len(body))
+	}
+	s.Address = common.BytesToAddress(body[0:20])
+	s.Kind = body[20]
+	s.Risks = binary.BigEndian.Uint32(body[21:25])
+	s.SellFee = int64(binary.BigEndian.Uint64(body[25:33]))
+	s.FirstSeenBlock = binary.BigEndian.Uint64(body[33:41])
+	s.CheckedBlock = binary.BigEndian.Uint64(body[41:49])
+	return nil
+}
+
+// ListEntry puts a token or a pair on the allow or deny list, ListNone removes it
+type ListEntry struct {
+	Address common.Address
+	Kind    uint8
+	List    uint8
+	Reason  string
+	// UpdatedAt is the unix nano time of the change
+	UpdatedAt int64
+}
+
+func (e *ListEntry) NeedUpdate(new interface{}) bool {
+	newEntry, ok := new.(*ListEntry)
+	return ok && newEntry.UpdatedAt >= e.UpdatedAt
+}
+
+func (e *ListEntry) Expired(head uint64, ttl uint64) bool {
+	return false
+}
+
+func (e *ListEntry) ToFileData() []byte {
+	if e == nil {
+		return []byte{}
+	}
+	return []byte(fmt.Sprintf("%s,%d,%d,%s,%d", e.Address, e.Kind, e.List, e.Reason, e.UpdatedAt))
+}
+
+// ToBinary layout: address, kind, list, updated at int64, reason prefixed by two length bytes
+func (e *ListEntry) ToBinary() []byte {
+	if e == nil {
+		return []byte{}
+	}
+	reason := e.Reason
+	if len(reason) > 0xffff {
+		reason = reason[:0xffff]
+	}
+	body := make([]byte, 0, 20+1+1+8+2+len(reason))
+	body = append(body, e.Address.Bytes()...)
+	body = append(body, e.Kind, e.List)
+	body = binary.BigEndian.AppendUint64(body, uint64(e.UpdatedAt))
+	body = binary.BigEndian.AppendUint16(body, uint16(len(reason)))
+	return append(body, reason...)
+}
+
+func (e *ListEntry) FromBinary(body []byte) error {
+	if e == nil {
+		return fmt.Errorf("e is nil")
+	}
+	if len(body) < 20+1+1+8+2 {
+		return fmt.Errorf("binary length error %d", len(body))
+	}
+	e.Address = common.BytesToAddress(body[0:20])
+	e.Kind = body[20]
+	e.List = body[21]
+	e.UpdatedAt = int64(binary.BigEndian.Uint64(body[22:30]))
+	length := int(binary.BigEndian.Uint16(body[30:32]))
+	if len(body) != 32+length {
+		return fmt.Errorf("binary length error %d", len(body))
+	}
+	e.Reason = string(body[32:])
+	return nil
+}
@@ -0,0 +1,235 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"monitor/abi"
+	"monitor/client"
+	"monitor/storage"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// DefaultTokenDecimals is used to display the amounts of tokens not read yet
+	DefaultTokenDecimals = 18
+	maxTokenTextLength   = 64
+)
+
+var (
+	_ storage.DataUpdate = &Token{}
+	_ DataConvert        = &Token{}
+
+	Tokens = storage.NewStore[common.Address, *Token]()
+)
+
+func init() {
+	storage.Register(storage.StoreKeyTokens, Tokens)
+}
+
+type Token struct {
+	Address  common.Address
+	Decimals uint8
+	Symbol   string
+	Name     string
+	// Error is set when the metadata can not be read
+	Error bool
+	// TransferFee is the share of a transfer out of a pair not received, in FeeBase units
+	TransferFee int64
+	// Rebasing is set when the sender balance moves by other than the amount sent
+	Rebasing bool
+	// CheckedBlock is the block the transfer was probed at, 0 when not probed yet
+	CheckedBlock uint64
+}
+
+func (t *Token) NeedUpdate(new interface{}) bool {
+	newToken, ok := new.(*Token)
+	return ok && newToken.CheckedBlock >= t.CheckedBlock
+}
+
+// Expired is always false, tokens are kept once read
+func (t *Token) Expired(head uint64, ttl uint64) bool {
+	return false
+}
+
+// Excluded reports whether the token must not be traded by the arbitrage
+func (t *Token) Excluded() bool {
+	return t != nil && (t.TransferFee > 0 || t.Rebasing)
+}
+
+func (t *Token) ToFileData() []byte {
+	if t == nil {
+		return []byte{}
+	}
+	return []byte(fmt.Sprintf("%s,%d,%s,%s,%t,%d,%t,%d",
+		t.Address,
+		t.Decimals,
+		t.Symbol,
+		t.Name,
+		t.Error,
+		t.TransferFee,
+		t.Rebasing,
+		t.CheckedBlock,
+	))
+}
+
+// ToBinary layout: address, decimals, flags, transfer fee int64, checked block,
+// symbol and name each prefixed by one length byte
+func (t *Token) ToBinary() []byte {
+	if t == nil {
+		return []byte{}
+	}
+	var (
+		symbol = truncateText(t.Symbol)
+		name   = truncateText(t.Name)
+		flags  = byte(0)
+		body   = make([]byte, 0, 20+1+1+8+8+2+len(symbol)+len(name))
+	)
+	if t.Error {
+		flags |= 1
+	}
+	if t.Rebasing {
+		flags |= 2
+	}
+	body = append(body, t.Address.Bytes()...)
+	body = append(body, t.Decimals, flags)
+	body = binary.BigEndian.AppendUint64(body, uint64(t.TransferFee))
+	body = binary.BigEndian.AppendUint64(body, t.CheckedBlock)
+	body = append(body, byte(len(symbol)))
+	body = append(body, symbol...)
+	body = append(body, byte(len(name)))
+	return append(body, name...)
+}
+
+func (t *Token) FromBinary(body []byte) error {
+	if t == nil {
+		return fmt.Errorf("t is nil")
+	}
+	if len(body) < 20+1+1+8+8+2 {
+		return fmt.Errorf("binary length error %d", len(body))
+	}
+	t.Address = common.BytesToAddress(body[0:20])
+	if t.Address == (common.Address{}) {
+		return fmt.Errorf("binary address empty")
+	}
+	t.Decimals = body[20]
+	t.Error = body[21]&1 != 0
+	t.Rebasing = body[21]&2 != 0
+	t.TransferFee = int64(binary.BigEndian.Uint64(body[22:30]))
+	t.CheckedBlock = binary.BigEndian.Uint64(body[30:38])
+	rest := body[38:]
+	for _, text := range []*string{&t.Symbol, &t.Name} {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return fmt.Errorf("text length error")
+		}
+		*text = string(rest[1 : 1+int(rest[0])])
+		rest = rest[1+int(rest[0]):]
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("binary length error %d", len(body))
+	}
+	return nil
+}
+
+func truncateText(text string) string {
+	if len(text) > maxTokenTextLength {
+		return text[:maxTokenTextLength]
+	}
+	return text
+}
+
+func NewTokenInfoCalls(token common.Address) []*client.ViewCall {
+	calls := []*client.ViewCall{}
+	for _, method := range []string{"decimals", "symbol", "name"} {
+		calls = append(calls, &client.ViewCall{
+			ID:   "ERC20-" + token.String() + "-" + method,
+			To:   token,
+			Data: abi.ERC20ABIInstance.Methods[method].ID,
+		})
+	}
+	return calls
+}
+
+func TokenCallResult(tokens map[common.Address]*Token, results map[string]*abi.Multicall2Result) {
+	for id, result := range results {
+		keys := strings.Split(id, "-")
+		if len(keys) != 3 || keys[0] != "ERC20" {
+			continue
+		}
+		addr := common.HexToAddress(keys[1])
+		if tokens[addr] == nil {
+			tokens[addr] = &Token{
+				Address:  addr,
+				Decimals: DefaultTokenDecimals,
+			}
+		}
+		token := tokens[addr]
+		if !result.Success {
+			token.Error = true
+			continue
+		}
+		switch keys[2] {
+		case "decimals":
+			if len(result.ReturnData) != 32 || new(big.Int).SetBytes(result.ReturnData).Cmp(big.NewInt(math.MaxUint8)) > 0 {
+				token.Error = true
+				continue
+			}
+			token.Decimals = result.ReturnData[31]
+		case "symbol":
+			token.Symbol = decodeTokenText(result.ReturnData)
+		case "name":
+			token.Name = decodeTokenText(result.ReturnData)
+		}
+	}
+}
+
+// decodeTokenText reads a string, or the bytes32 returned by older tokens
+func decodeTokenText(data []byte) string {
+	if len(data) == 32 {
+		return strings.TrimRight(string(data), "\x00")
+	}
+	values, err := abi.ERC20ABIInstance.Methods["symbol"].Outputs.Unpack(data)
+	if err != nil || len(values) != 1 {
+		return ""
+	}
+	text, _ := values[0].(string)
+	return truncateText(text)
+}
+
+// TokenSymbol returns the symbol of the token, or its address when unknown
+func TokenSymbol(addr common.Address) string {
+	token, ok := Tokens.Load(addr)
+	if !ok || token.Symbol == "" {
+		return addr.String()
+	}
+	return token.Symbol
+}
+
+// FormatAmount shows a raw amount of the token in its decimals with the symbol
+func FormatAmount(addr common.Address, amount float64) string {
+	decimals := DefaultTokenDecimals
+	if token, ok := Tokens.Load(addr); ok && !token.Error {
+		decimals = int(token.Decimals)
+	}
+	return fmt.Sprintf("%f %s", amount/math.Pow10(decimals), TokenSymbol(addr))
+}
+
+// FormatPath shows the tokens traded along the pairs starting from tokenIn
+func FormatPath(tokenIn common.Address, pairPath []*UniswapV2Pair) string {
+	var (
+		symbols = []string{TokenSymbol(tokenIn)}
+		token   = tokenIn
+	)
+	for _, pair := range pairPath {
+		if pair.Token0 == token {
+			token = pair.Token1
+		} else {
+			token = pair.Token0
+		}
+		symbols = append(symbols, TokenSymbol(token))
+	}
+	return strings.Join(symbols, " -> ")
+}
@@ -0,0 +1,294 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"monitor/client"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+const (
+	erc20BalanceOfSelector = 0x70a08231
+	erc20TransferSelector  = 0xa9059cbb
+
+	// probe result words in memory
+	probeRecipientBefore = 0x100
+	probeSelfBefore      = 0x120
+	probeRecipientAfter  = 0x140
+	probeSelfAfter       = 0x160
+	probeResultLength    = 0x80
+	// the sell leg returns its result after the buy leg, its input is written above
+	probeSellResult  = 0x180
+	probeSellInput   = 0x200
+	probeInputLength = 0x80
+)
+
+var (
+	// TokenProbeRecipient receives the probed transfer, it holds no code
+	TokenProbeRecipient = common.HexToAddress("0x5eed5eed5eed5eed5eed5eed5eed5eed5eed5eed")
+
+	// TokenProbeCode replaces the code of a pair in an eth_call, called with token, recipient
+	// and amount words it transfers amount of token to recipient and returns the balances
+	// of recipient and itself before and after the transfer, when a fourth word is set the
+	// recipient, running the same code, sends the amount received back and both results are returned
+	TokenProbeCode = newTokenProbeCode()
+)
+
+// TransferProbe is the balances read by TokenProbeCode
+type TransferProbe struct {
+	Amount          *big.Int
+	RecipientBefore *big.Int
+	RecipientAfter  *big.Int
+	SelfBefore      *big.Int
+	SelfAfter       *big.Int
+}
+
+func TokenProbeInput(token, recipient common.Address, amount *big.Int) []byte {
+	input := make([]byte, 0, 96)
+	input = append(input, common.BytesToHash(token.Bytes()).Bytes()...)
+	input = append(input, common.BytesToHash(recipient.Bytes()).Bytes()...)
+	return append(input, common.BigToHash(amount).Bytes()...)
+}
+
+// TokenRoundTripInput makes the recipient send back what it received
+func TokenRoundTripInput(token, recipient common.Address, amount *big.Int) []byte {
+	return append(TokenProbeInput(token, recipient, amount), common.BigToHash(common.Big1).Bytes()...)
+}
+
+func DecodeTransferProbe(amount *big.Int, data []byte) (*TransferProbe, error) {
+	if len(data) != probeResultLength {
+		return nil, fmt.Errorf("probe result length error %d", len(data))
+	}
+	return &TransferProbe{
+		Amount:          amount,
+		RecipientBefore: new(big.Int).SetBytes(data[0:32]),
+		SelfBefore:      new(big.Int).SetBytes(data[32:64]),
+		RecipientAfter:  new(big.Int).SetBytes(data[64:96]),
+		SelfAfter:       new(big.Int).SetBytes(data[96:128]),
+	}, nil
+}
+
+// DecodeRoundTripProbe splits the buy leg out of the pair and the sell leg back to it
+func DecodeRoundTripProbe(amount *big.Int, data []byte) (*TransferProbe, *TransferProbe, error) {
+	if len(data) != 2*probeResultLength {
+		return nil, nil, fmt.Errorf("probe result length error %d", len(data))
+	}
+	buy, err := DecodeTransferProbe(amount, data[:probeResultLength])
+	if err != nil {
+		return nil, nil, err
+	}
+	sell, err := DecodeTransferProbe(buy.Received(), data[probeResultLength:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return buy, sell, nil
+}
+
+func (p *TransferProbe) Received() *big.Int {
+	return new(big.Int).Sub(p.RecipientAfter, p.RecipientBefore)
+}
+
+// TransferFee is the share of the amount not received, in FeeBase units rounded up
+func (p *TransferProbe) TransferFee() int64 {
+	if p.Amount.Sign() <= 0 {
+		return 0
+	}
+	received := p.Received()
+	if received.Cmp(p.Amount) >= 0 {
+		return 0
+	}
+	if received.Sign() <= 0 {
+		return int64(FeeBase)
+	}
+	lost := new(big.Int).Sub(p.Amount, received)
+	lost.Mul(lost, big.NewInt(int64(FeeBase)))
+	lost.Add(lost, new(big.Int).Sub(p.Amount, big.NewInt(1)))
+	return lost.Div(lost, p.Amount).Int64()
+}
+
+// Rebasing reports whether the sender balance moved by other than the amount
+func (p *TransferProbe) Rebasing() bool {
+	return new(big.Int).Sub(p.SelfBefore, p.SelfAfter).Cmp(p.Amount) != 0
+}
+
+// evmAssembler builds small contracts, jumps are patched to their labels by build,
+// the label revert is added at the end
+type evmAssembler struct {
+	code   []byte
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (a *evmAssembler) op(ops ...vm.OpCode) {
+	for _, op := range ops {
+		a.code = append(a.code, byte(op))
+	}
+}
+
+func (a *evmAssembler) push(value uint64) {
+	body := binary.BigEndian.AppendUint64(nil, value)
+	for len(body) > 1 && body[0] == 0 {
+		body = body[1:]
+	}
+	a.code = append(a.code, byte(vm.PUSH1)+byte(len(body)-1))
+	a.code = append(a.code, body...)
+}
+
+func (a *evmAssembler) label(name string) {
+	if a.labels == nil {
+		a.labels = map[string]int{}
+	}
+	a.labels[name] = len(a.code)
+	a.op(vm.JUMPDEST)
+}
+
+// jumpIf jumps to the label when the top of the stack is not zero
+func (a *evmAssembler) jumpIf(name string) {
+	if a.jumps == nil {
+		a.jumps = map[int]string{}
+	}
+	a.op(vm.PUSH2)
+	a.jumps[len(a.code)] = name
+	a.code = append(a.code, 0, 0)
+	a.op(vm.JUMPI)
+}
+
+// revertIfZero reverts when the top of the stack is zero
+func (a *evmAssembler) revertIfZero() {
+	a.op(vm.ISZERO)
+	a.jumpIf("revert")
+}
+
+// selector stores the 4 bytes selector at memory 0
+func (a *evmAssembler) selector(selector uint64) {
+	a.push(selector)
+	a.push(0xe0)
+	a.op(vm.SHL)
+	a.push(0)
+	a.op(vm.MSTORE)
+}
+
+func (a *evmAssembler) build() []byte {
+	a.label("revert")
+	a.push(0)
+	a.push(0)
+	a.op(vm.REVERT)
+	for offset, name := range a.jumps {
+		binary.BigEndian.PutUint16(a.code[offset:], uint16(a.labels[name]))
+	}
+	return a.code
+}
+
+func newTokenProbeCode() []byte {
+	var (
+		a         = &evmAssembler{}
+		token     = func() { a.push(0); a.op(vm.CALLDATALOAD) }
+		recipient = func() { a.push(32); a.op(vm.CALLDATALOAD) }
+		amount    = func() { a.push(64); a.op(vm.CALLDATALOAD) }
+		balanceOf = func(who func(), to uint64) {
+			a.selector(erc20BalanceOfSelector)
+			who()
+			a.push(4)
+			a.op(vm.MSTORE)
+			// staticcall(gas, token, 0, 36, to, 32)
+			a.push(32)
+			a.push(to)
+			a.push(36)
+			a.push(0)
+			token()
+			a.op(vm.GAS, vm.STATICCALL)
+			a.revertIfZero()
+		}
+		self = func() { a.op(vm.ADDRESS) }
+	)
+	balanceOf(recipient, probeRecipientBefore)
+	balanceOf(self, probeSelfBefore)
+
+	a.selector(erc20TransferSelector)
+	recipient()
+	a.push(4)
+	a.op(vm.MSTORE)
+	amount()
+	a.push(36)
+	a.op(vm.MSTORE)
+	// call(gas, token, 0, 0, 68, 0, 0), the returned bool is checked by the balances
+	a.push(0)
+	a.push(0)
+	a.push(68)
+	a.push(0)
+	a.push(0)
+	token()
+	a.op(vm.GAS, vm.CALL)
+	a.revertIfZero()
+
+	balanceOf(recipient, probeRecipientAfter)
+	balanceOf(self, probeSelfAfter)
+
+	a.push(96)
+	a.op(vm.CALLDATALOAD)
+	a.jumpIf("sell")
+	a.push(probeResultLength)
+	a.push(probeRecipientBefore)
+	a.op(vm.RETURN)
+
+	// call(gas, recipient, 0, input, 128, result, 128) with token, self and the amount received
+	a.label("sell")
+	token()
+	a.push(probeSellInput)
+	a.op(vm.MSTORE)
+	self()
+	a.push(probeSellInput + 0x20)
+	a.op(vm.MSTORE)
+	a.push(probeRecipientBefore)
+	a.op(vm.MLOAD)
+	a.push(probeRecipientAfter)
+	a.op(vm.MLOAD, vm.SUB)
+	a.push(probeSellInput + 0x40)
+	a.op(vm.MSTORE)
+	a.push(probeResultLength)
+	a.push(probeSellResult)
+	a.push(probeInputLength)
+	a.push(probeSellInput)
+	a.push(0)
+	recipient()
+	a.op(vm.GAS, vm.CALL)
+	a.revertIfZero()
+	a.push(2 * probeResultLength)
+	a.push(probeRecipientBefore)
+	a.op(vm.RETURN)
+	return a.build()
+}
+
+// ProbeTokenTransfer simulates a transfer of amount out of pair, which must hold the token
+func ProbeTokenTransfer(ctx context.Context, cli *client.ETHClient, blockNumber *big.Int, token, pair common.Address, amount *big.Int) (*TransferProbe, error) {
+	data, err := cli.CallContractWithCode(ctx, ethereum.CallMsg{
+		To:   &pair,
+		Data: TokenProbeInput(token, TokenProbeRecipient, amount),
+	}, blockNumber, map[common.Address][]byte{
+		pair: TokenProbeCode,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return DecodeTransferProbe(amount, data)
+}
+
+// ProbeTokenRoundTrip simulates a buy of amount out of pair and the sell of what was received back
+func ProbeTokenRoundTrip(ctx context.Context, cli *client.ETHClient, blockNumber *big.Int, token, pair common.Address, amount *big.Int) (*TransferProbe, *TransferProbe, error) {
+	data, err := cli.CallContractWithCode(ctx, ethereum.CallMsg{
+		To:   &pair,
+		Data: TokenRoundTripInput(token, TokenProbeRecipient, amount),
+	}, blockNumber, map[common.Address][]byte{
+		pair:                TokenProbeCode,
+		TokenProbeRecipient: TokenProbeCode,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return DecodeRoundTripProbe(amount, data)
+}
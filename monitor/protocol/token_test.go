@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"math/big"
+	"monitor/abi"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+)
+
+// newFeeTokenCode builds a token keeping balances at the holder slot,
+// transfer credits amount*(100-fee)/100 and answers balanceOf
+func newFeeTokenCode(fee uint64) []byte {
+	a := &evmAssembler{}
+	a.push(0)
+	a.op(vm.CALLDATALOAD)
+	a.push(0xe0)
+	a.op(vm.SHR)
+	// selector != transfer means balanceOf
+	a.push(erc20TransferSelector)
+	a.op(vm.EQ)
+	a.jumpIf("transfer")
+	a.push(4)
+	a.op(vm.CALLDATALOAD, vm.SLOAD)
+	a.push(0)
+	a.op(vm.MSTORE)
+	a.push(32)
+	a.push(0)
+	a.op(vm.RETURN)
+
+	a.label("transfer")
+	// balance[caller] -= amount
+	a.op(vm.CALLER, vm.SLOAD)
+	a.push(36)
+	a.op(vm.CALLDATALOAD, vm.SWAP1, vm.SUB, vm.CALLER, vm.SSTORE)
+	// balance[to] += amount*(100-fee)/100
+	a.push(100)
+	a.push(100 - fee)
+	a.push(36)
+	a.op(vm.CALLDATALOAD, vm.MUL, vm.DIV)
+	a.push(4)
+	a.op(vm.CALLDATALOAD, vm.SLOAD, vm.ADD)
+	a.push(4)
+	a.op(vm.CALLDATALOAD, vm.SSTORE)
+	a.push(1)
+	a.push(0)
+	a.op(vm.MSTORE)
+	a.push(32)
+	a.push(0)
+	a.op(vm.RETURN)
+	return a.build()
+}
+
+func TestTokenProbe(t *testing.T) {
+	var (
+		token  = common.HexToAddress("0x4200000000000000000000000000000000000006")
+		pair   = common.HexToAddress("0x41d160033C222E6f3722EC97379867324567d883")
+		amount = big.NewInt(1000000)
+	)
+	for _, fee := range []uint64{0, 1, 100} {
+		statedb, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statedb.SetCode(token, newFeeTokenCode(fee))
+		statedb.SetCode(pair, TokenProbeCode)
+		statedb.SetState(token, common.BytesToHash(pair.Bytes()), common.BigToHash(big.NewInt(5000000)))
+		statedb.SetState(token, common.BytesToHash(TokenProbeRecipient.Bytes()), common.BigToHash(big.NewInt(7)))
+
+		data, _, err := runtime.Call(pair, TokenProbeInput(token, TokenProbeRecipient, amount), &runtime.Config{State: statedb})
+		if err != nil {
+			t.Fatal(fee, err)
+		}
+		probe, err := DecodeTransferProbe(amount, data)
+		if err != nil {
+			t.Fatal(fee, err)
+		}
+		if probe.RecipientBefore.Int64() != 7 || probe.SelfBefore.Int64() != 5000000 || probe.SelfAfter.Int64() != 4000000 {
+			t.Fatalf("%d %+v", fee, probe)
+		}
+		if probe.TransferFee() != int64(fee)*100 || probe.Rebasing() {
+			t.Fatalf("%d %+v %d", fee, probe, probe.TransferFee())
+		}
+
+		// the recipient sends back what it received, paying the fee again
+		statedb.SetCode(TokenProbeRecipient, TokenProbeCode)
+		data, _, err = runtime.Call(pair, TokenRoundTripInput(token, TokenProbeRecipient, amount), &runtime.Config{State: statedb})
+		if err != nil {
+			t.Fatal(fee, err)
+		}
+		buy, sell, err := DecodeRoundTripProbe(amount, data)
+		if err != nil {
+			t.Fatal(fee, err)
+		}
+		received := amount.Int64() * int64(100-fee) / 100
+		if buy.Received().Int64() != received || sell.Amount.Int64() != received ||
+			sell.Received().Int64() != received*int64(100-fee)/100 || sell.Rebasing() {
+			t.Fatalf("%d %+v %+v", fee, buy, sell)
+		}
+		if fee < 100 && sell.TransferFee() != int64(fee)*100 {
+			t.Fatal(fee, sell.TransferFee())
+		}
+	}
+
+	// a reverting token reverts the probe
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.SetCode(token, (&evmAssembler{}).build())
+	statedb.SetCode(pair, TokenProbeCode)
+	_, _, err := runtime.Call(pair, TokenProbeInput(token, TokenProbeRecipient, amount), &runtime.Config{State: statedb})
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestTokenBinary(t *testing.T) {
+	old := &Token{
+		Address:      common.HexToAddress("0xd9aAEc86B65D86f6A7B5B1b0c42FFA531710b6CA"),
+		Decimals:     6,
+		Symbol:       "USDbC",
+		Name:         "USD Base Coin",
+		Rebasing:     true,
+		TransferFee:  25,
+		CheckedBlock: 1234,
+	}
+	new := &Token{}
+	err := new.FromBinary(old.ToBinary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *new != *old {
+		t.Fatalf("%+v %+v", new, old)
+	}
+	body := old.ToBinary()
+	err = new.FromBinary(body[:len(body)-1])
+	if err == nil {
+		t.Fatal("should fail")
+	}
+	if !old.Excluded() || (&Token{Decimals: 18}).Excluded() {
+		t.Fatal("excluded")
+	}
+}
+
+func TestDecodeTokenText(t *testing.T) {
+	packed, err := abi.ERC20ABIInstance.Methods["symbol"].Outputs.Pack("Wrapped Ether")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := decodeTokenText(packed); text != "Wrapped Ether" {
+		t.Fatal(text)
+	}
+	// bytes32 symbols of older tokens
+	if text := decodeTokenText(common.RightPadBytes([]byte("MKR"), 32)); text != "MKR" {
+		t.Fatal(text)
+	}
+}
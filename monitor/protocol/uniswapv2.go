@@ -3,6 +3,7 @@ package protocol
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"math/big"
@@ -26,13 +27,21 @@ var (
 	UniswapV2PairEventSwapSign = abi.UniswapV2PairABIInstance.Events["Swap"].ID
 	UniswapV2PairEventSyncSign = abi.UniswapV2PairABIInstance.Events["Sync"].ID
 
+	UniswapV2FactoryEventPairCreatedSign = abi.UniswapV2FactoryABIInstance.Events["PairCreated"].ID
+
 	_ storage.DataUpdate = &UniswapV2Pair{}
 	_ DataConvert        = &UniswapV2Pair{}
 
+	UniswapV2Pairs = storage.NewStore[common.Address, *UniswapV2Pair]()
+
 	// swapEvent = cache.New(time.Minute, time.Hour)
 	// syncEvent = cache.New(time.Minute, time.Hour)
 )
 
+func init() {
+	storage.Register(storage.StoreKeyUniswapv2Pairs, UniswapV2Pairs)
+}
+
 /*
 ai/ao = (ri+ai)/ro
 ri/(ro-ao) = ai/ao
@@ -47,6 +56,8 @@ type UniswapV2Pair struct {
 	Weight1  float64
 	Error    bool
 	Fee      int64
+	// Factory is the factory created the pair, empty when unknown
+	Factory common.Address
 	*StateFromLogUpdate
 }
 
@@ -66,6 +77,10 @@ type UniswapV2SyncEvent struct {
 	Reserve1 *big.Int
 }
 
+func (p *UniswapV2Pair) IndexTokens() []common.Address {
+	return []common.Address{p.Token0, p.Token1}
+}
+
 func (p *UniswapV2Pair) ToFileData() []byte {
 	if p == nil {
 		return []byte{}
@@ -132,6 +147,91 @@ func (p *UniswapV2Pair) FromFileData(body []byte) error {
 	return p.StateFromLogUpdate.FromFileData(dataAndUpdate[1])
 }
 
+// ToBinary layout: address, token0, token1, error flag, fee int64,
+// reserve0 and reserve1 each prefixed by one length byte, the update state,
+// then the factory address only when it is known
+func (p *UniswapV2Pair) ToBinary() []byte {
+	if p == nil {
+		return []byte{}
+	}
+	var (
+		r0   = bigIntBytes(p.Reserve0)
+		r1   = bigIntBytes(p.Reserve1)
+		body = make([]byte, 0, 20*4+1+8+2+len(r0)+len(r1)+stateFromLogUpdateBinaryLength)
+	)
+	body = append(body, p.Address.Bytes()...)
+	body = append(body, p.Token0.Bytes()...)
+	body = append(body, p.Token1.Bytes()...)
+	if p.Error {
+		body = append(body, 1)
+	} else {
+		body = append(body, 0)
+	}
+	body = binary.BigEndian.AppendUint64(body, uint64(p.Fee))
+	body = append(body, byte(len(r0)))
+	body = append(body, r0...)
+	body = append(body, byte(len(r1)))
+	body = append(body, r1...)
+	body = append(body, p.StateFromLogUpdate.ToBinary()...)
+	if p.Factory != (common.Address{}) {
+		body = append(body, p.Factory.Bytes()...)
+	}
+	return body
+}
+
+func (p *UniswapV2Pair) FromBinary(body []byte) error {
+	if p == nil {
+		return fmt.Errorf("p is nil")
+	}
+	if len(body) < 20*3+1+8+1 {
+		return fmt.Errorf("binary length error %d", len(body))
+	}
+	p.Address = common.BytesToAddress(body[0:20])
+	p.Token0 = common.BytesToAddress(body[20:40])
+	p.Token1 = common.BytesToAddress(body[40:60])
+	if p.Address == (common.Address{}) || p.Token0 == (common.Address{}) || p.Token1 == (common.Address{}) {
+		return fmt.Errorf("binary address empty %x", body[:60])
+	}
+	p.Error = body[60] != 0
+	p.Fee = int64(binary.BigEndian.Uint64(body[61:69]))
+	rest := body[69:]
+	var err error
+	p.Reserve0, rest, err = readBigInt(rest)
+	if err != nil {
+		return fmt.Errorf("read reserve0 fail %s", err)
+	}
+	p.Reserve1, rest, err = readBigInt(rest)
+	if err != nil {
+		return fmt.Errorf("read reserve1 fail %s", err)
+	}
+	switch len(rest) {
+	case stateFromLogUpdateBinaryLength:
+		p.Factory = common.Address{}
+	case stateFromLogUpdateBinaryLength + 20:
+		p.Factory = common.BytesToAddress(rest[stateFromLogUpdateBinaryLength:])
+		rest = rest[:stateFromLogUpdateBinaryLength]
+	default:
+		return fmt.Errorf("binary length error %d", len(body))
+	}
+	p.StateFromLogUpdate = &StateFromLogUpdate{}
+	return p.StateFromLogUpdate.FromBinary(rest)
+}
+
+func bigIntBytes(i *big.Int) []byte {
+	if i == nil {
+		return []byte{}
+	}
+	return i.Bytes()
+}
+
+func readBigInt(body []byte) (*big.Int, []byte, error) {
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return nil, nil, fmt.Errorf("big int length error")
+	}
+	length := int(body[0])
+	return big.NewInt(0).SetBytes(body[1 : 1+length]), body[1+length:], nil
+}
+
 func FilterUniswapV2PairFromLog(ctx context.Context, logs []*types.Log) (map[common.Address]*UniswapV2Pair, error) {
 	datas := map[common.Address]*UniswapV2Pair{}
 	for _, log := range logs {
@@ -163,45 +263,59 @@ func FilterUniswapV2PairFromLog(ctx context.Context, logs []*types.Log) (map[com
 	return datas, nil
 }
 
-func FilterUniswapV2FeeFromLog(ctx context.Context, logs []*types.Log) (map[common.Address]int64, error) {
-	var (
-		fees         = map[common.Address]int64{}
-		swapEventMap = map[string]*UniswapV2SwapEvent{}
-		syncEventMap = map[string]*UniswapV2SyncEvent{}
-	)
+// FilterUniswapV2PairCreatedFromLog returns the pairs created by the factories,
+// reserves are left empty until they are seeded
+func FilterUniswapV2PairCreatedFromLog(ctx context.Context, logs []*types.Log, factories map[common.Address]bool) (map[common.Address]*UniswapV2Pair, error) {
+	datas := map[common.Address]*UniswapV2Pair{}
 	for _, log := range logs {
 		if len(log.Topics) != 3 ||
-			!strings.EqualFold(log.Topics[0].String(), UniswapV2PairEventSwapSign.String()) {
+			!strings.EqualFold(log.Topics[0].String(), UniswapV2FactoryEventPairCreatedSign.String()) ||
+			!factories[log.Address] {
 			continue
 		}
-		dataList, err := abi.UniswapV2PairABIInstance.Events["Swap"].Inputs.Unpack(log.Data)
+		dataList, err := abi.UniswapV2FactoryABIInstance.Events["PairCreated"].Inputs.NonIndexed().Unpack(log.Data)
 		if err != nil {
 			return nil, fmt.Errorf("unpack event data fail %s", err)
 		}
-		key := fmt.Sprintf("%d:%d:%d", log.BlockNumber, log.TxIndex, log.Index)
-		event := &UniswapV2SwapEvent{
-			Address:    log.Address,
-			Sender:     common.BytesToAddress(log.Topics[1].Bytes()),
-			To:         common.BytesToAddress(log.Topics[2].Bytes()),
-			Amount0In:  dataList[0].(*big.Int),
-			Amount1In:  dataList[1].(*big.Int),
-			Amount0Out: dataList[2].(*big.Int),
-			Amount1Out: dataList[3].(*big.Int),
-		}
-		swapEventMap[key] = event
-
-		if _, ok := fees[event.Address]; ok {
-			continue
-		}
-		syncEvent, ok := syncEventMap[key]
-		if !ok {
-			continue
+		if len(dataList) != 2 {
+			return nil, fmt.Errorf("unpack event data error %+v", dataList)
 		}
-		if syncEvent.Address != event.Address {
-			continue
+		pair := dataList[0].(common.Address)
+		datas[pair] = &UniswapV2Pair{
+			Address:  pair,
+			Token0:   common.BytesToAddress(log.Topics[1].Bytes()),
+			Token1:   common.BytesToAddress(log.Topics[2].Bytes()),
+			Reserve0: big.NewInt(0),
+			Reserve1: big.NewInt(0),
+			Factory:  log.Address,
+			StateFromLogUpdate: &StateFromLogUpdate{
+				BlockNumber: log.BlockNumber,
+				TxIndex:     log.TxIndex,
+				LogIndex:    log.Index,
+				Timestamp:   time.Now().Unix(),
+			},
 		}
-		fees[event.Address] = CalculatePairFee(event.Amount0In, event.Amount1In, event.Amount0Out, event.Amount1Out, syncEvent.Reserve0, syncEvent.Reserve1)
 	}
+	return datas, nil
+}
+
+// UniswapV2Swap is a swap log in its tx, with the sync log the pair emitted right before it,
+// Sync is nil when that log is not among the logs filtered
+type UniswapV2Swap struct {
+	*UniswapV2SwapEvent
+	Sync        *UniswapV2SyncEvent
+	BlockNumber uint64
+	TxHash      common.Hash
+	TxIndex     uint
+	LogIndex    uint
+}
+
+// FilterUniswapV2SwapFromLog returns the swap logs in log order, paired with their sync log
+func FilterUniswapV2SwapFromLog(ctx context.Context, logs []*types.Log) ([]*UniswapV2Swap, error) {
+	var (
+		swaps        = []*UniswapV2Swap{}
+		syncEventMap = map[string]*UniswapV2SyncEvent{}
+	)
 	for _, log := range logs {
 		if len(log.Topics) != 1 ||
 			!strings.EqualFold(log.Topics[0].String(), UniswapV2PairEventSyncSign.String()) {
@@ -214,25 +328,62 @@ func FilterUniswapV2FeeFromLog(ctx context.Context, logs []*types.Log) (map[comm
 		if len(dataList) != 2 {
 			return nil, fmt.Errorf("unpack event data error %+v", dataList)
 		}
+		// the sync log comes right before the swap log of the same pair
 		key := fmt.Sprintf("%d:%d:%d", log.BlockNumber, log.TxIndex, log.Index+1)
-		event := &UniswapV2SyncEvent{
+		syncEventMap[key] = &UniswapV2SyncEvent{
 			Address:  log.Address,
 			Reserve0: dataList[0].(*big.Int),
 			Reserve1: dataList[1].(*big.Int),
 		}
-		syncEventMap[key] = event
-
-		if _, ok := fees[event.Address]; ok {
+	}
+	for _, log := range logs {
+		if len(log.Topics) != 3 ||
+			!strings.EqualFold(log.Topics[0].String(), UniswapV2PairEventSwapSign.String()) {
 			continue
 		}
-		swapEvent, ok := swapEventMap[key]
-		if !ok {
-			continue
+		dataList, err := abi.UniswapV2PairABIInstance.Events["Swap"].Inputs.Unpack(log.Data)
+		if err != nil {
+			return nil, fmt.Errorf("unpack event data fail %s", err)
+		}
+		if len(dataList) != 4 {
+			return nil, fmt.Errorf("unpack event data error %+v", dataList)
+		}
+		swap := &UniswapV2Swap{
+			UniswapV2SwapEvent: &UniswapV2SwapEvent{
+				Address:    log.Address,
+				Sender:     common.BytesToAddress(log.Topics[1].Bytes()),
+				To:         common.BytesToAddress(log.Topics[2].Bytes()),
+				Amount0In:  dataList[0].(*big.Int),
+				Amount1In:  dataList[1].(*big.Int),
+				Amount0Out: dataList[2].(*big.Int),
+				Amount1Out: dataList[3].(*big.Int),
+			},
+			BlockNumber: log.BlockNumber,
+			TxHash:      log.TxHash,
+			TxIndex:     log.TxIndex,
+			LogIndex:    log.Index,
 		}
-		if swapEvent.Address != event.Address {
+		if sync, ok := syncEventMap[fmt.Sprintf("%d:%d:%d", log.BlockNumber, log.TxIndex, log.Index)]; ok && sync.Address == log.Address {
+			swap.Sync = sync
+		}
+		swaps = append(swaps, swap)
+	}
+	return swaps, nil
+}
+
+// FilterUniswapV2FeeFromLog calculates the fee of the pairs from their first swap paired
+// with its sync log
+func FilterUniswapV2FeeFromLog(ctx context.Context, logs []*types.Log) (map[common.Address]int64, error) {
+	swaps, err := FilterUniswapV2SwapFromLog(ctx, logs)
+	if err != nil {
+		return nil, err
+	}
+	fees := map[common.Address]int64{}
+	for _, swap := range swaps {
+		if _, ok := fees[swap.Address]; ok || swap.Sync == nil {
 			continue
 		}
-		fees[event.Address] = CalculatePairFee(swapEvent.Amount0In, swapEvent.Amount1In, swapEvent.Amount0Out, swapEvent.Amount1Out, event.Reserve0, event.Reserve1)
+		fees[swap.Address] = CalculatePairFee(swap.Amount0In, swap.Amount1In, swap.Amount0Out, swap.Amount1Out, swap.Sync.Reserve0, swap.Sync.Reserve1)
 	}
 	return fees, nil
 }
@@ -294,6 +445,11 @@ func NewUniswapV2PairInfoCalls(pair *UniswapV2Pair) []*client.ViewCall {
 			To:   pair.Address,
 			Data: abi.UniswapV2PairABIInstance.Methods["token1"].ID,
 		},
+		{
+			ID:   "UniswapV2-" + pair.Address.String() + "-factory",
+			To:   pair.Address,
+			Data: abi.UniswapV2PairABIInstance.Methods["factory"].ID,
+		},
 	}
 }
 
@@ -320,7 +476,10 @@ func UniswapV2PairCallResult(pairs map[common.Address]*UniswapV2Pair, results ma
 			}
 		}
 		if !result.Success {
-			pairs[addr].Error = true
+			// pairs without factory method are still tradable
+			if keys[2] != "factory" {
+				pairs[addr].Error = true
+			}
 			continue
 		}
 		switch keys[2] {
@@ -328,6 +487,10 @@ func UniswapV2PairCallResult(pairs map[common.Address]*UniswapV2Pair, results ma
 			pairs[addr].Token0 = common.BytesToAddress(result.ReturnData)
 		case "token1":
 			pairs[addr].Token1 = common.BytesToAddress(result.ReturnData)
+		case "factory":
+			if len(result.ReturnData) == 32 {
+				pairs[addr].Factory = common.BytesToAddress(result.ReturnData)
+			}
 		case "reserve":
 			if len(result.ReturnData) != 96 {
 				pairs[addr].Error = true
@@ -341,6 +504,55 @@ func UniswapV2PairCallResult(pairs map[common.Address]*UniswapV2Pair, results ma
 	}
 }
 
+func NewUniswapV2FactoryLengthCalls(factory common.Address) []*client.ViewCall {
+	return []*client.ViewCall{
+		{
+			ID:   "UniswapV2Factory-" + factory.String() + "-length",
+			To:   factory,
+			Data: abi.UniswapV2FactoryABIInstance.Methods["allPairsLength"].ID,
+		},
+	}
+}
+
+// NewUniswapV2FactoryPairsCalls reads allPairs of the index range [from, to)
+func NewUniswapV2FactoryPairsCalls(factory common.Address, from, to uint64) []*client.ViewCall {
+	calls := make([]*client.ViewCall, 0, to-from)
+	for i := from; i < to; i++ {
+		input, _ := abi.UniswapV2FactoryABIInstance.Methods["allPairs"].Inputs.Pack(new(big.Int).SetUint64(i))
+		calls = append(calls, &client.ViewCall{
+			ID:   "UniswapV2Factory-" + factory.String() + "-" + strconv.FormatUint(i, 10),
+			To:   factory,
+			Data: append(abi.UniswapV2FactoryABIInstance.Methods["allPairs"].ID, input...),
+		})
+	}
+	return calls
+}
+
+// UniswapV2FactoryCallResult returns the allPairsLength and the allPairs by index of the factory,
+// ok is false when the length was not read
+func UniswapV2FactoryCallResult(factory common.Address, results map[string]*abi.Multicall2Result) (length uint64, pairs map[uint64]common.Address, ok bool) {
+	pairs = map[uint64]common.Address{}
+	for id, result := range results {
+		keys := strings.Split(id, "-")
+		if len(keys) != 3 || keys[0] != "UniswapV2Factory" || common.HexToAddress(keys[1]) != factory {
+			continue
+		}
+		if !result.Success || len(result.ReturnData) != 32 {
+			continue
+		}
+		if keys[2] == "length" {
+			length, ok = new(big.Int).SetBytes(result.ReturnData).Uint64(), true
+			continue
+		}
+		index, err := strconv.ParseUint(keys[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		pairs[index] = common.BytesToAddress(result.ReturnData)
+	}
+	return length, pairs, ok
+}
+
 func GetAmountsOut(tokenIn common.Address, amountIn float64, pairPath []*UniswapV2Pair) float64 {
 	var (
 		pAmtOut  float64 = amountIn
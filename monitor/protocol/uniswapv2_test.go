@@ -3,11 +3,13 @@ package protocol
 import (
 	"context"
 	"math/big"
+	"monitor/abi"
 	"monitor/client"
 	"monitor/utils"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 func TestPairInfo(t *testing.T) {
@@ -33,8 +35,8 @@ func TestPairInfo(t *testing.T) {
 		common.HexToAddress(addr): pair,
 	}
 	UniswapV2PairCallResult(pairs, callResult)
-	for _, pair := range pairs {
-		utils.Infof("---- pair %s %+v", pair)
+	for addr, pair := range pairs {
+		utils.Infof("---- pair %s %+v", addr, pair)
 	}
 }
 
@@ -77,3 +79,191 @@ func TestFileData(t *testing.T) {
 		t.Fatalf("%+v %+v", new, old)
 	}
 }
+
+func TestBinaryData(t *testing.T) {
+	old := &UniswapV2Pair{
+		Address:  common.HexToAddress("0x41d160033C222E6f3722EC97379867324567d883"),
+		Token0:   common.HexToAddress("0x4200000000000000000000000000000000000006"),
+		Token1:   common.HexToAddress("0xd9aAEc86B65D86f6A7B5B1b0c42FFA531710b6CA"),
+		Reserve0: big.NewInt(0),
+		Reserve1: big.NewInt(5817201169869),
+		Error:    true,
+		Fee:      25,
+		StateFromLogUpdate: &StateFromLogUpdate{
+			BlockNumber: 1111,
+			TxIndex:     22,
+			LogIndex:    33,
+			Timestamp:   1690000000,
+		},
+	}
+	old.Reserve0.SetString("3471420952218753871639", 10)
+	new := &UniswapV2Pair{}
+	err := new.FromBinary(old.ToBinary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if new.Address != old.Address ||
+		new.Token0 != old.Token0 ||
+		new.Token1 != old.Token1 ||
+		new.Reserve0.Cmp(old.Reserve0) != 0 ||
+		new.Reserve1.Cmp(old.Reserve1) != 0 ||
+		new.Error != old.Error ||
+		new.Fee != old.Fee ||
+		*new.StateFromLogUpdate != *old.StateFromLogUpdate {
+		t.Fatalf("%+v %+v", new, old)
+	}
+	body := old.ToBinary()
+	err = new.FromBinary(body[:len(body)-1])
+	if err == nil {
+		t.Fatal("should fail")
+	}
+
+	// the factory is appended, records without it still decode
+	old.Factory = common.HexToAddress("0x8909Dc15e40173Ff4699343b6eB8132c65e18eC6")
+	withFactory := old.ToBinary()
+	if len(withFactory) != len(body)+20 {
+		t.Fatal(len(withFactory), len(body))
+	}
+	err = new.FromBinary(withFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if new.Factory != old.Factory || new.Fee != old.Fee || *new.StateFromLogUpdate != *old.StateFromLogUpdate {
+		t.Fatalf("%+v %+v", new, old)
+	}
+	err = new.FromBinary(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if new.Factory != (common.Address{}) {
+		t.Fatal(new.Factory)
+	}
+	err = new.FromBinary(withFactory[:len(withFactory)-1])
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestPairCreatedLog(t *testing.T) {
+	var (
+		factory = common.HexToAddress("0x8909Dc15e40173Ff4699343b6eB8132c65e18eC6")
+		token0  = common.HexToAddress("0x4200000000000000000000000000000000000006")
+		token1  = common.HexToAddress("0xd9aAEc86B65D86f6A7B5B1b0c42FFA531710b6CA")
+		pair    = common.HexToAddress("0x41d160033C222E6f3722EC97379867324567d883")
+	)
+	data, err := abi.UniswapV2FactoryABIInstance.Events["PairCreated"].Inputs.NonIndexed().Pack(pair, big.NewInt(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &types.Log{
+		Address: factory,
+		Topics: []common.Hash{
+			UniswapV2FactoryEventPairCreatedSign,
+			common.BytesToHash(token0.Bytes()),
+			common.BytesToHash(token1.Bytes()),
+		},
+		Data:        data,
+		BlockNumber: 100,
+		TxIndex:     2,
+		Index:       3,
+	}
+	pairs, err := FilterUniswapV2PairCreatedFromLog(context.Background(), []*types.Log{log}, map[common.Address]bool{factory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := pairs[pair]
+	if len(pairs) != 1 || created == nil ||
+		created.Token0 != token0 || created.Token1 != token1 || created.Factory != factory ||
+		created.BlockNumber != 100 || created.TxIndex != 2 || created.LogIndex != 3 {
+		t.Fatalf("%+v", pairs)
+	}
+
+	// factories not configured are ignored
+	pairs, err = FilterUniswapV2PairCreatedFromLog(context.Background(), []*types.Log{log}, map[common.Address]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 0 {
+		t.Fatalf("%+v", pairs)
+	}
+}
+
+func TestFactoryCallResult(t *testing.T) {
+	factory := common.HexToAddress("0x8909Dc15e40173Ff4699343b6eB8132c65e18eC6")
+	calls := append(NewUniswapV2FactoryLengthCalls(factory), NewUniswapV2FactoryPairsCalls(factory, 10, 13)...)
+	if len(calls) != 4 {
+		t.Fatal(len(calls))
+	}
+	results := map[string]*abi.Multicall2Result{
+		calls[0].ID: {Success: true, ReturnData: common.BigToHash(big.NewInt(13)).Bytes()},
+		calls[1].ID: {Success: true, ReturnData: common.BytesToHash([]byte{1}).Bytes()},
+		calls[2].ID: {Success: false},
+		calls[3].ID: {Success: true, ReturnData: common.BytesToHash([]byte{3}).Bytes()},
+		// pair calls of other protocols are skipped
+		"UniswapV2-" + factory.String() + "-token0": {Success: true, ReturnData: common.BytesToHash([]byte{9}).Bytes()},
+	}
+	length, pairs, ok := UniswapV2FactoryCallResult(factory, results)
+	if !ok || length != 13 || len(pairs) != 2 ||
+		pairs[10] != common.BytesToAddress([]byte{1}) || pairs[12] != common.BytesToAddress([]byte{3}) {
+		t.Fatal(length, pairs)
+	}
+	// a failed length call is told apart from an empty factory
+	results[calls[0].ID] = &abi.Multicall2Result{Success: false}
+	if _, _, ok := UniswapV2FactoryCallResult(factory, results); ok {
+		t.Fatal("failed length read")
+	}
+}
+
+func TestSwapLog(t *testing.T) {
+	var (
+		pair   = common.HexToAddress("0x41d160033C222E6f3722EC97379867324567d883")
+		other  = common.HexToAddress("0x8909Dc15e40173Ff4699343b6eB8132c65e18eC6")
+		sender = common.HexToAddress("0x229735D12D750B09b751fbD6b75B55902c1A2c0a")
+	)
+	syncLog := func(address common.Address, index uint, reserve0, reserve1 int64) *types.Log {
+		data, err := abi.UniswapV2PairABIInstance.Events["Sync"].Inputs.Pack(big.NewInt(reserve0), big.NewInt(reserve1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &types.Log{Address: address, Topics: []common.Hash{UniswapV2PairEventSyncSign}, Data: data, BlockNumber: 100, TxIndex: 1, Index: index}
+	}
+	swapLog := func(address common.Address, index uint, amount0In, amount1Out int64) *types.Log {
+		data, err := abi.UniswapV2PairABIInstance.Events["Swap"].Inputs.NonIndexed().Pack(big.NewInt(amount0In), big.NewInt(0), big.NewInt(0), big.NewInt(amount1Out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &types.Log{
+			Address:     address,
+			Topics:      []common.Hash{UniswapV2PairEventSwapSign, common.BytesToHash(sender.Bytes()), common.BytesToHash(pair.Bytes())},
+			Data:        data,
+			BlockNumber: 100,
+			TxIndex:     1,
+			Index:       index,
+		}
+	}
+	// the reserves after a swap of 1000 for 1987 at a 0.3% fee out of 100000:200000
+	logs := []*types.Log{
+		syncLog(pair, 0, 101000, 198013),
+		swapLog(pair, 1, 1000, 1987),
+		// a sync of another pair does not pair with the swap after it
+		syncLog(other, 2, 1, 1),
+		swapLog(pair, 3, 1000, 1000),
+	}
+	swaps, err := FilterUniswapV2SwapFromLog(context.Background(), logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(swaps) != 2 || swaps[0].LogIndex != 1 || swaps[0].Sync == nil || swaps[1].Sync != nil {
+		t.Fatalf("swaps %+v", swaps)
+	}
+	if swaps[0].Sender != sender || swaps[0].To != pair || swaps[0].Amount0In.Int64() != 1000 || swaps[0].Amount1Out.Int64() != 1987 {
+		t.Fatalf("swap %+v", swaps[0].UniswapV2SwapEvent)
+	}
+	fees, err := FilterUniswapV2FeeFromLog(context.Background(), logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fees) != 1 || fees[pair] != CalculatePairFee(big.NewInt(1000), big.NewInt(0), big.NewInt(0), big.NewInt(1987), big.NewInt(101000), big.NewInt(198013)) {
+		t.Fatalf("fees %+v", fees)
+	}
+}
@@ -0,0 +1,127 @@
+package recorder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"monitor/abi"
+	"monitor/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	RecordKindLogs      = "logs"
+	RecordKindMulticall = "multicall"
+
+	// fileSuffix names the record files, one per UTC day
+	fileSuffix = ".rec.gz"
+	dayLayout  = "2006-01-02"
+)
+
+// Record is one line of a record file, a batch of logs with the gas prices used
+// to handle it or the results of a multicall
+type Record struct {
+	Kind string `json:"kind"`
+	// Time is the unix nano time the record was written
+	Time        int64                            `json:"time"`
+	Logs        []*types.Log                     `json:"logs,omitempty"`
+	GasPrice    float64                          `json:"gasPrice,omitempty"`
+	ETHGasPrice float64                          `json:"ethGasPrice,omitempty"`
+	BlockNumber uint64                           `json:"blockNumber,omitempty"`
+	Results     map[string]*abi.Multicall2Result `json:"results,omitempty"`
+}
+
+func fileName(day time.Time) string {
+	return day.UTC().Format(dayLayout) + fileSuffix
+}
+
+// Files returns the record files of the directory in day order
+func Files(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+fileSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("glob record files fail %s", err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Reader reads the records of the files in order, every file is a gzip stream
+// of json lines appended by one member per recorder run
+type Reader struct {
+	files   []string
+	file    *os.File
+	gz      *gzip.Reader
+	scanner *bufio.Scanner
+}
+
+func NewReader(files []string) *Reader {
+	return &Reader{files: files}
+}
+
+// Next returns the next record, io.EOF after the last one, a file cut by a crash
+// ends at its last complete record
+func (r *Reader) Next() (*Record, error) {
+	for {
+		if r.scanner == nil {
+			if len(r.files) == 0 {
+				return nil, io.EOF
+			}
+			if err := r.open(r.files[0]); err != nil {
+				return nil, err
+			}
+			r.files = r.files[1:]
+		}
+		if r.scanner.Scan() {
+			record := &Record{}
+			if err := json.Unmarshal(r.scanner.Bytes(), record); err != nil {
+				utils.Warnf("skip record of %s fail %s", r.file.Name(), err)
+				continue
+			}
+			return record, nil
+		}
+		if err := r.scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("read %s fail %s", r.file.Name(), err)
+		} else if err != nil {
+			utils.Warnf("record file %s is cut %s", r.file.Name(), err)
+		}
+		r.closeFile()
+	}
+}
+
+func (r *Reader) open(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("open record file fail %s", err)
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("open gzip of %s fail %s", filePath, err)
+	}
+	r.file, r.gz = file, gz
+	r.scanner = bufio.NewScanner(gz)
+	r.scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	return nil
+}
+
+func (r *Reader) closeFile() {
+	if r.scanner == nil {
+		return
+	}
+	r.gz.Close()
+	r.file.Close()
+	r.scanner, r.gz, r.file = nil, nil, nil
+}
+
+func (r *Reader) Close() {
+	r.closeFile()
+	r.files = nil
+}
@@ -0,0 +1,201 @@
+package recorder
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"monitor/abi"
+	"monitor/action"
+	"monitor/client"
+	"monitor/config"
+	"monitor/utils"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const flushInterval = time.Second
+
+var (
+	_ utils.Keeper         = &Recorder{}
+	_ client.MulticallHook = &Recorder{}
+	_ action.Action        = &logAction{}
+)
+
+// GasPricer gives the gas prices the trades are sized with, the trader
+type GasPricer interface {
+	GasPrice() float64
+	ETHGasPrice() float64
+}
+
+// Recorder writes the logs handled by the monitor with the gas prices of the moment
+// and every multicall result read from the node into per day files, a replay feeds
+// them back to reproduce the decisions taken
+type Recorder struct {
+	config *config.Config
+	gas    GasPricer
+	now    func() time.Time
+
+	day    string
+	file   *os.File
+	writer *gzip.Writer
+	lock   sync.Mutex
+	closed bool
+}
+
+func NewRecorder(ctx context.Context, conf *config.Config, gas GasPricer) *Recorder {
+	return &Recorder{
+		config: conf,
+		gas:    gas,
+		now:    time.Now,
+	}
+}
+
+func (r *Recorder) Init(ctx context.Context) error {
+	if err := os.MkdirAll(r.config.RecordDir, 0755); err != nil {
+		return fmt.Errorf("make record dir fail %s", err)
+	}
+	client.SetMulticallHook(r)
+	utils.Go(ctx, "recorder.flush", r.loopFlush)
+	return nil
+}
+
+func (r *Recorder) ShutDown(ctx context.Context) {
+	client.SetMulticallHook(nil)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	if err := r.closeFile(); err != nil {
+		utils.Warnf("close record file fail %s", err)
+	}
+}
+
+// LogAction records the logs given to the monitor actions
+func (r *Recorder) LogAction() action.Action {
+	return &logAction{r}
+}
+
+func (r *Recorder) Replay(blockNumber *big.Int, calls []*client.ViewCall) (map[string]*abi.Multicall2Result, bool, error) {
+	return nil, false, nil
+}
+
+func (r *Recorder) Record(blockNumber *big.Int, calls []*client.ViewCall, results map[string]*abi.Multicall2Result) {
+	record := &Record{
+		Kind:    RecordKindMulticall,
+		Results: results,
+	}
+	if blockNumber != nil {
+		record.BlockNumber = blockNumber.Uint64()
+	}
+	if err := r.write(record); err != nil {
+		utils.Warnf("record multicall fail %s", err)
+	}
+}
+
+func (r *Recorder) recordLogs(logs []*types.Log) error {
+	record := &Record{
+		Kind: RecordKindLogs,
+		Logs: logs,
+	}
+	if r.gas != nil {
+		record.GasPrice = r.gas.GasPrice()
+		record.ETHGasPrice = r.gas.ETHGasPrice()
+	}
+	return r.write(record)
+}
+
+func (r *Recorder) write(record *Record) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	now := r.now()
+	record.Time = now.UnixNano()
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal record fail %s", err)
+	}
+	if err := r.rotate(now); err != nil {
+		return err
+	}
+	_, err = r.writer.Write(append(body, '\n'))
+	if err != nil {
+		return fmt.Errorf("write record fail %s", err)
+	}
+	return nil
+}
+
+// rotate opens the file of the day, a file written before is appended a new gzip member
+func (r *Recorder) rotate(now time.Time) error {
+	day := fileName(now)
+	if r.writer != nil && r.day == day {
+		return nil
+	}
+	if err := r.closeFile(); err != nil {
+		utils.Warnf("close record file fail %s", err)
+	}
+	file, err := os.OpenFile(filepath.Join(r.config.RecordDir, day), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open record file fail %s", err)
+	}
+	r.day, r.file, r.writer = day, file, gzip.NewWriter(file)
+	return nil
+}
+
+func (r *Recorder) closeFile() error {
+	if r.writer == nil {
+		return nil
+	}
+	err := r.writer.Close()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.writer, r.file, r.day = nil, nil, ""
+	return err
+}
+
+func (r *Recorder) loopFlush(ctx context.Context) error {
+	for utils.Sleep(ctx, flushInterval) {
+		r.lock.Lock()
+		if r.closed {
+			r.lock.Unlock()
+			return nil
+		}
+		if r.writer != nil {
+			if err := r.writer.Flush(); err != nil {
+				utils.Warnf("flush record file fail %s", err)
+			}
+		}
+		r.lock.Unlock()
+	}
+	return nil
+}
+
+type logAction struct {
+	recorder *Recorder
+}
+
+func (*logAction) Init(context.Context) error {
+	return nil
+}
+
+func (*logAction) OnNewBlockHandler(context.Context, ...interface{}) error {
+	return nil
+}
+
+func (a *logAction) OnNewLogHandler(ctx context.Context, params ...interface{}) error {
+	logs := params[0].([]*types.Log)
+	if len(logs) == 0 {
+		return nil
+	}
+	if err := a.recorder.recordLogs(logs); err != nil {
+		return fmt.Errorf("record logs fail %s", err)
+	}
+	return nil
+}
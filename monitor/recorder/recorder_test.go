@@ -0,0 +1,184 @@
+package recorder
+
+import (
+	"context"
+	"io"
+	"math/big"
+	"monitor/abi"
+	"monitor/backtest"
+	"monitor/client"
+	"monitor/config"
+	"monitor/protocol"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+type testGas struct{}
+
+func (testGas) GasPrice() float64 {
+	return 2e8
+}
+
+func (testGas) ETHGasPrice() float64 {
+	return 3e10
+}
+
+func newSyncLog(pair common.Address, blockNumber uint64, index uint, reserve0, reserve1 *big.Int) *types.Log {
+	return &types.Log{
+		Address:     pair,
+		Topics:      []common.Hash{protocol.UniswapV2PairEventSyncSign},
+		Data:        append(common.LeftPadBytes(reserve0.Bytes(), 32), common.LeftPadBytes(reserve1.Bytes(), 32)...),
+		BlockNumber: blockNumber,
+		Index:       index,
+	}
+}
+
+func newInfoResults(pair, token0, token1 common.Address) map[string]*abi.Multicall2Result {
+	return map[string]*abi.Multicall2Result{
+		"UniswapV2-" + pair.String() + "-token0":  {Success: true, ReturnData: common.LeftPadBytes(token0.Bytes(), 32)},
+		"UniswapV2-" + pair.String() + "-token1":  {Success: true, ReturnData: common.LeftPadBytes(token1.Bytes(), 32)},
+		"UniswapV2-" + pair.String() + "-factory": {Success: false},
+	}
+}
+
+func TestRecordFiles(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		conf = &config.Config{RecordDir: dir}
+		now  = time.Date(2024, 5, 1, 23, 59, 59, 0, time.UTC)
+		r    = NewRecorder(ctx, conf, testGas{})
+		pair = common.Address{0x01}
+	)
+	r.now = func() time.Time {
+		return now
+	}
+	if err := r.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.LogAction().OnNewLogHandler(ctx, []*types.Log{newSyncLog(pair, 10, 0, big.NewInt(1), big.NewInt(2))}); err != nil {
+		t.Fatal(err)
+	}
+	r.Record(big.NewInt(10), nil, newInfoResults(pair, common.Address{0x02}, common.Address{0x03}))
+	now = now.Add(time.Second)
+	if err := r.LogAction().OnNewLogHandler(ctx, []*types.Log{newSyncLog(pair, 11, 0, big.NewInt(3), big.NewInt(4))}); err != nil {
+		t.Fatal(err)
+	}
+	r.ShutDown(ctx)
+
+	files, err := Files(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || filepath.Base(files[0]) != "2024-05-01.rec.gz" || filepath.Base(files[1]) != "2024-05-02.rec.gz" {
+		t.Fatalf("files %v", files)
+	}
+	reader := NewReader(files)
+	defer reader.Close()
+	kinds := []string{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, record.Kind)
+		if record.Kind == RecordKindLogs && (record.GasPrice != 2e8 || record.ETHGasPrice != 3e10 || len(record.Logs) != 1) {
+			t.Fatalf("logs record %+v", record)
+		}
+		if record.Kind == RecordKindMulticall && (record.BlockNumber != 10 || len(record.Results) != 3) {
+			t.Fatalf("multicall record %+v", record)
+		}
+	}
+	if len(kinds) != 3 || kinds[0] != RecordKindLogs || kinds[1] != RecordKindMulticall || kinds[2] != RecordKindLogs {
+		t.Fatalf("kinds %v", kinds)
+	}
+
+	// a cut file keeps its complete records
+	body, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(files[0], body[:len(body)-4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader = NewReader(files[:1])
+	defer reader.Close()
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("cut file %s", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		weth  = common.Address{0xe1}
+		a     = common.Address{0xa1}
+		b     = common.Address{0xb1}
+		pairs = []common.Address{{0x51}, {0x52}, {0x53}}
+		ether = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+		units = func(n int64) *big.Int {
+			return new(big.Int).Mul(big.NewInt(n), ether)
+		}
+		now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		r   = NewRecorder(ctx, &config.Config{RecordDir: dir}, testGas{})
+	)
+	r.now = func() time.Time {
+		return now
+	}
+	if err := r.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the pair infos are recorded after the logs, as the actions run concurrently
+	r.LogAction().OnNewLogHandler(ctx, []*types.Log{
+		newSyncLog(pairs[0], 300, 0, units(100), units(100)),
+		newSyncLog(pairs[1], 300, 1, units(100), units(100)),
+		newSyncLog(pairs[2], 300, 2, units(100), units(100)),
+	})
+	for i, tokens := range [][2]common.Address{{weth, a}, {a, b}, {b, weth}} {
+		r.Record(nil, nil, newInfoResults(pairs[i], tokens[0], tokens[1]))
+	}
+	now = now.Add(2 * time.Second)
+	r.LogAction().OnNewLogHandler(ctx, []*types.Log{newSyncLog(pairs[1], 301, 0, units(100), units(200))})
+	r.ShutDown(ctx)
+
+	files, err := Files(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := NewSource(files)
+	defer source.Close()
+	conf := &config.Config{
+		Node:        ReplayNode,
+		WETHAddress: weth,
+		Factories:   []*config.Factory{},
+	}
+	executor := backtest.NewExecutor(ctx, conf)
+	report, err := backtest.NewBacktest(ctx, conf, source, executor, 0).Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Batches != 2 || report.LogErrors != 0 || len(report.Opportunities) != 1 {
+		t.Fatalf("report %+v", report)
+	}
+	one := report.Opportunities[0]
+	if !one.Time.Equal(now) || one.BlockNumber != 301 || one.Fee != executor.EstimateFee(3) {
+		t.Fatalf("opportunity %+v", one)
+	}
+	if pair, ok := protocol.UniswapV2Pairs.Load(pairs[1]); !ok || pair.Token0 != a || pair.Token1 != b {
+		t.Fatalf("pair infos not replayed")
+	}
+	// the recording is used up, a call not recorded fails instead of reaching a node
+	_, err = (&client.ETHClient{}).MultiViewCallAt(ctx, nil, protocol.NewUniswapV2PairInfoCalls(&protocol.UniswapV2Pair{Address: pairs[0]}))
+	if err == nil {
+		t.Fatalf("call not recorded replayed")
+	}
+}
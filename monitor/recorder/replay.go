@@ -0,0 +1,115 @@
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"monitor/abi"
+	"monitor/backtest"
+	"monitor/client"
+	"sync"
+	"time"
+)
+
+const (
+	// ReplayNode is configured as the node of a replay, the client dials it lazily and
+	// the multicalls are served by the recording so it is never reached
+	ReplayNode = "http://replay.invalid"
+
+	// replayLookahead is the log batches read ahead for the multicalls recorded after
+	// their batch, the actions of a batch run concurrently with the recorder
+	replayLookahead = 2
+)
+
+var (
+	_ backtest.Source      = &Source{}
+	_ client.MulticallHook = &tape{}
+)
+
+// Source replays record files to the backtest, every batch of logs comes with the time
+// and the gas prices it was handled with and the multicalls are served from the recording
+type Source struct {
+	reader  *Reader
+	tape    *tape
+	batches []*Record
+	eof     bool
+}
+
+// NewSource installs the recording as the multicall hook of the clients until Close
+func NewSource(files []string) *Source {
+	s := &Source{
+		reader: NewReader(files),
+		tape:   &tape{results: map[string][]*abi.Multicall2Result{}},
+	}
+	client.SetMulticallHook(s.tape)
+	return s
+}
+
+func (s *Source) Next(ctx context.Context) (*backtest.Batch, error) {
+	for !s.eof && len(s.batches) <= replayLookahead {
+		record, err := s.reader.Next()
+		if err == io.EOF {
+			s.eof = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch record.Kind {
+		case RecordKindLogs:
+			s.batches = append(s.batches, record)
+		case RecordKindMulticall:
+			s.tape.add(record.Results)
+		}
+	}
+	if len(s.batches) == 0 {
+		return nil, io.EOF
+	}
+	record := s.batches[0]
+	s.batches = s.batches[1:]
+	return &backtest.Batch{
+		Logs:        record.Logs,
+		Time:        time.Unix(0, record.Time),
+		GasPrice:    record.GasPrice,
+		ETHGasPrice: record.ETHGasPrice,
+	}, nil
+}
+
+func (s *Source) Close() {
+	client.SetMulticallHook(nil)
+	s.reader.Close()
+}
+
+// tape serves the recorded results of every call id in the order they were read
+type tape struct {
+	results map[string][]*abi.Multicall2Result
+	lock    sync.Mutex
+}
+
+func (t *tape) add(results map[string]*abi.Multicall2Result) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for id, result := range results {
+		t.results[id] = append(t.results[id], result)
+	}
+}
+
+func (t *tape) Replay(blockNumber *big.Int, calls []*client.ViewCall) (map[string]*abi.Multicall2Result, bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, call := range calls {
+		if len(t.results[call.ID]) == 0 {
+			return nil, false, fmt.Errorf("call %s not recorded", call.ID)
+		}
+	}
+	ret := make(map[string]*abi.Multicall2Result, len(calls))
+	for _, call := range calls {
+		ret[call.ID] = t.results[call.ID][0]
+		t.results[call.ID] = t.results[call.ID][1:]
+	}
+	return ret, true, nil
+}
+
+func (t *tape) Record(blockNumber *big.Int, calls []*client.ViewCall, results map[string]*abi.Multicall2Result) {
+}
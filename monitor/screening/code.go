@@ -0,0 +1,88 @@
+package screening
+
+import (
+	"bytes"
+	"encoding/binary"
+	"monitor/protocol"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	// codeRiskSignatures are owner functions found in the dispatcher of risky tokens
+	codeRiskSignatures = map[uint32][]string{
+		protocol.RiskBlacklist: {
+			"blacklist(address)",
+			"addToBlacklist(address)",
+			"addBlacklist(address)",
+			"isBlacklisted(address)",
+			"setBlacklist(address,bool)",
+			"blacklistAddress(address,bool)",
+			"setBots(address[])",
+			"addBots(address[])",
+			"blockBots(address[])",
+		},
+		protocol.RiskPause: {
+			"pause()",
+			"paused()",
+			"setPaused(bool)",
+		},
+		protocol.RiskOwnerFee: {
+			"setFee(uint256)",
+			"setFees(uint256,uint256)",
+			"setTaxes(uint256,uint256)",
+			"setBuyFee(uint256)",
+			"setSellFee(uint256)",
+			"setTaxFeePercent(uint256)",
+			"updateFees(uint256,uint256)",
+			"setSwapFee(uint256)",
+		},
+		protocol.RiskUpgradeable: {
+			"upgradeTo(address)",
+			"upgradeToAndCall(address,bytes)",
+		},
+	}
+	codeRiskSelectors = newCodeRiskSelectors()
+
+	// eip1967ImplementationSlot is pushed by proxies loading their implementation
+	eip1967ImplementationSlot = common.HexToHash("0x360894a13ba1a3210667c828492db98dca3e2076cc3735a920a3ca505d382bbc")
+)
+
+func newCodeRiskSelectors() map[uint32]uint32 {
+	selectors := map[uint32]uint32{}
+	for risk, signatures := range codeRiskSignatures {
+		for _, signature := range signatures {
+			selectors[binary.BigEndian.Uint32(crypto.Keccak256([]byte(signature))[:4])] |= risk
+		}
+	}
+	return selectors
+}
+
+// ScanCode returns the risks of the selectors pushed by the code, push datas are skipped
+// so constants are not taken for opcodes
+func ScanCode(code []byte) uint32 {
+	risks := uint32(0)
+	for i := 0; i < len(code); i++ {
+		op := vm.OpCode(code[i])
+		if op < vm.PUSH1 || op > vm.PUSH32 {
+			continue
+		}
+		size := int(op-vm.PUSH1) + 1
+		if i+size >= len(code) {
+			break
+		}
+		data := code[i+1 : i+1+size]
+		switch size {
+		case 4:
+			risks |= codeRiskSelectors[binary.BigEndian.Uint32(data)]
+		case 32:
+			if bytes.Equal(data, eip1967ImplementationSlot.Bytes()) {
+				risks |= protocol.RiskUpgradeable
+			}
+		}
+		i += size
+	}
+	return risks
+}
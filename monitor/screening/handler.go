@@ -0,0 +1,164 @@
+package screening
+
+import (
+	"encoding/json"
+	"monitor/protocol"
+	"monitor/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	kindNames = map[uint8]string{
+		protocol.ScreenKindToken: "token",
+		protocol.ScreenKindPair:  "pair",
+	}
+	listNames = map[uint8]string{
+		protocol.ListNone:  "none",
+		protocol.ListAllow: "allow",
+		protocol.ListDeny:  "deny",
+	}
+)
+
+type listEntryJSON struct {
+	Address   common.Address `json:"address"`
+	Kind      string         `json:"kind"`
+	List      string         `json:"list"`
+	Reason    string         `json:"reason"`
+	UpdatedAt int64          `json:"updatedAt,omitempty"`
+}
+
+type screenJSON struct {
+	Address        common.Address `json:"address"`
+	Kind           string         `json:"kind"`
+	Risks          []string       `json:"risks"`
+	Score          int64          `json:"score"`
+	SellFee        int64          `json:"sellFee"`
+	FirstSeenBlock uint64         `json:"firstSeenBlock"`
+	CheckedBlock   uint64         `json:"checkedBlock"`
+	List           string         `json:"list"`
+	Allowed        bool           `json:"allowed"`
+}
+
+// Handler serves the lists and the screens:
+//
+//	GET  /screening/lists              the allow and deny entries
+//	POST /screening/lists              {"address","kind":"token|pair","list":"allow|deny|none","reason"}
+//	GET  /screening/screens/<address>  the screen of a token or a pair
+func (s *Screener) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/screening/lists", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.handleGetLists(w, r)
+		case http.MethodPost:
+			s.handlePostList(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/screening/screens/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleGetScreen(w, r)
+	})
+	return mux
+}
+
+func (s *Screener) handleGetLists(w http.ResponseWriter, r *http.Request) {
+	entries := []*listEntryJSON{}
+	protocol.ScreenLists.Range(func(_ common.Address, entry *protocol.ListEntry) bool {
+		if entry.List == protocol.ListNone {
+			return true
+		}
+		entries = append(entries, &listEntryJSON{
+			Address:   entry.Address,
+			Kind:      kindNames[entry.Kind],
+			List:      listNames[entry.List],
+			Reason:    entry.Reason,
+			UpdatedAt: entry.UpdatedAt,
+		})
+		return true
+	})
+	utils.WriteJSON(w, entries)
+}
+
+func (s *Screener) handlePostList(w http.ResponseWriter, r *http.Request) {
+	body := &listEntryJSON{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		http.Error(w, "decode body fail "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind, ok := lookupName(kindNames, body.Kind)
+	if !ok {
+		http.Error(w, "unknown kind "+body.Kind, http.StatusBadRequest)
+		return
+	}
+	list, ok := lookupName(listNames, body.List)
+	if !ok {
+		http.Error(w, "unknown list "+body.List, http.StatusBadRequest)
+		return
+	}
+	if body.Address == (common.Address{}) {
+		http.Error(w, "missing address", http.StatusBadRequest)
+		return
+	}
+	entry := &protocol.ListEntry{
+		Address:   body.Address,
+		Kind:      kind,
+		List:      list,
+		Reason:    body.Reason,
+		UpdatedAt: time.Now().UnixNano(),
+	}
+	protocol.ScreenLists.Store([]common.Address{entry.Address}, []*protocol.ListEntry{entry})
+	body.UpdatedAt = entry.UpdatedAt
+	utils.WriteJSON(w, body)
+}
+
+func (s *Screener) handleGetScreen(w http.ResponseWriter, r *http.Request) {
+	value := strings.TrimPrefix(r.URL.Path, "/screening/screens/")
+	if !common.IsHexAddress(value) {
+		http.Error(w, "invalid address "+value, http.StatusBadRequest)
+		return
+	}
+	addr := common.HexToAddress(value)
+	screen, ok := protocol.Screens.Load(addr)
+	if !ok {
+		http.Error(w, "screen not found", http.StatusNotFound)
+		return
+	}
+	ret := &screenJSON{
+		Address:        screen.Address,
+		Kind:           kindNames[screen.Kind],
+		Risks:          RiskNames(screen.Risks),
+		Score:          Score(screen.Risks),
+		SellFee:        screen.SellFee,
+		FirstSeenBlock: screen.FirstSeenBlock,
+		CheckedBlock:   screen.CheckedBlock,
+		List:           listNames[protocol.ListNone],
+	}
+	if entry, ok := protocol.ScreenLists.Load(addr); ok {
+		ret.List = listNames[entry.List]
+	}
+	if screen.Kind == protocol.ScreenKindToken {
+		ret.Score = s.tokenScore(screen, s.liquidity.Load())
+		ret.Allowed = s.tokenFilter()(addr)
+	} else if pair, ok := protocol.UniswapV2Pairs.Load(addr); ok {
+		ret.Allowed = s.PairFilter()(pair)
+	}
+	utils.WriteJSON(w, ret)
+}
+
+func lookupName(names map[uint8]string, name string) (uint8, bool) {
+	for value, one := range names {
+		if one == name {
+			return value, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,431 @@
+package screening
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"monitor/client"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/storage"
+	"monitor/utils"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	DefaultMaxScore      = int64(50)
+	DefaultRefreshBlocks = uint64(43200)
+
+	screenInterval = 5 * time.Second
+	screenPageSize = 50
+	// probeShare is the part of the pair reserve the round trip buys, 1/1000
+	probeShare = 1000
+	// lowLiquidityScore is added to the tokens under the minimum liquidity
+	lowLiquidityScore = int64(100)
+)
+
+var (
+	_ utils.Keeper = &Screener{}
+
+	// errNotHeld skips the tokens no pair holds enough of, they are queued again by their pairs
+	errNotHeld = errors.New("token not held")
+
+	riskScores = map[uint32]int64{
+		protocol.RiskHoneypot:    100,
+		protocol.RiskSellFee:     100,
+		protocol.RiskBlacklist:   30,
+		protocol.RiskPause:       30,
+		protocol.RiskOwnerFee:    40,
+		protocol.RiskUpgradeable: 20,
+	}
+	riskNames = map[uint32]string{
+		protocol.RiskHoneypot:    "honeypot",
+		protocol.RiskSellFee:     "sell_fee",
+		protocol.RiskBlacklist:   "blacklist",
+		protocol.RiskPause:       "pause",
+		protocol.RiskOwnerFee:    "owner_fee",
+		protocol.RiskUpgradeable: "upgradeable",
+	}
+)
+
+// Score sums the scores of the risks, a token scoring the max score or more is excluded
+func Score(risks uint32) int64 {
+	score := int64(0)
+	for risk, one := range riskScores {
+		if risks&risk != 0 {
+			score += one
+		}
+	}
+	return score
+}
+
+func RiskNames(risks uint32) []string {
+	names := []string{}
+	for risk := uint32(1); risk != 0 && risk <= risks; risk <<= 1 {
+		if risks&risk != 0 {
+			names = append(names, riskNames[risk])
+		}
+	}
+	return names
+}
+
+// liquidityIndex is rebuilt from the pairs every screening round
+type liquidityIndex struct {
+	// weth is the reserve in ether of the deepest WETH pair of every token
+	weth map[common.Address]float64
+	// holder is the pair holding most of every token
+	holder map[common.Address]common.Address
+}
+
+// Screener scores the tokens of the stored pairs, a simulated buy sell round trip
+// and the owner functions of the token code give its risks, the liquidity and the
+// pair age are checked when the graph is built, the allow and deny lists come first
+type Screener struct {
+	config    *config.Config
+	pending   map[common.Address]bool
+	newPairs  map[common.Address]uint64
+	liquidity atomic.Pointer[liquidityIndex]
+	lock      sync.Mutex
+}
+
+func NewScreener(ctx context.Context, conf *config.Config) *Screener {
+	return &Screener{
+		config:   conf,
+		pending:  map[common.Address]bool{},
+		newPairs: map[common.Address]uint64{},
+	}
+}
+
+func (s *Screener) Init(ctx context.Context) error {
+	protocol.UniswapV2Pairs.Subscribe(func(_ []common.Address, pairs []*protocol.UniswapV2Pair) {
+		s.addPairs(pairs)
+	})
+	pairs := []*protocol.UniswapV2Pair{}
+	protocol.UniswapV2Pairs.Range(func(_ common.Address, pair *protocol.UniswapV2Pair) bool {
+		pairs = append(pairs, pair)
+		return true
+	})
+	s.addPairs(pairs)
+	utils.Go(client.WithPriority(ctx, client.PriorityBackground), "screening.screen", s.loopScreen)
+	return nil
+}
+
+// ShutDown has nothing to release, the supervisor cancels the loop and waits for it
+func (*Screener) ShutDown(context.Context) {
+
+}
+
+// addPairs queues the pairs not seen yet and their tokens not screened yet
+func (s *Screener) addPairs(pairs []*protocol.UniswapV2Pair) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, pair := range pairs {
+		if _, ok := protocol.Screens.Load(pair.Address); !ok {
+			s.newPairs[pair.Address] = pair.UpdatedBlock()
+		}
+		for _, token := range pair.IndexTokens() {
+			if _, ok := protocol.Screens.Load(token); !ok {
+				s.pending[token] = true
+			}
+		}
+	}
+}
+
+func (s *Screener) loopScreen(ctx context.Context) error {
+	for utils.Sleep(ctx, screenInterval) {
+		s.storeNewPairs()
+		s.indexLiquidity()
+		s.queueStale()
+		err := s.screen(ctx)
+		if err != nil {
+			utils.Warnf("screen tokens fail %s", err)
+		}
+	}
+	return nil
+}
+
+// storeNewPairs records the block the pairs were first seen at for the age check
+func (s *Screener) storeNewPairs() {
+	s.lock.Lock()
+	newPairs := s.newPairs
+	s.newPairs = map[common.Address]uint64{}
+	s.lock.Unlock()
+	var (
+		keys    = []common.Address{}
+		screens = []*protocol.Screen{}
+	)
+	for pair, blockNumber := range newPairs {
+		if _, ok := protocol.Screens.Load(pair); ok {
+			continue
+		}
+		keys = append(keys, pair)
+		screens = append(screens, &protocol.Screen{
+			Address:        pair,
+			Kind:           protocol.ScreenKindPair,
+			FirstSeenBlock: blockNumber,
+			CheckedBlock:   blockNumber,
+		})
+	}
+	protocol.Screens.Store(keys, screens)
+}
+
+func (s *Screener) indexLiquidity() {
+	var (
+		index = &liquidityIndex{
+			weth:   map[common.Address]float64{},
+			holder: map[common.Address]common.Address{},
+		}
+		held = map[common.Address]*big.Int{}
+		weth = s.config.WETHAddress
+		hold = func(pair, token common.Address, reserve *big.Int) {
+			if held[token] == nil || reserve.Cmp(held[token]) > 0 {
+				held[token] = reserve
+				index.holder[token] = pair
+			}
+		}
+	)
+	protocol.UniswapV2Pairs.Range(func(_ common.Address, pair *protocol.UniswapV2Pair) bool {
+		if pair.Error || pair.Reserve0 == nil || pair.Reserve1 == nil {
+			return true
+		}
+		hold(pair.Address, pair.Token0, pair.Reserve0)
+		hold(pair.Address, pair.Token1, pair.Reserve1)
+		var (
+			other   = pair.Token1
+			reserve = pair.Reserve0
+		)
+		if pair.Token1 == weth {
+			other, reserve = pair.Token0, pair.Reserve1
+		} else if pair.Token0 != weth {
+			return true
+		}
+		amount, _ := new(big.Float).SetInt(reserve).Float64()
+		amount /= math.Pow10(18)
+		if amount > index.weth[other] {
+			index.weth[other] = amount
+		}
+		return true
+	})
+	index.weth[weth] = math.Inf(1)
+	s.liquidity.Store(index)
+}
+
+// queueStale queues the tokens screened more than the refresh blocks ago
+func (s *Screener) queueStale() {
+	head := storage.Head()
+	refresh := s.config.ScreenRefreshBlocks
+	if refresh == 0 {
+		refresh = DefaultRefreshBlocks
+	}
+	if head <= refresh {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	protocol.Screens.Range(func(addr common.Address, screen *protocol.Screen) bool {
+		if screen.Kind == protocol.ScreenKindToken && screen.CheckedBlock+refresh < head {
+			s.pending[addr] = true
+		}
+		return true
+	})
+}
+
+// screen checks one page of the pending tokens, the ones failed are queued again
+func (s *Screener) screen(ctx context.Context) error {
+	batch := s.takePending()
+	if len(batch) == 0 {
+		return nil
+	}
+	cli, err := client.GetETHClient(ctx, s.config.Node, s.config.MulticallAddress)
+	if err != nil {
+		s.requeue(batch)
+		return fmt.Errorf("get eth client fail %s", err)
+	}
+	number, err := cli.BlockNumber(ctx)
+	if err != nil {
+		s.requeue(batch)
+		return fmt.Errorf("get block number fail %s", err)
+	}
+	var (
+		keys    = []common.Address{}
+		screens = []*protocol.Screen{}
+		failed  = []common.Address{}
+		index   = s.liquidity.Load()
+	)
+	for _, token := range batch {
+		screen, err := s.screenToken(ctx, cli, index, new(big.Int).SetUint64(number), token)
+		if errors.Is(err, errNotHeld) {
+			continue
+		}
+		if err != nil {
+			utils.Warnf("screen token %s fail %s", token, err)
+			failed = append(failed, token)
+			continue
+		}
+		screen.CheckedBlock = number
+		screen.FirstSeenBlock = number
+		if old, ok := protocol.Screens.Load(token); ok {
+			screen.FirstSeenBlock = old.FirstSeenBlock
+		}
+		if screen.Risks != 0 {
+			utils.Infof("screen token %s risks %s score %d", protocol.TokenSymbol(token), RiskNames(screen.Risks), Score(screen.Risks))
+		}
+		keys = append(keys, token)
+		screens = append(screens, screen)
+	}
+	protocol.Screens.Store(keys, screens)
+	s.requeue(failed)
+	return nil
+}
+
+func (s *Screener) screenToken(ctx context.Context, cli *client.ETHClient, index *liquidityIndex, blockNumber *big.Int, token common.Address) (*protocol.Screen, error) {
+	screen := &protocol.Screen{
+		Address: token,
+		Kind:    protocol.ScreenKindToken,
+	}
+	code, err := cli.CodeAt(ctx, token, blockNumber)
+	if err != nil {
+		return nil, fmt.Errorf("get code fail %s", err)
+	}
+	screen.Risks |= ScanCode(code)
+
+	if index == nil {
+		return nil, fmt.Errorf("liquidity not indexed")
+	}
+	pairAddr, ok := index.holder[token]
+	if !ok {
+		return nil, errNotHeld
+	}
+	pair, ok := protocol.UniswapV2Pairs.Load(pairAddr)
+	if !ok {
+		return nil, errNotHeld
+	}
+	reserve := pair.Reserve0
+	if pair.Token1 == token {
+		reserve = pair.Reserve1
+	}
+	amount := new(big.Int).Div(reserve, big.NewInt(probeShare))
+	if amount.Sign() <= 0 {
+		return nil, errNotHeld
+	}
+	_, sell, err := protocol.ProbeTokenRoundTrip(ctx, cli, blockNumber, token, pairAddr, amount)
+	if err != nil {
+		if !strings.Contains(err.Error(), "revert") {
+			return nil, fmt.Errorf("probe round trip fail %s", err)
+		}
+		screen.Risks |= protocol.RiskHoneypot
+		return screen, nil
+	}
+	if sell.Amount.Sign() <= 0 {
+		screen.Risks |= protocol.RiskHoneypot
+	} else if screen.SellFee = sell.TransferFee(); screen.SellFee > 0 {
+		screen.Risks |= protocol.RiskSellFee
+	}
+	return screen, nil
+}
+
+func (s *Screener) takePending() []common.Address {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	batch := []common.Address{}
+	for token := range s.pending {
+		if len(batch) >= screenPageSize {
+			break
+		}
+		batch = append(batch, token)
+		delete(s.pending, token)
+	}
+	return batch
+}
+
+func (s *Screener) requeue(tokens []common.Address) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, token := range tokens {
+		s.pending[token] = true
+	}
+}
+
+// PairFilter reports whether a pair may enter the graph, the lists and screens are read once
+// so it is called for every pair of a graph build, a nil Screener allows every pair
+func (s *Screener) PairFilter() func(pair *protocol.UniswapV2Pair) bool {
+	if s == nil {
+		return func(*protocol.UniswapV2Pair) bool {
+			return true
+		}
+	}
+	var (
+		lists        = protocol.ScreenLists.Snapshot()
+		screens      = protocol.Screens.Snapshot()
+		head         = storage.Head()
+		minAge       = s.config.ScreenMinPairAgeBlocks
+		tokenAllowed = s.tokenFilter()
+	)
+	return func(pair *protocol.UniswapV2Pair) bool {
+		if entry, ok := lists.Load(pair.Address); ok {
+			switch entry.List {
+			case protocol.ListDeny:
+				return false
+			case protocol.ListAllow:
+				return true
+			}
+		}
+		if minAge > 0 {
+			screen, ok := screens.Load(pair.Address)
+			if !ok || screen.FirstSeenBlock+minAge > head {
+				return false
+			}
+		}
+		return tokenAllowed(pair.Token0) && tokenAllowed(pair.Token1)
+	}
+}
+
+// tokenFilter reports whether a token may be traded, the tokens not screened yet are not
+func (s *Screener) tokenFilter() func(token common.Address) bool {
+	var (
+		lists   = protocol.ScreenLists.Snapshot()
+		screens = protocol.Screens.Snapshot()
+		index   = s.liquidity.Load()
+	)
+	return func(token common.Address) bool {
+		if entry, ok := lists.Load(token); ok {
+			switch entry.List {
+			case protocol.ListDeny:
+				return false
+			case protocol.ListAllow:
+				return true
+			}
+		}
+		if token == s.config.WETHAddress {
+			return true
+		}
+		screen, ok := screens.Load(token)
+		if !ok {
+			return false
+		}
+		return s.tokenScore(screen, index) < s.maxScore()
+	}
+}
+
+// tokenScore adds the liquidity score to the risks score
+func (s *Screener) tokenScore(screen *protocol.Screen, index *liquidityIndex) int64 {
+	score := Score(screen.Risks)
+	if s.config.ScreenMinLiquidity > 0 && (index == nil || index.weth[screen.Address] < s.config.ScreenMinLiquidity) {
+		score += lowLiquidityScore
+	}
+	return score
+}
+
+func (s *Screener) maxScore() int64 {
+	if s.config.ScreenMaxScore > 0 {
+		return s.config.ScreenMaxScore
+	}
+	return DefaultMaxScore
+}
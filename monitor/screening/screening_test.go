@@ -0,0 +1,204 @@
+package screening
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func selector(signature string) []byte {
+	return crypto.Keccak256([]byte(signature))[:4]
+}
+
+func TestScanCode(t *testing.T) {
+	blacklist := append([]byte{byte(vm.PUSH4)}, selector("blacklist(address)")...)
+	if risks := ScanCode(blacklist); risks != protocol.RiskBlacklist {
+		t.Fatalf("push4 selector risks %d", risks)
+	}
+	// the selector is data of a PUSH32, not a dispatched function
+	hidden := append([]byte{byte(vm.PUSH32)}, make([]byte, 28)...)
+	hidden = append(hidden, selector("pause()")...)
+	if risks := ScanCode(hidden); risks != 0 {
+		t.Fatalf("push32 data risks %d", risks)
+	}
+	code := append([]byte{byte(vm.PUSH4)}, selector("setSellFee(uint256)")...)
+	code = append(code, byte(vm.PUSH32))
+	code = append(code, eip1967ImplementationSlot.Bytes()...)
+	code = append(code, byte(vm.PUSH4))
+	code = append(code, selector("pause()")...)
+	want := protocol.RiskOwnerFee | protocol.RiskUpgradeable | protocol.RiskPause
+	if risks := ScanCode(code); risks != want {
+		t.Fatalf("code risks %d want %d", risks, want)
+	}
+	// a truncated push at the end is ignored
+	if risks := ScanCode([]byte{byte(vm.PUSH4), 0x01}); risks != 0 {
+		t.Fatalf("truncated risks %d", risks)
+	}
+}
+
+func TestScore(t *testing.T) {
+	risks := protocol.RiskBlacklist | protocol.RiskUpgradeable
+	if score := Score(risks); score != 50 {
+		t.Fatalf("score %d", score)
+	}
+	names := RiskNames(risks)
+	if len(names) != 2 || names[0] != "blacklist" || names[1] != "upgradeable" {
+		t.Fatalf("names %v", names)
+	}
+	if len(RiskNames(0)) != 0 {
+		t.Fatalf("names of no risk")
+	}
+}
+
+func testAddress(i uint32) common.Address {
+	addr := common.Address{0xcc}
+	binary.BigEndian.PutUint32(addr[16:], i)
+	return addr
+}
+
+func TestPairFilter(t *testing.T) {
+	var (
+		weth   = testAddress(1)
+		safe   = testAddress(2)
+		risky  = testAddress(3)
+		thin   = testAddress(4)
+		fresh  = testAddress(5)
+		denied = testAddress(6)
+		ether  = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+		conf   = &config.Config{
+			WETHAddress:            weth,
+			ScreenMinLiquidity:     1,
+			ScreenMinPairAgeBlocks: 100,
+		}
+		s     = NewScreener(context.Background(), conf)
+		pairs = map[common.Address]*protocol.UniswapV2Pair{}
+		head  = uint64(100000)
+	)
+	storage.UpdateHead(head)
+	newPair := func(i uint32, token common.Address, reserve int64) *protocol.UniswapV2Pair {
+		pair := &protocol.UniswapV2Pair{
+			Address:  testAddress(100 + i),
+			Token0:   weth,
+			Token1:   token,
+			Reserve0: new(big.Int).Mul(big.NewInt(reserve), ether),
+			Reserve1: new(big.Int).Mul(big.NewInt(reserve), ether),
+		}
+		pairs[token] = pair
+		protocol.UniswapV2Pairs.Store([]common.Address{pair.Address}, []*protocol.UniswapV2Pair{pair})
+		return pair
+	}
+	newPair(0, safe, 10)
+	newPair(1, risky, 10)
+	newPair(2, thin, 0)
+	newPair(3, fresh, 10)
+	newPair(4, denied, 10)
+	screens := []*protocol.Screen{}
+	for _, pair := range pairs {
+		firstSeen := uint64(1)
+		if pair.Token1 == fresh {
+			firstSeen = head - 10
+		}
+		screens = append(screens, &protocol.Screen{Address: pair.Address, Kind: protocol.ScreenKindPair, FirstSeenBlock: firstSeen})
+	}
+	screens = append(screens,
+		&protocol.Screen{Address: safe, Kind: protocol.ScreenKindToken, Risks: protocol.RiskUpgradeable},
+		&protocol.Screen{Address: risky, Kind: protocol.ScreenKindToken, Risks: protocol.RiskHoneypot},
+		&protocol.Screen{Address: thin, Kind: protocol.ScreenKindToken},
+		&protocol.Screen{Address: fresh, Kind: protocol.ScreenKindToken},
+		&protocol.Screen{Address: denied, Kind: protocol.ScreenKindToken},
+	)
+	for _, screen := range screens {
+		protocol.Screens.Store([]common.Address{screen.Address}, []*protocol.Screen{screen})
+	}
+	protocol.ScreenLists.Store([]common.Address{denied}, []*protocol.ListEntry{{Address: denied, Kind: protocol.ScreenKindToken, List: protocol.ListDeny}})
+	s.indexLiquidity()
+
+	allowed := s.PairFilter()
+	for token, want := range map[common.Address]bool{safe: true, risky: false, thin: false, fresh: false, denied: false} {
+		if got := allowed(pairs[token]); got != want {
+			t.Fatalf("token %s allowed %t want %t", token, got, want)
+		}
+	}
+	// the allow list wins over the screen
+	protocol.ScreenLists.Store([]common.Address{pairs[risky].Address}, []*protocol.ListEntry{{Address: pairs[risky].Address, Kind: protocol.ScreenKindPair, List: protocol.ListAllow}})
+	if !s.PairFilter()(pairs[risky]) {
+		t.Fatalf("allowed pair filtered")
+	}
+	// a token never screened is excluded
+	unknown := &protocol.UniswapV2Pair{Address: testAddress(200), Token0: weth, Token1: testAddress(7)}
+	protocol.Screens.Store([]common.Address{unknown.Address}, []*protocol.Screen{{Address: unknown.Address, Kind: protocol.ScreenKindPair, FirstSeenBlock: 1}})
+	if s.PairFilter()(unknown) {
+		t.Fatalf("unscreened token allowed")
+	}
+	var none *Screener
+	if !none.PairFilter()(unknown) {
+		t.Fatalf("nil screener filtered")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var (
+		token = testAddress(300)
+		s     = NewScreener(context.Background(), &config.Config{WETHAddress: testAddress(1)})
+		h     = s.Handler()
+	)
+	protocol.Screens.Store([]common.Address{token}, []*protocol.Screen{{Address: token, Kind: protocol.ScreenKindToken, Risks: protocol.RiskPause, CheckedBlock: 7}})
+
+	body, _ := json.Marshal(map[string]string{"address": token.Hex(), "kind": "token", "list": "deny", "reason": "scam"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/screening/lists", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("post list code %d %s", w.Code, w.Body)
+	}
+	if entry, ok := protocol.ScreenLists.Load(token); !ok || entry.List != protocol.ListDeny || entry.Reason != "scam" {
+		t.Fatalf("entry not stored %+v", entry)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/screening/lists", bytes.NewReader([]byte(`{"address":"`+token.Hex()+`","kind":"token","list":"grey"}`))))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("bad list code %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/screening/lists", nil))
+	entries := []*listEntryJSON{}
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, entry := range entries {
+		found = found || (entry.Address == token && entry.List == "deny")
+	}
+	if !found {
+		t.Fatalf("entry not listed %+v", entries)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/screening/screens/"+token.Hex(), nil))
+	screen := &screenJSON{}
+	if err := json.NewDecoder(w.Body).Decode(screen); err != nil {
+		t.Fatal(err)
+	}
+	if screen.List != "deny" || screen.Allowed || screen.Score != 30 || len(screen.Risks) != 1 || screen.Risks[0] != "pause" {
+		t.Fatalf("screen %+v", screen)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/screening/screens/"+testAddress(301).Hex(), nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("missing screen code %d", w.Code)
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"monitor/config"
+	"monitor/metrics"
+	"monitor/utils"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultTTLBlocks is about one day of 2 second blocks
+	DefaultTTLBlocks     = uint64(43200)
+	DefaultSweepInterval = time.Minute
+)
+
+var (
+	_ utils.Keeper = &Janitor{}
+
+	headBlock uint64
+)
+
+// UpdateHead records the latest block seen, it never goes backwards
+func UpdateHead(blockNumber uint64) {
+	for {
+		head := atomic.LoadUint64(&headBlock)
+		if blockNumber <= head || atomic.CompareAndSwapUint64(&headBlock, head, blockNumber) {
+			return
+		}
+	}
+}
+
+func Head() uint64 {
+	return atomic.LoadUint64(&headBlock)
+}
+
+// Janitor drops the datas of every registered storage older than the ttl in blocks
+type Janitor struct {
+	ttl      uint64
+	interval time.Duration
+	expired  *prometheus.CounterVec
+}
+
+func NewJanitor(ctx context.Context, conf *config.Config) *Janitor {
+	j := &Janitor{
+		ttl:      conf.StorageTTLBlocks,
+		interval: conf.StorageSweepInterval,
+	}
+	if j.ttl == 0 {
+		j.ttl = DefaultTTLBlocks
+	}
+	if j.interval <= 0 {
+		j.interval = DefaultSweepInterval
+	}
+	j.expired = metrics.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "storage",
+		Name:      "expired_total",
+		Help:      "Datas dropped by the janitor by store.",
+	}, "store")
+	metrics.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem: "storage",
+		Name:      "head_block",
+		Help:      "Latest block seen.",
+	}, func() float64 {
+		return float64(Head())
+	})
+	for key, store := range AllDatasStorage {
+		store := store
+		metrics.NewGaugeFunc(prometheus.GaugeOpts{
+			Subsystem:   "storage",
+			Name:        "datas",
+			Help:        "Datas held by store.",
+			ConstLabels: prometheus.Labels{"store": key},
+		}, func() float64 {
+			return float64(store.Len())
+		})
+	}
+	return j
+}
+
+func (j *Janitor) Init(ctx context.Context) error {
+	utils.Go(ctx, "storage.sweep", j.loopSweep)
+	return nil
+}
+
+func (*Janitor) ShutDown(context.Context) {
+
+}
+
+func (j *Janitor) loopSweep(ctx context.Context) error {
+	for utils.Sleep(ctx, j.interval) {
+		j.Sweep()
+	}
+	return nil
+}
+
+// Sweep does nothing until a head block is known, otherwise every data would look expired
+func (j *Janitor) Sweep() int {
+	head := Head()
+	if head == 0 {
+		return 0
+	}
+	total := 0
+	for key, store := range AllDatasStorage {
+		count := store.Expire(head, j.ttl)
+		if count > 0 {
+			utils.Infof("storage %s expired %d datas at block %d", key, count, head)
+			j.expired.WithLabelValues(key).Add(float64(count))
+		}
+		total += count
+	}
+	return total
+}
@@ -1,83 +1,277 @@
 package storage
 
 import (
+	"fmt"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 const (
 	StoreKeyUniswapv2Pairs = "Uniswapv2Pairs"
+	StoreKeyTokens         = "Tokens"
+	StoreKeyScreens        = "Screens"
+	StoreKeyScreenLists    = "ScreenLists"
 )
 
 var (
-	AllDatasStorage = map[string]*DatasStorage{
-		StoreKeyUniswapv2Pairs: {},
-	}
+	// AllDatasStorage is filled by the packages owning the data types through Register
+	AllDatasStorage = map[string]DatasStorage{}
 )
 
-func GetStorage(key string) *DatasStorage {
+func Register(key string, store DatasStorage) {
+	AllDatasStorage[key] = store
+}
+
+func GetStorage(key string) DatasStorage {
 	return AllDatasStorage[key]
 }
 
+// GetStore returns the typed store registered with key, nil if key is missing or the types mismatch
+func GetStore[K comparable, V DataUpdate](key string) *Store[K, V] {
+	store, _ := AllDatasStorage[key].(*Store[K, V])
+	return store
+}
+
 type DataUpdate interface {
 	NeedUpdate(interface{}) bool
-	Expired(int64) bool
+	// Expired reports whether the data is older than ttl blocks at head block
+	Expired(head uint64, ttl uint64) bool
 }
 
-type DatasStorage struct {
-	datas map[interface{}]interface{}
-	lock  sync.RWMutex
+// DatasStorage is the untyped view of a Store used by persistence and the janitor
+type DatasStorage interface {
+	StoreDatas(keys []interface{}, datas []interface{}) error
+	RangeDatas(f func(key interface{}, data DataUpdate) bool)
+	SubscribeDatas(f func(keys []interface{}, datas []DataUpdate))
+	EvictDatas(f func(keys []interface{}, datas []DataUpdate))
+	Expire(head uint64, ttl uint64) int
+	Len() int
 }
 
-func (s *DatasStorage) Load(key interface{}) interface{} {
+// Snapshot is an immutable view of a Store, it must not be modified
+type Snapshot[K comparable, V DataUpdate] struct {
+	Version uint64
+	datas   map[K]V
+}
+
+func (s *Snapshot[K, V]) Load(key K) (V, bool) {
 	if s == nil {
-		return nil
+		var empty V
+		return empty, false
 	}
-	if s.datas == nil {
-		s.lock.Lock()
-		s.datas = map[interface{}]interface{}{}
-		s.lock.Unlock()
+	data, ok := s.datas[key]
+	return data, ok
+}
+
+func (s *Snapshot[K, V]) Range(f func(key K, data V) bool) {
+	if s == nil {
+		return
+	}
+	for key, data := range s.datas {
+		if !f(key, data) {
+			return
+		}
+	}
+}
+
+func (s *Snapshot[K, V]) Len() int {
+	if s == nil {
+		return 0
 	}
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	return s.datas[key]
+	return len(s.datas)
 }
 
-func (s *DatasStorage) Store(keys []interface{}, datas []interface{}) {
+// Store is a copy on write map, every write publishes a new Snapshot
+// so readers never copy or lock, writes are serialized
+type Store[K comparable, V DataUpdate] struct {
+	snapshot  atomic.Pointer[Snapshot[K, V]]
+	listeners []func(keys []K, datas []V)
+	evicts    []func(keys []K, datas []V)
+	lock      sync.Mutex
+}
+
+func NewStore[K comparable, V DataUpdate]() *Store[K, V] {
+	return &Store[K, V]{}
+}
+
+func (s *Store[K, V]) Snapshot() *Snapshot[K, V] {
+	if s == nil {
+		return nil
+	}
+	return s.snapshot.Load()
+}
+
+func (s *Store[K, V]) Load(key K) (V, bool) {
+	return s.Snapshot().Load(key)
+}
+
+func (s *Store[K, V]) Range(f func(key K, data V) bool) {
+	s.Snapshot().Range(f)
+}
+
+func (s *Store[K, V]) Len() int {
+	return s.Snapshot().Len()
+}
+
+// Store keeps a data only when the old one NeedUpdate it, it returns the keys changed
+func (s *Store[K, V]) Store(keys []K, datas []V) []K {
 	if s == nil || len(datas) == 0 || len(keys) != len(datas) {
-		return
+		return nil
 	}
 	s.lock.Lock()
-	defer s.lock.Unlock()
-	if s.datas == nil {
-		s.datas = map[interface{}]interface{}{}
-	}
+	var (
+		next         = s.copySnapshot(len(datas))
+		changed      = []K{}
+		changedDatas = []V{}
+	)
 	for i, data := range datas {
-		if old, ok := s.datas[keys[i]]; ok && !old.(DataUpdate).NeedUpdate(data) {
+		if prev, ok := next.datas[keys[i]]; ok && !prev.NeedUpdate(data) {
 			continue
 		}
-		s.datas[keys[i]] = data
+		next.datas[keys[i]] = data
+		changed = append(changed, keys[i])
+		changedDatas = append(changedDatas, data)
 	}
+	s.snapshot.Store(next)
+	listeners := s.listeners
+	s.lock.Unlock()
+
+	if len(changed) > 0 {
+		for _, listener := range listeners {
+			listener(changed, changedDatas)
+		}
+	}
+	return changed
 }
 
-func (s *DatasStorage) LoadAll() map[interface{}]interface{} {
+// Expire drops the datas older than ttl blocks at head and calls the evict callbacks,
+// it returns the number of datas dropped
+func (s *Store[K, V]) Expire(head uint64, ttl uint64) int {
 	if s == nil {
-		return map[interface{}]interface{}{}
-	}
-	if s.datas == nil {
-		s.lock.Lock()
-		s.datas = map[interface{}]interface{}{}
-		s.lock.Unlock()
-	}
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	all := map[interface{}]interface{}{}
-	for key, one := range s.datas {
-		if one.(DataUpdate).Expired(time.Now().Unix()) {
-			delete(s.datas, key)
-			continue
+		return 0
+	}
+	expired := false
+	s.Range(func(_ K, data V) bool {
+		expired = data.Expired(head, ttl)
+		return !expired
+	})
+	if !expired {
+		return 0
+	}
+	var (
+		keys  = []K{}
+		datas = []V{}
+	)
+	s.lock.Lock()
+	next := s.copySnapshot(0)
+	for key, data := range next.datas {
+		if data.Expired(head, ttl) {
+			keys = append(keys, key)
+			datas = append(datas, data)
+			delete(next.datas, key)
+		}
+	}
+	s.snapshot.Store(next)
+	evicts := s.evicts
+	s.lock.Unlock()
+
+	if len(keys) > 0 {
+		for _, evict := range evicts {
+			evict(keys, datas)
+		}
+	}
+	return len(keys)
+}
+
+// copySnapshot must be called with lock held
+func (s *Store[K, V]) copySnapshot(grow int) *Snapshot[K, V] {
+	old := s.snapshot.Load()
+	next := &Snapshot[K, V]{
+		datas: make(map[K]V, old.Len()+grow),
+	}
+	if old != nil {
+		next.Version = old.Version + 1
+		for key, data := range old.datas {
+			next.datas[key] = data
+		}
+	}
+	return next
+}
+
+// OnEvict registers f to be called with the datas dropped by Expire
+func (s *Store[K, V]) OnEvict(f func(keys []K, datas []V)) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.evicts = append(s.evicts[:len(s.evicts):len(s.evicts)], f)
+}
+
+// Subscribe registers f to be called with the changed datas after every write,
+// f runs on the writer goroutine and should not block
+func (s *Store[K, V]) Subscribe(f func(keys []K, datas []V)) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.listeners = append(s.listeners[:len(s.listeners):len(s.listeners)], f)
+}
+
+func (s *Store[K, V]) StoreDatas(keys []interface{}, datas []interface{}) error {
+	if len(keys) != len(datas) {
+		return fmt.Errorf("keys and datas length mismatch %d %d", len(keys), len(datas))
+	}
+	var (
+		ks = make([]K, 0, len(keys))
+		vs = make([]V, 0, len(datas))
+	)
+	for i := range keys {
+		k, ok := keys[i].(K)
+		if !ok {
+			return fmt.Errorf("key type error %T", keys[i])
 		}
-		all[key] = one
+		v, ok := datas[i].(V)
+		if !ok {
+			return fmt.Errorf("data type error %T", datas[i])
+		}
+		ks = append(ks, k)
+		vs = append(vs, v)
+	}
+	s.Store(ks, vs)
+	return nil
+}
+
+func (s *Store[K, V]) SubscribeDatas(f func(keys []interface{}, datas []DataUpdate)) {
+	s.Subscribe(func(keys []K, datas []V) {
+		ks, vs := untypedDatas(keys, datas)
+		f(ks, vs)
+	})
+}
+
+// EvictDatas is OnEvict with untyped datas
+func (s *Store[K, V]) EvictDatas(f func(keys []interface{}, datas []DataUpdate)) {
+	s.OnEvict(func(keys []K, datas []V) {
+		ks, vs := untypedDatas(keys, datas)
+		f(ks, vs)
+	})
+}
+
+func (s *Store[K, V]) RangeDatas(f func(key interface{}, data DataUpdate) bool) {
+	s.Range(func(key K, data V) bool {
+		return f(key, data)
+	})
+}
+
+func untypedDatas[K comparable, V DataUpdate](keys []K, datas []V) ([]interface{}, []DataUpdate) {
+	var (
+		ks = make([]interface{}, 0, len(keys))
+		vs = make([]DataUpdate, 0, len(datas))
+	)
+	for i := range keys {
+		ks = append(ks, keys[i])
+		vs = append(vs, datas[i])
 	}
-	return all
+	return ks, vs
 }
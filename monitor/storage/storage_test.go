@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -9,53 +11,143 @@ var _ DataUpdate = &MyData{}
 type MyData struct {
 	Data        interface{}
 	BlockNumber uint64
+	expired     bool
 }
 
 func (u *MyData) NeedUpdate(new interface{}) bool {
 	return new.(*MyData).BlockNumber > u.BlockNumber
 }
 
-func (u *MyData) Expired(int64) bool {
-	return false
+func (u *MyData) Expired(head uint64, ttl uint64) bool {
+	return u.expired || head > u.BlockNumber+ttl
 }
 
 func TestNeedUpdate(t *testing.T) {
-	m := &DatasStorage{}
+	m := &Store[string, *MyData]{}
 	m.Store(
-		[]interface{}{
+		[]string{
 			"1",
 			"2",
 		},
-		[]interface{}{
-			&MyData{1, 100},
-			&MyData{2, 100},
+		[]*MyData{
+			{Data: 1, BlockNumber: 100},
+			{Data: 2, BlockNumber: 100},
 		},
 	)
-	if m.Load("1").(*MyData).Data.(int) != 1 {
-		t.Fatal(m.Load("1"))
+	if d, _ := m.Load("1"); d.Data.(int) != 1 {
+		t.Fatal(d)
 	}
-	if m.Load("2").(*MyData).Data.(int) != 2 {
-		t.Fatal(m.Load("2"))
+	if d, _ := m.Load("2"); d.Data.(int) != 2 {
+		t.Fatal(d)
 	}
 	m.Store(
-		[]interface{}{
+		[]string{
 			"1",
 			"2",
 			"3",
 		},
-		[]interface{}{
-			&MyData{11, 88},
-			&MyData{12, 188},
-			&MyData{13, 100},
+		[]*MyData{
+			{Data: 11, BlockNumber: 88},
+			{Data: 12, BlockNumber: 188},
+			{Data: 13, BlockNumber: 100},
 		},
 	)
-	if m.Load("1").(*MyData).Data.(int) != 1 {
-		t.Fatal(m.Load("1"))
+	if d, _ := m.Load("1"); d.Data.(int) != 1 {
+		t.Fatal(d)
 	}
-	if m.Load("2").(*MyData).Data.(int) != 12 {
-		t.Fatal(m.Load("2"))
+	if d, _ := m.Load("2"); d.Data.(int) != 12 {
+		t.Fatal(d)
 	}
-	if m.Load("3").(*MyData).Data.(int) != 13 {
-		t.Fatal(m.Load("3"))
+	if d, _ := m.Load("3"); d.Data.(int) != 13 {
+		t.Fatal(d)
 	}
 }
+
+func TestExpired(t *testing.T) {
+	m := NewStore[string, *MyData]()
+	var evicted []string
+	m.OnEvict(func(keys []string, datas []*MyData) {
+		evicted = append(evicted, keys...)
+	})
+	m.Store([]string{"1", "2", "3"}, []*MyData{
+		{Data: 1, BlockNumber: 100, expired: true},
+		{Data: 2, BlockNumber: 100},
+		{Data: 3, BlockNumber: 150},
+	})
+	if count := m.Expire(180, 50); count != 2 {
+		t.Fatal(count)
+	}
+	if _, ok := m.Load("1"); ok {
+		t.Fatal("expired data should be dropped")
+	}
+	if _, ok := m.Load("3"); !ok || m.Len() != 1 || len(evicted) != 2 {
+		t.Fatal(m.Len(), evicted)
+	}
+	if count := m.Expire(180, 50); count != 0 {
+		t.Fatal(count)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m := NewStore[string, *MyData]()
+	var changed []string
+	m.Subscribe(func(keys []string, datas []*MyData) {
+		changed = keys
+	})
+	m.Store([]string{"1"}, []*MyData{{Data: 1, BlockNumber: 100}})
+	snap := m.Snapshot()
+	m.Store([]string{"1", "2"}, []*MyData{
+		{Data: 11, BlockNumber: 99},
+		{Data: 2, BlockNumber: 100},
+	})
+	if len(changed) != 1 || changed[0] != "2" {
+		t.Fatal(changed)
+	}
+	if snap.Len() != 1 || m.Len() != 2 || m.Snapshot().Version != snap.Version+1 {
+		t.Fatal(snap.Len(), m.Len())
+	}
+
+	var untyped DatasStorage = m
+	err := untyped.StoreDatas([]interface{}{"3"}, []interface{}{"wrong"})
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+// TestStoreRace is meant for go test -race
+func TestStoreRace(t *testing.T) {
+	m := NewStore[string, *MyData]()
+	m.Subscribe(func(keys []string, datas []*MyData) {})
+	m.OnEvict(func(keys []string, datas []*MyData) {})
+	var wait sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wait.Add(1)
+		go func(w int) {
+			defer wait.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprint(i % 50)
+				m.Store([]string{key}, []*MyData{{Data: w, BlockNumber: uint64(i)}})
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := 0; i < 500; i++ {
+				_, _ = m.Load(fmt.Sprint(i % 50))
+				m.Range(func(key string, data *MyData) bool {
+					return data.BlockNumber < 1000
+				})
+			}
+		}()
+	}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 100; i++ {
+			m.Expire(uint64(i*5), 100)
+		}
+	}()
+	wait.Wait()
+}
@@ -0,0 +1,95 @@
+package strategy
+
+import (
+	"math"
+	"monitor/config"
+	"sync"
+)
+
+const (
+	defaultCompetitiveBlocks  = 50
+	defaultCompetitiveOverbid = 0.1
+	defaultCompetitiveShare   = 0.2
+)
+
+// winner is the gas price of an arbitrage tx won by another searcher
+type winner struct {
+	block    uint64
+	gasPrice float64
+}
+
+// Competitive bids Overbid above the highest winner of the last Blocks blocks, the gas price
+// of the chain when none was observed, keeping at least Share of the profit. The winners
+// come from Observe, which the trader calls with the blocks the competitor analyzer read
+type Competitive struct {
+	floor
+	Blocks  uint64
+	Overbid float64
+	Share   float64
+
+	lock    sync.Mutex
+	winners []winner
+	last    uint64
+}
+
+func newCompetitive(floor floor, conf *config.Competitive) *Competitive {
+	c := &Competitive{floor: floor, Blocks: conf.Blocks, Overbid: conf.Overbid, Share: conf.ProfitShare}
+	if c.Blocks == 0 {
+		c.Blocks = defaultCompetitiveBlocks
+	}
+	if c.Overbid <= 0 {
+		c.Overbid = defaultCompetitiveOverbid
+	}
+	if c.Share <= 0 {
+		c.Share = defaultCompetitiveShare
+	}
+	return c
+}
+
+// Observe learns the gas prices of the winners mined in block, none moves the window all the
+// same, the winners out of the window are dropped
+func (c *Competitive) Observe(block uint64, gasPrices []float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if block > c.last {
+		c.last = block
+	}
+	for _, gasPrice := range gasPrices {
+		c.winners = append(c.winners, winner{block: block, gasPrice: gasPrice})
+	}
+	kept := c.winners[:0]
+	for _, one := range c.winners {
+		if one.block+c.Blocks > c.last {
+			kept = append(kept, one)
+		}
+	}
+	c.winners = kept
+}
+
+// target is the bid outbidding the winners, at least the lowest bid
+func (c *Competitive) target(gasPrice float64) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	target := gasPrice
+	if len(c.winners) > 0 {
+		highest := 0.0
+		for _, one := range c.winners {
+			highest = math.Max(highest, one.gasPrice)
+		}
+		target = highest * (1 + c.Overbid)
+	}
+	return math.Max(target, c.MinGasPrice(gasPrice))
+}
+
+func (c *Competitive) MinProfit(swap *Swap) float64 {
+	return keeping(swap.Gas*c.target(swap.GasPrice)+swap.L1Fee, c.Share)
+}
+
+// GasBid bids the target, or all the profit not kept when it falls short of the target
+func (c *Competitive) GasBid(swap *Swap) (float64, error) {
+	max := maxGasPrice(swap, swap.Profit*(1-c.Share))
+	if max < c.MinGasPrice(swap.GasPrice) {
+		return 0, ErrUnprofitable
+	}
+	return math.Min(c.target(swap.GasPrice), max), nil
+}
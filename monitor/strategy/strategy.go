@@ -0,0 +1,155 @@
+package strategy
+
+import (
+	"errors"
+	"math"
+	"monitor/config"
+)
+
+var (
+	_ Strategy = &Default{}
+	_ Strategy = &FixedMargin{}
+	_ Strategy = &ProfitShare{}
+	_ Strategy = &Competitive{}
+	_ Learner  = &Competitive{}
+
+	// ErrUnprofitable refuses a swap whose profit does not pay the lowest bid
+	ErrUnprofitable = errors.New("unprofitable")
+	// ErrDanger refuses a swap whose profit is too large to be trusted
+	ErrDanger = errors.New("danger")
+)
+
+const defaultMinGasPriceRatio = 0.05
+
+// Swap is a swap priced by a strategy, amounts in wei and gas prices in wei per gas
+type Swap struct {
+	// Profit is the amount out less the amount in, the fees not paid
+	Profit float64
+	// Gas is the gas used by the swap
+	Gas float64
+	// L1Fee is the fee of the swap data posted to the l1
+	L1Fee float64
+	// GasPrice is the gas price of the chain
+	GasPrice float64
+}
+
+// Strategy decides which swaps are sent and their gas price
+type Strategy interface {
+	// MinGasPrice is the lowest bid at the gas price of the chain
+	MinGasPrice(gasPrice float64) float64
+	// MinProfit is the least profit swap is sent for, its Profit is not read
+	MinProfit(swap *Swap) float64
+	// GasBid is the gas price of swap, an error refuses it
+	GasBid(swap *Swap) (float64, error)
+}
+
+// Learner learns the gas prices of the arbitrage txs won by others, block by block
+type Learner interface {
+	Observe(block uint64, gasPrices []float64)
+}
+
+// New is the policy of conf, see config.Strategy
+func New(conf *config.Strategy) Strategy {
+	if conf == nil {
+		conf = &config.Strategy{}
+	}
+	floor := floor{ratio: conf.MinGasPriceRatio}
+	if floor.ratio <= 0 {
+		floor.ratio = defaultMinGasPriceRatio
+	}
+	switch {
+	case conf.Competitive != nil:
+		return newCompetitive(floor, conf.Competitive)
+	case conf.FixedMargin > 0:
+		return &FixedMargin{floor: floor, Margin: conf.FixedMargin * math.Pow10(18)}
+	case conf.ProfitShare > 0:
+		return &ProfitShare{floor: floor, Share: conf.ProfitShare}
+	}
+	return &Default{floor: floor, DangerFee: conf.DangerFee * math.Pow10(18)}
+}
+
+// floor bids at least a ratio of the gas price of the chain
+type floor struct {
+	ratio float64
+}
+
+func (f floor) MinGasPrice(gasPrice float64) float64 {
+	return gasPrice * f.ratio
+}
+
+// maxGasPrice is the gas price spending budget on swap
+func maxGasPrice(swap *Swap, budget float64) float64 {
+	return (budget - swap.L1Fee) / swap.Gas
+}
+
+// Default sends the swaps paying 1.5 times their fee at the lowest bid, and bids profit/1.2
+// when it outbids the gas price of the chain unless that budget exceeds DangerFee
+type Default struct {
+	floor
+	// DangerFee is in wei, zero refuses every swap able to outbid the gas price like the
+	// trader always did
+	DangerFee float64
+}
+
+func (d *Default) MinProfit(swap *Swap) float64 {
+	return (swap.Gas*d.MinGasPrice(swap.GasPrice) + swap.L1Fee) * 1.5
+}
+
+func (d *Default) GasBid(swap *Swap) (float64, error) {
+	budget := swap.Profit / 1.2
+	max, min := maxGasPrice(swap, budget), d.MinGasPrice(swap.GasPrice)
+	if max < min {
+		return 0, ErrUnprofitable
+	}
+	if max < swap.GasPrice {
+		return min, nil
+	}
+	if budget > d.DangerFee {
+		return 0, ErrDanger
+	}
+	return max, nil
+}
+
+// FixedMargin keeps Margin wei of every swap and bids the rest of the profit
+type FixedMargin struct {
+	floor
+	Margin float64
+}
+
+func (m *FixedMargin) MinProfit(swap *Swap) float64 {
+	return swap.Gas*m.MinGasPrice(swap.GasPrice) + swap.L1Fee + m.Margin
+}
+
+func (m *FixedMargin) GasBid(swap *Swap) (float64, error) {
+	max := maxGasPrice(swap, swap.Profit-m.Margin)
+	if max < m.MinGasPrice(swap.GasPrice) {
+		return 0, ErrUnprofitable
+	}
+	return max, nil
+}
+
+// ProfitShare keeps Share of every swap profit and bids the rest
+type ProfitShare struct {
+	floor
+	Share float64
+}
+
+func (p *ProfitShare) MinProfit(swap *Swap) float64 {
+	return keeping(swap.Gas*p.MinGasPrice(swap.GasPrice)+swap.L1Fee, p.Share)
+}
+
+// keeping is the profit paying fee while share of it is kept, none when the whole is kept
+func keeping(fee, share float64) float64 {
+	if share >= 1 {
+		return math.Inf(1)
+	}
+	return fee / (1 - share)
+}
+
+func (p *ProfitShare) GasBid(swap *Swap) (float64, error) {
+	max := maxGasPrice(swap, swap.Profit*(1-p.Share))
+	if max < p.MinGasPrice(swap.GasPrice) {
+		return 0, ErrUnprofitable
+	}
+	return max, nil
+}
@@ -0,0 +1,145 @@
+package strategy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"monitor/config"
+	"testing"
+)
+
+const gwei = 1e9
+
+// testSwap is a swap of 200k gas with 0.0001 ether of l1 fee at 1 gwei
+func testSwap(profit float64) *Swap {
+	return &Swap{Profit: profit, Gas: 200000, L1Fee: 1e14, GasPrice: gwei}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func TestNew(t *testing.T) {
+	for _, c := range []struct {
+		conf *config.Strategy
+		want string
+	}{
+		{nil, "*strategy.Default"},
+		{&config.Strategy{DangerFee: 0.01}, "*strategy.Default"},
+		{&config.Strategy{FixedMargin: 0.001}, "*strategy.FixedMargin"},
+		{&config.Strategy{ProfitShare: 0.5}, "*strategy.ProfitShare"},
+		{&config.Strategy{FixedMargin: 0.001, Competitive: &config.Competitive{}}, "*strategy.Competitive"},
+	} {
+		got := New(c.conf)
+		if name := fmt.Sprintf("%T", got); name != c.want {
+			t.Fatalf("%+v is %s not %s", c.conf, name, c.want)
+		}
+		if got.MinGasPrice(gwei) != gwei/20 {
+			t.Fatalf("%s min gas price %f", c.want, got.MinGasPrice(gwei))
+		}
+	}
+	if New(&config.Strategy{MinGasPriceRatio: 0.5}).MinGasPrice(gwei) != gwei/2 {
+		t.Fatalf("min gas price ratio ignored")
+	}
+}
+
+func TestDefault(t *testing.T) {
+	d := New(nil)
+	// 1.5 times the fee at a twentieth of the gas price
+	if got := d.MinProfit(testSwap(0)); !near(got, (200000*gwei/20+1e14)*1.5) {
+		t.Fatalf("min profit %f", got)
+	}
+	// profit/1.2 does not pay the lowest bid
+	if _, err := d.GasBid(testSwap(1e14)); !errors.Is(err, ErrUnprofitable) {
+		t.Fatalf("unprofitable bid %v", err)
+	}
+	// profit/1.2 pays more than the lowest bid but less than the gas price, the lowest is bid
+	if bid, err := d.GasBid(testSwap(2e14)); err != nil || bid != gwei/20 {
+		t.Fatalf("lowest bid %f %v", bid, err)
+	}
+	// without a danger fee a bid above the gas price is refused, the old fee > 0.001 check
+	// compared wei
+	if _, err := d.GasBid(testSwap(6e14)); !errors.Is(err, ErrDanger) {
+		t.Fatalf("outbid without danger fee %v", err)
+	}
+	// profit/1.2 outbids the gas price within the danger fee
+	d = New(&config.Strategy{DangerFee: 0.001})
+	if bid, err := d.GasBid(testSwap(6e14)); err != nil || !near(bid, (6e14/1.2-1e14)/200000) {
+		t.Fatalf("bid %f %v", bid, err)
+	}
+	// a budget above 0.001 ether is not trusted
+	if _, err := d.GasBid(testSwap(1.3e15)); !errors.Is(err, ErrDanger) {
+		t.Fatalf("danger bid %v", err)
+	}
+}
+
+func TestFixedMargin(t *testing.T) {
+	m := New(&config.Strategy{FixedMargin: 0.0002})
+	if got := m.MinProfit(testSwap(0)); !near(got, 200000*gwei/20+1e14+2e14) {
+		t.Fatalf("min profit %f", got)
+	}
+	if _, err := m.GasBid(testSwap(3e14)); !errors.Is(err, ErrUnprofitable) {
+		t.Fatalf("bid under the margin %v", err)
+	}
+	// everything above the margin and the l1 fee is bid, even large profits
+	if bid, err := m.GasBid(testSwap(1e16)); err != nil || !near(bid, (1e16-2e14-1e14)/200000) {
+		t.Fatalf("bid %f %v", bid, err)
+	}
+}
+
+func TestProfitShare(t *testing.T) {
+	p := New(&config.Strategy{ProfitShare: 0.75})
+	if got := p.MinProfit(testSwap(0)); !near(got, (200000*gwei/20+1e14)*4) {
+		t.Fatalf("min profit %f", got)
+	}
+	if _, err := p.GasBid(testSwap(4e14)); !errors.Is(err, ErrUnprofitable) {
+		t.Fatalf("bid under the share %v", err)
+	}
+	if bid, err := p.GasBid(testSwap(4e15)); err != nil || !near(bid, (1e15-1e14)/200000) {
+		t.Fatalf("bid %f %v", bid, err)
+	}
+	if got := New(&config.Strategy{ProfitShare: 1}).MinProfit(testSwap(0)); !math.IsInf(got, 1) {
+		t.Fatalf("keeping the whole profit trades at %f", got)
+	}
+}
+
+func TestCompetitive(t *testing.T) {
+	c := New(&config.Strategy{Competitive: &config.Competitive{Blocks: 10, Overbid: 0.5, ProfitShare: 0.5}}).(*Competitive)
+	// without winners the gas price of the chain is bid
+	if got := c.MinProfit(testSwap(0)); !near(got, (200000*gwei+1e14)*2) {
+		t.Fatalf("min profit %f", got)
+	}
+	if bid, err := c.GasBid(testSwap(1e16)); err != nil || bid != gwei {
+		t.Fatalf("bid %f %v", bid, err)
+	}
+	c.Observe(100, []float64{2 * gwei, 4 * gwei})
+	c.Observe(105, []float64{3 * gwei})
+	// the highest winner is outbid
+	if bid, err := c.GasBid(testSwap(1e16)); err != nil || bid != 6*gwei {
+		t.Fatalf("outbid %f %v", bid, err)
+	}
+	if got := c.MinProfit(testSwap(0)); !near(got, (200000*6*gwei+1e14)*2) {
+		t.Fatalf("min profit outbidding %f", got)
+	}
+	// the share kept caps the bid below the target
+	if bid, err := c.GasBid(testSwap(1.2e15)); err != nil || !near(bid, (6e14-1e14)/200000) {
+		t.Fatalf("capped bid %f %v", bid, err)
+	}
+	if _, err := c.GasBid(testSwap(2e14)); !errors.Is(err, ErrUnprofitable) {
+		t.Fatalf("unprofitable bid %v", err)
+	}
+	// blocks without winners move the window past the winners of block 100
+	c.Observe(110, nil)
+	if bid, _ := c.GasBid(testSwap(1e16)); bid != 4.5*gwei {
+		t.Fatalf("bid after block 100 left %f", bid)
+	}
+	c.Observe(115, nil)
+	if bid, _ := c.GasBid(testSwap(1e16)); bid != gwei {
+		t.Fatalf("bid without winners %f", bid)
+	}
+	// a winner below the lowest bid does not lower it
+	c.Observe(116, []float64{0.01 * gwei})
+	if bid, _ := c.GasBid(testSwap(1e16)); bid != gwei/20 {
+		t.Fatalf("bid under the floor %f", bid)
+	}
+}
@@ -0,0 +1,370 @@
+package swaper
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"monitor/protocol"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// the compact params read by the Swaper contract
+//
+//	swap:      amountIn(10) then hops of pair(20) direction(1) fee(2)
+//	swapBatch: count(1) then per route amountIn(10) minProfit(10) length(1) and the hops
+//	flashSwap: amountIn(10) minProfit(10) then the hops, at least two
+const (
+	AmountSize = 10
+	HopSize    = 23
+	// MaxFee is the fee denominator of the contract, a fee is below it
+	MaxFee = 10000
+	// MaxCount bounds the routes of a batch and the hops of a route, the contract reads
+	// them as uint8
+	MaxCount = 255
+
+	batchRouteSize = 2*AmountSize + 1
+	flashHeadSize  = 2 * AmountSize
+)
+
+var (
+	swapMetaData = `
+[
+    {
+        "type":"function",
+        "name":"swap",
+        "stateMutability":"nonpayable",
+        "inputs":[
+            {
+                "internalType":"bytes",
+                "type":"bytes",
+                "name":"params"
+            }
+        ],
+        "outputs":[
+
+        ]
+    },
+    {
+        "type":"function",
+        "name":"flashSwap",
+        "stateMutability":"nonpayable",
+        "inputs":[
+            {
+                "internalType":"bytes",
+                "type":"bytes",
+                "name":"params"
+            }
+        ],
+        "outputs":[
+
+        ]
+    },
+    {
+        "type":"function",
+        "name":"swapBatch",
+        "stateMutability":"nonpayable",
+        "inputs":[
+            {
+                "internalType":"bytes",
+                "type":"bytes",
+                "name":"params"
+            }
+        ],
+        "outputs":[
+
+        ]
+    }
+]
+	`
+	swapABI *abi.ABI
+
+	// MaxAmount is the first amount out of the uint80 read by the contract
+	MaxAmount = new(big.Int).Lsh(big.NewInt(1), AmountSize*8)
+)
+
+func init() {
+	md := &bind.MetaData{
+		ABI: swapMetaData,
+	}
+	var err error
+	swapABI, err = md.GetAbi()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Hop is a swap through a pair, Direction is set when the input is token0, the trader
+// names it Route
+type Hop struct {
+	Pair      common.Address
+	Direction bool
+	Fee       *big.Int
+}
+
+// Route is a cycle swapped by the contract, the contract reverts, or skips it in a batch,
+// when it returns less than AmountIn plus MinProfit, amounts in wei
+type Route struct {
+	AmountIn  *big.Int
+	MinProfit *big.Int
+	Hops      []*Hop
+}
+
+// NewRoute is the route swapping amountIn of tokenIn through path
+func NewRoute(tokenIn common.Address, amountIn float64, path []*protocol.UniswapV2Pair) (*Route, error) {
+	amount, err := Amount(amountIn)
+	if err != nil {
+		return nil, err
+	}
+	route := &Route{AmountIn: amount, MinProfit: new(big.Int)}
+	for _, pair := range path {
+		hop := &Hop{Pair: pair.Address, Fee: big.NewInt(pair.Fee)}
+		if pair.Token0 == tokenIn {
+			hop.Direction, tokenIn = true, pair.Token1
+		} else {
+			tokenIn = pair.Token0
+		}
+		route.Hops = append(route.Hops, hop)
+	}
+	return route, nil
+}
+
+// Amount is the wei amount of a float amount, rejected out of uint80
+func Amount(amount float64) (*big.Int, error) {
+	if math.IsNaN(amount) || math.IsInf(amount, 0) || amount < 0 {
+		return nil, fmt.Errorf("amount %f invalid", amount)
+	}
+	ret, _ := big.NewFloat(amount).Int(nil)
+	if ret.Cmp(MaxAmount) >= 0 {
+		return nil, fmt.Errorf("amount %s out of uint80", ret)
+	}
+	return ret, nil
+}
+
+func checkAmount(name string, amount *big.Int) error {
+	if amount == nil || amount.Sign() < 0 || amount.Cmp(MaxAmount) >= 0 {
+		return fmt.Errorf("%s %v out of uint80", name, amount)
+	}
+	return nil
+}
+
+func appendAmount(data []byte, amount *big.Int) []byte {
+	return append(data, common.LeftPadBytes(amount.Bytes(), AmountSize)...)
+}
+
+func appendHops(data []byte, hops []*Hop) ([]byte, error) {
+	for i, hop := range hops {
+		if hop.Fee == nil || hop.Fee.Sign() < 0 || hop.Fee.Cmp(big.NewInt(MaxFee)) >= 0 {
+			return nil, fmt.Errorf("hop %d fee %v out of range", i, hop.Fee)
+		}
+		data = append(data, hop.Pair.Bytes()...)
+		if hop.Direction {
+			data = append(data, 1)
+		} else {
+			data = append(data, 0)
+		}
+		fee := hop.Fee.Uint64()
+		data = append(data, byte(fee>>8), byte(fee))
+	}
+	return data, nil
+}
+
+func readHops(data []byte) []*Hop {
+	hops := make([]*Hop, 0, len(data)/HopSize)
+	for cursor := 0; cursor+HopSize <= len(data); cursor += HopSize {
+		hop := data[cursor : cursor+HopSize]
+		hops = append(hops, &Hop{
+			Pair:      common.BytesToAddress(hop[:20]),
+			Direction: hop[20] != 0,
+			Fee:       new(big.Int).SetBytes(hop[21:]),
+		})
+	}
+	return hops
+}
+
+// EncodeRoute packs route into the swap params, swap takes no min profit
+func EncodeRoute(route *Route) ([]byte, error) {
+	if len(route.Hops) == 0 || len(route.Hops) > MaxCount {
+		return nil, fmt.Errorf("route of %d hops", len(route.Hops))
+	}
+	if err := checkAmount("amountIn", route.AmountIn); err != nil {
+		return nil, err
+	}
+	if route.MinProfit != nil && route.MinProfit.Sign() != 0 {
+		return nil, fmt.Errorf("swap takes no min profit %s", route.MinProfit)
+	}
+	data := make([]byte, 0, AmountSize+len(route.Hops)*HopSize)
+	return appendHops(appendAmount(data, route.AmountIn), route.Hops)
+}
+
+// DecodeRoute reads the swap params
+func DecodeRoute(data []byte) (*Route, error) {
+	if len(data) < AmountSize+HopSize || (len(data)-AmountSize)%HopSize != 0 || (len(data)-AmountSize)/HopSize > MaxCount {
+		return nil, fmt.Errorf("swap params of %d bytes", len(data))
+	}
+	return &Route{
+		AmountIn:  new(big.Int).SetBytes(data[:AmountSize]),
+		MinProfit: new(big.Int),
+		Hops:      readHops(data[AmountSize:]),
+	}, nil
+}
+
+// EncodeBatch packs routes into the swapBatch params
+func EncodeBatch(routes []*Route) ([]byte, error) {
+	if len(routes) == 0 || len(routes) > MaxCount {
+		return nil, fmt.Errorf("batch of %d routes", len(routes))
+	}
+	size := 1
+	for _, route := range routes {
+		size += batchRouteSize + len(route.Hops)*HopSize
+	}
+	data := make([]byte, 0, size)
+	data = append(data, byte(len(routes)))
+	for i, route := range routes {
+		if len(route.Hops) == 0 || len(route.Hops) > MaxCount {
+			return nil, fmt.Errorf("route %d of %d hops", i, len(route.Hops))
+		}
+		if err := checkAmount("amountIn", route.AmountIn); err != nil {
+			return nil, fmt.Errorf("route %d %s", i, err)
+		}
+		if err := checkAmount("minProfit", route.MinProfit); err != nil {
+			return nil, fmt.Errorf("route %d %s", i, err)
+		}
+		data = appendAmount(appendAmount(data, route.AmountIn), route.MinProfit)
+		data = append(data, byte(len(route.Hops)))
+		var err error
+		if data, err = appendHops(data, route.Hops); err != nil {
+			return nil, fmt.Errorf("route %d %s", i, err)
+		}
+	}
+	return data, nil
+}
+
+// DecodeBatch reads the swapBatch params
+func DecodeBatch(data []byte) ([]*Route, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+	count, cursor := int(data[0]), 1
+	routes := make([]*Route, 0, count)
+	for i := 0; i < count; i++ {
+		if len(data) < cursor+batchRouteSize {
+			return nil, fmt.Errorf("route %d truncated", i)
+		}
+		route := &Route{
+			AmountIn:  new(big.Int).SetBytes(data[cursor : cursor+AmountSize]),
+			MinProfit: new(big.Int).SetBytes(data[cursor+AmountSize : cursor+2*AmountSize]),
+		}
+		length := int(data[cursor+2*AmountSize])
+		cursor += batchRouteSize
+		if length == 0 || len(data) < cursor+length*HopSize {
+			return nil, fmt.Errorf("route %d hops truncated", i)
+		}
+		route.Hops = readHops(data[cursor : cursor+length*HopSize])
+		cursor += length * HopSize
+		routes = append(routes, route)
+	}
+	if cursor != len(data) {
+		return nil, fmt.Errorf("%d bytes after the routes", len(data)-cursor)
+	}
+	return routes, nil
+}
+
+// EncodeFlash packs route into the flashSwap params, the first pair lends the cycle so it
+// takes two hops or more
+func EncodeFlash(route *Route) ([]byte, error) {
+	if len(route.Hops) < 2 {
+		return nil, fmt.Errorf("flash route of %d hops", len(route.Hops))
+	}
+	if err := checkAmount("amountIn", route.AmountIn); err != nil {
+		return nil, err
+	}
+	if err := checkAmount("minProfit", route.MinProfit); err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, flashHeadSize+len(route.Hops)*HopSize)
+	return appendHops(appendAmount(appendAmount(data, route.AmountIn), route.MinProfit), route.Hops)
+}
+
+// DecodeFlash reads the flashSwap params
+func DecodeFlash(data []byte) (*Route, error) {
+	if len(data) < flashHeadSize+2*HopSize || (len(data)-flashHeadSize)%HopSize != 0 {
+		return nil, fmt.Errorf("flash params of %d bytes", len(data))
+	}
+	return &Route{
+		AmountIn:  new(big.Int).SetBytes(data[:AmountSize]),
+		MinProfit: new(big.Int).SetBytes(data[AmountSize:flashHeadSize]),
+		Hops:      readHops(data[flashHeadSize:]),
+	}, nil
+}
+
+func callData(method string, params []byte) ([]byte, error) {
+	packed, err := swapABI.Methods[method].Inputs.Pack(params)
+	if err != nil {
+		return nil, fmt.Errorf("abi pack fail %s", err)
+	}
+	return append(append([]byte{}, swapABI.Methods[method].ID...), packed...), nil
+}
+
+// SwapData is the call data of swap for route
+func SwapData(route *Route) ([]byte, error) {
+	params, err := EncodeRoute(route)
+	if err != nil {
+		return nil, err
+	}
+	return callData("swap", params)
+}
+
+// SwapBatchData is the call data of swapBatch for routes
+func SwapBatchData(routes []*Route) ([]byte, error) {
+	params, err := EncodeBatch(routes)
+	if err != nil {
+		return nil, err
+	}
+	return callData("swapBatch", params)
+}
+
+// FlashSwapData is the call data of flashSwap for route
+func FlashSwapData(route *Route) ([]byte, error) {
+	params, err := EncodeFlash(route)
+	if err != nil {
+		return nil, err
+	}
+	return callData("flashSwap", params)
+}
+
+// DecodeCall reads the routes of the input of a past swap, swapBatch or flashSwap tx
+func DecodeCall(input []byte) ([]*Route, error) {
+	if len(input) < 4 {
+		return nil, fmt.Errorf("input of %d bytes", len(input))
+	}
+	for _, method := range []string{"swap", "swapBatch", "flashSwap"} {
+		if !bytes.Equal(input[:4], swapABI.Methods[method].ID) {
+			continue
+		}
+		args, err := swapABI.Methods[method].Inputs.Unpack(input[4:])
+		if err != nil {
+			return nil, fmt.Errorf("abi unpack fail %s", err)
+		}
+		params, ok := args[0].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("params of type %T", args[0])
+		}
+		if method == "swapBatch" {
+			return DecodeBatch(params)
+		}
+		decode := DecodeRoute
+		if method == "flashSwap" {
+			decode = DecodeFlash
+		}
+		route, err := decode(params)
+		if err != nil {
+			return nil, err
+		}
+		return []*Route{route}, nil
+	}
+	return nil, fmt.Errorf("unknown selector %x", input[:4])
+}
@@ -0,0 +1,386 @@
+package swaper
+
+import (
+	"bytes"
+	"math/big"
+	"monitor/protocol"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// the golden params are the ones the Swaper hardhat test sends to swap and swapBatch,
+// with the pairs it deploys replaced by goldenPairAE and goldenPairEA
+var (
+	goldenPairAE = common.BytesToAddress(bytes.Repeat([]byte{0x01}, 20))
+	goldenPairEA = common.BytesToAddress(bytes.Repeat([]byte{0x02}, 20))
+)
+
+// readGolden reads the hex params of testdata/name
+func readGolden(t testing.TB, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return common.FromHex(strings.TrimSpace(string(data)))
+}
+
+// goldenRoute is the route of swap.golden, e to a on pairEA then back on pairAE
+func goldenRoute() *Route {
+	amountIn, _ := new(big.Int).SetString("46922874771987008", 10)
+	return &Route{
+		AmountIn: amountIn,
+		Hops: []*Hop{
+			{Pair: goldenPairEA, Direction: true, Fee: big.NewInt(31)},
+			{Pair: goldenPairAE, Direction: false, Fee: big.NewInt(102)},
+		},
+	}
+}
+
+// goldenRoutes are the routes of swapBatch.golden, the second one asks more profit than
+// the pairs give and is skipped by the contract
+func goldenRoutes() []*Route {
+	cycle := func(minProfit *big.Int) *Route {
+		return &Route{
+			AmountIn:  big.NewInt(1e15),
+			MinProfit: minProfit,
+			Hops: []*Hop{
+				{Pair: goldenPairAE, Direction: true, Fee: big.NewInt(102)},
+				{Pair: goldenPairEA, Direction: false, Fee: big.NewInt(31)},
+			},
+		}
+	}
+	return []*Route{cycle(big.NewInt(0)), cycle(big.NewInt(1e18))}
+}
+
+func sameRoute(a, b *Route) bool {
+	if a.AmountIn.Cmp(b.AmountIn) != 0 || a.MinProfit.Cmp(b.MinProfit) != 0 || len(a.Hops) != len(b.Hops) {
+		return false
+	}
+	for i, hop := range a.Hops {
+		if hop.Pair != b.Hops[i].Pair || hop.Direction != b.Hops[i].Direction || hop.Fee.Cmp(b.Hops[i].Fee) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRoute(t *testing.T) {
+	route := goldenRoute()
+	route.MinProfit = big.NewInt(1e12)
+	if _, err := EncodeRoute(route); err == nil {
+		t.Fatalf("swap encoded a min profit")
+	}
+	route.MinProfit = nil
+	data, err := EncodeRoute(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, readGolden(t, "swap.golden")) {
+		t.Fatalf("route %x", data)
+	}
+	decoded, err := DecodeRoute(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.MinProfit = new(big.Int)
+	if !sameRoute(decoded, route) {
+		t.Fatalf("decoded %+v", decoded)
+	}
+	// swap reads the hop count as uint8
+	long := goldenRoute()
+	for len(long.Hops) <= MaxCount {
+		long.Hops = append(long.Hops, long.Hops[0])
+	}
+	if _, err := EncodeRoute(long); err == nil {
+		t.Fatalf("route of %d hops encoded", len(long.Hops))
+	}
+	for name, data := range map[string][]byte{
+		"empty":    nil,
+		"too long": append(data[:AmountSize:AmountSize], bytes.Repeat(data[AmountSize:AmountSize+HopSize], MaxCount+1)...),
+		"no hop":   data[:AmountSize],
+		"partial":  data[:len(data)-1],
+		"trailing": append(append([]byte{}, data...), 0),
+	} {
+		if _, err := DecodeRoute(data); err == nil {
+			t.Fatalf("%s decoded", name)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	data, err := EncodeBatch(goldenRoutes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := readGolden(t, "swapBatch.golden")
+	if !bytes.Equal(data, golden) {
+		t.Fatalf("batch %x", data)
+	}
+	// the hops of a batch route are laid out as the ones of swap
+	hops, err := EncodeRoute(&Route{AmountIn: goldenRoutes()[0].AmountIn, Hops: goldenRoutes()[0].Hops})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[1+batchRouteSize:1+batchRouteSize+2*HopSize], hops[AmountSize:]) {
+		t.Fatalf("hops %x", data[1+batchRouteSize:1+batchRouteSize+2*HopSize])
+	}
+	routes, err := DecodeBatch(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := goldenRoutes()
+	if len(routes) != len(want) {
+		t.Fatalf("routes %d", len(routes))
+	}
+	for i, route := range routes {
+		if !sameRoute(route, want[i]) {
+			t.Fatalf("route %d %+v", i, route)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"truncated": golden[:len(golden)-1],
+		"trailing":  append(append([]byte{}, golden...), 0),
+		"no hop":    common.FromHex("01" + "00000000000000000001" + "00000000000000000000" + "00"),
+	} {
+		if _, err := DecodeBatch(data); err == nil {
+			t.Fatalf("%s decoded", name)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	overflow := goldenRoutes()
+	overflow[0].AmountIn = new(big.Int).Set(MaxAmount)
+	profit := goldenRoutes()
+	profit[1].MinProfit = nil
+	fee := goldenRoutes()
+	fee[1].Hops[0].Fee = big.NewInt(MaxFee)
+	negative := goldenRoutes()
+	negative[1].Hops[0].Fee = big.NewInt(-1)
+	empty := goldenRoutes()
+	empty[1].Hops = nil
+	for name, routes := range map[string][]*Route{
+		"no route": nil,
+		"overflow": overflow,
+		"profit":   profit,
+		"fee":      fee,
+		"negative": negative,
+		"no hop":   empty,
+	} {
+		if _, err := EncodeBatch(routes); err == nil {
+			t.Fatalf("%s encoded", name)
+		}
+	}
+}
+
+func TestAmount(t *testing.T) {
+	// above the int64 range, the 9.2 ether a int64 conversion overflowed
+	amount, err := Amount(20e18)
+	if err != nil || amount.String() != "20000000000000000000" {
+		t.Fatalf("amount %s %v", amount, err)
+	}
+	max, _ := new(big.Float).SetInt(MaxAmount).Float64()
+	for _, amount := range []float64{-1, max, max * 2} {
+		if _, err := Amount(amount); err == nil {
+			t.Fatalf("amount %f converted", amount)
+		}
+	}
+}
+
+func TestNewRoute(t *testing.T) {
+	weth, a := common.HexToAddress("0x42"), common.HexToAddress("0x43")
+	path := []*protocol.UniswapV2Pair{
+		{Address: common.HexToAddress("0x52"), Token0: weth, Token1: a, Fee: 30},
+		{Address: common.HexToAddress("0x53"), Token0: weth, Token1: a, Fee: 25},
+	}
+	route, err := NewRoute(weth, 1e18, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !route.Hops[0].Direction || route.Hops[1].Direction || route.Hops[1].Fee.Int64() != 25 || route.AmountIn.String() != "1000000000000000000" {
+		t.Fatalf("route %+v %+v %+v", route, route.Hops[0], route.Hops[1])
+	}
+}
+
+func TestFlash(t *testing.T) {
+	route := goldenRoute()
+	route.MinProfit = big.NewInt(1e12)
+	data, err := EncodeFlash(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the swap params with the min profit after amountIn
+	swap := readGolden(t, "swap.golden")
+	if common.Bytes2Hex(data) != common.Bytes2Hex(swap[:AmountSize])+"0000000000e8d4a51000"+common.Bytes2Hex(swap[AmountSize:]) {
+		t.Fatalf("flash %x", data)
+	}
+	decoded, err := DecodeFlash(data)
+	if err != nil || !sameRoute(decoded, route) {
+		t.Fatalf("decoded %+v %v", decoded, err)
+	}
+	call, err := FlashSwapData(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(call[:4], crypto.Keccak256([]byte("flashSwap(bytes)"))[:4]) {
+		t.Fatalf("selector %x", call[:4])
+	}
+	routes, err := DecodeCall(call)
+	if err != nil || len(routes) != 1 || !sameRoute(routes[0], route) {
+		t.Fatalf("decoded call %v %v", routes, err)
+	}
+
+	// the first pair lends the cycle, a single hop has no pair to swap it back
+	single := goldenRoute()
+	single.Hops = single.Hops[:1]
+	profit := goldenRoute()
+	profit.MinProfit = new(big.Int).Set(MaxAmount)
+	for name, route := range map[string]*Route{"single": single, "profit": profit} {
+		if _, err := EncodeFlash(route); err == nil {
+			t.Fatalf("%s encoded", name)
+		}
+	}
+	for name, data := range map[string][]byte{
+		"single":  data[:flashHeadSize+HopSize],
+		"partial": data[:len(data)-1],
+	} {
+		if _, err := DecodeFlash(data); err == nil {
+			t.Fatalf("%s decoded", name)
+		}
+	}
+}
+
+func TestDecodeCall(t *testing.T) {
+	route := goldenRoute()
+	route.MinProfit = new(big.Int)
+	data, err := SwapData(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:4], crypto.Keccak256([]byte("swap(bytes)"))[:4]) {
+		t.Fatalf("selector %x", data[:4])
+	}
+	routes, err := DecodeCall(data)
+	if err != nil || len(routes) != 1 || !sameRoute(routes[0], route) {
+		t.Fatalf("decoded %v %v", routes, err)
+	}
+
+	data, err = SwapBatchData(goldenRoutes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:4], crypto.Keccak256([]byte("swapBatch(bytes)"))[:4]) {
+		t.Fatalf("selector %x", data[:4])
+	}
+	routes, err = DecodeCall(data)
+	if err != nil || len(routes) != 2 || !sameRoute(routes[1], goldenRoutes()[1]) {
+		t.Fatalf("decoded %v %v", routes, err)
+	}
+
+	if _, err := DecodeCall(common.FromHex("0xa9059cbb")); err == nil {
+		t.Fatalf("transfer decoded")
+	}
+}
+
+// validFees tells whether the hops can be encoded again, the decoders read any uint16 fee
+// like the contract, and any non zero direction byte as true so the bytes encoded again may
+// differ from the decoded ones
+func validFees(routes []*Route) bool {
+	for _, route := range routes {
+		for _, hop := range route.Hops {
+			if hop.Fee.Cmp(big.NewInt(MaxFee)) >= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func FuzzDecodeRoute(f *testing.F) {
+	f.Add(readGolden(f, "swap.golden"))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		route, err := DecodeRoute(data)
+		if err != nil || !validFees([]*Route{route}) {
+			return
+		}
+		encoded, err := EncodeRoute(route)
+		if err != nil || len(encoded) != len(data) {
+			t.Fatalf("encoded %x %v from %x", encoded, err, data)
+		}
+		if again, err := DecodeRoute(encoded); err != nil || !sameRoute(again, route) {
+			t.Fatalf("decoded %v %v from %x", again, err, encoded)
+		}
+	})
+}
+
+func FuzzDecodeBatch(f *testing.F) {
+	f.Add(readGolden(f, "swapBatch.golden"))
+	f.Add([]byte{0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		routes, err := DecodeBatch(data)
+		if err != nil || len(routes) == 0 || !validFees(routes) {
+			return
+		}
+		encoded, err := EncodeBatch(routes)
+		if err != nil || len(encoded) != len(data) {
+			t.Fatalf("encoded %x %v from %x", encoded, err, data)
+		}
+		again, err := DecodeBatch(encoded)
+		if err != nil || len(again) != len(routes) {
+			t.Fatalf("decoded %v %v from %x", again, err, encoded)
+		}
+		for i, route := range routes {
+			if !sameRoute(again[i], route) {
+				t.Fatalf("route %d decoded %+v", i, again[i])
+			}
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte{0xa6, 0xb4, 0x1b}, []byte{0x10}, []byte{0xe1, 0x2e}, true, uint16(31), uint8(2))
+	f.Add([]byte{}, []byte{}, []byte{}, false, uint16(MaxFee), uint8(1))
+	f.Fuzz(func(t *testing.T, amountIn, minProfit, pair []byte, direction bool, fee uint16, hops uint8) {
+		route := &Route{
+			AmountIn:  new(big.Int).SetBytes(amountIn),
+			MinProfit: new(big.Int).SetBytes(minProfit),
+		}
+		for i := 0; i < int(hops); i++ {
+			route.Hops = append(route.Hops, &Hop{
+				Pair:      common.BytesToAddress(append([]byte{byte(i)}, pair...)),
+				Direction: direction != (i%2 == 1),
+				Fee:       big.NewInt(int64(fee)),
+			})
+		}
+		valid := hops > 0 && fee < MaxFee && route.AmountIn.Cmp(MaxAmount) < 0 && route.MinProfit.Cmp(MaxAmount) < 0
+		data, err := EncodeBatch([]*Route{route, route})
+		if (err == nil) != valid {
+			t.Fatalf("valid %v encode %v", valid, err)
+		}
+		if err != nil {
+			return
+		}
+		routes, err := DecodeBatch(data)
+		if err != nil || len(routes) != 2 || !sameRoute(routes[0], route) || !sameRoute(routes[1], route) {
+			t.Fatalf("decoded %v %v from %x", routes, err, data)
+		}
+		if data, err = EncodeFlash(route); (err == nil) != (hops > 1) {
+			t.Fatalf("hops %d flash encode %v", hops, err)
+		}
+		if err != nil {
+			return
+		}
+		flash, err := DecodeFlash(data)
+		if err != nil || !sameRoute(flash, route) {
+			t.Fatalf("flash decoded %v %v from %x", flash, err, data)
+		}
+	})
+}
@@ -0,0 +1,211 @@
+package tokenregistry
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"monitor/client"
+	"monitor/config"
+	"monitor/protocol"
+	"monitor/utils"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	resolveInterval = 5 * time.Second
+	resolvePageSize = 100
+	// probeShare is the part of the pair reserve the probe transfers, 1/1000
+	probeShare = 1000
+)
+
+var _ utils.Keeper = &TokenRegistry{}
+
+// TokenRegistry reads the metadata of every token of the stored pairs and simulates
+// a transfer out of one of its pairs to flag fee on transfer and rebasing tokens
+type TokenRegistry struct {
+	config *config.Config
+	// pending maps a token to probe to a pair holding it
+	pending map[common.Address]common.Address
+	lock    sync.Mutex
+}
+
+func NewTokenRegistry(ctx context.Context, conf *config.Config) *TokenRegistry {
+	return &TokenRegistry{
+		config:  conf,
+		pending: map[common.Address]common.Address{},
+	}
+}
+
+func (r *TokenRegistry) Init(ctx context.Context) error {
+	protocol.UniswapV2Pairs.Subscribe(func(_ []common.Address, pairs []*protocol.UniswapV2Pair) {
+		r.addPairs(pairs)
+	})
+	pairs := []*protocol.UniswapV2Pair{}
+	protocol.UniswapV2Pairs.Range(func(_ common.Address, pair *protocol.UniswapV2Pair) bool {
+		pairs = append(pairs, pair)
+		return true
+	})
+	r.addPairs(pairs)
+	utils.Go(client.WithPriority(ctx, client.PriorityBackground), "tokenregistry.resolve", r.loopResolve)
+	return nil
+}
+
+// ShutDown has nothing to release, the supervisor cancels the loop and waits for it
+func (*TokenRegistry) ShutDown(context.Context) {
+
+}
+
+// addPairs queues the tokens not probed yet with a pair holding them
+func (r *TokenRegistry) addPairs(pairs []*protocol.UniswapV2Pair) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, pair := range pairs {
+		if pair.Error {
+			continue
+		}
+		for token, reserve := range map[common.Address]*big.Int{pair.Token0: pair.Reserve0, pair.Token1: pair.Reserve1} {
+			if reserve == nil || reserve.Cmp(big.NewInt(probeShare)) < 0 {
+				continue
+			}
+			if _, ok := r.pending[token]; ok {
+				continue
+			}
+			if known, ok := protocol.Tokens.Load(token); ok && known.CheckedBlock > 0 {
+				continue
+			}
+			r.pending[token] = pair.Address
+		}
+	}
+}
+
+func (r *TokenRegistry) loopResolve(ctx context.Context) error {
+	for utils.Sleep(ctx, resolveInterval) {
+		err := r.resolve(ctx)
+		if err != nil {
+			utils.Warnf("resolve tokens fail %s", err)
+		}
+	}
+	return nil
+}
+
+// resolve reads and probes one page of the pending tokens, the tokens failed are queued again
+func (r *TokenRegistry) resolve(ctx context.Context) error {
+	batch := r.takePending()
+	if len(batch) == 0 {
+		return nil
+	}
+	cli, err := client.GetETHClient(ctx, r.config.Node, r.config.MulticallAddress)
+	if err != nil {
+		r.requeue(batch)
+		return fmt.Errorf("get eth client fail %s", err)
+	}
+	number, err := cli.BlockNumber(ctx)
+	if err != nil {
+		r.requeue(batch)
+		return fmt.Errorf("get block number fail %s", err)
+	}
+	var (
+		blockNumber = new(big.Int).SetUint64(number)
+		tokens      = map[common.Address]*protocol.Token{}
+		viewcalls   = []*client.ViewCall{}
+	)
+	for token := range batch {
+		if known, ok := protocol.Tokens.Load(token); ok {
+			copy := *known
+			tokens[token] = &copy
+			continue
+		}
+		viewcalls = append(viewcalls, protocol.NewTokenInfoCalls(token)...)
+	}
+	callResult, err := cli.MultiViewCallAt(ctx, blockNumber, viewcalls)
+	if err != nil {
+		r.requeue(batch)
+		return fmt.Errorf("multi view call fail %s", err)
+	}
+	protocol.TokenCallResult(tokens, callResult)
+
+	var (
+		storeKeys  = []common.Address{}
+		storeDatas = []*protocol.Token{}
+		failed     = map[common.Address]common.Address{}
+	)
+	for token, pairAddr := range batch {
+		data := tokens[token]
+		err := r.probe(ctx, cli, blockNumber, data, pairAddr)
+		if err != nil {
+			utils.Warnf("probe token %s pair %s fail %s", token, pairAddr, err)
+			failed[token] = pairAddr
+			continue
+		}
+		data.CheckedBlock = number
+		if data.Excluded() {
+			utils.Warnf("exclude token %s %s transfer fee %d rebasing %t", token, data.Symbol, data.TransferFee, data.Rebasing)
+		}
+		storeKeys = append(storeKeys, token)
+		storeDatas = append(storeDatas, data)
+	}
+	protocol.Tokens.Store(storeKeys, storeDatas)
+	r.requeue(failed)
+	utils.Infof("resolve tokens %d failed %d pending %d", len(storeKeys), len(failed), r.pendingLen())
+	return nil
+}
+
+// probe transfers a share of the pair reserve to a fresh account, a reverted transfer
+// means the token can not leave the pair
+func (r *TokenRegistry) probe(ctx context.Context, cli *client.ETHClient, blockNumber *big.Int, token *protocol.Token, pairAddr common.Address) error {
+	pair, ok := protocol.UniswapV2Pairs.Load(pairAddr)
+	if !ok {
+		return fmt.Errorf("pair gone")
+	}
+	reserve := pair.Reserve0
+	if pair.Token1 == token.Address {
+		reserve = pair.Reserve1
+	}
+	amount := new(big.Int).Div(reserve, big.NewInt(probeShare))
+	if amount.Sign() <= 0 {
+		return fmt.Errorf("reserve too small %s", reserve)
+	}
+	probe, err := protocol.ProbeTokenTransfer(ctx, cli, blockNumber, token.Address, pairAddr, amount)
+	if err != nil {
+		if !strings.Contains(err.Error(), "revert") {
+			return err
+		}
+		token.TransferFee = int64(protocol.FeeBase)
+		return nil
+	}
+	token.TransferFee = probe.TransferFee()
+	token.Rebasing = probe.Rebasing()
+	return nil
+}
+
+func (r *TokenRegistry) takePending() map[common.Address]common.Address {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	batch := map[common.Address]common.Address{}
+	for token, pair := range r.pending {
+		if len(batch) >= resolvePageSize {
+			break
+		}
+		batch[token] = pair
+		delete(r.pending, token)
+	}
+	return batch
+}
+
+func (r *TokenRegistry) requeue(batch map[common.Address]common.Address) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for token, pair := range batch {
+		r.pending[token] = pair
+	}
+}
+
+func (r *TokenRegistry) pendingLen() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.pending)
+}
@@ -0,0 +1,267 @@
+package trader
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math"
+	"monitor/client"
+	"monitor/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/console/prompt"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// account is a hot wallet signing swaps, with its own nonces and inventory
+type account struct {
+	address common.Address
+	signer  Signer
+	nonces  nonces
+	wallet  wallet
+	// busy is set while the account sends a swap or a wallet tx and until its receipt, guarded
+	// by the lock of the pool
+	busy   bool
+	pairs  []common.Address
+	lowGas atomic.Bool
+}
+
+// nonces hands out the nonces of an account without a request per tx, they are read again
+// from the pending state after a failed send
+type nonces struct {
+	lock   sync.Mutex
+	next   uint64
+	synced bool
+}
+
+// get returns the next nonce, commit must follow a sent tx and reset a failed one
+func (n *nonces) get(ctx context.Context, cli *client.ETHClient, address common.Address) (uint64, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if !n.synced {
+		next, err := cli.PendingNonceAt(ctx, address)
+		if err != nil {
+			return 0, fmt.Errorf("get nonce fail %s", err)
+		}
+		n.next, n.synced = next, true
+	}
+	return n.next, nil
+}
+
+func (n *nonces) commit(nonce uint64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if nonce >= n.next {
+		n.next = nonce + 1
+	}
+}
+
+func (n *nonces) reset() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.synced = false
+}
+
+// accounts dispatches the swaps to the idle accounts, cycles sharing a pair with a swap in
+// flight are refused as the later one would trade against reserves already moved
+type accounts struct {
+	lock  sync.Mutex
+	list  []*account
+	pairs map[common.Address]bool
+}
+
+func newAccounts(list []*account) *accounts {
+	return &accounts{list: list, pairs: map[common.Address]bool{}}
+}
+
+// acquire picks the idle account with the most WETH available for a swap of amount through
+// pairs, release must follow
+func (a *accounts) acquire(pairs []common.Address, amount float64) (*account, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, pair := range pairs {
+		if a.pairs[pair] {
+			return nil, fmt.Errorf("pair %s in flight", pair)
+		}
+	}
+	var (
+		best      *account
+		available float64
+	)
+	for _, acc := range a.list {
+		if acc.busy {
+			continue
+		}
+		if v := acc.wallet.available(); best == nil || v > available {
+			best, available = acc, v
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no idle account")
+	}
+	if amount > available {
+		return nil, fmt.Errorf("insufficient inventory amountIn %f available %f", amount/math.Pow10(18), available/math.Pow10(18))
+	}
+	best.busy, best.pairs = true, pairs
+	for _, pair := range pairs {
+		a.pairs[pair] = true
+	}
+	return best, nil
+}
+
+// acquireIdle takes acc for a wallet tx when it is idle
+func (a *accounts) acquireIdle(acc *account) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if acc.busy || acc.wallet.unsettled() {
+		return false
+	}
+	acc.busy = true
+	return true
+}
+
+func (a *accounts) release(acc *account) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, pair := range acc.pairs {
+		delete(a.pairs, pair)
+	}
+	acc.busy, acc.pairs = false, nil
+}
+
+// available is the most WETH an idle account can spend
+func (a *accounts) available() float64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	available := 0.0
+	for _, acc := range a.list {
+		if v := acc.wallet.available(); !acc.busy && v > available {
+			available = v
+		}
+	}
+	return available
+}
+
+// idle tells whether an account can take a swap
+func (a *accounts) idle() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, acc := range a.list {
+		if !acc.busy {
+			return true
+		}
+	}
+	return false
+}
+
+// promptPassphrase asks the keystore passphrase on the terminal
+var promptPassphrase = func() (string, error) {
+	return prompt.Stdin.PromptPassword("keystore passphrase: ")
+}
+
+// loadAccounts reads the private key of the config, the keystores of KeystoreDir and the
+// accounts of the remote signer
+func loadAccounts(ctx context.Context, conf *config.Config) ([]*account, error) {
+	signers := []Signer{}
+	if len(conf.PrivateKey) > 0 {
+		key, err := crypto.HexToECDSA(strings.TrimPrefix(conf.PrivateKey, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("hex to ecdsa fail %s", err)
+		}
+		if address := crypto.PubkeyToAddress(key.PublicKey); conf.FromAddress != (common.Address{}) && address != conf.FromAddress {
+			return nil, fmt.Errorf("private key of %s is not the one of %s", address, conf.FromAddress)
+		}
+		signers = append(signers, NewKeySigner(key))
+	}
+	if len(conf.KeystoreDir) > 0 {
+		passphrase, err := keystorePassphrase(conf)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := readKeystores(conf.KeystoreDir, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			signers = append(signers, NewKeySigner(key))
+		}
+	}
+	if conf.RemoteSigner != nil {
+		remotes, err := DialRemoteSigner(ctx, conf.RemoteSigner)
+		if err != nil {
+			return nil, err
+		}
+		for _, remote := range remotes {
+			signers = append(signers, remote)
+		}
+	}
+	ret := []*account{}
+	seen := map[common.Address]bool{}
+	for _, signer := range signers {
+		address := signer.Address()
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		ret = append(ret, &account{address: address, signer: signer})
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no signer account configured")
+	}
+	return ret, nil
+}
+
+// keystorePassphrase is the configured passphrase, else the first line of the passphrase
+// file, else the one typed on the terminal
+func keystorePassphrase(conf *config.Config) (string, error) {
+	if len(conf.KeystorePassphrase) > 0 {
+		return conf.KeystorePassphrase, nil
+	}
+	if len(conf.KeystorePassphraseFile) > 0 {
+		data, err := os.ReadFile(conf.KeystorePassphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("read passphrase file fail %s", err)
+		}
+		line, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimRight(line, "\r"), nil
+	}
+	passphrase, err := promptPassphrase()
+	if err != nil {
+		return "", fmt.Errorf("prompt passphrase fail %s", err)
+	}
+	return passphrase, nil
+}
+
+// readKeystores decrypts the keystore files of dir in name order, hidden files are skipped
+func readKeystores(dir, passphrase string) ([]*ecdsa.PrivateKey, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read keystore dir fail %s", err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	keys := []*ecdsa.PrivateKey{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		keyJSON, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read keystore %s fail %s", entry.Name(), err)
+		}
+		key, err := keystore.DecryptKey(keyJSON, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt keystore %s fail %s", entry.Name(), err)
+		}
+		keys = append(keys, key.PrivateKey)
+	}
+	return keys, nil
+}
@@ -0,0 +1,126 @@
+package trader
+
+import (
+	"monitor/utils"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ledgerSize is the number of trades kept for inspection
+const ledgerSize = 200
+
+// LedgerEntry is a swap sent and its outcome, amounts in ether
+type LedgerEntry struct {
+	Time      time.Time        `json:"time"`
+	Trade     string           `json:"trade,omitempty"`
+	Account   common.Address   `json:"account"`
+	Tx        common.Hash      `json:"tx"`
+	Pairs     []common.Address `json:"pairs"`
+	AmountIn  float64          `json:"amountIn"`
+	AmountOut float64          `json:"amountOut"`
+	GasPrice  float64          `json:"gasPrice"`
+	Expected  float64          `json:"expected"`
+	Status    string           `json:"status"`
+	Block     uint64           `json:"block,omitempty"`
+	GasUsed   uint64           `json:"gasUsed,omitempty"`
+	Realized  *float64         `json:"realized,omitempty"`
+	// Flash is set for the swaps funded by a flash swap
+	Flash bool `json:"flash,omitempty"`
+}
+
+// ledger keeps the last trades, newest last, the entries are copied out under the lock
+type ledger struct {
+	entries   []*LedgerEntry
+	listeners []func(entry LedgerEntry)
+	lock      sync.Mutex
+}
+
+func (l *ledger) add(entry *LedgerEntry) {
+	l.lock.Lock()
+	if len(l.entries) >= ledgerSize {
+		l.entries = append(l.entries[:0], l.entries[1:]...)
+	}
+	l.entries = append(l.entries, entry)
+	copied, listeners := *entry, l.listeners
+	l.lock.Unlock()
+	for _, listener := range listeners {
+		listener(copied)
+	}
+}
+
+// update changes the entry of tx, if it is still kept
+func (l *ledger) update(tx common.Hash, f func(entry *LedgerEntry)) {
+	l.lock.Lock()
+	var found *LedgerEntry
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if l.entries[i].Tx == tx {
+			found = l.entries[i]
+			f(found)
+			break
+		}
+	}
+	if found == nil {
+		l.lock.Unlock()
+		return
+	}
+	copied, listeners := *found, l.listeners
+	l.lock.Unlock()
+	for _, listener := range listeners {
+		listener(copied)
+	}
+}
+
+func (l *ledger) subscribe(f func(entry LedgerEntry)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.listeners = append(l.listeners[:len(l.listeners):len(l.listeners)], f)
+}
+
+func (l *ledger) recent(limit int) []LedgerEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if limit <= 0 || limit > len(l.entries) {
+		limit = len(l.entries)
+	}
+	ret := make([]LedgerEntry, 0, limit)
+	for i := len(l.entries) - 1; i >= 0 && len(ret) < limit; i-- {
+		ret = append(ret, *l.entries[i])
+	}
+	return ret
+}
+
+// Ledger returns the last trades sent, newest first
+func (t *Trader) Ledger(limit int) []LedgerEntry {
+	return t.ledger.recent(limit)
+}
+
+// SubscribeLedger calls f with a copy of every trade added to the ledger or updated
+func (t *Trader) SubscribeLedger(f func(entry LedgerEntry)) {
+	t.ledger.subscribe(f)
+}
+
+// Handler serves the ledger at GET /trader/ledger?limit= and the wallet at GET /trader/wallet
+func (t *Trader) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/trader/ledger", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := ledgerSize
+		if s := r.URL.Query().Get("limit"); len(s) > 0 {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil {
+				http.Error(w, "invalid limit "+s, http.StatusBadRequest)
+				return
+			}
+		}
+		utils.WriteJSON(w, t.Ledger(limit))
+	})
+	mux.HandleFunc("/trader/wallet", t.serveWallet)
+	return mux
+}
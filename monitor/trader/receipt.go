@@ -0,0 +1,103 @@
+package trader
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/big"
+	"monitor/client"
+	"monitor/utils"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	receiptInterval = 2 * time.Second
+	receiptTimeout  = 2 * time.Minute
+)
+
+// transferSign is the topic of the erc20 Transfer(from, to, value) event
+var transferSign = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
+// watchReceipt polls the receipt of a swap sent by acc, counts it mined, reverted or dropped
+// and observes the realized profit, expected is the swap profit net of the l1 fee in wei
+func (t *Trader) watchReceipt(ctx context.Context, acc *account, hash common.Hash, expected float64) {
+	log := logger.Ctx(ctx).With(utils.F("tx", hash))
+	deadline := time.Now().Add(receiptTimeout)
+	for time.Now().Before(deadline) {
+		<-time.After(receiptInterval)
+		cli, err := client.GetETHClient(ctx, t.config.Node, t.config.MulticallAddress)
+		if err != nil {
+			log.Warnf("get eth client fail %s", err)
+			continue
+		}
+		receipt, err := cli.TransactionReceipt(ctx, hash)
+		if errors.Is(err, ethereum.NotFound) {
+			continue
+		}
+		if err != nil {
+			log.Warnf("get receipt fail %s", err)
+			continue
+		}
+		t.observeReceipt(log, receipt, acc.address, expected)
+		acc.wallet.settle(hash, receipt.BlockNumber)
+		return
+	}
+	log.Warnf("swap tx dropped, no receipt after %s", receiptTimeout)
+	acc.wallet.settle(hash, nil)
+	// a dropped swap leaves its nonce unused
+	acc.nonces.reset()
+	t.trades.WithLabelValues("dropped").Inc()
+	t.ledger.update(hash, func(entry *LedgerEntry) {
+		entry.Status = "dropped"
+	})
+}
+
+// observeReceipt counts the swap mined or reverted, the realized profit is the weth the
+// receipt moved into account, amount out or flash profit less amount in, net of the gas cost
+func (t *Trader) observeReceipt(log *utils.Logger, receipt *types.Receipt, account common.Address, expected float64) {
+	gasCost := new(big.Int).SetUint64(receipt.GasUsed)
+	if receipt.EffectiveGasPrice != nil {
+		gasCost.Mul(gasCost, receipt.EffectiveGasPrice)
+	}
+	cost, _ := gasCost.Float64()
+	flow, _ := wethFlow(receipt, t.config.WETHAddress, account).Float64()
+	status, realized := "mined", (flow-cost)/math.Pow10(18)
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		status = "reverted"
+		log.Warnf("swap tx reverted gas cost %f", cost/math.Pow10(18))
+	} else {
+		log.Infof("swap tx mined in block %s profit %f expected %f", receipt.BlockNumber, realized, expected/math.Pow10(18))
+	}
+	t.trades.WithLabelValues(status).Inc()
+	t.profit.WithLabelValues("realized").Observe(realized)
+	t.ledger.update(receipt.TxHash, func(entry *LedgerEntry) {
+		entry.Status, entry.Realized, entry.GasUsed = status, &realized, receipt.GasUsed
+		if receipt.BlockNumber != nil {
+			entry.Block = receipt.BlockNumber.Uint64()
+		}
+	})
+}
+
+// wethFlow sums the weth transferred to account in the receipt less the weth transferred from
+// it, a reverted receipt has no logs
+func wethFlow(receipt *types.Receipt, weth, account common.Address) *big.Int {
+	flow := new(big.Int)
+	for _, l := range receipt.Logs {
+		if l.Address != weth || len(l.Topics) != 3 || l.Topics[0] != transferSign || len(l.Data) != 32 {
+			continue
+		}
+		value := new(big.Int).SetBytes(l.Data)
+		if common.BytesToAddress(l.Topics[2].Bytes()) == account {
+			flow.Add(flow, value)
+		}
+		if common.BytesToAddress(l.Topics[1].Bytes()) == account {
+			flow.Sub(flow, value)
+		}
+	}
+	return flow
+}
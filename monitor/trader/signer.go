@@ -0,0 +1,215 @@
+package trader
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"monitor/config"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	_ Signer = &KeySigner{}
+	_ Signer = &RemoteSigner{}
+)
+
+// Signer signs the txs of an account, the key may live out of the process
+type Signer interface {
+	Address() common.Address
+	SignTx(ctx context.Context, signer types.Signer, tx *types.Transaction) (*types.Transaction, error)
+}
+
+// KeySigner signs with a private key held in memory
+type KeySigner struct {
+	key     *ecdsa.PrivateKey
+	address common.Address
+}
+
+func NewKeySigner(key *ecdsa.PrivateKey) *KeySigner {
+	return &KeySigner{key: key, address: crypto.PubkeyToAddress(key.PublicKey)}
+}
+
+func (s *KeySigner) Address() common.Address {
+	return s.address
+}
+
+func (s *KeySigner) SignTx(ctx context.Context, signer types.Signer, tx *types.Transaction) (*types.Transaction, error) {
+	return types.SignTx(tx, signer, s.key)
+}
+
+// RemoteSigner asks a json rpc signer for the signature of an account
+type RemoteSigner struct {
+	client  *rpc.Client
+	address common.Address
+}
+
+// DialRemoteSigner connects the signer of conf and returns one RemoteSigner per account
+func DialRemoteSigner(ctx context.Context, conf *config.RemoteSigner) ([]*RemoteSigner, error) {
+	headers := http.Header{}
+	for key, value := range conf.Headers {
+		headers.Set(key, value)
+	}
+	client, err := rpc.DialOptions(ctx, conf.URL, rpc.WithHeaders(headers))
+	if err != nil {
+		return nil, fmt.Errorf("dial remote signer fail %s", err)
+	}
+	addresses := conf.Accounts
+	if len(addresses) == 0 {
+		if err := client.CallContext(ctx, &addresses, "eth_accounts"); err != nil {
+			return nil, fmt.Errorf("get remote signer accounts fail %s", err)
+		}
+	}
+	ret := make([]*RemoteSigner, 0, len(addresses))
+	for _, address := range addresses {
+		ret = append(ret, &RemoteSigner{client: client, address: address})
+	}
+	return ret, nil
+}
+
+func (s *RemoteSigner) Address() common.Address {
+	return s.address
+}
+
+// SignTx sends the tx fields to eth_signTransaction, the signed tx returned must be the
+// one asked and signed by the account
+func (s *RemoteSigner) SignTx(ctx context.Context, signer types.Signer, tx *types.Transaction) (*types.Transaction, error) {
+	args := newSignTxArgs(s.address, signer.ChainID(), tx)
+	var result json.RawMessage
+	if err := s.client.CallContext(ctx, &result, "eth_signTransaction", args); err != nil {
+		return nil, fmt.Errorf("remote sign fail %s", err)
+	}
+	// web3signer returns the raw tx, geth an object holding it and the decoded tx
+	var raw hexutil.Bytes
+	if len(result) > 0 && result[0] == '"' {
+		if err := json.Unmarshal(result, &raw); err != nil {
+			return nil, fmt.Errorf("decode signed tx fail %s", err)
+		}
+	} else {
+		var signed struct {
+			Raw hexutil.Bytes `json:"raw"`
+		}
+		if err := json.Unmarshal(result, &signed); err != nil {
+			return nil, fmt.Errorf("decode signed tx fail %s", err)
+		}
+		raw = signed.Raw
+	}
+	signed := new(types.Transaction)
+	if err := signed.UnmarshalBinary(raw); err != nil {
+		return nil, fmt.Errorf("unmarshal signed tx fail %s", err)
+	}
+	if signer.Hash(signed) != signer.Hash(tx) {
+		return nil, fmt.Errorf("remote signer changed tx %s", signed.Hash())
+	}
+	if from, err := types.Sender(signer, signed); err != nil || from != s.address {
+		return nil, fmt.Errorf("remote signer signed as %s not %s %v", from, s.address, err)
+	}
+	return signed, nil
+}
+
+// signTxArgs are the eth_signTransaction params, legacy txs carry gasPrice and dynamic fee
+// txs the fee caps
+type signTxArgs struct {
+	From                 common.Address  `json:"from"`
+	To                   *common.Address `json:"to,omitempty"`
+	Gas                  hexutil.Uint64  `json:"gas"`
+	GasPrice             *hexutil.Big    `json:"gasPrice,omitempty"`
+	MaxFeePerGas         *hexutil.Big    `json:"maxFeePerGas,omitempty"`
+	MaxPriorityFeePerGas *hexutil.Big    `json:"maxPriorityFeePerGas,omitempty"`
+	Value                *hexutil.Big    `json:"value"`
+	Nonce                hexutil.Uint64  `json:"nonce"`
+	Data                 hexutil.Bytes   `json:"data"`
+	ChainID              *hexutil.Big    `json:"chainId,omitempty"`
+}
+
+func newSignTxArgs(from common.Address, chainID *big.Int, tx *types.Transaction) *signTxArgs {
+	args := &signTxArgs{
+		From:    from,
+		To:      tx.To(),
+		Gas:     hexutil.Uint64(tx.Gas()),
+		Value:   (*hexutil.Big)(tx.Value()),
+		Nonce:   hexutil.Uint64(tx.Nonce()),
+		Data:    tx.Data(),
+		ChainID: (*hexutil.Big)(chainID),
+	}
+	if tx.Type() == types.DynamicFeeTxType {
+		args.MaxFeePerGas, args.MaxPriorityFeePerGas = (*hexutil.Big)(tx.GasFeeCap()), (*hexutil.Big)(tx.GasTipCap())
+	} else {
+		args.GasPrice = (*hexutil.Big)(tx.GasPrice())
+	}
+	return args
+}
+
+func (a *signTxArgs) tx() *types.Transaction {
+	value := new(big.Int)
+	if a.Value != nil {
+		value = a.Value.ToInt()
+	}
+	if a.MaxFeePerGas != nil {
+		return types.NewTx(&types.DynamicFeeTx{
+			ChainID:   a.ChainID.ToInt(),
+			Nonce:     uint64(a.Nonce),
+			GasTipCap: a.MaxPriorityFeePerGas.ToInt(),
+			GasFeeCap: a.MaxFeePerGas.ToInt(),
+			Gas:       uint64(a.Gas),
+			To:        a.To,
+			Value:     value,
+			Data:      a.Data,
+		})
+	}
+	return types.NewTx(&types.LegacyTx{
+		Nonce:    uint64(a.Nonce),
+		GasPrice: a.GasPrice.ToInt(),
+		Gas:      uint64(a.Gas),
+		To:       a.To,
+		Value:    value,
+		Data:     a.Data,
+	})
+}
+
+// localSigner serves eth_accounts and eth_signTransaction from signers in the process
+type localSigner struct {
+	signers map[common.Address]Signer
+	order   []common.Address
+}
+
+func (s *localSigner) Accounts() []common.Address {
+	return s.order
+}
+
+func (s *localSigner) SignTransaction(ctx context.Context, args signTxArgs) (hexutil.Bytes, error) {
+	one := s.signers[args.From]
+	if one == nil {
+		return nil, fmt.Errorf("unknown account %s", args.From)
+	}
+	if args.ChainID == nil {
+		return nil, fmt.Errorf("missing chain id")
+	}
+	signed, err := one.SignTx(ctx, types.LatestSignerForChainID(args.ChainID.ToInt()), args.tx())
+	if err != nil {
+		return nil, err
+	}
+	return signed.MarshalBinary()
+}
+
+// LocalSignerHandler serves signers as a remote signer, the stand-in of a signer service in
+// tests and local runs
+func LocalSignerHandler(signers ...Signer) (http.Handler, error) {
+	local := &localSigner{signers: map[common.Address]Signer{}}
+	for _, one := range signers {
+		local.signers[one.Address()] = one
+		local.order = append(local.order, one.Address())
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", local); err != nil {
+		return nil, fmt.Errorf("register signer fail %s", err)
+	}
+	return server, nil
+}
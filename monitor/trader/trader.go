@@ -2,68 +2,56 @@ package trader
 
 import (
 	"context"
-	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
 	"monitor/client"
 	"monitor/config"
+	"monitor/metrics"
 	"monitor/protocol"
+	"monitor/strategy"
+	"monitor/swaper"
 	"monitor/utils"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum"
-	"github.com/ethereum/go-ethereum/accounts/abi"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
 	_ utils.Keeper = &Trader{}
 
-	swapMetaData = `
-[
-    {
-        "type":"function",
-        "name":"swap",
-        "stateMutability":"nonpayable",
-        "inputs":[
-            {
-                "internalType":"bytes",
-                "type":"bytes",
-                "name":"params"
-            }
-        ],
-        "outputs":[
-
-        ]
-    }
-]
-	`
-	swapABI *abi.ABI
+	logger = utils.NewLogger("trader")
 )
 
-func init() {
-	md := &bind.MetaData{
-		ABI: swapMetaData,
-	}
-	var err error
-	swapABI, err = md.GetAbi()
-	if err != nil {
-		panic(err)
-	}
-}
-
 type Trader struct {
 	config *config.Config
 
 	gasPrice    *big.Int
 	ethGasPrice *big.Int
 	signer      types.Signer
-	privateKey  *ecdsa.PrivateKey
+	accounts    *accounts
+	strategy    strategy.Strategy
+
+	finalChecks *prometheus.CounterVec
+	trades      *prometheus.CounterVec
+	profit      *prometheus.HistogramVec
+	gasPrices   *prometheus.GaugeVec
+
+	walletBalances *prometheus.GaugeVec
+	walletLowGas   *prometheus.GaugeVec
+
+	ledger ledger
+	// pending counts the swaps in flight until their receipt is read, ShutDown waits for
+	// them, swapLock orders the swaps accepted with closed
+	pending  sync.WaitGroup
+	closed   atomic.Bool
+	swapLock sync.Mutex
 }
 
 func NewTrader(ctx context.Context, conf *config.Config) *Trader {
@@ -71,6 +59,39 @@ func NewTrader(ctx context.Context, conf *config.Config) *Trader {
 		config:      conf,
 		gasPrice:    big.NewInt(120000000),
 		ethGasPrice: big.NewInt(20000000000),
+		accounts:    newAccounts(nil),
+		strategy:    strategy.New(conf.Strategy),
+		finalChecks: metrics.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "trader",
+			Name:      "final_checks_total",
+			Help:      "Final checks before sending a swap by result: pass, fail or danger.",
+		}, "result"),
+		trades: metrics.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "trader",
+			Name:      "trades_total",
+			Help:      "Swap transactions by status: sent, mined, reverted or dropped.",
+		}, "status"),
+		profit: metrics.NewHistogramVec(prometheus.HistogramOpts{
+			Subsystem: "trader",
+			Name:      "profit_ether",
+			Help:      "Profit of the swaps net of gas by kind, expected when sent or realized from the receipt.",
+			Buckets:   []float64{-0.01, -0.001, -0.0001, 0, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05},
+		}, "kind"),
+		gasPrices: metrics.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "trader",
+			Name:      "gas_price_gwei",
+			Help:      "Suggested gas price by chain, l2 or l1.",
+		}, "chain"),
+		walletBalances: metrics.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "trader",
+			Name:      "wallet_ether",
+			Help:      "Hot wallet funds in ether by account and asset: weth, eth, allowance or reserved.",
+		}, "account", "asset"),
+		walletLowGas: metrics.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "trader",
+			Name:      "wallet_low_gas",
+			Help:      "1 while the native balance of the account is below the minimum gas balance.",
+		}, "account"),
 	}
 }
 
@@ -85,37 +106,60 @@ func (t *Trader) Init(ctx context.Context) error {
 		return fmt.Errorf("get chain id fail %s", err)
 	}
 	t.signer = types.LatestSignerForChainID(chainID)
-	t.privateKey, err = crypto.HexToECDSA(strings.TrimPrefix(t.config.PrivateKey, "0x"))
+	list, err := loadAccounts(ctx, t.config)
+	if err != nil {
+		return fmt.Errorf("load accounts fail %s", err)
+	}
+	t.accounts = newAccounts(list)
+	logger.Infof("trade with %d accounts", len(list))
+
+	blockNumber, err := cli.BlockNumber(ctx)
 	if err != nil {
-		return fmt.Errorf("hex to ecdsa fail %s", err)
+		return fmt.Errorf("get block number fail %s", err)
+	}
+	err = t.refreshWallets(ctx, blockNumber)
+	if err != nil {
+		return fmt.Errorf("refresh wallets fail %s", err)
 	}
 
-	go t.loopWatcher(ctx)
+	utils.Go(client.WithPriority(ctx, client.PriorityBackground), "trader.watcher", t.loopWatcher)
+	utils.Go(client.WithPriority(ctx, client.PriorityBackground), "trader.wallet", t.loopWallet)
 	return nil
 }
 
-func (*Trader) ShutDown(context.Context) {
-
+// ShutDown refuses new swaps and waits for the swaps in flight to be sent and mined
+func (t *Trader) ShutDown(ctx context.Context) {
+	t.swapLock.Lock()
+	t.closed.Store(true)
+	t.swapLock.Unlock()
+	if !utils.Wait(ctx, &t.pending) {
+		logger.Errorf("swaps sent still without receipt at shutdown")
+	}
 }
 
-func (t *Trader) loopWatcher(ctx context.Context) {
+func (t *Trader) loopWatcher(ctx context.Context) error {
 	var logFeeTime = time.Now()
 	for {
 		err := t.fetchGasPrice(ctx)
 		if err != nil {
-			utils.Warnf("fetch gas price fail %s", err)
+			logger.Warnf("fetch gas price fail %s", err)
 		}
 
 		err = t.fetchETHGasPrice(ctx)
 		if err != nil {
-			utils.Warnf("fetch eth gas price fail %s", err)
+			logger.Warnf("fetch eth gas price fail %s", err)
 		}
 
+		t.gasPrices.WithLabelValues("l2").Set(t.GasPrice() / math.Pow10(9))
+		t.gasPrices.WithLabelValues("l1").Set(t.ETHGasPrice() / math.Pow10(9))
+
 		if now := time.Now(); now.Sub(logFeeTime) > time.Second*5 {
-			utils.Infof("current suggest gas price is %f gwei, eth gas price is %f gwei", t.GasPrice()/math.Pow10(9), t.ETHGasPrice()/math.Pow10(9))
+			logger.Infof("current suggest gas price is %f gwei, eth gas price is %f gwei", t.GasPrice()/math.Pow10(9), t.ETHGasPrice()/math.Pow10(9))
 			logFeeTime = now
 		}
-		<-time.After(time.Second * 2)
+		if !utils.Sleep(ctx, time.Second*2) {
+			return nil
+		}
 	}
 }
 
@@ -149,6 +193,16 @@ func (t *Trader) fetchETHGasPrice(ctx context.Context) error {
 	return nil
 }
 
+// SetGasPrice replaces the fetched gas prices, backtests set them instead of fetching them
+func (t *Trader) SetGasPrice(gasPrice, ethGasPrice *big.Int) {
+	if gasPrice != nil && gasPrice.Sign() > 0 {
+		t.gasPrice = gasPrice
+	}
+	if ethGasPrice != nil && ethGasPrice.Sign() > 0 {
+		t.ethGasPrice = ethGasPrice
+	}
+}
+
 func (t *Trader) GasPrice() float64 {
 	gp, _ := t.gasPrice.Float64()
 	return gp
@@ -159,42 +213,105 @@ func (t *Trader) ETHGasPrice() float64 {
 	return gp
 }
 
-type Route struct {
-	Pair      common.Address
-	Direction bool
-	Fee       *big.Int
+// Route is a hop of the swap params, the pair, its direction and fee
+type Route = swaper.Hop
+
+// Swap is a cycle of a batch, its input in wei and its pairs
+type Swap struct {
+	AmountIn float64
+	Path     []*protocol.UniswapV2Pair
 }
 
 func (t *Trader) SwapV2(ctx context.Context, inputAmount float64, pairPath []*protocol.UniswapV2Pair) error {
+	return t.swap(ctx, []*Swap{{AmountIn: inputAmount, Path: pairPath}})
+}
+
+// SwapBatch sends the cycles in one swapBatch tx, the contract skips the ones no longer
+// profitable, they must not share a pair
+func (t *Trader) SwapBatch(ctx context.Context, swaps []*Swap) error {
+	if len(swaps) == 0 {
+		return fmt.Errorf("empty batch")
+	}
+	if len(swaps) > 1 && t.config.FlashSwap {
+		return fmt.Errorf("flash swaps are not batched")
+	}
+	return t.swap(ctx, swaps)
+}
+
+func (t *Trader) swap(ctx context.Context, swaps []*Swap) error {
+	t.swapLock.Lock()
+	if t.closed.Load() {
+		t.swapLock.Unlock()
+		return fmt.Errorf("trader shut down")
+	}
+	t.pending.Add(1)
+	t.swapLock.Unlock()
+	// a swap accepted is sent and recorded even when the keepers are cancelled to shut down
+	ctx = client.WithPriority(utils.WithoutCancel(ctx), client.PriorityTrade)
+	sent := false
+	defer func() {
+		if !sent {
+			t.pending.Done()
+		}
+	}()
 	minGasPrice := int64(t.MinGasPrice())
 	if minGasPrice <= 0 {
 		return fmt.Errorf("gas price error %d", minGasPrice)
 	}
+	var (
+		weth        = t.config.WETHAddress
+		pairs       []common.Address
+		routes      = make([]*swaper.Route, 0, len(swaps))
+		inputAmount float64
+		gasLimit    = 70000 + t.flashGas()
+	)
+	for _, swap := range swaps {
+		for _, pair := range swap.Path {
+			pairs = append(pairs, pair.Address)
+		}
+		route, err := swaper.NewRoute(weth, swap.AmountIn, swap.Path)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, route)
+		inputAmount += swap.AmountIn
+		gasLimit += len(swap.Path) * 100000
+		if len(swaps) > 1 {
+			gasLimit += batchCycleGas
+		}
+	}
+	// a flash swap borrows its input from the first pair, the account spends no WETH
+	spend := inputAmount
+	if t.config.FlashSwap {
+		spend = 0
+	}
+	// the account is released once the swap receipt is read, or now if the swap is not sent
+	acc, err := t.accounts.acquire(pairs, spend)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !sent {
+			t.accounts.release(acc)
+		}
+	}()
 	call := ethereum.CallMsg{
-		From:     t.config.FromAddress,
+		From:     acc.address,
 		To:       &t.config.SwapAddress,
-		Gas:      uint64(70000 + len(pairPath)*100000),
+		Gas:      uint64(gasLimit),
 		GasPrice: big.NewInt(minGasPrice),
 	}
-	var (
-		inAddr          = t.config.WETHAddress
-		paramStr string = fmt.Sprintf("%020x", big.NewInt(int64(inputAmount)))
-	)
-	for _, pair := range pairPath {
-		var boolToInt int
-		if pair.Token0 == inAddr {
-			boolToInt = 1
-			inAddr = pair.Token1
-		} else {
-			inAddr = pair.Token0
-		}
-		paramStr += fmt.Sprintf("%040x%02x%04x", pair.Address, boolToInt, big.NewInt(pair.Fee))
+	switch {
+	case len(routes) > 1:
+		call.Data, err = swaper.SwapBatchData(routes)
+	case t.config.FlashSwap:
+		call.Data, err = swaper.FlashSwapData(routes[0])
+	default:
+		call.Data, err = swaper.SwapData(routes[0])
 	}
-	param, err := swapABI.Methods["swap"].Inputs.Pack(common.FromHex(paramStr))
 	if err != nil {
-		return fmt.Errorf("abi pack fail %s", err)
+		return err
 	}
-	call.Data = append(swapABI.Methods["swap"].ID, param...)
 
 	cli, err := client.GetETHClient(ctx, t.config.Node, t.config.MulticallAddress)
 	if err != nil {
@@ -205,66 +322,130 @@ func (t *Trader) SwapV2(ctx context.Context, inputAmount float64, pairPath []*pr
 		return fmt.Errorf("estimate gas fail %s %s", err, common.Bytes2Hex(call.Data))
 	}
 
-	nonce, err := cli.NonceAt(ctx, call.From, nil)
+	// final check, the tx is signed with the gas price bid
+	var amountOut, l1Fee float64
+	for _, swap := range swaps {
+		amountOut += protocol.GetAmountsOut(weth, swap.AmountIn, swap.Path)
+		l1Fee += t.ETHGasPrice() * swapBaseEthGas(len(swap.Path))
+	}
+	gasPrice, err := t.finalCheck(ctx, gasUsed, inputAmount, amountOut, l1Fee)
+	if err != nil {
+		return err
+	}
+	call.GasPrice = big.NewInt(gasPrice)
+
+	nonce, err := acc.nonces.get(ctx, cli, acc.address)
 	if err != nil {
-		return fmt.Errorf("get nonce fail %s", err)
+		return err
 	}
 	tx := types.NewTransaction(nonce, *call.To, big.NewInt(0), uint64(float64(gasUsed)*1.1), call.GasPrice, call.Data)
-	tx, err = types.SignTx(tx, t.signer, t.privateKey)
+	tx, err = acc.signer.SignTx(ctx, t.signer, tx)
 	if err != nil {
 		return fmt.Errorf("sign tx fail %s", err)
 	}
-	// final check
-	gasPrice, err := t.finalCheck(gasUsed, inputAmount, pairPath)
+	if inventory := acc.wallet.snapshot(); inventory != nil && inventory.ETH.Cmp(new(big.Int).Mul(new(big.Int).SetUint64(tx.Gas()), tx.GasPrice())) < 0 {
+		return fmt.Errorf("insufficient gas balance of %s %s wei", acc.address, inventory.ETH)
+	}
+	err = acc.wallet.reserve(tx.Hash(), spend)
 	if err != nil {
 		return err
 	}
-	call.GasPrice = big.NewInt(gasPrice)
 	// return nil
-	return cli.SendTransaction(ctx, tx)
+	err = cli.SendTransaction(ctx, tx)
+	if err != nil {
+		acc.wallet.settle(tx.Hash(), nil)
+		acc.nonces.reset()
+		return err
+	}
+	acc.nonces.commit(nonce)
+	sent = true
+	for _, swap := range swaps {
+		logger.Ctx(ctx).Warnf("send swap tx %s amountIn %s path %s", tx.Hash(), protocol.FormatAmount(weth, swap.AmountIn), protocol.FormatPath(weth, swap.Path))
+	}
+	t.trades.WithLabelValues("sent").Inc()
+	// a flash swap repays the first pair with the WETH input, not with the token borrowed, so
+	// the first hop pays the fee of a swap and the profit is the one of a swap
+	expected := amountOut - inputAmount - l1Fee
+	gasCost, _ := new(big.Int).Mul(new(big.Int).SetUint64(gasUsed), tx.GasPrice()).Float64()
+	t.profit.WithLabelValues("expected").Observe((expected - gasCost) / math.Pow10(18))
+	gasPriceValue, _ := tx.GasPrice().Float64()
+	t.ledger.add(&LedgerEntry{
+		Time:      time.Now(),
+		Trade:     utils.CorrelationID(ctx, "trade"),
+		Account:   acc.address,
+		Tx:        tx.Hash(),
+		Pairs:     pairs,
+		AmountIn:  inputAmount / math.Pow10(18),
+		AmountOut: amountOut / math.Pow10(18),
+		GasPrice:  gasPriceValue,
+		Expected:  (expected - gasCost) / math.Pow10(18),
+		Status:    "sent",
+		Flash:     t.config.FlashSwap,
+	})
+	watchCtx := utils.WithLogFields(context.Background(), utils.LogFields(ctx)...)
+	utils.SafeGo(client.WithPriority(watchCtx, client.PriorityBackground), "trader.receipt", func(ctx context.Context) {
+		defer t.pending.Done()
+		defer t.accounts.release(acc)
+		t.watchReceipt(ctx, acc, tx.Hash(), expected)
+	})
+	return nil
 }
 
-func (t *Trader) finalCheck(gasUsed uint64, inputAmount float64, pairPath []*protocol.UniswapV2Pair) (int64, error) {
+// finalCheck bids the gas price of the swaps of inputAmount returning amountOut, the l1 fee
+// is the one of their data
+func (t *Trader) finalCheck(ctx context.Context, gasUsed uint64, inputAmount, amountOut, l1Fee float64) (int64, error) {
 	// TODO base chain
-	amountOut := protocol.GetAmountsOut(t.config.WETHAddress, inputAmount, pairPath)
-	fee := (amountOut - inputAmount) / 1.2
-	maxGasPrice := t.gasPriceFromFee(len(pairPath), gasUsed, fee)
 	minGasPrice := t.MinGasPrice()
-	gasPrice := t.GasPrice()
-	if maxGasPrice < minGasPrice {
-		return 0, fmt.Errorf("final check fail amountIn %f amountOut %f gasUsed %d maxGasPrice %f gwei minGasPrice %f gwei eth gasPrice %f gwei", inputAmount/math.Pow10(18), amountOut/math.Pow10(18), gasUsed, maxGasPrice/math.Pow10(9), minGasPrice/math.Pow10(9), t.ETHGasPrice()/math.Pow10(9))
-	}
-	if maxGasPrice < gasPrice {
-		gasPrice = minGasPrice
-	} else if fee > 0.001 {
-		return 0, fmt.Errorf("final check danger amountIn %f amountOut %f gasUsed %d maxGasPrice %f gwei minGasPrice %f gwei eth gasPrice %f gwei", inputAmount/math.Pow10(18), amountOut/math.Pow10(18), gasUsed, maxGasPrice/math.Pow10(9), minGasPrice/math.Pow10(9), t.ETHGasPrice()/math.Pow10(9))
-	} else {
-		gasPrice = maxGasPrice
-	}
-	utils.Warnf("final check pass amountIn %f amountOut %f gasUsed %d passGasPrice %f gwei maxGasPrice %f gwei minGasPrice %f gwei eth gasPrice %f gwei", inputAmount/math.Pow10(18), amountOut/math.Pow10(18), gasUsed, gasPrice/math.Pow10(9), maxGasPrice/math.Pow10(9), minGasPrice/math.Pow10(9), t.ETHGasPrice()/math.Pow10(9))
+	gasPrice, err := t.strategy.GasBid(&strategy.Swap{
+		Profit:   amountOut - inputAmount,
+		Gas:      float64(gasUsed),
+		L1Fee:    l1Fee,
+		GasPrice: t.GasPrice(),
+	})
+	if err != nil {
+		status := "fail"
+		if errors.Is(err, strategy.ErrDanger) {
+			status = "danger"
+		}
+		t.finalChecks.WithLabelValues(status).Inc()
+		return 0, fmt.Errorf("final check %s amountIn %f amountOut %f gasUsed %d minGasPrice %f gwei eth gasPrice %f gwei", err, inputAmount/math.Pow10(18), amountOut/math.Pow10(18), gasUsed, minGasPrice/math.Pow10(9), t.ETHGasPrice()/math.Pow10(9))
+	}
+	t.finalChecks.WithLabelValues("pass").Inc()
+	logger.Ctx(ctx).Warnf("final check pass amountIn %f amountOut %f gasUsed %d passGasPrice %f gwei minGasPrice %f gwei eth gasPrice %f gwei", inputAmount/math.Pow10(18), amountOut/math.Pow10(18), gasUsed, gasPrice/math.Pow10(9), minGasPrice/math.Pow10(9), t.ETHGasPrice()/math.Pow10(9))
 	return int64(gasPrice), nil
 }
 
-func (t *Trader) gasPriceFromFee(length int, gasUsed uint64, fee float64) float64 {
+// feeSwap is the swap of length hops priced by the strategy before its gas is estimated
+func (t *Trader) feeSwap(length int) *strategy.Swap {
 	// TODO base chain
-	eGasPrice := t.ETHGasPrice()
-	eGas := swapBaseEthGas(length)
-	return (fee - (eGasPrice * eGas)) / float64(gasUsed)
+	return &strategy.Swap{
+		Gas:      swapGas(length) + float64(t.flashGas()),
+		L1Fee:    t.ETHGasPrice() * swapBaseEthGas(length),
+		GasPrice: t.GasPrice(),
+	}
 }
 
+// EstimateFee is the fee of a swap of length hops at the lowest bid
 func (t *Trader) EstimateFee(length int) float64 {
-	// TODO base chain
-	gasPrice := t.MinGasPrice()
-	eGasPrice := t.ETHGasPrice()
-	gas := swapGas(length)
-	eGas := swapBaseEthGas(length)
-	fee := gas*gasPrice + (eGasPrice * eGas)
-	return fee
+	swap := t.feeSwap(length)
+	return swap.Gas*t.MinGasPrice() + swap.L1Fee
+}
+
+// MinProfit is the least profit a cycle of length hops is traded for
+func (t *Trader) MinProfit(length int) float64 {
+	return t.strategy.MinProfit(t.feeSwap(length))
 }
 
 func (t *Trader) MinGasPrice() float64 {
-	// TODO base chain
-	return t.GasPrice() / 20
+	return t.strategy.MinGasPrice(t.GasPrice())
+}
+
+// ObserveWinners feeds the gas prices of the arbitrage txs others won in block to a learning
+// strategy
+func (t *Trader) ObserveWinners(block uint64, gasPrices []float64) {
+	if learner, ok := t.strategy.(strategy.Learner); ok {
+		learner.Observe(block, gasPrices)
+	}
 }
 
 func swapGas(length int) float64 {
@@ -282,6 +463,21 @@ func swapGas(length int) float64 {
 	}
 }
 
+const flashSwapGas = 60000
+
+// batchCycleGas is the gas swapBatch spends on each cycle above the swaps, the external call
+// isolating its revert and the params read
+const batchCycleGas = 30000
+
+// flashGas is the gas a flash swap spends above a swap, the callback, the first hop output
+// moved to the second pair and the repayment and profit transfers
+func (t *Trader) flashGas() int {
+	if t.config.FlashSwap {
+		return flashSwapGas
+	}
+	return 0
+}
+
 // TODO base chain
 func swapBaseEthGas(length int) float64 {
 	switch length {
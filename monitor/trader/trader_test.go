@@ -2,12 +2,27 @@ package trader
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
 	"fmt"
+	"math"
 	"math/big"
 	"monitor/config"
+	"monitor/protocol"
+	"monitor/swaper"
+	"monitor/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
 )
 
 func TestGasPrice(t *testing.T) {
@@ -49,4 +64,386 @@ func TestBytes(t *testing.T) {
 	}
 	t.Log(str)
 	t.Log(common.Bytes2Hex(common.FromHex(str)))
+	data, err := swaper.EncodeRoute(&swaper.Route{AmountIn: bi, Hops: pairs})
+	if err != nil || common.Bytes2Hex(data) != str {
+		t.Fatalf("encoded %x %v", data, err)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	weth, account, pair := common.Address{0x42}, common.Address{0xac}, common.Address{0xa1}
+	trader := NewTrader(context.Background(), &config.Config{WETHAddress: weth})
+	for i := 0; i < ledgerSize+1; i++ {
+		trader.ledger.add(&LedgerEntry{Tx: common.BigToHash(big.NewInt(int64(i))), Status: "sent", Expected: 0.01})
+	}
+	last := common.BigToHash(big.NewInt(ledgerSize))
+	updates := []LedgerEntry{}
+	trader.SubscribeLedger(func(entry LedgerEntry) {
+		updates = append(updates, entry)
+	})
+	trader.observeReceipt(logger, &types.Receipt{
+		TxHash:            last,
+		Status:            types.ReceiptStatusFailed,
+		GasUsed:           100000,
+		EffectiveGasPrice: big.NewInt(1e9),
+		BlockNumber:       big.NewInt(12),
+	}, account, 1e16)
+	entries := trader.Ledger(2)
+	if len(trader.Ledger(0)) != ledgerSize || len(entries) != 2 || entries[0].Tx != last {
+		t.Fatalf("entries %d %+v", len(trader.Ledger(0)), entries)
+	}
+	if entries[0].Status != "reverted" || entries[0].Block != 12 || *entries[0].Realized != -0.0001 || entries[1].Status != "sent" {
+		t.Fatalf("reverted entry %+v", entries[0])
+	}
+	if len(updates) != 1 || updates[0].Tx != last || updates[0].Status != "reverted" {
+		t.Fatalf("ledger updates %+v", updates)
+	}
+
+	// the realized profit is the weth moved into the account, not the expected one
+	transfer := func(token, from, to common.Address, value int64) *types.Log {
+		return &types.Log{
+			Address: token,
+			Topics:  []common.Hash{transferSign, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())},
+			Data:    common.BigToHash(big.NewInt(value)).Bytes(),
+		}
+	}
+	mined := common.BigToHash(big.NewInt(ledgerSize - 1))
+	trader.observeReceipt(logger, &types.Receipt{
+		TxHash:            mined,
+		Status:            types.ReceiptStatusSuccessful,
+		GasUsed:           100000,
+		EffectiveGasPrice: big.NewInt(1e9),
+		BlockNumber:       big.NewInt(13),
+		Logs: []*types.Log{
+			transfer(weth, account, pair, 1e16),
+			transfer(common.Address{0x01}, pair, account, 5e16),
+			transfer(weth, pair, account, 1.2e16),
+		},
+	}, account, 1e16)
+	entries = trader.Ledger(2)
+	if entries[1].Tx != mined || entries[1].Status != "mined" || entries[1].Block != 13 ||
+		math.Abs(*entries[1].Realized-0.0019) > 1e-12 {
+		t.Fatalf("mined entry %+v", entries[1])
+	}
+}
+
+func TestWallet(t *testing.T) {
+	var (
+		w     = &wallet{}
+		ether = math.Pow10(18)
+	)
+	if w.available() != 0 || w.snapshot() != nil {
+		t.Fatalf("wallet not read yet available %f", w.available())
+	}
+	inventory := func(block uint64, weth, allowance int64) *Inventory {
+		return &Inventory{
+			Block:     block,
+			WETH:      new(big.Int).Mul(big.NewInt(weth), big.NewInt(1e18)),
+			Allowance: new(big.Int).Mul(big.NewInt(allowance), big.NewInt(1e18)),
+			ETH:       big.NewInt(1e16),
+		}
+	}
+	// the allowance caps the balance
+	w.set(inventory(10, 3, 2))
+	if w.available() != 2*ether {
+		t.Fatalf("available %f", w.available()/ether)
+	}
+	w.set(inventory(10, 3, 5))
+	swap := common.HexToHash("0x01")
+	if err := w.reserve(swap, 4*ether); err == nil {
+		t.Fatalf("reserved above the balance")
+	}
+	if err := w.reserve(swap, 2*ether); err != nil || w.available() != ether || !w.unsettled() {
+		t.Fatalf("reserve %s available %f", err, w.available()/ether)
+	}
+	// the reservation holds until the wallet is read at the block the swap was mined in
+	w.settle(swap, big.NewInt(12))
+	w.set(inventory(11, 3, 5))
+	if w.available() != ether {
+		t.Fatalf("released before mined block %f", w.available()/ether)
+	}
+	w.set(inventory(12, 1, 5))
+	if w.available() != ether || w.snapshot().Reserved != 0 || w.unsettled() {
+		t.Fatalf("not released at mined block %+v", w.snapshot())
+	}
+	// a stale read is ignored
+	w.set(inventory(11, 3, 5))
+	if w.snapshot().Block != 12 {
+		t.Fatalf("stale read kept %+v", w.snapshot())
+	}
+	dropped := common.HexToHash("0x03")
+	if err := w.reserve(dropped, ether); err != nil {
+		t.Fatal(err)
+	}
+	w.settle(dropped, nil)
+	if w.available() != ether {
+		t.Fatalf("dropped swap kept %f", w.available()/ether)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	ether := math.Pow10(18)
+	list := []*account{{address: common.Address{0x01}}, {address: common.Address{0x02}}}
+	for i, acc := range list {
+		acc.wallet.set(&Inventory{
+			Block:     1,
+			WETH:      new(big.Int).Mul(big.NewInt(int64(i+1)), big.NewInt(1e18)),
+			Allowance: new(big.Int).Mul(big.NewInt(10), big.NewInt(1e18)),
+			ETH:       big.NewInt(1e16),
+		})
+	}
+	pool := newAccounts(list)
+	if pool.available() != 2*ether {
+		t.Fatalf("available %f", pool.available()/ether)
+	}
+	var (
+		pairA = common.Address{0xa1}
+		pairB = common.Address{0xa2}
+		pairC = common.Address{0xa3}
+	)
+	// the account with the most WETH takes the first cycle
+	first, err := pool.acquire([]common.Address{pairA, pairB}, 1.5*ether)
+	if err != nil || first != list[1] {
+		t.Fatalf("first %v %v", first, err)
+	}
+	if _, err := pool.acquire([]common.Address{pairB, pairC}, ether/2); err == nil {
+		t.Fatalf("cycle sharing a pair in flight dispatched")
+	}
+	if _, err := pool.acquire([]common.Address{pairC}, 1.5*ether); err == nil {
+		t.Fatalf("cycle above the idle inventory dispatched")
+	}
+	second, err := pool.acquire([]common.Address{pairC}, ether/2)
+	if err != nil || second != list[0] {
+		t.Fatalf("second %v %v", second, err)
+	}
+	if _, err := pool.acquire([]common.Address{{0xa4}}, 1); err == nil || pool.available() != 0 {
+		t.Fatalf("busy account dispatched")
+	}
+	if pool.acquireIdle(first) {
+		t.Fatalf("busy account taken for a wallet tx")
+	}
+	pool.release(first)
+	if _, err := pool.acquire([]common.Address{pairB}, ether); err != nil {
+		t.Fatalf("released pair refused %s", err)
+	}
+}
+
+func TestFlashSwap(t *testing.T) {
+	var (
+		wallet = NewTrader(context.Background(), &config.Config{})
+		flash  = NewTrader(context.Background(), &config.Config{FlashSwap: true})
+	)
+	for _, trader := range []*Trader{wallet, flash} {
+		trader.SetGasPrice(big.NewInt(2e9), big.NewInt(3e10))
+		// the accounts hold no WETH
+		trader.accounts = newAccounts([]*account{{address: common.Address{0x01}}})
+		trader.accounts.list[0].wallet.set(&Inventory{Block: 1, WETH: big.NewInt(0), Allowance: big.NewInt(0), ETH: big.NewInt(1e16)})
+	}
+	if extra := flash.EstimateFee(3) - wallet.EstimateFee(3); extra != flashSwapGas*flash.MinGasPrice() {
+		t.Fatalf("flash swap extra fee %f", extra)
+	}
+	if wallet.Available() != 0 || !math.IsInf(flash.Available(), 1) {
+		t.Fatalf("available wallet %f flash %f", wallet.Available(), flash.Available())
+	}
+	// a flash swap takes an idle account whatever its WETH
+	acc, err := flash.accounts.acquire([]common.Address{{0xa1}}, 0)
+	if err != nil || acc.address != (common.Address{0x01}) {
+		t.Fatalf("acquire %v %v", acc, err)
+	}
+	if flash.Available() != 0 {
+		t.Fatalf("available without idle account %f", flash.Available())
+	}
+	// the flash swap call takes a single cycle
+	swaps := []*Swap{{AmountIn: 1e18}, {AmountIn: 1e18}}
+	if err := flash.SwapBatch(context.Background(), swaps); err == nil || err.Error() != "flash swaps are not batched" {
+		t.Fatalf("flash batch %v", err)
+	}
+}
+
+func TestStrategy(t *testing.T) {
+	trader := NewTrader(context.Background(), &config.Config{})
+	trader.SetGasPrice(big.NewInt(2e9), big.NewInt(3e10))
+	// the default policy trades the cycles paying 1.5 times their fee at a twentieth of the gas price
+	if trader.MinGasPrice() != 1e8 || trader.MinProfit(3) != trader.EstimateFee(3)*1.5 {
+		t.Fatalf("min gas price %f min profit %f fee %f", trader.MinGasPrice(), trader.MinProfit(3), trader.EstimateFee(3))
+	}
+	competitive := NewTrader(context.Background(), &config.Config{Strategy: &config.Strategy{Competitive: &config.Competitive{}}})
+	competitive.SetGasPrice(big.NewInt(2e9), big.NewInt(3e10))
+	before := competitive.MinProfit(3)
+	competitive.ObserveWinners(10, []float64{4e9})
+	if competitive.MinProfit(3) <= before {
+		t.Fatalf("min profit %f not raised by a winner from %f", competitive.MinProfit(3), before)
+	}
+}
+
+func TestLoadAccounts(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		keys = []*ecdsa.PrivateKey{}
+	)
+	for i := 0; i < 3; i++ {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// the configured key is also stored, it is loaded once
+	for i, key := range keys[1:] {
+		keyJSON, err := keystore.EncryptKey(&keystore.Key{
+			Id:         uuid.New(),
+			Address:    crypto.PubkeyToAddress(key.PublicKey),
+			PrivateKey: key,
+		}, "secret", keystore.LightScryptN, keystore.LightScryptP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("key%d", i)), keyJSON, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := &config.Config{
+		FromAddress:        crypto.PubkeyToAddress(keys[0].PublicKey),
+		PrivateKey:         hex.EncodeToString(crypto.FromECDSA(keys[0])),
+		KeystoreDir:        dir,
+		KeystorePassphrase: "secret",
+	}
+	list, err := loadAccounts(context.Background(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("accounts %d", len(list))
+	}
+	for i, acc := range list {
+		if acc.address != crypto.PubkeyToAddress(keys[i].PublicKey) {
+			t.Fatalf("account %d %s", i, acc.address)
+		}
+	}
+
+	// the passphrase is read from the file, or prompted without one
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf.KeystorePassphrase, conf.KeystorePassphraseFile = "", passphraseFile
+	if list, err := loadAccounts(context.Background(), conf); err != nil || len(list) != 3 {
+		t.Fatalf("passphrase file %s", err)
+	}
+	prompted, restore := 0, promptPassphrase
+	defer func() {
+		promptPassphrase = restore
+	}()
+	promptPassphrase = func() (string, error) {
+		prompted++
+		return "wrong", nil
+	}
+	conf.KeystorePassphraseFile = ""
+	if _, err := loadAccounts(context.Background(), conf); err == nil || prompted != 1 {
+		t.Fatalf("wrong passphrase accepted %d", prompted)
+	}
+	conf.KeystoreDir, conf.FromAddress = "", common.Address{0x01}
+	if _, err := loadAccounts(context.Background(), conf); err == nil {
+		t.Fatalf("key of another address accepted")
+	}
+	if _, err := loadAccounts(context.Background(), &config.Config{}); err == nil {
+		t.Fatalf("no account accepted")
+	}
+}
+
+// lyingSigner claims an address but signs with another key
+type lyingSigner struct {
+	*KeySigner
+	address common.Address
+}
+
+func (s *lyingSigner) Address() common.Address {
+	return s.address
+}
+
+func TestRemoteSigner(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		local = NewKeySigner(key)
+		liar  = &lyingSigner{KeySigner: NewKeySigner(other), address: common.Address{0x01}}
+	)
+	handler, err := LocalSignerHandler(local, liar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	remotes, err := DialRemoteSigner(ctx, &config.RemoteSigner{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remotes) != 2 || remotes[0].Address() != local.Address() || remotes[1].Address() != liar.Address() {
+		t.Fatalf("remote accounts %+v", remotes)
+	}
+	signer := types.LatestSignerForChainID(big.NewInt(8453))
+	to := common.Address{0x02}
+	for _, tx := range []*types.Transaction{
+		types.NewTransaction(7, to, big.NewInt(1), 100000, big.NewInt(1e9), []byte{0x01, 0x02}),
+		types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(8453), Nonce: 8, GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(1e9), Gas: 100000, To: &to, Value: big.NewInt(0)}),
+	} {
+		signed, err := remotes[0].SignTx(ctx, signer, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := local.SignTx(ctx, signer, tx)
+		if signed.Hash() != want.Hash() {
+			t.Fatalf("remote signed %s local %s", signed.Hash(), want.Hash())
+		}
+	}
+	if _, err := remotes[1].SignTx(ctx, signer, types.NewTransaction(7, to, big.NewInt(1), 100000, big.NewInt(1e9), nil)); err == nil {
+		t.Fatalf("tx signed by another key accepted")
+	}
+
+	// the accounts of the remote signer are traded with the local key
+	list, err := loadAccounts(ctx, &config.Config{
+		PrivateKey:   hex.EncodeToString(crypto.FromECDSA(key)),
+		RemoteSigner: &config.RemoteSigner{URL: server.URL, Accounts: []common.Address{local.Address()}, Headers: map[string]string{"Authorization": "Bearer token"}},
+	})
+	if err != nil || len(list) != 1 {
+		t.Fatalf("accounts %d %v", len(list), err)
+	}
+	if _, err := DialRemoteSigner(ctx, &config.RemoteSigner{URL: server.URL}); err == nil {
+		t.Fatalf("unauthorized signer accounts read")
+	}
+}
+
+func TestShutDown(t *testing.T) {
+	trader := NewTrader(context.Background(), &config.Config{})
+	trader.SetGasPrice(big.NewInt(2e9), big.NewInt(3e10))
+	path := []*protocol.UniswapV2Pair{{Address: common.Address{0xa1}}}
+	// a swap not sent is no longer in flight, even with its context cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := trader.SwapV2(ctx, 1e18, path); err == nil {
+		t.Fatal("swap without account sent")
+	}
+	wait, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	if !utils.Wait(wait, &trader.pending) {
+		t.Fatal("swap not sent still pending")
+	}
+	trader.ShutDown(wait)
+	if err := trader.SwapV2(context.Background(), 1e18, path); err == nil || err.Error() != "trader shut down" {
+		t.Fatalf("swap after shut down %v", err)
+	}
 }
@@ -0,0 +1,436 @@
+package trader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"monitor/abi"
+	"monitor/client"
+	"monitor/utils"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// defaultMinGasBalance is the native balance in ether below which the low gas alert is raised
+const defaultMinGasBalance = 0.005
+
+var (
+	wethMetaData = `
+[
+    {
+        "type":"function",
+        "name":"deposit",
+        "stateMutability":"payable",
+        "inputs":[
+
+        ],
+        "outputs":[
+
+        ]
+    }
+]
+	`
+	wethDeposit []byte
+)
+
+func init() {
+	md := &bind.MetaData{
+		ABI: wethMetaData,
+	}
+	wethABI, err := md.GetAbi()
+	if err != nil {
+		panic(err)
+	}
+	wethDeposit = wethABI.Methods["deposit"].ID
+}
+
+// Inventory is a hot wallet read at a block, amounts in wei
+type Inventory struct {
+	Address   common.Address `json:"address"`
+	Block     uint64         `json:"block"`
+	Time      time.Time      `json:"time"`
+	WETH      *big.Int       `json:"weth"`
+	ETH       *big.Int       `json:"eth"`
+	Allowance *big.Int       `json:"allowance"`
+	// Reserved is the WETH of the swaps sent whose spend the balance does not show yet
+	Reserved  float64 `json:"reserved"`
+	Available float64 `json:"available"`
+	LowGas    bool    `json:"lowGas"`
+}
+
+// reservation is the input of a swap sent, it is held until the wallet is read at the
+// block the swap was mined in
+type reservation struct {
+	tx     common.Hash
+	amount float64
+	mined  uint64
+}
+
+// wallet keeps the last inventory read of an account and the swaps it does not account for yet
+type wallet struct {
+	lock         sync.Mutex
+	inventory    *Inventory
+	reservations []*reservation
+}
+
+func (w *wallet) set(inventory *Inventory) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.inventory != nil && inventory.Block < w.inventory.Block {
+		return
+	}
+	w.inventory = inventory
+	kept := w.reservations[:0]
+	for _, r := range w.reservations {
+		if r.mined == 0 || r.mined > inventory.Block {
+			kept = append(kept, r)
+		}
+	}
+	w.reservations = kept
+}
+
+// available is the WETH the next swap can spend, the balance capped by the allowance less
+// the reservations, 0 before the wallet is read
+func (w *wallet) available() float64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.availableLocked()
+}
+
+func (w *wallet) availableLocked() float64 {
+	if w.inventory == nil {
+		return 0
+	}
+	funds := w.inventory.WETH
+	if w.inventory.Allowance.Cmp(funds) < 0 {
+		funds = w.inventory.Allowance
+	}
+	available, _ := funds.Float64()
+	return math.Max(available-w.reservedLocked(), 0)
+}
+
+func (w *wallet) reservedLocked() float64 {
+	reserved := 0.0
+	for _, r := range w.reservations {
+		reserved += r.amount
+	}
+	return reserved
+}
+
+// reserve holds amount for tx when it is still available
+func (w *wallet) reserve(tx common.Hash, amount float64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if available := w.availableLocked(); amount > available {
+		return fmt.Errorf("insufficient inventory amountIn %f available %f", amount/math.Pow10(18), available/math.Pow10(18))
+	}
+	w.reservations = append(w.reservations, &reservation{tx: tx, amount: amount})
+	return nil
+}
+
+// settle keeps the reservation of tx until the wallet is read at block, a nil block drops it
+func (w *wallet) settle(tx common.Hash, block *big.Int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for i, r := range w.reservations {
+		if r.tx != tx {
+			continue
+		}
+		if block == nil || (w.inventory != nil && block.Uint64() <= w.inventory.Block) {
+			w.reservations = append(w.reservations[:i], w.reservations[i+1:]...)
+		} else {
+			r.mined = block.Uint64()
+		}
+		return
+	}
+}
+
+// unsettled tells whether a swap spend is not shown by the balance yet
+func (w *wallet) unsettled() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.reservations) > 0
+}
+
+// snapshot copies the last inventory read, nil before the wallet is read
+func (w *wallet) snapshot() *Inventory {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.inventory == nil {
+		return nil
+	}
+	ret := *w.inventory
+	ret.Reserved = w.reservedLocked()
+	ret.Available = w.availableLocked()
+	return &ret
+}
+
+// Available is the most WETH in wei an idle account can spend on the next swap, unbounded
+// for flash swaps while an account is idle
+func (t *Trader) Available() float64 {
+	if t.config.FlashSwap {
+		if t.accounts.idle() {
+			return math.Inf(1)
+		}
+		return 0
+	}
+	return t.accounts.available()
+}
+
+// Inventory returns the wallets of the accounts read, in account order
+func (t *Trader) Inventory() []*Inventory {
+	ret := []*Inventory{}
+	for _, acc := range t.accounts.list {
+		if inventory := acc.wallet.snapshot(); inventory != nil {
+			ret = append(ret, inventory)
+		}
+	}
+	return ret
+}
+
+func (t *Trader) minGasBalance() float64 {
+	if t.config.MinGasBalance > 0 {
+		return t.config.MinGasBalance
+	}
+	return defaultMinGasBalance
+}
+
+// loopWallet reads the wallets once per block, then keeps their gas and WETH topped up
+func (t *Trader) loopWallet(ctx context.Context) error {
+	var last uint64
+	for utils.Sleep(ctx, time.Second) {
+		cli, err := client.GetETHClient(ctx, t.config.Node, t.config.MulticallAddress)
+		if err != nil {
+			logger.Warnf("get eth client fail %s", err)
+			continue
+		}
+		blockNumber, err := cli.BlockNumber(ctx)
+		if err != nil {
+			logger.Warnf("get block number fail %s", err)
+			continue
+		}
+		if blockNumber <= last {
+			continue
+		}
+		if err := t.refreshWallets(ctx, blockNumber); err != nil {
+			logger.Warnf("refresh wallets fail %s", err)
+			continue
+		}
+		last = blockNumber
+		for _, acc := range t.accounts.list {
+			t.maintainWallet(ctx, acc)
+		}
+	}
+	return nil
+}
+
+// refreshWallets reads the balances and the allowance of the swap contract of every account
+// at blockNumber in one multicall
+func (t *Trader) refreshWallets(ctx context.Context, blockNumber uint64) error {
+	cli, err := client.GetETHClient(ctx, t.config.Node, t.config.MulticallAddress)
+	if err != nil {
+		return fmt.Errorf("get eth client fail %s", err)
+	}
+	calls := []*client.ViewCall{}
+	for _, acc := range t.accounts.list {
+		balanceOf, err := abi.ERC20ABIInstance.Pack("balanceOf", acc.address)
+		if err != nil {
+			return fmt.Errorf("pack balanceOf fail %s", err)
+		}
+		allowance, err := abi.ERC20ABIInstance.Pack("allowance", acc.address, t.config.SwapAddress)
+		if err != nil {
+			return fmt.Errorf("pack allowance fail %s", err)
+		}
+		ethBalance, err := abi.Multicall2ABIInstance.Pack("getEthBalance", acc.address)
+		if err != nil {
+			return fmt.Errorf("pack getEthBalance fail %s", err)
+		}
+		calls = append(calls,
+			&client.ViewCall{ID: "wallet-" + acc.address.Hex() + "-weth", To: t.config.WETHAddress, Data: balanceOf},
+			&client.ViewCall{ID: "wallet-" + acc.address.Hex() + "-allowance", To: t.config.WETHAddress, Data: allowance},
+			&client.ViewCall{ID: "wallet-" + acc.address.Hex() + "-eth", To: t.config.MulticallAddress, Data: ethBalance},
+		)
+	}
+	results, err := cli.MultiViewCallAt(ctx, new(big.Int).SetUint64(blockNumber), calls)
+	if err != nil {
+		return fmt.Errorf("multicall fail %s", err)
+	}
+	now := time.Now()
+	for _, acc := range t.accounts.list {
+		inventory := &Inventory{Address: acc.address, Block: blockNumber, Time: now}
+		for asset, value := range map[string]**big.Int{
+			"weth":      &inventory.WETH,
+			"allowance": &inventory.Allowance,
+			"eth":       &inventory.ETH,
+		} {
+			id := "wallet-" + acc.address.Hex() + "-" + asset
+			result := results[id]
+			if result == nil || !result.Success || len(result.ReturnData) != 32 {
+				return fmt.Errorf("%s call fail", id)
+			}
+			*value = new(big.Int).SetBytes(result.ReturnData)
+		}
+		eth, _ := inventory.ETH.Float64()
+		inventory.LowGas = eth/math.Pow10(18) < t.minGasBalance()
+		if inventory.LowGas && !acc.lowGas.Swap(true) {
+			logger.Errorf("gas balance of %s low %f eth below %f", acc.address, eth/math.Pow10(18), t.minGasBalance())
+		} else if !inventory.LowGas && acc.lowGas.Swap(false) {
+			logger.Infof("gas balance of %s restored %f eth", acc.address, eth/math.Pow10(18))
+		}
+		acc.wallet.set(inventory)
+		t.observeWallet(acc)
+	}
+	return nil
+}
+
+func (t *Trader) observeWallet(acc *account) {
+	inventory := acc.wallet.snapshot()
+	if inventory == nil {
+		return
+	}
+	address := acc.address.Hex()
+	weth, _ := inventory.WETH.Float64()
+	eth, _ := inventory.ETH.Float64()
+	allowance, _ := inventory.Allowance.Float64()
+	t.walletBalances.WithLabelValues(address, "weth").Set(weth / math.Pow10(18))
+	t.walletBalances.WithLabelValues(address, "eth").Set(eth / math.Pow10(18))
+	t.walletBalances.WithLabelValues(address, "allowance").Set(allowance / math.Pow10(18))
+	t.walletBalances.WithLabelValues(address, "reserved").Set(inventory.Reserved / math.Pow10(18))
+	lowGas := 0.0
+	if inventory.LowGas {
+		lowGas = 1
+	}
+	t.walletLowGas.WithLabelValues(address).Set(lowGas)
+}
+
+// maintainWallet wraps the native balance above the reserve and approves the swap contract,
+// only while the account is idle so the wallet tx does not hold up a swap
+func (t *Trader) maintainWallet(ctx context.Context, acc *account) {
+	inventory := acc.wallet.snapshot()
+	if inventory == nil || t.closed.Load() {
+		return
+	}
+	var (
+		to    common.Address
+		value = big.NewInt(0)
+		data  []byte
+		kind  string
+	)
+	reserve := new(big.Int).SetUint64(uint64(t.config.AutoWrapReserve * math.Pow10(18)))
+	if t.config.AutoWrapReserve > 0 && inventory.ETH.Cmp(new(big.Int).Mul(reserve, big.NewInt(2))) > 0 {
+		to, value, data, kind = t.config.WETHAddress, new(big.Int).Sub(inventory.ETH, reserve), wethDeposit, "wrap"
+	} else if t.config.AutoApprove && !t.config.FlashSwap && inventory.Allowance.Cmp(inventory.WETH) < 0 {
+		approve, err := abi.ERC20ABIInstance.Pack("approve", t.config.SwapAddress, new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1)))
+		if err != nil {
+			logger.Errorf("pack approve fail %s", err)
+			return
+		}
+		to, data, kind = t.config.WETHAddress, approve, "approve"
+	} else {
+		return
+	}
+	if !t.accounts.acquireIdle(acc) {
+		return
+	}
+	hash, err := t.sendWalletTx(ctx, acc, to, value, data)
+	if err != nil {
+		logger.Errorf("send %s tx of %s fail %s", kind, acc.address, err)
+		t.accounts.release(acc)
+		return
+	}
+	logger.Warnf("send %s tx %s of %s value %f", kind, hash, acc.address, new(big.Float).Quo(new(big.Float).SetInt(value), big.NewFloat(1e18)))
+	t.pending.Add(1)
+	utils.SafeGo(ctx, "trader.wallet.receipt", func(ctx context.Context) {
+		defer t.pending.Done()
+		defer t.accounts.release(acc)
+		receipt, err := t.waitReceipt(ctx, hash)
+		if err != nil {
+			acc.nonces.reset()
+			logger.Errorf("%s tx %s fail %s", kind, hash, err)
+			return
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			logger.Errorf("%s tx %s reverted", kind, hash)
+			return
+		}
+		if err := t.refreshWallets(ctx, receipt.BlockNumber.Uint64()); err != nil {
+			logger.Warnf("refresh wallets fail %s", err)
+		}
+	})
+}
+
+// sendWalletTx signs and sends a wallet maintenance tx of acc at the suggested gas price
+func (t *Trader) sendWalletTx(ctx context.Context, acc *account, to common.Address, value *big.Int, data []byte) (common.Hash, error) {
+	cli, err := client.GetETHClient(ctx, t.config.Node, t.config.MulticallAddress)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("get eth client fail %s", err)
+	}
+	gasPrice := new(big.Int).Set(t.gasPrice)
+	gasUsed, err := cli.EstimateGas(ctx, ethereum.CallMsg{
+		From:     acc.address,
+		To:       &to,
+		GasPrice: gasPrice,
+		Value:    value,
+		Data:     data,
+	})
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("estimate gas fail %s", err)
+	}
+	nonce, err := acc.nonces.get(ctx, cli, acc.address)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	tx := types.NewTransaction(nonce, to, value, uint64(float64(gasUsed)*1.2), gasPrice, data)
+	tx, err = acc.signer.SignTx(ctx, t.signer, tx)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("sign tx fail %s", err)
+	}
+	if err := cli.SendTransaction(ctx, tx); err != nil {
+		acc.nonces.reset()
+		return common.Hash{}, err
+	}
+	acc.nonces.commit(nonce)
+	return tx.Hash(), nil
+}
+
+// waitReceipt polls the receipt of hash until it is mined or receiptTimeout passes
+func (t *Trader) waitReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	deadline := time.Now().Add(receiptTimeout)
+	for time.Now().Before(deadline) && utils.Sleep(ctx, receiptInterval) {
+		cli, err := client.GetETHClient(ctx, t.config.Node, t.config.MulticallAddress)
+		if err != nil {
+			continue
+		}
+		receipt, err := cli.TransactionReceipt(ctx, hash)
+		if errors.Is(err, ethereum.NotFound) {
+			continue
+		}
+		if err != nil {
+			logger.Warnf("get receipt %s fail %s", hash, err)
+			continue
+		}
+		return receipt, nil
+	}
+	return nil, fmt.Errorf("no receipt after %s", receiptTimeout)
+}
+
+func (t *Trader) serveWallet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	inventory := t.Inventory()
+	if len(inventory) == 0 {
+		http.Error(w, "wallets not read yet", http.StatusServiceUnavailable)
+		return
+	}
+	utils.WriteJSON(w, inventory)
+}
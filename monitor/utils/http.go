@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// WriteJSON encodes value as the json body of the response
+func WriteJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		http.Error(w, "encode fail "+err.Error(), http.StatusInternalServerError)
+	}
+}
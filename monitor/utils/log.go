@@ -2,25 +2,21 @@ package utils
 
 import (
 	"fmt"
-	"time"
 )
 
+// Infof, Warnf and Errorf log with the logger of the calling package, so the package
+// levels of ConfigureLog apply to them
+
 func Infof(format string, a ...interface{}) {
-	a = append([]interface{}{time.Now()}, a...)
-	s := fmt.Sprintf("%s [info] "+format, a...)
-	LogWithColor(s, 32)
+	callerLogger(1).logf(LevelInfo, format, a...)
 }
 
 func Warnf(format string, a ...interface{}) {
-	a = append([]interface{}{time.Now()}, a...)
-	s := fmt.Sprintf("%s [warn] "+format, a...)
-	LogWithColor(s, 33)
+	callerLogger(1).logf(LevelWarn, format, a...)
 }
 
 func Errorf(format string, a ...interface{}) {
-	a = append([]interface{}{time.Now()}, a...)
-	s := fmt.Sprintf("%s [error] "+format, a...)
-	LogWithColor(s, 31)
+	callerLogger(1).logf(LevelError, format, a...)
 }
 
 func LogWithColor(s string, c int64) {
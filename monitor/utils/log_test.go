@@ -1,9 +1,94 @@
 package utils
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestLog(t *testing.T) {
 	Infof("abcd")
 	Warnf("test %d", 123)
 	Errorf("fail %s", "111")
 }
+
+func captureLog(t *testing.T, conf *LogConfig) *bytes.Buffer {
+	if err := ConfigureLog(conf); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	SetLogOutput(buf)
+	t.Cleanup(func() {
+		ConfigureLog(nil)
+		SetLogOutput(nil)
+	})
+	return buf
+}
+
+func TestLogFormat(t *testing.T) {
+	buf := captureLog(t, &LogConfig{Format: LogFormatJSON})
+	ctx := WithLogFields(context.Background(), F("trade", "ab12"))
+	NewLogger("trader").Ctx(ctx).With(F("amount", 1.5)).Warnf("send swap %d", 3)
+	line := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("%s %s", err, buf)
+	}
+	if line["level"] != "warn" || line["module"] != "trader" || line["msg"] != "send swap 3" || line["trade"] != "ab12" || line["amount"] != 1.5 {
+		t.Fatalf("json line %s", buf)
+	}
+
+	buf = captureLog(t, &LogConfig{Format: LogFormatLogfmt})
+	NewLogger("arbitrage").With(F("path", "a b")).Infof("found")
+	if !strings.Contains(buf.String(), ` level=info module=arbitrage msg=found path="a b"`) {
+		t.Fatalf("logfmt line %s", buf)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	buf := captureLog(t, &LogConfig{Format: LogFormatLogfmt, Levels: map[string]string{"utils": "warn"}})
+	Infof("silenced")
+	Warnf("kept")
+	NewLogger("other").Infof("other")
+	NewLogger("other").Debugf("debug")
+	out := buf.String()
+	if strings.Contains(out, "silenced") || !strings.Contains(out, "module=utils msg=kept") || !strings.Contains(out, "module=other msg=other") || strings.Contains(out, "debug") {
+		t.Fatalf("levels %s", out)
+	}
+	if err := ConfigureLog(&LogConfig{Level: "verbose"}); err == nil {
+		t.Fatalf("unknown level accepted")
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	buf := captureLog(t, &LogConfig{Format: LogFormatLogfmt, SampleFirst: 2, SampleThereafter: 3})
+	logger := NewLogger("onchainmonitor")
+	for i := 0; i < 8; i++ {
+		logger.Infof("on new logs %d", i)
+		logger.Warnf("handle fail %d", i)
+	}
+	if n := strings.Count(buf.String(), "on new logs"); n != 4 {
+		t.Fatalf("sampled %d lines %s", n, buf)
+	}
+	if n := strings.Count(buf.String(), "handle fail"); n != 8 {
+		t.Fatalf("warn sampled %d", n)
+	}
+
+	s := &logSampler{counts: map[string]int{}}
+	now := time.Unix(100, 0)
+	s.allow(now, "k", 1, 0)
+	if s.allow(now, "k", 1, 0) || !s.allow(now.Add(time.Second), "k", 1, 0) {
+		t.Fatalf("sampler not reset every second")
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	ctx := WithCorrelationID(context.Background(), "batch")
+	ctx = WithCorrelationID(ctx, "trade")
+	fields := LogFields(ctx)
+	if len(fields) != 2 || fields[0].Key != "batch" || fields[1].Key != "trade" || len(fields[1].Value.(string)) != 12 {
+		t.Fatalf("fields %+v", fields)
+	}
+}
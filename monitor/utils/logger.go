@@ -0,0 +1,388 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// levelColors are the ansi colors of the text format
+var levelColors = []int64{36, 32, 33, 31}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s", s)
+}
+
+const (
+	LogFormatText   = "text"
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+// LogConfig configures the output of every logger
+type LogConfig struct {
+	// Format is "text" (default, colored), "logfmt" or "json"
+	Format string
+	// Level is the minimum level logged, default info
+	Level string
+	// Levels overrides Level by package name, like "onchainmonitor": "warn"
+	Levels map[string]string
+	// SampleFirst and SampleThereafter sample the debug and info messages, every second the
+	// first SampleFirst messages of a format are logged then one in SampleThereafter,
+	// a zero SampleFirst disables sampling
+	SampleFirst      int
+	SampleThereafter int
+}
+
+type logSettings struct {
+	format           string
+	level            Level
+	levels           map[string]Level
+	sampleFirst      int
+	sampleThereafter int
+}
+
+var (
+	settings atomic.Pointer[logSettings]
+
+	output     io.Writer = os.Stdout
+	outputLock sync.Mutex
+
+	sampler = &logSampler{counts: map[string]int{}}
+
+	// callerModules caches the package name of the callers of the legacy helpers
+	callerModules sync.Map
+)
+
+func init() {
+	settings.Store(&logSettings{format: LogFormatText, level: LevelInfo})
+}
+
+// ConfigureLog replaces the log settings, a nil config restores the defaults
+func ConfigureLog(conf *LogConfig) error {
+	s := &logSettings{format: LogFormatText, level: LevelInfo, levels: map[string]Level{}}
+	if conf == nil {
+		settings.Store(s)
+		return nil
+	}
+	switch conf.Format {
+	case "":
+	case LogFormatText, LogFormatLogfmt, LogFormatJSON:
+		s.format = conf.Format
+	default:
+		return fmt.Errorf("unknown log format %s", conf.Format)
+	}
+	if len(conf.Level) > 0 {
+		level, err := ParseLevel(conf.Level)
+		if err != nil {
+			return err
+		}
+		s.level = level
+	}
+	for module, name := range conf.Levels {
+		level, err := ParseLevel(name)
+		if err != nil {
+			return fmt.Errorf("package %s %s", module, err)
+		}
+		s.levels[module] = level
+	}
+	s.sampleFirst, s.sampleThereafter = conf.SampleFirst, conf.SampleThereafter
+	settings.Store(s)
+	return nil
+}
+
+// SetLogOutput replaces stdout as the log output, nil restores stdout
+func SetLogOutput(w io.Writer) {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	if w == nil {
+		w = os.Stdout
+	}
+	output = w
+}
+
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+type logFieldsKey struct{}
+
+// WithLogFields adds fields to the messages logged with the context
+func WithLogFields(ctx context.Context, fields ...Field) context.Context {
+	parent := LogFields(ctx)
+	merged := make([]Field, 0, len(parent)+len(fields))
+	merged = append(append(merged, parent...), fields...)
+	return context.WithValue(ctx, logFieldsKey{}, merged)
+}
+
+func LogFields(ctx context.Context) []Field {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(logFieldsKey{}).([]Field)
+	return fields
+}
+
+// WithCorrelationID adds a random id under key, the messages of one batch or one trade
+// are found by it across the keepers
+func WithCorrelationID(ctx context.Context, key string) context.Context {
+	return WithLogFields(ctx, F(key, NewCorrelationID()))
+}
+
+// CorrelationID returns the id added under key, empty when there is none
+func CorrelationID(ctx context.Context, key string) string {
+	fields := LogFields(ctx)
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].Key == key {
+			id, _ := fields[i].Value.(string)
+			return id
+		}
+	}
+	return ""
+}
+
+func NewCorrelationID() string {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Logger logs the messages of a package with its fields
+type Logger struct {
+	module string
+	fields []Field
+}
+
+func NewLogger(module string) *Logger {
+	return &Logger{module: module}
+}
+
+func (l *Logger) With(fields ...Field) *Logger {
+	merged := make([]Field, 0, len(l.fields)+len(fields))
+	merged = append(append(merged, l.fields...), fields...)
+	return &Logger{module: l.module, fields: merged}
+}
+
+// Ctx adds the fields of the context
+func (l *Logger) Ctx(ctx context.Context) *Logger {
+	fields := LogFields(ctx)
+	if len(fields) == 0 {
+		return l
+	}
+	return l.With(fields...)
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	s := settings.Load()
+	min, ok := s.levels[l.module]
+	if !ok {
+		min = s.level
+	}
+	return level >= min
+}
+
+func (l *Logger) Debugf(format string, a ...interface{}) {
+	l.logf(LevelDebug, format, a...)
+}
+
+func (l *Logger) Infof(format string, a ...interface{}) {
+	l.logf(LevelInfo, format, a...)
+}
+
+func (l *Logger) Warnf(format string, a ...interface{}) {
+	l.logf(LevelWarn, format, a...)
+}
+
+func (l *Logger) Errorf(format string, a ...interface{}) {
+	l.logf(LevelError, format, a...)
+}
+
+func (l *Logger) logf(level Level, format string, a ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	s := settings.Load()
+	now := time.Now()
+	if level <= LevelInfo && s.sampleFirst > 0 && !sampler.allow(now, l.module+format, s.sampleFirst, s.sampleThereafter) {
+		return
+	}
+	msg := fmt.Sprintf(format, a...)
+	var line []byte
+	switch s.format {
+	case LogFormatJSON:
+		line = l.encodeJSON(now, level, msg)
+	case LogFormatLogfmt:
+		line = l.encodeLogfmt(now, level, msg)
+	default:
+		line = l.encodeText(now, level, msg)
+	}
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	output.Write(line)
+}
+
+// encodeText keeps the colored lines of the first helpers, the fields follow the message
+func (l *Logger) encodeText(now time.Time, level Level, msg string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "\033[1;%d;40m%s [%s] %s", levelColors[level], now, level, msg)
+	for _, field := range l.fields {
+		b.WriteByte(' ')
+		b.WriteString(field.Key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(field.Value))
+	}
+	b.WriteString("\033[0m\n")
+	return b.Bytes()
+}
+
+func (l *Logger) encodeLogfmt(now time.Time, level Level, msg string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "time=%s level=%s", now.Format(time.RFC3339Nano), level)
+	if len(l.module) > 0 {
+		fmt.Fprintf(&b, " module=%s", l.module)
+	}
+	fmt.Fprintf(&b, " msg=%s", logfmtValue(msg))
+	for _, field := range l.fields {
+		fmt.Fprintf(&b, " %s=%s", field.Key, logfmtValue(field.Value))
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func (l *Logger) encodeJSON(now time.Time, level Level, msg string) []byte {
+	var b bytes.Buffer
+	writeJSONField(&b, "time", now.Format(time.RFC3339Nano), true)
+	writeJSONField(&b, "level", level.String(), false)
+	if len(l.module) > 0 {
+		writeJSONField(&b, "module", l.module, false)
+	}
+	writeJSONField(&b, "msg", msg, false)
+	for _, field := range l.fields {
+		writeJSONField(&b, field.Key, field.Value, false)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+func writeJSONField(b *bytes.Buffer, key string, value interface{}, first bool) {
+	if first {
+		b.WriteByte('{')
+	} else {
+		b.WriteByte(',')
+	}
+	k, _ := json.Marshal(key)
+	b.Write(k)
+	b.WriteByte(':')
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	body, err := json.Marshal(value)
+	if err != nil {
+		body, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(body)
+}
+
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if len(s) == 0 || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// logSampler counts the messages of every format within the current second
+type logSampler struct {
+	lock   sync.Mutex
+	second int64
+	counts map[string]int
+}
+
+func (s *logSampler) allow(now time.Time, key string, first, thereafter int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if second := now.Unix(); second != s.second {
+		s.second = second
+		s.counts = map[string]int{}
+	}
+	s.counts[key]++
+	n := s.counts[key]
+	if n <= first {
+		return true
+	}
+	return thereafter > 0 && (n-first)%thereafter == 0
+}
+
+// callerLogger is the logger of the package calling the legacy helpers, skip frames above it
+func callerLogger(skip int) *Logger {
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return defaultLogger
+	}
+	if logger, ok := callerModules.Load(pc); ok {
+		return logger.(*Logger)
+	}
+	logger := NewLogger(packageName(runtime.FuncForPC(pc)))
+	callerModules.Store(pc, logger)
+	return logger
+}
+
+// packageName is the last element of the package path of a function,
+// "monitor/onchainmonitor.(*EVMMonitor).onNewLogs" gives "onchainmonitor"
+func packageName(fn *runtime.Func) string {
+	if fn == nil {
+		return ""
+	}
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+var defaultLogger = NewLogger("")
@@ -9,7 +9,7 @@ import (
 func Retry(ctx context.Context, function func(context.Context) error, waitTime time.Duration, retyCount int64) error {
 	var retryLeftCount = retyCount
 	for {
-		err := function(ctx)
+		err := Protect(ctx, "retry", function)
 		if err == nil {
 			return nil
 		}
@@ -20,6 +20,8 @@ func Retry(ctx context.Context, function func(context.Context) error, waitTime t
 			}
 		}
 		Infof("try function fail, waiting for retry %d %s", retryLeftCount, err)
-		<-time.After(waitTime)
+		if !Sleep(ctx, waitTime) {
+			return fmt.Errorf("retry stopped %s", ctx.Err())
+		}
 	}
 }
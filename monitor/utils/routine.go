@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"monitor/metrics"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the restart backoff of a routine doubles between these bounds
+var (
+	restartMinBackoff = time.Second
+	restartMaxBackoff = time.Minute
+)
+
+var (
+	routineLogger = NewLogger("routine")
+
+	routinePanics = metrics.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "routine",
+		Name:      "panics_total",
+		Help:      "Panics recovered by routine.",
+	}, "routine")
+	routineRestarts = metrics.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "routine",
+		Name:      "restarts_total",
+		Help:      "Restarts of the supervised loops by routine.",
+	}, "routine")
+)
+
+// PanicError is the error of a routine recovered from a panic
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic %v", e.Value)
+}
+
+// Protect runs f and turns a panic into a PanicError, the stack is logged with the
+// fields of ctx and the panic counted under name
+func Protect(ctx context.Context, name string, f func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := &PanicError{Value: r, Stack: debug.Stack()}
+			routinePanics.WithLabelValues(name).Inc()
+			routineLogger.Ctx(ctx).With(F("routine", name)).Errorf("%s\n%s", panicErr, panicErr.Stack)
+			err = panicErr
+		}
+	}()
+	return f(ctx)
+}
+
+// SafeGo runs f once in a goroutine, a panic is recovered and logged instead of
+// crashing the process
+func SafeGo(ctx context.Context, name string, f func(ctx context.Context)) {
+	go Protect(ctx, name, func(ctx context.Context) error {
+		f(ctx)
+		return nil
+	})
+}
+
+// Go runs f until ctx is done, f is restarted with a growing jittered backoff when it
+// returns an error early or panics. Under a supervised context the routine is reported
+// in the keeper health and waited for by ShutDown
+func Go(ctx context.Context, name string, f func(ctx context.Context) error) {
+	k, _ := ctx.Value(supervisedKey{}).(*supervised)
+	routine := &RoutineHealth{Name: name, Running: true}
+	if k != nil {
+		k.lock.Lock()
+		k.routines = append(k.routines, routine)
+		k.lock.Unlock()
+		k.wait.Add(1)
+	}
+	update := func(f func()) {
+		if k != nil {
+			k.lock.Lock()
+			defer k.lock.Unlock()
+		}
+		f()
+	}
+	go func() {
+		defer func() {
+			update(func() {
+				routine.Running = false
+			})
+			if k != nil {
+				k.wait.Done()
+			}
+		}()
+		backoff := restartMinBackoff
+		for {
+			startTime := time.Now()
+			err := Protect(ctx, name, f)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			// a routine running a while before failing starts its backoff over
+			if time.Since(startTime) > restartMaxBackoff {
+				backoff = restartMinBackoff
+			}
+			wait := jitter(backoff)
+			routineLogger.Ctx(ctx).Warnf("routine %s fail %s, restart in %s", name, err, wait)
+			routineRestarts.WithLabelValues(name).Inc()
+			update(func() {
+				routine.Restarts++
+				routine.LastError, routine.LastErrorAt = err.Error(), time.Now()
+				if _, ok := err.(*PanicError); ok {
+					routine.Panics++
+				}
+			})
+			if !Sleep(ctx, wait) {
+				return
+			}
+			if backoff *= 2; backoff > restartMaxBackoff {
+				backoff = restartMaxBackoff
+			}
+		}
+	}()
+}
+
+// jitter spreads the waits of the routines failing together between half and all of d
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Sleep waits for d, it returns false when ctx is done first
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Wait waits for wg, it returns false when ctx is done first
+func Wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-done:
+		return true
+	}
+}
+
+// WithoutCancel keeps the values of ctx but not its cancel nor deadline, the work started
+// before a shut down is then done
+func WithoutCancel(ctx context.Context) context.Context {
+	return withoutCancel{ctx}
+}
+
+type withoutCancel struct {
+	parent context.Context
+}
+
+func (withoutCancel) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (withoutCancel) Done() <-chan struct{}       { return nil }
+func (withoutCancel) Err() error                  { return nil }
+
+func (c withoutCancel) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProtect(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetLogOutput(buf)
+	defer SetLogOutput(nil)
+
+	before := testutil.ToFloat64(routinePanics.WithLabelValues("test.protect"))
+	ctx := WithLogFields(context.Background(), F("pair", "0x01"))
+	err := Protect(ctx, "test.protect", func(context.Context) error {
+		panic("boom")
+	})
+	panicErr, ok := err.(*PanicError)
+	if !ok || panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+		t.Fatal(err)
+	}
+	if after := testutil.ToFloat64(routinePanics.WithLabelValues("test.protect")); after != before+1 {
+		t.Fatal(before, after)
+	}
+	out := buf.String()
+	for _, s := range []string{"panic boom", "pair=0x01", "routine=test.protect", "routine_test.go"} {
+		if !strings.Contains(out, s) {
+			t.Fatal(s, out)
+		}
+	}
+
+	err = Protect(ctx, "test.protect", func(context.Context) error {
+		return fmt.Errorf("plain")
+	})
+	if err == nil || err.Error() != "plain" {
+		t.Fatal(err)
+	}
+}
+
+func TestGoPanic(t *testing.T) {
+	SetLogOutput(&bytes.Buffer{})
+	defer SetLogOutput(nil)
+	restartMinBackoff, restartMaxBackoff = time.Millisecond, 4*time.Millisecond
+	defer func() {
+		restartMinBackoff, restartMaxBackoff = time.Second, time.Minute
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	k := &supervised{}
+	ctx = context.WithValue(ctx, supervisedKey{}, k)
+	runs := int32(0)
+	Go(ctx, "test.panic", func(ctx context.Context) error {
+		if atomic.AddInt32(&runs, 1) < 3 {
+			panic("boom")
+		}
+		<-ctx.Done()
+		return nil
+	})
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&runs) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("routine not restarted after panic")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	k.wait.Wait()
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	routine := k.routines[0]
+	if routine.Running || routine.Restarts != 2 || routine.Panics != 2 || routine.LastError != "panic boom" {
+		t.Fatalf("%+v", routine)
+	}
+}
+
+func TestSafeGo(t *testing.T) {
+	SetLogOutput(&bytes.Buffer{})
+	defer SetLogOutput(nil)
+	done := make(chan struct{})
+	SafeGo(context.Background(), "test.safe", func(context.Context) {
+		defer close(done)
+		panic("boom")
+	})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("routine not run")
+	}
+}
+
+func TestRetryPanic(t *testing.T) {
+	SetLogOutput(&bytes.Buffer{})
+	defer SetLogOutput(nil)
+	c := 0
+	err := Retry(context.Background(), func(context.Context) error {
+		c++
+		if c < 3 {
+			panic("boom")
+		}
+		return nil
+	}, time.Millisecond, -1)
+	if err != nil || c != 3 {
+		t.Fatal(err, c)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < time.Second/2 || d > time.Second {
+			t.Fatal(d)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if Wait(ctx, &wg) {
+		t.Fatal("waited for a running group")
+	}
+	wg.Done()
+	if !Wait(context.Background(), &wg) {
+		t.Fatal("done group not waited")
+	}
+}
+
+func TestWithoutCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(WithCorrelationID(context.Background(), "trade"))
+	detached := WithoutCancel(ctx)
+	cancel()
+	if detached.Err() != nil || detached.Done() != nil {
+		t.Fatal("detached context cancelled")
+	}
+	if CorrelationID(detached, "trade") != CorrelationID(ctx, "trade") {
+		t.Fatal("detached context values lost")
+	}
+}
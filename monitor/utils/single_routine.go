@@ -10,10 +10,11 @@ func NewSingleRoutine(ctx context.Context) *SingleRoutine {
 	return &SingleRoutine{}
 }
 
+// Run cancels the routine run before and runs f instead, a panic of f is recovered
 func (r *SingleRoutine) Run(ctx context.Context, f func(context.Context)) {
 	if r.cancel != nil {
 		r.cancel()
 	}
 	ctx, r.cancel = context.WithCancel(ctx)
-	go f(ctx)
+	SafeGo(ctx, "single", f)
 }
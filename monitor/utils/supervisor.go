@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownTimeout bounds the ShutDown of every keeper
+const DefaultShutdownTimeout = 30 * time.Second
+
+const (
+	KeeperStarting = "starting"
+	KeeperRunning  = "running"
+	KeeperFailed   = "failed"
+	KeeperStopping = "stopping"
+	KeeperStopped  = "stopped"
+)
+
+// Checker is a keeper reporting its own health, an error marks it unhealthy
+type Checker interface {
+	Check() error
+}
+
+type RoutineHealth struct {
+	Name        string    `json:"name"`
+	Running     bool      `json:"running"`
+	Restarts    int       `json:"restarts"`
+	Panics      int       `json:"panics"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitempty"`
+}
+
+type KeeperHealth struct {
+	Name      string           `json:"name"`
+	State     string           `json:"state"`
+	Healthy   bool             `json:"healthy"`
+	Error     string           `json:"error,omitempty"`
+	StartedAt time.Time        `json:"startedAt,omitempty"`
+	Routines  []*RoutineHealth `json:"routines"`
+}
+
+// Supervisor starts the keepers in the order they are added, each with a context of its
+// own, and shuts them down in reverse, cancelling the context before calling ShutDown
+type Supervisor struct {
+	timeout time.Duration
+	keepers []*supervised
+}
+
+type supervised struct {
+	name      string
+	keeper    Keeper
+	cancel    context.CancelFunc
+	state     string
+	err       error
+	startedAt time.Time
+	routines  []*RoutineHealth
+	// wait counts the routines started with Go
+	wait sync.WaitGroup
+	lock sync.Mutex
+}
+
+type supervisedKey struct{}
+
+func NewSupervisor(timeout time.Duration) *Supervisor {
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	return &Supervisor{timeout: timeout}
+}
+
+func (s *Supervisor) Add(name string, keeper Keeper) {
+	s.keepers = append(s.keepers, &supervised{name: name, keeper: keeper, state: KeeperStarting})
+}
+
+// Start inits the keepers one after another and stops at the first failure,
+// ShutDown stops the keepers started
+func (s *Supervisor) Start(ctx context.Context) error {
+	for _, k := range s.keepers {
+		kctx, cancel := context.WithCancel(ctx)
+		kctx = context.WithValue(kctx, supervisedKey{}, k)
+		k.lock.Lock()
+		k.cancel = cancel
+		k.lock.Unlock()
+		err := k.keeper.Init(kctx)
+		k.lock.Lock()
+		if err != nil {
+			k.state, k.err = KeeperFailed, err
+		} else {
+			k.state, k.startedAt = KeeperRunning, time.Now()
+		}
+		k.lock.Unlock()
+		if err != nil {
+			return fmt.Errorf("init keeper %s fail %s", k.name, err)
+		}
+		Infof("keeper %s started", k.name)
+	}
+	return nil
+}
+
+// ShutDown stops the keepers in reverse order, the routines of a keeper are waited for
+// before its ShutDown, a keeper not done within the timeout is left behind so the next
+// ones still stop
+func (s *Supervisor) ShutDown(ctx context.Context) {
+	for i := len(s.keepers) - 1; i >= 0; i-- {
+		k := s.keepers[i]
+		k.lock.Lock()
+		cancel := k.cancel
+		if cancel == nil || k.state == KeeperStopped {
+			k.lock.Unlock()
+			continue
+		}
+		k.state = KeeperStopping
+		k.lock.Unlock()
+
+		cancel()
+		sctx, scancel := context.WithTimeout(ctx, s.timeout)
+		done := make(chan struct{})
+		go func() {
+			k.wait.Wait()
+			k.keeper.ShutDown(sctx)
+			close(done)
+		}()
+		select {
+		case <-done:
+			Infof("keeper %s stopped", k.name)
+		case <-sctx.Done():
+			Errorf("keeper %s not stopped within %s", k.name, s.timeout)
+		}
+		scancel()
+		k.lock.Lock()
+		k.state = KeeperStopped
+		k.lock.Unlock()
+	}
+}
+
+// Health reports every keeper, a running keeper is healthy unless its Check fails
+func (s *Supervisor) Health() []*KeeperHealth {
+	ret := make([]*KeeperHealth, 0, len(s.keepers))
+	for _, k := range s.keepers {
+		k.lock.Lock()
+		health := &KeeperHealth{
+			Name:      k.name,
+			State:     k.state,
+			Healthy:   k.state == KeeperRunning,
+			StartedAt: k.startedAt,
+			Routines:  make([]*RoutineHealth, 0, len(k.routines)),
+		}
+		if k.err != nil {
+			health.Error = k.err.Error()
+		}
+		for _, routine := range k.routines {
+			one := *routine
+			health.Routines = append(health.Routines, &one)
+		}
+		k.lock.Unlock()
+		if checker, ok := k.keeper.(Checker); ok && health.Healthy {
+			if err := checker.Check(); err != nil {
+				health.Healthy, health.Error = false, err.Error()
+			}
+		}
+		ret = append(ret, health)
+	}
+	return ret
+}
+
+// Handler serves the health of the keepers at GET /health, 503 when one is unhealthy
+func (s *Supervisor) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		health := s.Health()
+		for _, one := range health {
+			if !one.Healthy {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				break
+			}
+		}
+		WriteJSON(w, health)
+	})
+}
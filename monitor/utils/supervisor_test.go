@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testKeeper struct {
+	name     string
+	events   *[]string
+	lock     *sync.Mutex
+	initErr  error
+	block    chan struct{}
+	check    error
+	routines int
+}
+
+func (k *testKeeper) record(event string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	*k.events = append(*k.events, event+" "+k.name)
+}
+
+func (k *testKeeper) Init(ctx context.Context) error {
+	k.record("init")
+	if k.initErr != nil {
+		return k.initErr
+	}
+	Go(ctx, k.name+".loop", func(ctx context.Context) error {
+		k.lock.Lock()
+		k.routines++
+		runs := k.routines
+		k.lock.Unlock()
+		if runs < 3 {
+			return fmt.Errorf("run %d", runs)
+		}
+		<-ctx.Done()
+		k.record("loop done")
+		return nil
+	})
+	return nil
+}
+
+func (k *testKeeper) ShutDown(ctx context.Context) {
+	if k.block != nil {
+		<-k.block
+	}
+	k.record("shutdown")
+}
+
+func (k *testKeeper) Check() error {
+	return k.check
+}
+
+func TestSupervisor(t *testing.T) {
+	restartMinBackoff, restartMaxBackoff = time.Millisecond, 4*time.Millisecond
+	defer func() {
+		restartMinBackoff, restartMaxBackoff = time.Second, time.Minute
+	}()
+	var (
+		events = []string{}
+		lock   = &sync.Mutex{}
+		a      = &testKeeper{name: "a", events: &events, lock: lock}
+		b      = &testKeeper{name: "b", events: &events, lock: lock, block: make(chan struct{})}
+		s      = NewSupervisor(50 * time.Millisecond)
+	)
+	s.Add("a", a)
+	s.Add("b", b)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the loops fail twice before running
+	deadline := time.Now().Add(time.Second)
+	for {
+		lock.Lock()
+		runs := a.routines
+		if b.routines < runs {
+			runs = b.routines
+		}
+		lock.Unlock()
+		if runs >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("loop not restarted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	health := s.Health()
+	if len(health) != 2 || !health[0].Healthy || health[0].State != KeeperRunning || health[0].Routines[0].Restarts != 2 || health[0].Routines[0].LastError != "run 2" {
+		t.Fatalf("health %+v %+v", health[0], health[0].Routines[0])
+	}
+
+	b.check = fmt.Errorf("stuck")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil || w.Code != http.StatusServiceUnavailable || health[1].Healthy || health[1].Error != "stuck" {
+		t.Fatalf("health %d %s", w.Code, w.Body)
+	}
+
+	// b blocks in ShutDown past the timeout, a is still stopped after it
+	s.ShutDown(context.Background())
+	defer close(b.block)
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{"init a", "init b", "loop done b", "loop done a", "shutdown a"}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Fatalf("events %v", events)
+	}
+	if health := s.Health(); health[0].State != KeeperStopped || health[0].Routines[0].Running {
+		t.Fatalf("health after shutdown %+v", health[0])
+	}
+}
+
+func TestSupervisorInitFail(t *testing.T) {
+	var (
+		events = []string{}
+		lock   = &sync.Mutex{}
+		s      = NewSupervisor(time.Second)
+	)
+	s.Add("a", &testKeeper{name: "a", events: &events, lock: lock, routines: 2})
+	s.Add("b", &testKeeper{name: "b", events: &events, lock: lock, initErr: fmt.Errorf("no node")})
+	s.Add("c", &testKeeper{name: "c", events: &events, lock: lock})
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatalf("init fail not returned")
+	}
+	if health := s.Health(); health[1].State != KeeperFailed || health[1].Error != "no node" || health[2].State != KeeperStarting {
+		t.Fatalf("health %+v", health)
+	}
+	s.ShutDown(context.Background())
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{"init a", "init b", "shutdown b", "loop done a", "shutdown a"}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Fatalf("events %v", events)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if Sleep(ctx, time.Hour) {
+		t.Fatalf("sleep not stopped")
+	}
+	if !Sleep(context.Background(), time.Millisecond) {
+		t.Fatalf("sleep stopped")
+	}
+}
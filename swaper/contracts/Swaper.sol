@@ -4,11 +4,14 @@ pragma solidity ^0.8.9;
 interface IERC20 {
     function balanceOf(address account) external view returns (uint256);
     function transferFrom(address from, address to, uint256 amount) external returns (bool);
+    function transfer(address to, uint256 amount) external returns (bool);
 }
 
 interface IUniswapV2Pair {
     function getReserves() external view returns (uint112 reserve0, uint112 reserve1, uint32 blockTimestampLast);
     function swap(uint amount0Out, uint amount1Out, address to, bytes calldata data) external;
+    function token0() external view returns (address);
+    function token1() external view returns (address);
 }
 
 contract Swaper {
@@ -17,6 +20,8 @@ contract Swaper {
 
     address immutable account;
     address immutable weth;
+    // flashPair is the pair lending the flash swap in progress, the only caller of uniswapV2Call
+    address flashPair;
 
     struct Route {
         address pair;
@@ -25,6 +30,9 @@ contract Swaper {
         // uint256 amountOut;
     }
 
+    // CycleSkipped is emitted for the cycles of a batch reverted or below their min profit
+    event CycleSkipped(uint256 index);
+
     constructor (address _account, address _weth) {
         account = _account;
         weth = _weth;
@@ -54,16 +62,144 @@ contract Swaper {
             routes[i].direction = direction == 0 ? false : true ;
             routes[i].fee = fee;
         }
-        _swap(amountIn, routes);
+        _swap(amountIn, 0, routes);
+    }
+
+    // swapBatch runs several cycles in one call, a cycle reverting or below its min profit is
+    // skipped, the call reverts only when every cycle is skipped
+    // params: count(1) then per cycle amountIn(10) minProfit(10) length(1) and length hops of
+    // pair(20) direction(1) fee(2)
+    function swapBatch(bytes memory params) external {
+        uint256 end;
+        uint256 cursor;
+        uint8 count;
+        assembly {
+            end := add(add(params, 32), mload(params))
+            cursor := add(params, 32)
+            count := shr(248, mload(cursor))
+        }
+        cursor += 1;
+        uint256 executed;
+        for (uint8 c = 0; c < count; c++) {
+            uint80 amountIn;
+            uint80 minProfit;
+            uint8 length;
+            require(cursor + 21 <= end, "batch too short");
+            assembly {
+                amountIn := shr(176, mload(cursor))
+                minProfit := shr(176, mload(add(cursor, 10)))
+                length := shr(248, mload(add(cursor, 20)))
+            }
+            cursor += 21;
+            require(length > 0 && cursor + uint256(length) * 23 <= end, "batch too short");
+            Route[] memory routes = new Route[](length);
+            address pair;
+            uint8 direction;
+            uint16 fee;
+            for (uint8 i = 0; i < length; i++) {
+                assembly {
+                    pair := shr(96, mload(cursor))
+                    direction := shr(248, mload(add(cursor, 20)))
+                    fee := shr(240, mload(add(cursor, 21)))
+                }
+                cursor += 23;
+                routes[i].pair = pair;
+                routes[i].direction = direction == 0 ? false : true ;
+                routes[i].fee = fee;
+            }
+            try this.swapCycle(amountIn, minProfit, routes) {
+                executed++;
+            } catch {
+                emit CycleSkipped(c);
+            }
+        }
+        require(cursor == end, "batch too long");
+        require(executed > 0, "every cycle skipped");
+    }
+
+    // swapCycle runs a cycle of swapBatch, external so its revert only undoes the cycle
+    function swapCycle(uint256 amountIn, uint256 minProfit, Route[] memory routes) external {
+        require(msg.sender == address(this), "only batch");
+        _swap(amountIn, minProfit, routes);
+    }
+
+    // flashSwap runs a cycle funded by the first pair, the pair sends its output before it is
+    // paid and calls uniswapV2Call where the other hops run and amountIn is repaid from the
+    // cycle output, the account needs neither WETH nor an allowance
+    // params: amountIn(10) minProfit(10) then hops of pair(20) direction(1) fee(2)
+    function flashSwap(bytes memory params) external {
+        uint80 amountIn;
+        uint80 minProfit;
+        uint256 cursor;
+        uint256 end;
+        require(params.length >= 20 + 2 * 23 && (params.length - 20) % 23 == 0, "flash params length");
+        assembly {
+            cursor := add(params, 32)
+            end := add(cursor, mload(params))
+            amountIn := shr(176, mload(cursor))
+            minProfit := shr(176, mload(add(cursor, 10)))
+        }
+        cursor += 20;
+        Route[] memory routes = new Route[]((end - cursor) / 23);
+        address pair;
+        uint8 direction;
+        uint16 fee;
+        for (uint256 i = 0; i < routes.length; i++) {
+            assembly {
+                pair := shr(96, mload(cursor))
+                direction := shr(248, mload(add(cursor, 20)))
+                fee := shr(240, mload(add(cursor, 21)))
+            }
+            cursor += 23;
+            routes[i].pair = pair;
+            routes[i].direction = direction == 0 ? false : true ;
+            routes[i].fee = fee;
+        }
+        uint[] memory amounts = getAmountsOut(amountIn, routes);
+        require(amounts[amounts.length - 1] > amountIn + minProfit, "amount out less than amount in");
+
+        flashPair = routes[0].pair;
+        bytes memory data = abi.encode(amountIn, amounts, routes);
+        if (routes[0].direction) {
+            IUniswapV2Pair(routes[0].pair).swap(0, amounts[0], address(this), data);
+        } else {
+            IUniswapV2Pair(routes[0].pair).swap(amounts[0], 0, address(this), data);
+        }
+        flashPair = address(0);
+    }
+
+    // uniswapV2Call is the callback of the first pair of flashSwap, it holds the first hop
+    // output, repaying amountIn of WETH settles the first hop as a plain swap with its usual fee
+    function uniswapV2Call(address sender, uint, uint, bytes calldata data) external {
+        require(msg.sender == flashPair && sender == address(this), "unexpected flash callback");
+        (uint256 amountIn, uint[] memory amounts, Route[] memory routes) = abi.decode(data, (uint256, uint[], Route[]));
+        IUniswapV2Pair first = IUniswapV2Pair(routes[0].pair);
+        address tokenOut = routes[0].direction ? first.token1() : first.token0();
+        IERC20(tokenOut).transfer(routes[1].pair, amounts[0]);
+
+        uint routesLength = routes.length;
+        for (uint i = 1; i < routesLength; i++) {
+            address to = address(this);
+            if (i != routesLength - 1) {
+                to = routes[i+1].pair;
+            }
+            if (routes[i].direction) {
+                IUniswapV2Pair(routes[i].pair).swap(0, amounts[i], to, "");
+            } else {
+                IUniswapV2Pair(routes[i].pair).swap(amounts[i], 0, to, "");
+            }
+        }
+        IERC20(weth).transfer(routes[0].pair, amountIn);
+        IERC20(weth).transfer(account, amounts[routesLength - 1] - amountIn);
     }
 
-    function _swap(uint256 amountIn, Route[] memory routes) internal {
+    function _swap(uint256 amountIn, uint256 minProfit, Route[] memory routes) internal {
         uint256 balance = IERC20(weth).balanceOf(account);
         if (amountIn > balance) {
             amountIn = balance;
         }
         uint[] memory amounts = getAmountsOut(amountIn, routes);
-        require(amounts[amounts.length - 1] > amountIn, "amount out less than amount in");
+        require(amounts[amounts.length - 1] > amountIn + minProfit, "amount out less than amount in");
 
         IERC20(weth).transferFrom(account, routes[0].pair, amountIn);
     
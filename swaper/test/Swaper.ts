@@ -1,9 +1,20 @@
 import { expect } from "chai";
 import { ethers } from "hardhat";
 import { Web3, eth } from "web3";
+import * as fs from "fs";
+import * as path from "path";
 
 var swaperAddress, wethAddress, aAddress, pairEAAddress, pairAEAddress, multicallAddress;
 
+// golden reads the params the go encoder is tested against, its pairs are placeholders
+// of the pairs deployed here
+function golden(name) {
+    const param = fs.readFileSync(path.join(__dirname, "../../monitor/swaper/testdata", name), "utf8").trim();
+    return ("0x" + param)
+        .split("01".repeat(20)).join(pairAEAddress.slice(2).toLowerCase())
+        .split("02".repeat(20)).join(pairEAAddress.slice(2).toLowerCase());
+}
+
 describe("Swaper", function () {
 
     describe("Deployment", function () {
@@ -192,14 +203,99 @@ describe("Swaper", function () {
                 ethers.zeroPadValue(ethers.toBeHex(102), 2),
             ])
             console.log(param);
-            
-            const tx = await swaper.swap(param);
+            expect(golden("swap.golden")).equal(param);
+
+            const tx = await swaper.swap(golden("swap.golden"));
             const receipt = await tx.wait();
             const gasUsed = receipt.gasUsed;
             console.log(`---- gas used ${gasUsed}`)
             console.log(`---- balance ${(await weth.balanceOf(accounts[1].address)).toString()}`)
         });
 
+        it("swapBatch", async function () {
+            const accounts = await ethers.getSigners();
+            const Swaper = await ethers.getContractFactory("Swaper");
+            const Token = await ethers.getContractFactory("Token");
+            const swaper = await Swaper.attach(swaperAddress.toString());
+            const weth = await Token.attach(wethAddress);
+
+            // the swap above overshot, the cycle now pays from pairAE to pairEA
+            const cycle = (amountIn, minProfit) => ethers.concat([
+                ethers.zeroPadValue(ethers.toBeHex(amountIn), 10),
+                ethers.zeroPadValue(ethers.toBeHex(minProfit), 10),
+                ethers.toBeHex(2),
+                ethers.zeroPadValue(ethers.toBeHex(pairAEAddress), 20),
+                ethers.toBeHex(1),
+                ethers.zeroPadValue(ethers.toBeHex(102), 2),
+                ethers.zeroPadValue(ethers.toBeHex(pairEAAddress), 20),
+                ethers.toBeHex(0),
+                ethers.zeroPadValue(ethers.toBeHex(31), 2),
+            ]);
+
+            // the second cycle asks more profit than the pairs give and is skipped
+            var param = ethers.concat([
+                ethers.toBeHex(2),
+                cycle("1000000000000000", 0),
+                cycle("1000000000000000", "1000000000000000000"),
+            ]);
+            console.log(param);
+            expect(golden("swapBatch.golden")).equal(param);
+
+            const balance = await weth.balanceOf(accounts[1].address);
+            const tx = await swaper.swapBatch(golden("swapBatch.golden"));
+            await expect(tx).to.emit(swaper, "CycleSkipped").withArgs(1);
+            const receipt = await tx.wait();
+            console.log(`---- gas used ${receipt.gasUsed}`)
+            expect(await weth.balanceOf(accounts[1].address)).greaterThan(balance);
+
+            await expect(swaper.swapBatch(ethers.concat([
+                ethers.toBeHex(1),
+                cycle("10000000000000000", "1000000000000000000"),
+            ]))).to.be.revertedWith("every cycle skipped");
+            await expect(swaper.swapBatch(ethers.concat([param, "0x00"]))).to.be.revertedWith("batch too long");
+        });
+
+        it("flashSwap", async function () {
+            const accounts = await ethers.getSigners();
+            const Swaper = await ethers.getContractFactory("Swaper");
+            const Token = await ethers.getContractFactory("Token");
+            const weth = await Token.attach(wethAddress);
+
+            // the account of this swaper holds no WETH and approved nothing
+            const swaper = await Swaper.deploy(accounts[2].address, wethAddress);
+            await swaper.waitForDeployment();
+            expect(await weth.balanceOf(accounts[2].address)).equal(0);
+
+            const hops = ethers.concat([
+                ethers.zeroPadValue(ethers.toBeHex(pairAEAddress), 20),
+                ethers.toBeHex(1),
+                ethers.zeroPadValue(ethers.toBeHex(102), 2),
+                ethers.zeroPadValue(ethers.toBeHex(pairEAAddress), 20),
+                ethers.toBeHex(0),
+                ethers.zeroPadValue(ethers.toBeHex(31), 2),
+            ]);
+            var param = ethers.concat([
+                ethers.zeroPadValue(ethers.toBeHex("2000000000000000"), 10),
+                ethers.zeroPadValue(ethers.toBeHex(0), 10),
+                hops,
+            ]);
+            console.log(param);
+
+            const tx = await swaper.flashSwap(param);
+            const receipt = await tx.wait();
+            console.log(`---- gas used ${receipt.gasUsed}`)
+            console.log(`---- balance ${(await weth.balanceOf(accounts[2].address)).toString()}`)
+            expect(await weth.balanceOf(accounts[2].address)).greaterThan(0);
+            expect(await weth.balanceOf(await swaper.getAddress())).equal(0);
+
+            await expect(swaper.flashSwap(ethers.concat([
+                ethers.zeroPadValue(ethers.toBeHex("2000000000000000"), 10),
+                ethers.zeroPadValue(ethers.toBeHex("1000000000000000000"), 10),
+                hops,
+            ]))).to.be.revertedWith("amount out less than amount in");
+            await expect(swaper.uniswapV2Call(await swaper.getAddress(), 0, 0, "0x")).to.be.revertedWith("unexpected flash callback");
+        });
+
         it("getAmountOut", async function () {
             // const Swaper = await ethers.getContractFactory("Swaper");
             // const swaper = await Swaper.attach(swaperAddress.toString());